@@ -2,12 +2,122 @@ package http2
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"sync"
 )
 
+var ErrBodyClosed = errors.New("read on closed body")
+
+// Body is a pipe from DATA frames of a stream to its reader.
+// Read blocks until DATA arrives, and returns io.EOF after END_STREAM.
 type Body struct {
-	bytes.Buffer
+	buf  bytes.Buffer
+	err  error // returned after buf is drained
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// err which reader got, nil until reader reaches it
+	readErr error
+
+	// called with size of read data,
+	// stream sends WINDOW_UPDATE for them
+	OnRead func(n int)
+
+	// called once before the first Read,
+	// server sends 100 Continue for Expect: 100-continue
+	OnFirstRead func()
+	firstRead   sync.Once
+}
+
+func NewBody() *Body {
+	body := new(Body)
+	body.cond = sync.NewCond(&body.mu)
+	return body
 }
 
+// buffers data of DATA frame
+func (b *Body) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	defer b.cond.Broadcast()
+	return b.buf.Write(p)
+}
+
+func (b *Body) Read(p []byte) (n int, err error) {
+	if b.OnFirstRead != nil {
+		b.firstRead.Do(b.OnFirstRead)
+	}
+
+	b.mu.Lock()
+	for b.buf.Len() == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.buf.Len() == 0 {
+		err = b.err
+		b.readErr = err
+		b.mu.Unlock()
+		return 0, err
+	}
+	n, _ = b.buf.Read(p)
+	b.mu.Unlock()
+
+	if b.OnRead != nil {
+		b.OnRead(n)
+	}
+	return n, nil
+}
+
+// size of buffered data, not read yet
+func (b *Body) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+// error returned after buffered data, nil while receiving
+func (b *Body) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// error returned to reader by Read, nil if reader doesn't reach it.
+// it differs from Err if handler stops reading before the end.
+func (b *Body) ReadErr() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.readErr
+}
+
+// no more DATA, reader gets err after buffered data.
+// err is io.EOF at END_STREAM
+func (b *Body) CloseWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+// closed by reader, buffered data is discarded
+// and its window is returned as it is read
 func (b *Body) Close() error {
+	b.mu.Lock()
+	if b.err == nil || b.err == io.EOF {
+		b.err = ErrBodyClosed
+	}
+	n := b.buf.Len()
+	b.buf.Reset()
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	if n > 0 && b.OnRead != nil {
+		b.OnRead(n)
+	}
 	return nil
 }
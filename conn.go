@@ -1,13 +1,19 @@
 package http2
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	. "github.com/Jxck/color"
-	"github.com/Jxck/hpack"
 	. "github.com/Jxck/http2/frame"
+	"github.com/Jxck/http2/hpack"
 	. "github.com/Jxck/logger"
 	"io"
 	"log"
+	"net/http"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -15,120 +21,1121 @@ func init() {
 	log.SetFlags(log.Lshortfile)
 }
 
+// stream is not processed by peer, because of GOAWAY or REFUSED_STREAM,
+// so the request is safe to retry on new connection (RFC 7540 8.1.4)
+var ErrRetryOnNewConn = errors.New("request is not processed, retry on new connection")
+
+// pushes reach MaxConcurrentPushes or peer's SETTINGS_MAX_CONCURRENT_STREAMS
+var ErrPushLimit = errors.New("push exceeds concurrent pushes")
+
+// keepalive PING is not acknowledged, peer seems to be dead
+var ErrPingTimeout = errors.New("PING ACK is not received, connection is closed")
+
+// stream id is 31 bit and never reused (RFC 7540 5.1.1)
+// connection which used it up cannot open new stream.
+const MAX_STREAM_ID uint32 = 1<<31 - 1
+
+// which side of the connection we are
+type Role uint8
+
+const (
+	ServerRole Role = iota
+	ClientRole
+)
+
+func (role Role) String() string {
+	if role == ClientRole {
+		return "client"
+	}
+	return "server"
+}
+
+// Conn is a HTTP/2 connection over rw (net.Conn)
+//
+// ReadLoop reads frames and dispatches them to connection level
+// handling or each stream, WriteLoop writes frames sent to WriteChan.
+// Close stops both loops.
 type Conn struct {
-	RW           io.ReadWriter
-	HpackContext *hpack.Context
-	LastStreamID uint32
-	Window       *Window
-	Settings     map[SettingsID]int32
-	PeerSettings map[SettingsID]int32
-	Streams      map[uint32]*Stream
-	WriteChan    chan Frame
-	CallBack     func(stream *Stream)
-}
-
-func NewConn(rw io.ReadWriter) *Conn {
+	RW               io.ReadWriter
+	Role             Role
+	Framer           *Framer
+	HpackContext     *hpack.Context // decode, limited by our SETTINGS_HEADER_TABLE_SIZE
+	PeerHpackContext *hpack.Context // encode, limited by peer's SETTINGS_HEADER_TABLE_SIZE
+	LastStreamID     uint32
+	Window           *Window
+	windowMu         sync.Mutex // WINDOW_UPDATE of Window by ReadLoop and readers of body
+	Settings         *Settings  // ours and peer's, shared with streams
+	Streams          map[uint32]*Stream
+	Priority         *PriorityTree
+	// PRIORITY on idle or removed stream leaves node in Priority,
+	// older ones than MaxIdlePriorities are removed
+	MaxIdlePriorities int
+	idlePriorities    []uint32
+	WriteChan         chan Frame
+	CallBack          func(stream *Stream)
+
+	// called with every received frame of the type before dispatch
+	FrameCallBack map[FrameType]func(frame Frame)
+
+	// connection error of PROTOCOL_ERROR if connection preface and
+	// SETTINGS of peer, or CONTINUATIONs after HEADERS without END_HEADERS
+	// are not read in this duration. it uses read deadline of RW like
+	// net.Conn, and Framer.HeaderBlockTimeout. 0 disables it.
+	ReadHeaderTimeout time.Duration
+	handshaking       bool // preface is read, waiting SETTINGS of peer
+
+	// connection error of SETTINGS_TIMEOUT
+	// if peer doesn't ACK our SETTINGS in this duration
+	SettingsTimeout time.Duration
+	settingsTimer   *time.Timer
+	settingsMu      sync.Mutex
+
+	// sends PING if no frame is read in ReadIdleTimeout, and closes
+	// the connection if its ACK is not read in PingTimeout.
+	// 0 of ReadIdleTimeout disables it. set them before ReadLoop.
+	ReadIdleTimeout time.Duration
+	PingTimeout     time.Duration
+	idleTimer       *time.Timer
+	pinging         bool // keepalive PING is waiting ACK
+	keepaliveMu     sync.Mutex
+
+	// sends GOAWAY(NO_ERROR) and closes the connection, if it has
+	// no stream for IdleTimeout. new stream and PING of peer reset it.
+	// 0 disables it. set it before ReadLoop.
+	IdleTimeout    time.Duration
+	closeIdleTimer *time.Timer
+
+	// streams blocked by flow control longer than this are reset
+	// with CANCEL, see Stream.WriteTimeout. 0 disables it.
+	WriteTimeout time.Duration
+
+	// malformed request (RFC 7540 8.1.2.6) is answered by
+	// 400 instead of RST_STREAM(PROTOCOL_ERROR) on its stream.
+	// body of wrong content-length is always reset, since
+	// the response may be started. set it before ReadLoop.
+	BadRequest bool
+
+	// request body of a stream over this is not delivered to handler,
+	// which is answered by 413 or reset. 0 is no limit.
+	// set it before ReadLoop.
+	MaxRequestBodyBytes int64
+
+	// connection error of ENHANCE_YOUR_CALM, if more than MaxRapidResets
+	// streams of peer are reset in RapidResetWindow after opened.
+	// it blocks flood of HEADERS and RST_STREAM, which costs us
+	// without counted in SETTINGS_MAX_CONCURRENT_STREAMS
+	MaxRapidResets   int
+	RapidResetWindow time.Duration
+	resets           []time.Time // rapid resets in the window
+	stats            ConnStats
+	statsMu          sync.Mutex
+
+	// PINGs waiting ACK by opaque data, and rtt of the latest
+	pings     map[string]chan struct{}
+	pingCount uint64
+	rtt       time.Duration
+	pingMu    sync.Mutex
+
+	writeMu   sync.Mutex // Framer writes from WriteLoop and WriteFrame
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// base of stream contexts, canceled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// closed streams waiting removal from Streams
+	closedStreams []closedStream
+
+	// frames waiting in WriteLoop.
+	// DATA waits connection window in queue of the stream,
+	// and frames after it keep the order.
+	// controlQueue is also filled by send of ReadLoop.
+	controlQueue []Frame
+	controlMu    sync.Mutex
+	controlReady chan struct{} // wakes WriteLoop after send
+	dataQueues   map[uint32][]Frame
+
+	// connection error of ENHANCE_YOUR_CALM, if more than this
+	// control frames are not written. peer which doesn't read
+	// while sending PING etc. exhausts memory by their ACKs.
+	MaxQueuedControlFrames int
+
+	// Streams is written by OpenStream on client
+	streamsMu      sync.Mutex
+	openMu         sync.Mutex // HEADERS of OpenStream go in order of stream id
+	nextStreamID   uint32
+	clientStreams  int           // active streams opened by OpenStream
+	streamReleased chan struct{} // closed when a stream gets closed
+
+	// pushed streams not closed yet including reserved ones,
+	// more than MaxConcurrentPushes fails push. 0 disables push
+	MaxConcurrentPushes int
+	pushStreams         int
+
+	// GOAWAY of Shutdown or IdleTimeout is sent, new streams are refused
+	goingAway bool
+
+	// GOAWAY is received, streams above peerLastStreamID are not processed
+	peerGoingAway    bool
+	peerLastStreamID uint32
+
+	// requests of WriteLoop to close them when all frames are written
+	flush        chan chan struct{}
+	flushWaiters []chan struct{}
+}
+
+// counters of the connection for operators
+type ConnStats struct {
+	RapidResets     int           // streams reset shortly after opened
+	EnhanceYourCalm bool          // closed by too many rapid resets
+	ControlFlood    bool          // closed by too many unsent control frames
+	QueuedControl   int           // control frames not written yet
+	RTT             time.Duration // measured by the latest Ping
+}
+
+type closedStream struct {
+	id     uint32
+	closed time.Time
+}
+
+func NewConn(rw io.ReadWriter, role Role) *Conn {
+	return newConn(context.Background(), rw, role)
+}
+
+// ctx is parent of Context of the connection and its streams
+func newConn(ctx context.Context, rw io.ReadWriter, role Role) *Conn {
 	conn := &Conn{
-		RW:           rw,
-		HpackContext: hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE)),
-		Settings:     DefaultSettings,
-		PeerSettings: DefaultSettings,
-		Window:       NewWindowDefault(),
-		Streams:      make(map[uint32]*Stream),
-		WriteChan:    make(chan Frame),
+		RW:                     rw,
+		Role:                   role,
+		Framer:                 NewFramer(rw, rw),
+		HpackContext:           hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE)),
+		PeerHpackContext:       hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE)),
+		Settings:               NewSettings(),
+		Window:                 NewWindowDefault(),
+		Streams:                make(map[uint32]*Stream),
+		Priority:               NewPriorityTree(),
+		WriteChan:              make(chan Frame),
+		FrameCallBack:          make(map[FrameType]func(frame Frame)),
+		SettingsTimeout:        SettingsTimeout,
+		ReadHeaderTimeout:      ReadHeaderTimeout,
+		PingTimeout:            PingTimeout,
+		MaxRapidResets:         MaxRapidResets,
+		RapidResetWindow:       RapidResetWindow,
+		MaxQueuedControlFrames: MaxQueuedControlFrames,
+		MaxIdlePriorities:      MaxIdlePriorities,
+		MaxConcurrentPushes:    MaxConcurrentPushes,
+		closed:                 make(chan struct{}),
+		nextStreamID:           1,
+		streamReleased:         make(chan struct{}),
+		dataQueues:             make(map[uint32][]Frame),
+		controlReady:           make(chan struct{}, 1),
+		flush:                  make(chan chan struct{}),
+		pings:                  make(map[string]chan struct{}),
 	}
+	if role == ServerRole {
+		// server initiates even-numbered stream
+		conn.nextStreamID = 2
+	}
+	conn.ctx, conn.cancel = context.WithCancel(ctx)
+	conn.Framer.SetMaxReadFrameSize(DefaultSettings[SETTINGS_MAX_FRAME_SIZE])
+	conn.Framer.SetMaxHeaderListSize(DefaultSettings[SETTINGS_MAX_HEADER_LIST_SIZE])
+	conn.Framer.AssembleHeaders = true
+	conn.Framer.MaxHeaderBlockSize = MaxHeaderBlockSize
 	return conn
 }
 
+// client side Conn, which sends connection preface and SETTINGS
+// before returning, so they go exactly once before any request.
+// settings are merged into DefaultSettings, nil is default.
+func NewClientConn(rw io.ReadWriter, settings map[SettingsID]int32) (*Conn, error) {
+	conn := NewConn(rw, ClientRole)
+	merged := CopySettings(DefaultSettings)
+	// client doesn't handle PUSH_PROMISE
+	merged[SETTINGS_ENABLE_PUSH] = 0
+	// extended CONNECT is accepted only by server
+	delete(merged, SETTINGS_ENABLE_CONNECT_PROTOCOL)
+	for id, value := range settings {
+		merged[id] = value
+	}
+	conn.Framer.SetMaxReadFrameSize(merged[SETTINGS_MAX_FRAME_SIZE])
+	conn.Framer.SetMaxHeaderListSize(merged[SETTINGS_MAX_HEADER_LIST_SIZE])
+
+	err := conn.WriteMagic()
+	if err != nil {
+		return nil, err
+	}
+	err = conn.WriteSettings(merged)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// records frames of this connection into w
+// replay it with frame.Replay()
+func (conn *Conn) Record(w io.Writer) {
+	recorder := NewRecorder(conn.RW, conn.RW, w)
+	framer := NewFramer(recorder, recorder)
+	framer.SetMaxReadFrameSize(conn.Framer.MaxReadFrameSize())
+	framer.SetMaxWriteFrameSize(conn.Framer.MaxWriteFrameSize())
+	framer.SetMaxHeaderListSize(conn.Framer.MaxHeaderListSize())
+	framer.WriteMode = conn.Framer.WriteMode
+	framer.CheckContinuation = conn.Framer.CheckContinuation
+	framer.AssembleHeaders = conn.Framer.AssembleHeaders
+	framer.MaxHeaderBlockSize = conn.Framer.MaxHeaderBlockSize
+	framer.HeaderBlockTimeout = conn.Framer.HeaderBlockTimeout
+	conn.Framer = framer
+}
+
 func (conn *Conn) NewStream(streamid uint32) *Stream {
 	stream := NewStream(
 		streamid,
 		conn.WriteChan,
 		conn.Settings,
-		conn.PeerSettings,
 		conn.HpackContext,
+		conn.PeerHpackContext,
 		conn.CallBack,
 	)
+	stream.WriteTimeout = conn.WriteTimeout
+	stream.badRequest = conn.BadRequest
+	stream.maxBody = conn.MaxRequestBodyBytes
+	// handler of the stream is canceled with the connection
+	stream.ctx, stream.cancel = context.WithCancel(conn.ctx)
 	Debug("adding new stream (id=%d) total (%d)", stream.ID, len(conn.Streams))
 	return stream
 }
 
-func (conn *Conn) HandleSettings(settingsFrame *SettingsFrame) {
-	if settingsFrame.Flags == ACK {
-		// receive ACK
-		Trace("receive SETTINGS ACK")
+// removes streams closed more than 1 second ago.
+// nil is left in Streams, for knowing the stream was closed.
+// called from ReadLoop, not from timer goroutine which races with it.
+func (conn *Conn) removeClosedStreams() {
+	i := 0
+	for ; i < len(conn.closedStreams); i++ {
+		closed := conn.closedStreams[i]
+		if time.Since(closed.closed) < time.Second {
+			break
+		}
+		Info("remove stream(%d) from conn.Streams[]", closed.id)
+		conn.streamsMu.Lock()
+		conn.Streams[closed.id] = nil
+		conn.streamsMu.Unlock()
+		conn.Priority.Remove(closed.id)
+	}
+	conn.closedStreams = conn.closedStreams[i:]
+}
+
+// streams not removed yet
+func (conn *Conn) openedStreams() []*Stream {
+	conn.streamsMu.Lock()
+	defer conn.streamsMu.Unlock()
+	streams := make([]*Stream, 0, len(conn.Streams))
+	for _, stream := range conn.Streams {
+		if stream != nil {
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
+
+// count of open or half closed streams
+func (conn *Conn) activeStreams() (count int) {
+	return conn.countActive(func(id uint32) bool { return true })
+}
+
+// count of open or half closed streams initiated by peer,
+// which our SETTINGS_MAX_CONCURRENT_STREAMS limits (RFC 7540 5.1.2)
+func (conn *Conn) activePeerStreams() (count int) {
+	return conn.countActive(func(id uint32) bool { return !conn.localStream(id) })
+}
+
+// streams in reserved states are not counted
+func (conn *Conn) countActive(filter func(id uint32) bool) (count int) {
+	for _, stream := range conn.openedStreams() {
+		if !filter(stream.ID) {
+			continue
+		}
+		switch stream.CurrentState() {
+		case OPEN, HALF_CLOSED_LOCAL, HALF_CLOSED_REMOTE:
+			count++
+		}
+	}
+	return count
+}
+
+// stream of received frame (RFC 7540 5.1)
+// creates new stream for HEADERS on idle stream.
+// nil stream without error means the frame should be ignored.
+func (conn *Conn) recvStream(frame Frame) (*Stream, error) {
+	streamID := frame.Header().StreamID
+	types := frame.Header().Type
+
+	conn.streamsMu.Lock()
+	stream, ok := conn.Streams[streamID]
+	conn.streamsMu.Unlock()
+	if ok && stream != nil {
+		// legality in its state is checked by ChangeState
+		return stream, nil
+	}
+
+	var msg string
+	switch {
+	case ok || streamID <= conn.LastStreamID:
+		// closed and removed, or implicitly closed by larger stream id
+		switch types {
+		case PriorityFrameType, WindowUpdateFrameType, RstStreamFrameType:
+			return nil, nil
+		case HeadersFrameType:
+			if !ok {
+				msg = fmt.Sprintf("HEADERS on stream(%v) lower than last stream(%v)", streamID, conn.LastStreamID)
+				break
+			}
+			fallthrough
+		default:
+			Error("%v frame on closed stream(%v)", types, streamID)
+			return nil, &StreamError{StreamID: streamID, Code: STREAM_CLOSED}
+		}
+	case types == PriorityFrameType:
+		// idle stream can be prioritized before opened
+		return nil, nil
+	case types != HeadersFrameType:
+		msg = fmt.Sprintf("%v frame on idle stream(%v)", types, streamID)
+	case conn.Role != ServerRole || conn.localStream(streamID):
+		// client initiates odd-numbered stream, server uses PUSH_PROMISE
+		msg = fmt.Sprintf("HEADERS on stream(%v) which peer of %v cannot open", streamID, conn.Role)
+	}
+	if msg != "" {
+		Error("%v", msg)
+		return nil, &ConnectionError{Code: PROTOCOL_ERROR, Reason: msg}
+	}
+
+	// our SETTINGS_MAX_CONCURRENT_STREAMS (RFC 7540 5.1.2)
+	// refused stream is closed without calling handler
+	if max := conn.Settings.Local(SETTINGS_MAX_CONCURRENT_STREAMS); conn.activePeerStreams() >= int(max) {
+		Error("stream(%v) exceeds SETTINGS_MAX_CONCURRENT_STREAMS(%v)", streamID, max)
+		conn.streamsMu.Lock()
+		conn.Streams[streamID] = nil
+		conn.LastStreamID = streamID
+		conn.streamsMu.Unlock()
+		return nil, &StreamError{StreamID: streamID, Code: REFUSED_STREAM}
+	}
+
+	// create stream with streamID
+	// after GOAWAY of Shutdown, peer can retry it on other connection
+	conn.streamsMu.Lock()
+	if conn.goingAway {
+		conn.Streams[streamID] = nil
+		conn.LastStreamID = streamID
+		conn.streamsMu.Unlock()
+		Error("stream(%v) after GOAWAY is refused", streamID)
+		return nil, &StreamError{StreamID: streamID, Code: REFUSED_STREAM}
+	}
+	stream = conn.NewStream(streamID)
+	stream.onClose = func() {
+		conn.streamsMu.Lock()
+		conn.releaseStream()
+		conn.streamsMu.Unlock()
+	}
+	opened := time.Now()
+	stream.onReset = func() {
+		conn.rapidReset(opened)
+	}
+	stream.push = func(header http.Header) error {
+		return conn.push(stream, header)
+	}
+	conn.Streams[streamID] = stream
+
+	// update last stream id
+	conn.LastStreamID = streamID
+	conn.streamsMu.Unlock()
+	conn.Priority.Add(streamID)
+	conn.resetCloseIdleTimer()
+	return stream, nil
+}
+
+// stream 1 of HTTP/1.1 request upgraded to h2c, which is half-closed
+// (remote) since the request is already received (RFC 7540 3.2).
+// its body is not flow controlled, so it doesn't recover the window.
+func (conn *Conn) upgradeStream(header http.Header, body []byte) error {
+	frame := NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, nil, nil)
+	frame.Headers = header
+	stream, err := conn.recvStream(frame)
+	if err != nil {
+		return err
+	}
+	if stream == nil {
+		return fmt.Errorf("stream(1) of upgrade is not opened")
+	}
+	err = stream.ChangeState(frame, RECV)
+	if err != nil {
+		return err
+	}
+	stream.Bucket.Body.OnRead = nil
+	stream.Bucket.Body.Write(body)
+	stream.received = int64(len(body))
+	if stream.maxBody > 0 && stream.received > stream.maxBody {
+		stream.rejected = http.StatusRequestEntityTooLarge
+	}
+	stream.Read(frame)
+	return nil
+}
+
+// opens new stream of client with request headers.
+// waits while the streams reach peer's SETTINGS_MAX_CONCURRENT_STREAMS,
+// and the stream frees the slot when it gets closed (RFC 7540 5.1.2)
+func (conn *Conn) OpenStream(header http.Header, endStream bool, callback CallBack) (*Stream, error) {
+	return conn.openStream(header, endStream, callback, nil)
+}
+
+// informational is called with 1xx response before callback, nil ignores it.
+func (conn *Conn) openStream(header http.Header, endStream bool, callback CallBack, informational func(status int, header http.Header) error) (*Stream, error) {
+	conn.openMu.Lock()
+	defer conn.openMu.Unlock()
+
+	conn.streamsMu.Lock()
+	for conn.clientStreams >= int(conn.Settings.Peer(SETTINGS_MAX_CONCURRENT_STREAMS)) && !conn.peerGoingAway && !conn.goingAway {
+		Debug("wait stream slot of SETTINGS_MAX_CONCURRENT_STREAMS(%v)", conn.Settings.Peer(SETTINGS_MAX_CONCURRENT_STREAMS))
+		released := conn.streamReleased
+		conn.streamsMu.Unlock()
+		select {
+		case <-released:
+		case <-conn.closed:
+			return nil, fmt.Errorf("open stream on closed connection")
+		}
+		conn.streamsMu.Lock()
+	}
+	if conn.peerGoingAway || conn.goingAway {
+		conn.streamsMu.Unlock()
+		return nil, ErrRetryOnNewConn
+	}
+	if conn.nextStreamID > MAX_STREAM_ID {
+		conn.streamsMu.Unlock()
+		Error("stream id is exhausted, open stream on new connection")
+		return nil, ErrRetryOnNewConn
+	}
+
+	conn.clientStreams++
+	stream := conn.NewStream(conn.nextStreamID)
+	stream.CallBack = callback
+	stream.noBody = header.Get(":method") == "HEAD"
+	stream.informational = informational
+	if informational == nil {
+		stream.informational = func(status int, header http.Header) error { return nil }
+	}
+	// response is read by application, which may be slower than peer
+	stream.holdConn = conn.WindowHold
+	stream.releaseConn = conn.WindowRelease
+	stream.onClose = func() {
+		conn.streamsMu.Lock()
+		conn.clientStreams--
+		conn.releaseStream()
+		conn.streamsMu.Unlock()
+	}
+	conn.Streams[stream.ID] = stream
+	conn.nextStreamID += 2
+	conn.streamsMu.Unlock()
+	conn.Priority.Add(stream.ID)
+	conn.resetCloseIdleTimer()
+
+	var flags Flag = END_HEADERS
+	if endStream {
+		flags += END_STREAM
+	}
+	frame := NewHeadersFrame(flags, stream.ID, nil, nil, nil)
+	frame.Headers = header
+	frame.HpackContext = stream.PeerHpackContext
+	stream.Write(frame)
+	return stream, nil
+}
+
+// reserves stream for server push by PUSH_PROMISE of the promised
+// request on parent stream (RFC 7540 8.2), and serves it with CallBack.
+// the stream is RESERVED_LOCAL until the response HEADERS.
+// fails with http.ErrNotSupported if peer disables push.
+func (conn *Conn) push(parent *Stream, header http.Header) error {
+	if conn.Settings.Peer(SETTINGS_ENABLE_PUSH) == 0 || conn.MaxConcurrentPushes == 0 {
+		return http.ErrNotSupported
+	}
+
+	// PUSH_PROMISEs go in order of promised stream id
+	conn.openMu.Lock()
+	defer conn.openMu.Unlock()
+
+	if parent.Context().Err() != nil {
+		return parent.Err()
+	}
+
+	// pushed streams count in peer's SETTINGS_MAX_CONCURRENT_STREAMS
+	// after the response HEADERS, not while reserved (RFC 7540 5.1.2)
+	pushing := conn.countActive(conn.localStream)
+	if max := int(conn.Settings.Peer(SETTINGS_MAX_CONCURRENT_STREAMS)); pushing >= max {
+		Error("push on stream(%v) exceeds peer's SETTINGS_MAX_CONCURRENT_STREAMS(%v)", parent.ID, max)
+		return ErrPushLimit
+	}
+
+	conn.streamsMu.Lock()
+	if conn.peerGoingAway || conn.goingAway || conn.nextStreamID > MAX_STREAM_ID {
+		conn.streamsMu.Unlock()
+		return fmt.Errorf("push on stream(%v) after GOAWAY", parent.ID)
+	}
+	if conn.pushStreams >= conn.MaxConcurrentPushes {
+		conn.streamsMu.Unlock()
+		Error("push on stream(%v) exceeds %v concurrent pushes", parent.ID, conn.MaxConcurrentPushes)
+		return ErrPushLimit
+	}
+	conn.pushStreams++
+	stream := conn.NewStream(conn.nextStreamID)
+	stream.onClose = func() {
+		conn.streamsMu.Lock()
+		conn.pushStreams--
+		conn.releaseStream()
+		conn.streamsMu.Unlock()
+	}
+	conn.Streams[stream.ID] = stream
+	conn.nextStreamID += 2
+	conn.streamsMu.Unlock()
+
+	// pushed stream depends on parent (RFC 7540 5.3.5)
+	conn.Priority.Set(stream.ID, parent.ID, DEFAULT_WEIGHT, false)
+
+	// header of PUSH_PROMISE is encoded when written,
+	// so handler gets a copy of it
+	pushPromise := NewPushPromiseFrame(END_HEADERS, parent.ID, stream.ID, nil, nil)
+	pushPromise.Headers = header
+	pushPromise.HpackContext = parent.PeerHpackContext
+	stream.ChangeState(pushPromise, SEND)
+	parent.Write(pushPromise)
+
+	// promised request has no body
+	for name, values := range header {
+		stream.Bucket.Headers[name] = append([]string(nil), values...)
+	}
+	stream.Bucket.Body.CloseWithError(io.EOF)
+	stream.called = true
+	go stream.CallBack(stream)
+	return nil
+}
+
+// false after GOAWAY, Close or the last stream id,
+// new request needs new connection
+func (conn *Conn) CanTakeNewRequest() bool {
+	conn.streamsMu.Lock()
+	defer conn.streamsMu.Unlock()
+	return !conn.peerGoingAway && !conn.goingAway && !conn.IsClosed() && conn.nextStreamID <= MAX_STREAM_ID
+}
+
+// stream initiated by us, which has odd id on client
+// and even id on server (RFC 7540 5.1.1)
+func (conn *Conn) localStream(id uint32) bool {
+	return (id%2 == 1) == (conn.Role == ClientRole)
+}
+
+// wakes OpenStream waiting for a slot, and Shutdown
+// should be called with streamsMu
+func (conn *Conn) releaseStream() {
+	close(conn.streamReleased)
+	conn.streamReleased = make(chan struct{})
+	conn.resetCloseIdleTimer()
+}
+
+// sends our SETTINGS, which waits ACK from peer
+func (conn *Conn) WriteSettings(settings map[SettingsID]int32) error {
+	conn.Settings.Send(settings)
+	err := conn.WriteFrame(NewSettingsFrame(UNSET, 0, settings))
+	if err != nil {
+		return err
+	}
+	conn.settingsMu.Lock()
+	if conn.settingsTimer == nil {
+		conn.settingsTimer = time.AfterFunc(conn.SettingsTimeout, conn.settingsTimeout)
+	}
+	conn.settingsMu.Unlock()
+	return nil
+}
+
+// restarts timer for next unacknowledged SETTINGS, if any
+func (conn *Conn) resetSettingsTimer() {
+	conn.settingsMu.Lock()
+	defer conn.settingsMu.Unlock()
+	if conn.settingsTimer == nil {
+		return
+	}
+	conn.settingsTimer.Stop()
+	conn.settingsTimer = nil
+	if conn.Settings.Unacked() > 0 {
+		conn.settingsTimer = time.AfterFunc(conn.SettingsTimeout, conn.settingsTimeout)
+	}
+}
+
+// peer didn't ACK our SETTINGS (RFC 7540 6.5.3)
+func (conn *Conn) settingsTimeout() {
+	if conn.IsClosed() {
 		return
 	}
+	msg := fmt.Sprintf("SETTINGS ACK is not received in %v", conn.SettingsTimeout)
+	Error("%v", msg)
+	conn.GoAway(0, &ConnectionError{Code: SETTINGS_TIMEOUT, Reason: msg})
+
+	// ReadLoop fails to read and closes the connection
+	if closer, ok := conn.RW.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func (conn *Conn) HandleSettings(settingsFrame *SettingsFrame) error {
+	if settingsFrame.Flags == ACK {
+		// receive ACK of our oldest SETTINGS
+		previous := conn.Settings.Acked(SETTINGS_INITIAL_WINDOW_SIZE)
+		previousTableSize := conn.Settings.Acked(SETTINGS_HEADER_TABLE_SIZE)
+		if !conn.Settings.Ack() {
+			Error("SETTINGS ACK without SETTINGS sent")
+			return nil
+		}
+
+		// peer uses our SETTINGS_HEADER_TABLE_SIZE after ACK,
+		// decoder keeps the previous table until peer updates it
+		if headerTableSize := conn.Settings.Acked(SETTINGS_HEADER_TABLE_SIZE); headerTableSize != previousTableSize {
+			conn.HpackContext.Decoder.SetMaxTableSizeLimit(uint32(headerTableSize))
+		}
+
+		// our SETTINGS_INITIAL_WINDOW_SIZE applies to streams at ACK,
+		// since peer sends DATA before it within the previous window.
+		// streams opened meanwhile have the new one already.
+		if initialWindowSize := conn.Settings.Acked(SETTINGS_INITIAL_WINDOW_SIZE); initialWindowSize != previous {
+			for _, stream := range conn.openedStreams() {
+				if stream.CurrentState() == CLOSED {
+					continue
+				}
+				stream.Window.UpdateLocalInitialSize(initialWindowSize)
+				// smaller window is recovered here,
+				// DATA within the previous one may be read already
+				stream.WindowUpdate(0)
+			}
+		}
+		conn.resetSettingsTimer()
+		Trace("receive SETTINGS ACK, unacked(%v)", conn.Settings.Unacked())
+		return nil
+	}
 
 	if settingsFrame.Flags != UNSET {
 		Error("unknown flag of SETTINGS Frame %v", settingsFrame.Flags)
-		return
+		return nil
 	}
 
 	// received SETTINGS Frame
-	settings := settingsFrame.Settings
+	// values are applied all together before ACK (RFC 7540 6.5.3)
+	err := conn.applyPeerSettings(settingsFrame.Settings)
+	if err != nil {
+		return err
+	}
 
-	defaultSettings := map[SettingsID]int32{
-		SETTINGS_HEADER_TABLE_SIZE:      DEFAULT_HEADER_TABLE_SIZE,
-		SETTINGS_ENABLE_PUSH:            DEFAULT_ENABLE_PUSH,
-		SETTINGS_MAX_CONCURRENT_STREAMS: DEFAULT_MAX_CONCURRENT_STREAMS,
-		SETTINGS_INITIAL_WINDOW_SIZE:    DEFAULT_INITIAL_WINDOW_SIZE,
-		SETTINGS_MAX_FRAME_SIZE:         DEFAULT_MAX_FRAME_SIZE,
-		SETTINGS_MAX_HEADER_LIST_SIZE:   DEFAULT_MAX_HEADER_LIST_SIZE,
+	// send ACK
+	ack := NewSettingsFrame(ACK, 0, NilSettings)
+	conn.send(ack)
+	return nil
+}
+
+// SETTINGS of peer, from SETTINGS frame or HTTP2-Settings of h2c upgrade
+func (conn *Conn) applyPeerSettings(settings map[SettingsID]int32) error {
+	previous := conn.Settings.ApplyPeer(settings)
+
+	// SETTINGS_HEADER_TABLE_SIZE
+	// limits dynamic table of our encoder
+	headerTableSize, ok := settings[SETTINGS_HEADER_TABLE_SIZE]
+	if ok {
+		// Dynamic Table Size Update is sent at the head of next header block
+		encoder := conn.PeerHpackContext.Encoder
+		encoder.SetMaxTableSize(uint32(headerTableSize))
+		Debug("peer header table size %v (%v octets in %v entries)", headerTableSize, encoder.TableSize(), encoder.TableLen())
 	}
 
-	// merge with default
-	for k, v := range settings {
-		defaultSettings[k] = v
+	// SETTINGS_MAX_FRAME_SIZE
+	maxFrameSize, ok := settings[SETTINGS_MAX_FRAME_SIZE]
+	if ok {
+		conn.Framer.SetMaxWriteFrameSize(maxFrameSize)
 	}
 
-	Trace("merged settigns ============")
-	for k, v := range defaultSettings {
-		Trace("%v:%v", k, v)
+	// SETTINGS_INITIAL_WINDOW_SIZE
+	// applies delta to windows of open and half closed streams
+	_, changed := previous[SETTINGS_INITIAL_WINDOW_SIZE]
+	if changed {
+		initialWindowSize := settings[SETTINGS_INITIAL_WINDOW_SIZE]
+		for _, stream := range conn.openedStreams() {
+			if stream.CurrentState() == CLOSED {
+				continue
+			}
+			Debug("apply initial window size %v to stream(%v)", initialWindowSize, stream.ID)
+			err := stream.Window.UpdateInitialSize(initialWindowSize)
+			if err != nil {
+				return err
+			}
+		}
 	}
-	Trace("merged settigns ============")
 
-	// save settings to conn
-	conn.Settings = defaultSettings
+	// SETTINGS_MAX_CONCURRENT_STREAMS
+	// raised limit may start waiting streams
+	_, changed = previous[SETTINGS_MAX_CONCURRENT_STREAMS]
+	if changed {
+		conn.streamsMu.Lock()
+		conn.releaseStream()
+		conn.streamsMu.Unlock()
+	}
 
-	// SETTINGS_INITIAL_WINDOW_SIZE
-	initialWindowSize, ok := settings[SETTINGS_INITIAL_WINDOW_SIZE]
-	if ok {
+	// SETTINGS_MAX_HEADER_LIST_SIZE is read from conn.Settings.Peer() when used
+	return nil
+}
+
+// aborts our streams above last stream id with ErrRetryOnNewConn.
+// last stream id of GOAWAY may decrease, but not increase (RFC 7540 6.8)
+func (conn *Conn) HandleGoAway(frame *GoAwayFrame) {
+	Debug("GOAWAY(%v) last stream(%v) %q", frame.ErrorCode, frame.LastStreamID, frame.AdditionalDebugData)
+
+	conn.streamsMu.Lock()
+	first := !conn.peerGoingAway
+	if first || frame.LastStreamID < conn.peerLastStreamID {
+		conn.peerLastStreamID = frame.LastStreamID
+	}
+	conn.peerGoingAway = true
+	lastStreamID := conn.peerLastStreamID
+	// wakes OpenStream waiting for a slot
+	conn.releaseStream()
+	conn.streamsMu.Unlock()
+
+	for _, stream := range conn.openedStreams() {
+		// peer only processes streams initiated by us
+		if !conn.localStream(stream.ID) || stream.ID <= lastStreamID || stream.CurrentState() == CLOSED {
+			continue
+		}
+		Info("stream(%v) is not processed by peer", stream.ID)
+		stream.abort(ErrRetryOnNewConn)
+		conn.closedStreams = append(conn.closedStreams, closedStream{stream.ID, time.Now()})
+	}
+
+	if first {
+		go func() {
+			conn.drain(context.Background())
+			conn.Close()
+		}()
+	}
+}
+
+// no frame is read in ReadIdleTimeout, checks the peer is alive
+func (conn *Conn) readIdle() {
+	conn.keepaliveMu.Lock()
+	defer conn.keepaliveMu.Unlock()
+	if conn.pinging || conn.IsClosed() {
+		return
+	}
+	Debug("read idle %v, send keepalive PING", conn.ReadIdleTimeout)
+	conn.pinging = true
+	go conn.keepalive()
+}
+
+// peer doesn't ACK keepalive PING in PingTimeout,
+// outstanding streams fail with ErrPingTimeout
+func (conn *Conn) keepalive() {
+	ctx, cancel := context.WithTimeout(context.Background(), conn.PingTimeout)
+	defer cancel()
+	_, err := conn.Ping(ctx)
+
+	conn.keepaliveMu.Lock()
+	conn.pinging = false
+	conn.keepaliveMu.Unlock()
+
+	if err != context.DeadlineExceeded || conn.IsClosed() {
+		return
+	}
+	Error("keepalive PING ACK is not received in %v", conn.PingTimeout)
+	for _, stream := range conn.openedStreams() {
+		stream.CloseWithError(ErrPingTimeout)
+	}
+	conn.Close()
+}
 
-		if initialWindowSize > 2147483647 { // validate < 2^31-1
-			Error("FLOW_CONTROL_ERROR (%s)", "SETTINGS_INITIAL_WINDOW_SIZE too large")
+// any frame proves the peer is alive
+func (conn *Conn) resetIdleTimer() {
+	conn.keepaliveMu.Lock()
+	defer conn.keepaliveMu.Unlock()
+	if conn.idleTimer != nil {
+		conn.idleTimer.Reset(conn.ReadIdleTimeout)
+	}
+}
+
+// stops timers of keepalive and IdleTimeout
+func (conn *Conn) stopIdleTimer() {
+	conn.keepaliveMu.Lock()
+	defer conn.keepaliveMu.Unlock()
+	if conn.idleTimer != nil {
+		conn.idleTimer.Stop()
+	}
+	if conn.closeIdleTimer != nil {
+		conn.closeIdleTimer.Stop()
+	}
+}
+
+// new stream, closed stream and PING of peer restart IdleTimeout
+func (conn *Conn) resetCloseIdleTimer() {
+	conn.keepaliveMu.Lock()
+	defer conn.keepaliveMu.Unlock()
+	if conn.closeIdleTimer != nil {
+		conn.closeIdleTimer.Reset(conn.IdleTimeout)
+	}
+}
+
+// no stream in IdleTimeout, sends GOAWAY(NO_ERROR) and closes.
+// does nothing while Shutdown or GOAWAY of peer is draining,
+// which closes the connection by itself.
+func (conn *Conn) closeIdle() {
+	conn.streamsMu.Lock()
+	nextStreamID, lastStreamID := conn.nextStreamID, conn.LastStreamID
+	conn.streamsMu.Unlock()
+
+	// stream in IDLE is about to send HEADERS
+	for _, stream := range conn.openedStreams() {
+		if stream.CurrentState() != CLOSED {
 			return
 		}
+	}
+
+	conn.streamsMu.Lock()
+	if conn.goingAway || conn.peerGoingAway || conn.IsClosed() ||
+		nextStreamID != conn.nextStreamID || lastStreamID != conn.LastStreamID {
+		// draining, or stream is opened meanwhile
+		conn.streamsMu.Unlock()
+		return
+	}
+	conn.goingAway = true
+	conn.streamsMu.Unlock()
+
+	Info("close idle connection after %v", conn.IdleTimeout)
+	err := conn.WriteFrame(NewGoAwayFrame(0, lastStreamID, NO_ERROR, nil))
+	if err != nil {
+		Error("%v", err)
+	}
+	conn.Close()
+}
+
+// sends PING and returns time until its ACK (RFC 7540 6.7)
+// opaque data is unique for each, so concurrent pings are matched.
+func (conn *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	conn.pingMu.Lock()
+	conn.pingCount++
+	opaqueData := make([]byte, 8)
+	binary.BigEndian.PutUint64(opaqueData, conn.pingCount)
+	ack := make(chan struct{})
+	conn.pings[string(opaqueData)] = ack
+	conn.pingMu.Unlock()
+
+	defer func() {
+		conn.pingMu.Lock()
+		delete(conn.pings, string(opaqueData))
+		conn.pingMu.Unlock()
+	}()
+
+	// written now, not to wait frames queued in WriteLoop
+	start := time.Now()
+	err := conn.WriteFrame(NewPingFrame(UNSET, 0, opaqueData))
+	if err != nil {
+		return 0, err
+	}
 
-		conn.PeerSettings[SETTINGS_INITIAL_WINDOW_SIZE] = initialWindowSize
+	select {
+	case <-ack:
+		rtt := time.Since(start)
+		Debug("PING rtt %v", rtt)
+		conn.pingMu.Lock()
+		conn.rtt = rtt
+		conn.pingMu.Unlock()
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-conn.closed:
+		return 0, fmt.Errorf("connection closed while waiting PING ACK")
+	}
+}
 
-		for _, stream := range conn.Streams {
-			log.Println("apply settings to stream", stream)
-			stream.Window.UpdateInitialSize(initialWindowSize)
-			stream.PeerSettings[SETTINGS_INITIAL_WINDOW_SIZE] = initialWindowSize
+// wakes Ping waiting the ACK, unknown one is ignored
+func (conn *Conn) pingACK(opaqueData []byte) {
+	conn.pingMu.Lock()
+	defer conn.pingMu.Unlock()
+	ack, ok := conn.pings[string(opaqueData)]
+	if !ok {
+		Debug("ignore PING ACK %x", opaqueData)
+		return
+	}
+	close(ack)
+	delete(conn.pings, string(opaqueData))
+}
+
+// rtt measured by the latest Ping, 0 before any
+func (conn *Conn) RTT() time.Duration {
+	conn.pingMu.Lock()
+	defer conn.pingMu.Unlock()
+	return conn.rtt
+}
+
+// snapshot of counters
+func (conn *Conn) Stats() ConnStats {
+	conn.statsMu.Lock()
+	stats := conn.stats
+	conn.statsMu.Unlock()
+	stats.RTT = conn.RTT()
+	conn.controlMu.Lock()
+	stats.QueuedControl = len(conn.controlQueue)
+	conn.controlMu.Unlock()
+	return stats
+}
+
+// counts reset of peer's stream opened at the time,
+// too many of them in the window is ENHANCE_YOUR_CALM
+func (conn *Conn) rapidReset(opened time.Time) {
+	now := time.Now()
+	if now.Sub(opened) > conn.RapidResetWindow {
+		return
+	}
+
+	conn.statsMu.Lock()
+	conn.stats.RapidResets++
+	i := 0
+	for ; i < len(conn.resets); i++ {
+		if now.Sub(conn.resets[i]) <= conn.RapidResetWindow {
+			break
 		}
 	}
+	conn.resets = append(conn.resets[i:], now)
+	calm := len(conn.resets) > conn.MaxRapidResets && !conn.stats.EnhanceYourCalm
+	if calm {
+		conn.stats.EnhanceYourCalm = true
+	}
+	conn.statsMu.Unlock()
 
-	// send ACK
-	ack := NewSettingsFrame(ACK, 0, NilSettings)
-	conn.WriteChan <- ack
+	if calm {
+		msg := fmt.Sprintf("more than %v streams are reset in %v", conn.MaxRapidResets, conn.RapidResetWindow)
+		Error("%v", msg)
+		conn.GoAway(0, &ConnectionError{Code: ENHANCE_YOUR_CALM, Reason: msg})
+		conn.Close()
+	}
+}
+
+// PRIORITY without Stream is retained for MaxIdlePriorities,
+// so it cannot be used for exhausting memory.
+// called from ReadLoop.
+func (conn *Conn) retainPriority(id uint32) {
+	conn.streamsMu.Lock()
+	stream := conn.Streams[id]
+	conn.streamsMu.Unlock()
+	if stream != nil {
+		return
+	}
+	conn.idlePriorities = append(conn.idlePriorities, id)
+	for len(conn.idlePriorities) > conn.MaxIdlePriorities {
+		oldest := conn.idlePriorities[0]
+		conn.idlePriorities = conn.idlePriorities[1:]
+		conn.streamsMu.Lock()
+		stream := conn.Streams[oldest]
+		conn.streamsMu.Unlock()
+		if stream == nil {
+			Debug("remove priority of idle stream(%v)", oldest)
+			conn.Priority.Remove(oldest)
+		}
+	}
 }
 
+// reads frames until error, then closes the connection
 func (conn *Conn) ReadLoop() {
 	Debug("start conn.ReadLoop()")
+	defer conn.Close()
+	if conn.ReadIdleTimeout > 0 {
+		conn.keepaliveMu.Lock()
+		conn.idleTimer = time.AfterFunc(conn.ReadIdleTimeout, conn.readIdle)
+		conn.keepaliveMu.Unlock()
+	}
+	if conn.IdleTimeout > 0 {
+		conn.keepaliveMu.Lock()
+		conn.closeIdleTimer = time.AfterFunc(conn.IdleTimeout, conn.closeIdle)
+		conn.keepaliveMu.Unlock()
+	}
+	conn.Framer.HeaderBlockTimeout = conn.ReadHeaderTimeout
+	var consumed int32 // DATA of the previous frame
 	for {
+		// connection window is consumed after the frame is dispatched,
+		// so DATA buffered by stream is held before it, see WindowHold
+		if consumed > 0 {
+			conn.WindowConsume(consumed)
+			consumed = 0
+		}
+
 		// コネクションからフレームを読み込む
-		frame, err := ReadFrame(conn.RW, conn.Settings)
+		frame, err := conn.Framer.ReadFrame()
+		if err == nil {
+			conn.resetIdleTimer()
+		}
+		if err != nil && conn.IsClosed() {
+			Debug("stop conn.ReadLoop() by Close()")
+			break
+		}
+		if err != nil && conn.handshaking && os.IsTimeout(err) {
+			msg := fmt.Sprintf("SETTINGS is not received in %v", conn.ReadHeaderTimeout)
+			err = &ConnectionError{Code: PROTOCOL_ERROR, Reason: msg}
+		}
 		if err != nil {
 			Error("%v", err)
-			h2Error, ok := err.(*H2Error)
-			if ok {
-				conn.GoAway(0, h2Error)
+			var streamError *StreamError
+			if errors.As(err, &streamError) {
+				conn.RstStream(streamError)
+				continue
+			}
+			var connectionError *ConnectionError
+			if errors.As(err, &connectionError) {
+				conn.GoAway(0, connectionError)
 			}
 			break
 		}
+
+		// decode header block in order of receiving,
+		// because HPACK context is shared by the connection
+		// (CONTINUATIONs are already assembled by Framer)
+		switch f := frame.(type) {
+		case *HeadersFrame:
+			err = f.Decode(conn.HpackContext)
+		case *ContinuationFrame:
+			err = f.Decode(conn.HpackContext)
+		case *PushPromiseFrame:
+			err = f.Decode(conn.HpackContext)
+		}
+		// request header list larger than our limit or malformed is
+		// discarded, but the stream may be opened to be answered by status
+		rejected := conn.rejectStatus(frame, err)
+		if rejected > 0 {
+			frame.(*HeadersFrame).Headers = make(http.Header)
+			err = nil
+		}
+		if err != nil {
+			var streamError *StreamError
+			if errors.As(err, &streamError) {
+				conn.RstStream(streamError)
+				continue
+			}
+			var connectionError *ConnectionError
+			if errors.As(err, &connectionError) {
+				conn.GoAway(0, connectionError)
+			}
+			break
+		}
+
 		if frame != nil {
-			Notice("%v %v", Green("recv"), util.Indent(frame.String()))
+			Notice("%v %v", Green("recv"), util.Indent(frameString(frame)))
+		}
+
+		conn.removeClosedStreams()
+
+		if callback, ok := conn.FrameCallBack[frame.Header().Type]; ok {
+			callback(frame)
+		}
+
+		// ignore unknown type of frame
+		if _, ok := frame.(*UnknownFrame); ok {
+			continue
 		}
 
 		streamID := frame.Header().StreamID
@@ -143,9 +1150,9 @@ func (conn *Conn) ReadLoop() {
 				types == PushPromiseFrameType ||
 				types == ContinuationFrameType {
 
-				msg := fmt.Sprintf("%s FRAME for Stream ID 0", types)
+				msg := fmt.Sprintf("%s frame on stream(0)", types)
 				Error("%v", msg)
-				conn.GoAway(0, &H2Error{PROTOCOL_ERROR, msg})
+				conn.GoAway(0, &ConnectionError{Code: PROTOCOL_ERROR, Reason: msg})
 				break // TODO: check this flow is correct or not
 			}
 
@@ -156,7 +1163,19 @@ func (conn *Conn) ReadLoop() {
 					Error("invalid settings frame %v", frame)
 					return
 				}
-				conn.HandleSettings(settingsFrame)
+				// handshake of connection preface and SETTINGS completes
+				if conn.handshaking && settingsFrame.Flags != ACK {
+					conn.handshaking = false
+					conn.setReadDeadline(time.Time{})
+				}
+				err := conn.HandleSettings(settingsFrame)
+				if err != nil {
+					var connectionError *ConnectionError
+					if errors.As(err, &connectionError) {
+						conn.GoAway(0, connectionError)
+					}
+					break
+				}
 			}
 
 			// Connection Level Window Update
@@ -167,22 +1186,30 @@ func (conn *Conn) ReadLoop() {
 					return
 				}
 				Debug("connection window size increment(%v)", int32(windowUpdateFrame.WindowSizeIncrement))
-				conn.Window.UpdatePeer(int32(windowUpdateFrame.WindowSizeIncrement))
+				err := conn.Window.UpdatePeer(int32(windowUpdateFrame.WindowSizeIncrement))
+				if err != nil {
+					conn.GoAway(0, &ConnectionError{Code: FLOW_CONTROL_ERROR, Reason: err.Error()})
+					break
+				}
 			}
 
-			// respond to PING
+			// respond to PING with the same opaque data
 			if types == PingFrameType {
-				// ignore ack
+				opaqueData := frame.(*PingFrame).OpaqueData
 				if frame.Header().Flags != ACK {
-					conn.PingACK([]byte("pong    ")) // should be 8 byte
+					conn.resetCloseIdleTimer()
+					conn.PingACK(opaqueData)
+				} else {
+					conn.pingACK(opaqueData)
 				}
 				continue
 			}
 
-			// handle GOAWAY with close connection
+			// streams below last stream id of GOAWAY continue,
+			// and connection is closed after them
 			if types == GoAwayFrameType {
-				Debug("stop conn.ReadLoop() by GOAWAY")
-				break
+				conn.HandleGoAway(frame.(*GoAwayFrame))
+				continue
 			}
 		}
 
@@ -192,104 +1219,461 @@ func (conn *Conn) ReadLoop() {
 				types == PingFrameType ||
 				types == GoAwayFrameType {
 
-				msg := fmt.Sprintf("%s FRAME for Stream ID not 0", types)
+				msg := fmt.Sprintf("%s frame on stream(%v)", types, streamID)
 				Error("%v", msg)
-				conn.GoAway(0, &H2Error{PROTOCOL_ERROR, msg})
+				conn.GoAway(0, &ConnectionError{Code: PROTOCOL_ERROR, Reason: msg})
 				break // TODO: check this flow is correct or not
 			}
 
+			// client never pushes, and push is disabled by SETTINGS (RFC 7540 8.2)
+			if types == PushPromiseFrameType && (conn.Role == ServerRole || conn.Settings.Local(SETTINGS_ENABLE_PUSH) == 0) {
+				msg := fmt.Sprintf("PUSH_PROMISE on stream(%v) is not allowed", streamID)
+				Error("%v", msg)
+				conn.GoAway(0, &ConnectionError{Code: PROTOCOL_ERROR, Reason: msg})
+				break
+			}
+
 			// DATA frame なら winodw を消費
+			// Length includes padding, which is also flow controlled
 			if types == DataFrameType {
-				length := int32(frame.Header().Length)
-				conn.WindowConsume(length)
+				consumed = int32(frame.Header().Length)
 			}
 
-			// 新しいストリーム ID なら対応するストリームを生成
-			stream, ok := conn.Streams[streamID]
-			if !ok {
-				// create stream with streamID
-				stream = conn.NewStream(streamID)
-				conn.Streams[streamID] = stream
+			// PRIORITY may come on idle or closed stream (RFC 7540 5.3)
+			if priorityFrame, ok := frame.(*PriorityFrame); ok {
+				err := conn.Priority.Set(streamID, priorityFrame.StreamDependency, priorityWeight(priorityFrame.Weight), priorityFrame.Exclusive)
+				var streamError *StreamError
+				if errors.As(err, &streamError) {
+					conn.RstStream(streamError)
+					continue
+				}
+				conn.retainPriority(streamID)
+			}
 
-				// update last stream id
-				if streamID > conn.LastStreamID {
-					conn.LastStreamID = streamID
+			// 新しいストリーム ID なら対応するストリームを生成
+			stream, err := conn.recvStream(frame)
+			if err != nil {
+				var streamError *StreamError
+				if errors.As(err, &streamError) {
+					conn.RstStream(streamError)
+					continue
+				}
+				var connectionError *ConnectionError
+				if errors.As(err, &connectionError) {
+					conn.GoAway(0, connectionError)
 				}
+				break
+			}
+			if stream == nil {
+				// ignored
+				continue
 			}
+			if rejected > 0 {
+				stream.rejected = rejected
+			}
+
+			// frames allowed on closed stream need nothing to do,
+			// and its ReadLoop may be stopped
+			closed := stream.CurrentState() == CLOSED
 
 			// stream の state を変える
+			// DATA and HEADERS after END_STREAM are STREAM_CLOSED,
+			// and DATA has consumed connection window above
 			err = stream.ChangeState(frame, RECV)
 			if err != nil {
 				Error("%v", err)
-				h2Error, ok := err.(*H2Error)
-				if ok {
-					conn.GoAway(0, h2Error)
+				var streamError *StreamError
+				if errors.As(err, &streamError) && !closed {
+					// sending RST_STREAM closes the stream, without delivering the frame
+					stream.Write(NewRstStreamFrame(streamID, streamError.Code))
+					stream.CloseWithError(streamError)
+					conn.closedStreams = append(conn.closedStreams, closedStream{streamID, time.Now()})
+					continue
+				}
+				if errors.As(err, &streamError) {
+					conn.RstStream(streamError)
+					continue
+				}
+				var connectionError *ConnectionError
+				if errors.As(err, &connectionError) {
+					conn.GoAway(0, connectionError)
 				}
 				break
 			}
 
+			if closed {
+				continue
+			}
+
+			// HEADERS with priority reprioritizes the stream
+			if headersFrame, ok := frame.(*HeadersFrame); ok && headersFrame.DependencyTree != nil {
+				tree := headersFrame.DependencyTree
+				err := conn.Priority.Set(streamID, tree.StreamDependency, headersWeight(tree.Weight), tree.Exclusive)
+				if err != nil {
+					// sending RST_STREAM closes the stream, without calling handler
+					stream.Write(NewRstStreamFrame(streamID, PROTOCOL_ERROR))
+					stream.Close()
+					conn.closedStreams = append(conn.closedStreams, closedStream{streamID, time.Now()})
+					continue
+				}
+			}
+
+			// stops sending and wakes writers and readers of the stream,
+			// and queued DATA is discarded
+			if rstStreamFrame, ok := frame.(*RstStreamFrame); ok {
+				stream.reset(rstStreamFrame.ErrorCode)
+				conn.closedStreams = append(conn.closedStreams, closedStream{streamID, time.Now()})
+				continue
+			}
+
+			// stream window is updated here, overflow is stream error
+			if windowUpdateFrame, ok := frame.(*WindowUpdateFrame); ok {
+				Info("Window Update %d byte stream(%v)", windowUpdateFrame.WindowSizeIncrement, streamID)
+				err := stream.Window.UpdatePeer(int32(windowUpdateFrame.WindowSizeIncrement))
+				if err != nil {
+					// sending RST_STREAM closes the stream
+					stream.Write(NewRstStreamFrame(streamID, FLOW_CONTROL_ERROR))
+					stream.Close()
+					conn.closedStreams = append(conn.closedStreams, closedStream{streamID, time.Now()})
+				}
+				continue
+			}
+
 			// stream が close ならリストから消す
-			if stream.State == CLOSED {
-
-				// ただし、1 秒は window update が来てもいいように待つ
-				// TODO: atomic にする
-				go func(streamID uint32) {
-					<-time.After(1 * time.Second)
-					Info("remove stream(%d) from conn.Streams[]", streamID)
-					conn.Streams[streamID] = nil
-				}(streamID)
+			// ただし、1 秒は window update が来てもいいように待つ
+			if stream.CurrentState() == CLOSED {
+				conn.closedStreams = append(conn.closedStreams, closedStream{streamID, time.Now()})
 			}
 
 			// ストリームにフレームを渡す
-			stream.ReadChan <- frame
+			// read here in order of receiving, RST_STREAM follows the frames before it
+			if stream.Context().Err() != nil {
+				Debug("discard %v to closed stream(%v)", types, streamID)
+				continue
+			}
+			stream.Read(frame)
 		}
 	}
 
 	Debug("stop the readloop")
 }
 
+// writes frames from WriteChan.
+// DATA is sent within connection window, and streams share it
+// by Priority. other frames go as soon as possible.
 func (conn *Conn) WriteLoop() (err error) {
 	Debug("start conn.WriteLoop()")
-	for frame := range conn.WriteChan {
-		Notice("%v %v", Red("send"), util.Indent(frame.String()))
+	for {
+		// take frames sent by now, to choose from them
+		for received := true; received; {
+			select {
+			case frame := <-conn.WriteChan:
+				conn.enqueue(frame)
+			default:
+				received = false
+			}
+		}
 
-		// TODO: ここで connection レベルの WindowSize を見る
-		err = frame.Write(conn.RW)
+		updated := conn.Window.Updated()
+		frame := conn.nextFrame()
+		if frame == nil {
+			// waits next frame, or connection window for queued DATA
+			select {
+			case frame := <-conn.WriteChan:
+				conn.enqueue(frame)
+			case <-conn.controlReady:
+			case <-updated:
+			case flushed := <-conn.flush:
+				conn.flushWaiters = append(conn.flushWaiters, flushed)
+			case <-conn.closed:
+				Debug("stop conn.WriteLoop() by Close()")
+				return nil
+			}
+			conn.flushed()
+			continue
+		}
+
+		err = conn.write(frame)
 		if err != nil {
 			Error("%v", err)
 			return err
 		}
+		conn.flushed()
+	}
+}
+
+// wakes flush waiters if no frame is queued
+func (conn *Conn) flushed() {
+	conn.controlMu.Lock()
+	queued := len(conn.controlQueue)
+	conn.controlMu.Unlock()
+	if len(conn.flushWaiters) == 0 || queued > 0 || len(conn.dataQueues) > 0 {
+		return
+	}
+	for _, flushed := range conn.flushWaiters {
+		close(flushed)
+	}
+	conn.flushWaiters = nil
+}
+
+// DATA and frames following it on the stream wait in its queue.
+// RST_STREAM discards them, since the stream is over.
+// but RST_STREAM(NO_ERROR) follows the response it completes.
+func (conn *Conn) enqueue(frame Frame) {
+	streamID := frame.Header().StreamID
+	if _, ok := conn.dataQueues[streamID]; ok {
+		if rst, ok := frame.(*RstStreamFrame); ok && rst.ErrorCode != NO_ERROR {
+			delete(conn.dataQueues, streamID)
+		} else {
+			conn.dataQueues[streamID] = append(conn.dataQueues[streamID], frame)
+			return
+		}
+	}
+	if streamID > 0 && frame.Header().Type == DataFrameType {
+		conn.dataQueues[streamID] = []Frame{frame}
+		return
+	}
+	conn.controlMu.Lock()
+	conn.controlQueue = append(conn.controlQueue, frame)
+	conn.controlMu.Unlock()
+}
+
+// frame to write now, nil if nothing can be sent.
+// DATA larger than connection window is split.
+func (conn *Conn) nextFrame() Frame {
+	conn.controlMu.Lock()
+	if len(conn.controlQueue) > 0 {
+		frame := conn.controlQueue[0]
+		conn.controlQueue = conn.controlQueue[1:]
+		conn.controlMu.Unlock()
+		return frame
+	}
+	conn.controlMu.Unlock()
+	if len(conn.dataQueues) == 0 {
+		return nil
+	}
+
+	// frames of stream closed by RST_STREAM are discarded,
+	// and stream removed from Priority may still have frames
+	for id := range conn.dataQueues {
+		conn.streamsMu.Lock()
+		stream := conn.Streams[id]
+		conn.streamsMu.Unlock()
+		if stream == nil || stream.Context().Err() != nil {
+			Debug("discard %v frames of closed stream(%v)", len(conn.dataQueues[id]), id)
+			delete(conn.dataQueues, id)
+			continue
+		}
+		conn.Priority.Add(id)
+	}
+	if len(conn.dataQueues) == 0 {
+		return nil
+	}
+
+	available := conn.Window.Consumable(1) > 0
+	streamID, ok := conn.Priority.Next(func(id uint32) bool {
+		queue, ok := conn.dataQueues[id]
+		if !ok {
+			return false
+		}
+		data, ok := queue[0].(*DataFrame)
+		return available || !ok || len(data.Data) == 0
+	})
+	if !ok {
+		return nil
+	}
+
+	queue := conn.dataQueues[streamID]
+	frame := queue[0]
+	if data, ok := frame.(*DataFrame); ok && len(data.Data) > 0 {
+		size := conn.Window.TryAcquirePeer(int32(len(data.Data)))
+		conn.Priority.Sent(streamID, int(size))
+		conn.streamsMu.Lock()
+		if stream := conn.Streams[streamID]; stream != nil {
+			stream.dequeue(int(size))
+		}
+		conn.streamsMu.Unlock()
+		if int(size) < len(data.Data) {
+			// rest waits next window
+			queue[0] = NewDataFrame(data.Flags, streamID, data.Data[size:], nil)
+			return NewDataFrame(data.Flags&^END_STREAM, streamID, data.Data[:size], nil)
+		}
+	}
+
+	if len(queue) == 1 {
+		delete(conn.dataQueues, streamID)
+	} else {
+		conn.dataQueues[streamID] = queue[1:]
+	}
+	return frame
+}
+
+// status to answer new request whose Decode failed, 0 if it is reset.
+// too large header list is 431 (RFC 6585 5), and malformed one
+// is 400 by BadRequest. others, like trailer or response, are reset.
+func (conn *Conn) rejectStatus(frame Frame, err error) int {
+	var streamError *StreamError
+	if conn.Role != ServerRole || !errors.As(err, &streamError) {
+		return 0
+	}
+	if _, ok := frame.(*HeadersFrame); !ok {
+		return 0
+	}
+	var status int
+	switch {
+	case streamError.Code == REFUSED_STREAM:
+		status = http.StatusRequestHeaderFieldsTooLarge
+	case streamError.Code == PROTOCOL_ERROR && conn.BadRequest:
+		status = http.StatusBadRequest
+	default:
+		return 0
+	}
+	conn.streamsMu.Lock()
+	defer conn.streamsMu.Unlock()
+	if _, ok := conn.Streams[frame.Header().StreamID]; ok {
+		return 0
+	}
+	return status
+}
+
+// writes frame immediately, not via WriteChan
+// so it may go before the frames waiting in WriteChan.
+func (conn *Conn) WriteFrame(frame Frame) error {
+	if conn.IsClosed() {
+		return fmt.Errorf("write %v to closed connection", frame.Header().Type)
+	}
+	return conn.write(frame)
+}
+
+func (conn *Conn) write(frame Frame) error {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	Notice("%v %v", Red("send"), util.Indent(frameString(frame)))
+	return conn.Framer.WriteFrame(frame)
+}
+
+// queues frame of ReadLoop to WriteLoop without blocking, so
+// ReadLoop keeps reading while WriteLoop is blocked by peer.
+// discarded if closed.
+func (conn *Conn) send(frame Frame) {
+	if conn.IsClosed() {
+		Debug("discard %v to closed connection", frame.Header().Type)
+		return
+	}
+	conn.controlMu.Lock()
+	flood := len(conn.controlQueue) >= conn.MaxQueuedControlFrames
+	if !flood {
+		conn.controlQueue = append(conn.controlQueue, frame)
+	}
+	conn.controlMu.Unlock()
+	if flood {
+		conn.controlFlood()
+		return
+	}
+	select {
+	case conn.controlReady <- struct{}{}:
+	default:
 	}
-	return
+}
+
+// peer doesn't read our control frames, ENHANCE_YOUR_CALM
+func (conn *Conn) controlFlood() {
+	conn.statsMu.Lock()
+	first := !conn.stats.ControlFlood
+	conn.stats.ControlFlood = true
+	conn.statsMu.Unlock()
+	if !first {
+		return
+	}
+
+	msg := fmt.Sprintf("more than %v control frames are not written", conn.MaxQueuedControlFrames)
+	Error("%v", msg)
+	// GOAWAY may be blocked too, since peer doesn't read
+	written := make(chan struct{})
+	go func() {
+		conn.GoAway(0, &ConnectionError{Code: ENHANCE_YOUR_CALM, Reason: msg})
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+	}
+	conn.Close()
 }
 
 func (conn *Conn) PingACK(opaqueData []byte) {
 	Debug("Ping ACK with opaque(%v)", opaqueData)
 	pingAck := NewPingFrame(ACK, 0, opaqueData)
-	conn.WriteChan <- pingAck
+	conn.send(pingAck)
 }
 
-func (conn *Conn) GoAway(streamId uint32, h2Error *H2Error) {
-	Debug("connection close with GO_AWAY(%v)", h2Error)
-	errorCode := h2Error.ErrorCode
-	additionalDebugData := []byte(h2Error.AdditiolanDebugData)
+// sends GOAWAY with reason of the error as debug data,
+// which is cut in MaxGoAwayDebugData
+func (conn *Conn) GoAway(streamId uint32, connectionError *ConnectionError) {
+	Debug("connection close with GO_AWAY(%v)", connectionError)
+	errorCode := connectionError.Code
+	additionalDebugData := []byte(connectionError.Reason)
+	if len(additionalDebugData) > MaxGoAwayDebugData {
+		additionalDebugData = additionalDebugData[:MaxGoAwayDebugData]
+	}
 	goaway := NewGoAwayFrame(streamId, conn.LastStreamID, errorCode, additionalDebugData)
-	conn.WriteChan <- goaway
+
+	// connection will be closed after this,
+	// so write it now instead of WriteChan
+	err := conn.WriteFrame(goaway)
+	if err != nil {
+		Error("%v", err)
+	}
+}
+
+// stream error of peer's frame, which also counts as rapid reset
+// if the stream is opened and not closed yet. refused stream or
+// frame on closed stream is not counted.
+func (conn *Conn) RstStream(streamError *StreamError) {
+	Debug("stream close with RST_STREAM(%v)", streamError)
+	conn.streamsMu.Lock()
+	stream := conn.Streams[streamError.StreamID]
+	conn.streamsMu.Unlock()
+	if stream != nil && stream.onReset != nil && stream.CurrentState() != CLOSED {
+		stream.onReset()
+	}
+	rst := NewRstStreamFrame(streamError.StreamID, streamError.Code)
+	conn.send(rst)
 }
 
 func (conn *Conn) WindowConsume(length int32) {
 	Debug("connection window update %d byte", length)
+	conn.windowMu.Lock()
+	defer conn.windowMu.Unlock()
 
 	// update する必要があればそれが返ってくる
 	update := conn.Window.Consume(length)
 
 	// update があれば WindowUpdate を送る
 	if update > 0 {
-		conn.WriteChan <- NewWindowUpdateFrame(0, uint32(update))
+		conn.send(NewWindowUpdateFrame(0, uint32(update)))
 		conn.Window.Update(update)
 	}
 }
 
+// DATA buffered in body of stream holds connection window until it is read,
+// so reader slower than peer holds back all streams of the connection
+func (conn *Conn) WindowHold(length int32) {
+	conn.Window.Hold(length)
+}
+
+// called with size of read body, or discarded one
+func (conn *Conn) WindowRelease(length int32) {
+	Debug("connection window release %d byte", length)
+	conn.windowMu.Lock()
+	defer conn.windowMu.Unlock()
+	update := conn.Window.Release(length)
+	if update > 0 {
+		conn.Window.Update(update)
+		conn.send(NewWindowUpdateFrame(0, uint32(update)))
+	}
+}
+
 func (conn *Conn) WriteMagic() (err error) {
 	_, err = conn.RW.Write([]byte(CONNECTION_PREFACE))
 	if err != nil {
@@ -299,28 +1683,175 @@ func (conn *Conn) WriteMagic() (err error) {
 	return
 }
 
+// reads connection preface of client (RFC 7540 3.5)
+// it may arrive in several segments, and each part is checked
+// so that HTTP/1.1 request fails without waiting the rest.
+// invalid preface is answered with GOAWAY(PROTOCOL_ERROR).
 func (conn *Conn) ReadMagic() (err error) {
-	magic := make([]byte, len(CONNECTION_PREFACE))
-	_, err = conn.RW.Read(magic)
-	if err != nil {
-		return err
+	if conn.ReadHeaderTimeout > 0 {
+		conn.handshaking = true
+		conn.setReadDeadline(time.Now().Add(conn.ReadHeaderTimeout))
 	}
-	if string(magic) != CONNECTION_PREFACE {
-		Info("Invalid Magic String: %q", string(magic))
-		return fmt.Errorf("Invalid Magic String")
+	magic := make([]byte, len(CONNECTION_PREFACE))
+	for n := 0; n < len(magic); {
+		var m int
+		m, err = conn.RW.Read(magic[n:])
+		if os.IsTimeout(err) {
+			msg := fmt.Sprintf("connection preface is not received in %v", conn.ReadHeaderTimeout)
+			Error("%v", msg)
+			connectionError := &ConnectionError{Code: PROTOCOL_ERROR, Reason: msg}
+			conn.GoAway(0, connectionError)
+			return connectionError
+		}
+		if string(magic[n:n+m]) != CONNECTION_PREFACE[n:n+m] {
+			msg := fmt.Sprintf("invalid connection preface %q", magic[:n+m])
+			Error("%v", msg)
+			connectionError := &ConnectionError{Code: PROTOCOL_ERROR, Reason: msg}
+			conn.GoAway(0, connectionError)
+			return connectionError
+		}
+		n += m
+		if err == io.EOF && n > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
 	}
 	Info("%v %q", Green("recv"), string(magic))
 	return
 }
 
+// read deadline of RW if it supports, zero time clears it
+func (conn *Conn) setReadDeadline(t time.Time) {
+	if rw, ok := conn.RW.(interface{ SetReadDeadline(time.Time) error }); ok {
+		rw.SetReadDeadline(t)
+	}
+}
+
+// closes connection gracefully (RFC 7540 6.8)
+// sends GOAWAY(NO_ERROR) with last accepted stream, which refuses
+// new streams, and closes after active streams complete and
+// their frames are written. closes immediately when ctx is done.
+func (conn *Conn) Shutdown(ctx context.Context) error {
+	conn.streamsMu.Lock()
+	first := !conn.goingAway
+	conn.goingAway = true
+	lastStreamID := conn.LastStreamID
+	conn.streamsMu.Unlock()
+
+	if first {
+		Debug("shutdown connection with GOAWAY last stream(%v)", lastStreamID)
+		err := conn.WriteFrame(NewGoAwayFrame(0, lastStreamID, NO_ERROR, nil))
+		if err != nil {
+			Error("%v", err)
+		}
+	}
+
+	err := conn.drain(ctx)
+	conn.Close()
+	return err
+}
+
+// waits active streams and frames of them are written
+func (conn *Conn) drain(ctx context.Context) error {
+	for {
+		conn.streamsMu.Lock()
+		released := conn.streamReleased
+		conn.streamsMu.Unlock()
+		if conn.activeStreams() == 0 {
+			break
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-conn.closed:
+			return nil
+		}
+	}
+
+	// closed stream may be sending its last frame
+	written := make(chan struct{})
+	go func() {
+		for _, stream := range conn.openedStreams() {
+			stream.waitWrite()
+		}
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-conn.closed:
+		return nil
+	}
+
+	flushed := make(chan struct{})
+	select {
+	case conn.flush <- flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-conn.closed:
+		return nil
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-conn.closed:
+		return nil
+	}
+}
+
+// closes all streams and rw, which unblocks ReadLoop/WriteLoop.
+// safe to call more than once.
 func (conn *Conn) Close() {
-	Info("close all conn.Streams")
-	for i, stream := range conn.Streams {
-		if stream != nil {
-			Debug("close stream(%d)", i)
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+
+		conn.settingsMu.Lock()
+		if conn.settingsTimer != nil {
+			conn.settingsTimer.Stop()
+		}
+		conn.settingsMu.Unlock()
+		conn.stopIdleTimer()
+
+		Info("close all conn.Streams")
+		for _, stream := range conn.openedStreams() {
+			Debug("close stream(%d)", stream.ID)
 			stream.Close()
 		}
+		// streams not in conn.Streams yet
+		conn.cancel()
+
+		if closer, ok := conn.RW.(io.Closer); ok {
+			Info("close %v connection", conn.Role)
+			closer.Close()
+		}
+	})
+}
+
+// done when the connection is closed,
+// contexts of streams are derived from it.
+func (conn *Conn) Context() context.Context {
+	return conn.ctx
+}
+
+func (conn *Conn) IsClosed() bool {
+	select {
+	case <-conn.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// frame for verbose log
+func frameString(frame Frame) string {
+	if FrameDump {
+		return frame.String() + "\n" + DumpFrame(frame)
 	}
-	Info("close conn.WriteChan")
-	close(conn.WriteChan)
+	return frame.String()
 }
@@ -0,0 +1,796 @@
+package http2
+
+import (
+	"context"
+	"encoding/hex"
+	assert "github.com/Jxck/assertion"
+	. "github.com/Jxck/http2/frame"
+	"github.com/Jxck/http2/hpack"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// server side Conn and client side Framer over pipe
+func newTestConn(t *testing.T) (*Conn, *Framer) {
+	client, server := net.Pipe()
+	conn := NewConn(server, ServerRole)
+	go conn.WriteLoop()
+	t.Cleanup(func() {
+		conn.Close()
+		client.Close()
+	})
+	return conn, NewFramer(client, client)
+}
+
+// reads frames in background
+func readFrames(framer *Framer) chan Frame {
+	frames := make(chan Frame, 16)
+	go func() {
+		defer close(frames)
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+	return frames
+}
+
+func nextFrame(t *testing.T, frames chan Frame) Frame {
+	select {
+	case frame, ok := <-frames:
+		if !ok {
+			t.Fatal("connection closed")
+		}
+		return frame
+	case <-time.After(time.Second):
+		t.Fatal("frame timeout")
+	}
+	return nil
+}
+
+// GET https://www.example.com/ encoded by golang.org/x/net/http2/hpack
+func getExampleHeaderBlock() []byte {
+	hb, _ := hex.DecodeString("828784418cf1e3c2e5f23a6ba0ab90f4ff7a8dc475a74a6b589418b525812e0f")
+	return hb
+}
+
+func TestConnDispatch(t *testing.T) {
+	conn, framer := newTestConn(t)
+	frames := readFrames(framer)
+
+	received := make(chan Frame, 4)
+	conn.FrameCallBack[SettingsFrameType] = func(frame Frame) { received <- frame }
+	conn.FrameCallBack[PingFrameType] = func(frame Frame) { received <- frame }
+
+	streams := make(chan *Stream, 1)
+	conn.CallBack = func(stream *Stream) { streams <- stream }
+	go conn.ReadLoop()
+
+	// connection level
+	framer.WriteFrame(NewSettingsFrame(UNSET, 0, NilSettings))
+	assert.Equal(t, nextFrame(t, received).Header().Type, FrameType(SettingsFrameType))
+	ack := nextFrame(t, frames)
+	assert.Equal(t, ack.Header().Type, FrameType(SettingsFrameType))
+	assert.Equal(t, ack.Header().Flags, Flag(ACK))
+
+	framer.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+	assert.Equal(t, nextFrame(t, received).Header().Type, FrameType(PingFrameType))
+	ack = nextFrame(t, frames)
+	assert.Equal(t, ack.Header().Type, FrameType(PingFrameType))
+	assert.Equal(t, ack.Header().Flags, Flag(ACK))
+	assert.Equal(t, string(ack.(*PingFrame).OpaqueData), "deadbeef")
+
+	// stream level
+	hb := getExampleHeaderBlock()
+	framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil))
+	select {
+	case stream := <-streams:
+		assert.Equal(t, stream.ID, uint32(1))
+		assert.Equal(t, stream.Bucket.Headers.Get(":authority"), "www.example.com")
+	case <-time.After(time.Second):
+		t.Fatal("stream callback timeout")
+	}
+	assert.Equal(t, conn.LastStreamID, uint32(1))
+}
+
+func TestConnSettings(t *testing.T) {
+	conn, framer := newTestConn(t)
+	frames := readFrames(framer)
+	go conn.ReadLoop()
+
+	// hold stream to see initial window change
+	stream := conn.NewStream(1)
+	conn.Streams[stream.ID] = stream
+
+	framer.WriteFrame(NewSettingsFrame(UNSET, 0, map[SettingsID]int32{
+		SETTINGS_INITIAL_WINDOW_SIZE:    1000,
+		SETTINGS_MAX_FRAME_SIZE:         1 << 20,
+		SETTINGS_MAX_CONCURRENT_STREAMS: 10,
+	}))
+
+	// applied before ACK
+	ack := nextFrame(t, frames)
+	assert.Equal(t, ack.Header().Flags, Flag(ACK))
+	assert.Equal(t, conn.Settings.Peer(SETTINGS_MAX_CONCURRENT_STREAMS), int32(10))
+	assert.Equal(t, conn.Framer.MaxWriteFrameSize(), int32(1<<20))
+	assert.Equal(t, stream.Window.peerCurrentSize, int32(1000))
+
+	// ours waits ACK
+	err := conn.WriteSettings(map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextFrame(t, frames)
+	assert.Equal(t, conn.Settings.Unacked(), 1)
+
+	framer.WriteFrame(NewSettingsFrame(ACK, 0, NilSettings))
+	framer.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+	nextFrame(t, frames) // PING ACK after SETTINGS ACK handled
+	assert.Equal(t, conn.Settings.Unacked(), 0)
+	assert.Equal(t, conn.Settings.Acked(SETTINGS_INITIAL_WINDOW_SIZE), int32(100))
+}
+
+func TestConnSettingsHeaderTableSize(t *testing.T) {
+	conn, framer := newTestConn(t)
+	frames := readFrames(framer)
+	go conn.ReadLoop()
+
+	encoder := conn.PeerHpackContext.Encoder
+	conn.PeerHpackContext.Encode(hpack.HeaderList{hpack.NewHeaderField("x-custom", "value")})
+	assert.Equal(t, encoder.TableLen(), 1)
+	assert.Equal(t, encoder.TableSize(), uint32(len("x-custom")+len("value")+32))
+
+	// peer empties our dynamic table
+	framer.WriteFrame(NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_HEADER_TABLE_SIZE: 0}))
+	ack := nextFrame(t, frames)
+	assert.Equal(t, ack.Header().Flags, Flag(ACK))
+	assert.Equal(t, encoder.TableLen(), 0)
+	assert.Equal(t, encoder.TableSize(), uint32(0))
+
+	// notified at the head of next block, and nothing is indexed
+	wire := conn.PeerHpackContext.Encode(hpack.HeaderList{hpack.NewHeaderField("x-custom", "value")})
+	assert.Equal(t, wire[0], byte(0x20))
+	assert.Equal(t, encoder.TableLen(), 0)
+}
+
+func TestConnSettingsTimeout(t *testing.T) {
+	// ACK in time
+	conn, framer := newTestConn(t)
+	conn.SettingsTimeout = 100 * time.Millisecond
+	frames := readFrames(framer)
+	go conn.ReadLoop()
+
+	conn.WriteSettings(NilSettings)
+	nextFrame(t, frames)
+	framer.WriteFrame(NewSettingsFrame(ACK, 0, NilSettings))
+	time.Sleep(200 * time.Millisecond)
+	framer.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+	assert.Equal(t, nextFrame(t, frames).Header().Type, FrameType(PingFrameType))
+
+	// no ACK
+	conn, framer = newTestConn(t)
+	conn.SettingsTimeout = 100 * time.Millisecond
+	frames = readFrames(framer)
+	go conn.ReadLoop()
+
+	conn.WriteSettings(NilSettings)
+	nextFrame(t, frames)
+	goaway, ok := nextFrame(t, frames).(*GoAwayFrame)
+	if !ok {
+		t.Fatal("GOAWAY should be sent")
+	}
+	assert.Equal(t, goaway.ErrorCode, SETTINGS_TIMEOUT)
+
+	select {
+	case _, ok := <-frames:
+		if ok {
+			t.Error("connection should be closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("connection is not closed")
+	}
+}
+
+func TestConnMaxConcurrentStreams(t *testing.T) {
+	conn, framer := newTestConn(t)
+	frames := readFrames(framer)
+
+	// handlers keep streams half closed (remote)
+	called := make(chan uint32, 32)
+	conn.CallBack = func(stream *Stream) { called <- stream.ID }
+	go conn.ReadLoop()
+
+	limit := 5
+	conn.WriteSettings(map[SettingsID]int32{SETTINGS_MAX_CONCURRENT_STREAMS: int32(limit)})
+	nextFrame(t, frames)
+
+	hb := getExampleHeaderBlock()
+	for i := 0; i < limit+10; i++ {
+		framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, uint32(2*i+1), nil, hb, nil))
+	}
+
+	for i := 0; i < 10; i++ {
+		rst, ok := nextFrame(t, frames).(*RstStreamFrame)
+		if !ok {
+			t.Fatal("RST_STREAM should be sent")
+		}
+		assert.Equal(t, rst.ErrorCode, REFUSED_STREAM)
+		if rst.StreamID <= uint32(2*limit) {
+			t.Errorf("stream(%v) in limit is refused", rst.StreamID)
+		}
+	}
+	waitCalled := func() uint32 {
+		select {
+		case id := <-called:
+			return id
+		case <-time.After(time.Second):
+			t.Fatal("handler is not called")
+		}
+		return 0
+	}
+	for i := 0; i < limit; i++ {
+		waitCalled()
+	}
+
+	// closing a stream frees a slot
+	framer.WriteFrame(NewRstStreamFrame(1, CANCEL))
+	id := uint32(2*(limit+10) + 1)
+	framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, id, nil, hb, nil))
+	assert.Equal(t, waitCalled(), id)
+	assert.Equal(t, len(called), 0)
+}
+
+// client side Conn after SETTINGS exchange, and server side Framer
+func newTestClientConn(t *testing.T, settings map[SettingsID]int32) (*Conn, *Framer, chan Frame) {
+	client, server := net.Pipe()
+	framer := NewFramer(server, server)
+	ready := make(chan chan Frame)
+	go func() {
+		io.ReadFull(server, make([]byte, len(CONNECTION_PREFACE)))
+		ready <- readFrames(framer)
+	}()
+	conn, err := NewClientConn(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := <-ready
+	go conn.WriteLoop()
+	go conn.ReadLoop()
+	t.Cleanup(func() {
+		conn.Close()
+		server.Close()
+	})
+
+	waitFrame(t, frames, SettingsFrameType)
+	framer.WriteFrame(NewSettingsFrame(UNSET, 0, settings))
+	waitFrame(t, frames, SettingsFrameType) // ACK
+	return conn, framer, frames
+}
+
+var testRequestHeader = http.Header{
+	":method":    {"GET"},
+	":scheme":    {"https"},
+	":authority": {"example.com"},
+	":path":      {"/"},
+}
+
+func TestConnOpenStream(t *testing.T) {
+	conn, framer, frames := newTestClientConn(t, map[SettingsID]int32{SETTINGS_MAX_CONCURRENT_STREAMS: 1})
+	for i := 0; i < 10; i++ {
+		go conn.OpenStream(testRequestHeader, true, func(stream *Stream) {})
+	}
+
+	// one by one
+	for i := 0; i < 10; i++ {
+		id := waitFrame(t, frames, HeadersFrameType).Header().StreamID
+		assert.Equal(t, id, uint32(2*i+1))
+		select {
+		case frame := <-frames:
+			t.Fatalf("%v is sent while stream(%v) is active", frame, id)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// response or reset frees the slot
+		if i%2 == 0 {
+			framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, id, nil, []byte{0x88}, nil)) // :status: 200
+		} else {
+			framer.WriteFrame(NewRstStreamFrame(id, CANCEL))
+		}
+	}
+}
+
+func TestConnStreamID(t *testing.T) {
+	// client opens odd, server opens even
+	assert.Equal(t, NewConn(nil, ClientRole).nextStreamID, uint32(1))
+	assert.Equal(t, NewConn(nil, ServerRole).nextStreamID, uint32(2))
+
+	// last stream id is 2^31-1, and it doesn't wrap
+	conn, _, frames := newTestClientConn(t, nil)
+	conn.nextStreamID = MAX_STREAM_ID - 2
+	for _, id := range []uint32{MAX_STREAM_ID - 2, MAX_STREAM_ID} {
+		_, err := conn.OpenStream(testRequestHeader, true, func(stream *Stream) {})
+		assert.Equal(t, err, nil)
+		assert.Equal(t, waitFrame(t, frames, HeadersFrameType).Header().StreamID, id)
+	}
+	assert.Equal(t, conn.CanTakeNewRequest(), false)
+	_, err := conn.OpenStream(testRequestHeader, true, func(stream *Stream) {})
+	assert.Equal(t, err, ErrRetryOnNewConn)
+}
+
+func TestConnGoAway(t *testing.T) {
+	conn, framer, frames := newTestClientConn(t, NilSettings)
+
+	streams := make([]*Stream, 3)
+	for i := range streams {
+		stream, err := conn.OpenStream(testRequestHeader, true, func(stream *Stream) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams[i] = stream
+		waitFrame(t, frames, HeadersFrameType)
+	}
+
+	// stream 5 is not processed
+	framer.WriteFrame(NewGoAwayFrame(0, 3, NO_ERROR, nil))
+	<-streams[2].Context().Done()
+	assert.Equal(t, streams[2].Err(), ErrRetryOnNewConn)
+	assert.Equal(t, conn.CanTakeNewRequest(), false)
+
+	_, err := conn.OpenStream(testRequestHeader, true, func(stream *Stream) {})
+	assert.Equal(t, err, ErrRetryOnNewConn)
+
+	// last stream id decreases
+	framer.WriteFrame(NewGoAwayFrame(0, 1, NO_ERROR, nil))
+	<-streams[1].Context().Done()
+	assert.Equal(t, streams[1].Err(), ErrRetryOnNewConn)
+
+	// stream 1 completes, then connection is closed
+	assert.Equal(t, streams[0].Context().Err(), nil)
+	framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, []byte{0x88}, nil)) // :status: 200
+	for range frames {
+	}
+	assert.Equal(t, conn.IsClosed(), true)
+}
+
+func TestConnRefusedStream(t *testing.T) {
+	conn, framer, frames := newTestClientConn(t, NilSettings)
+
+	stream, err := conn.OpenStream(testRequestHeader, true, func(stream *Stream) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFrame(t, frames, HeadersFrameType)
+
+	framer.WriteFrame(NewRstStreamFrame(1, REFUSED_STREAM))
+	<-stream.Context().Done()
+	assert.Equal(t, stream.Err(), ErrRetryOnNewConn)
+
+	// connection is still available
+	assert.Equal(t, conn.CanTakeNewRequest(), true)
+}
+
+func TestConnKeepalive(t *testing.T) {
+	conn, framer := newTestConn(t)
+	frames := readFrames(framer)
+	conn.ReadIdleTimeout = 50 * time.Millisecond
+	conn.PingTimeout = 200 * time.Millisecond
+	streams := make(chan *Stream, 1)
+	conn.CallBack = func(stream *Stream) { streams <- stream }
+	go conn.ReadLoop()
+
+	hb := getExampleHeaderBlock()
+	framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil))
+	stream := <-streams
+
+	// frames keep the connection without PING
+	for i := 0; i < 10; i++ {
+		framer.WriteFrame(NewWindowUpdateFrame(0, 1))
+		select {
+		case frame := <-frames:
+			t.Fatalf("got %v while reading frames", frame)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	// PING after idle, ACK keeps the connection
+	ping := waitFrame(t, frames, PingFrameType).(*PingFrame)
+	assert.Equal(t, ping.Flags, UNSET)
+	framer.WriteFrame(NewPingFrame(ACK, 0, ping.OpaqueData))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, conn.IsClosed(), false)
+
+	// peer stops responding
+	for range frames {
+	}
+	assert.Equal(t, conn.IsClosed(), true)
+	<-stream.Context().Done()
+	assert.Equal(t, stream.Err(), ErrPingTimeout)
+}
+
+func TestConnRstStream(t *testing.T) {
+	conn, framer, frames := newTestClientConn(t, NilSettings)
+
+	streams := make(chan *Stream, 1)
+	_, err := conn.OpenStream(testRequestHeader, true, func(stream *Stream) { streams <- stream })
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFrame(t, frames, HeadersFrameType)
+
+	// reset in the middle of response body
+	framer.WriteFrame(NewHeadersFrame(END_HEADERS, 1, nil, []byte{0x88}, nil)) // :status: 200
+	framer.WriteFrame(NewDataFrame(UNSET, 1, []byte("hello"), nil))
+	framer.WriteFrame(NewRstStreamFrame(1, INTERNAL_ERROR))
+
+	stream := <-streams
+	body, err := ioutil.ReadAll(stream.Bucket.Body)
+	assert.Equal(t, string(body), "hello")
+	streamError, ok := err.(*StreamError)
+	if !ok {
+		t.Fatalf("got %v want StreamError", err)
+	}
+	assert.Equal(t, streamError.Code, INTERNAL_ERROR)
+}
+
+func TestConnRapidReset(t *testing.T) {
+	conn, framer := newTestConn(t)
+	frames := readFrames(framer)
+	conn.CallBack = func(stream *Stream) {}
+	conn.MaxRapidResets = 10
+	go conn.ReadLoop()
+
+	hb := getExampleHeaderBlock()
+	for i := 0; i < 10; i++ {
+		framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, uint32(2*i+1), nil, hb, nil))
+		framer.WriteFrame(NewRstStreamFrame(uint32(2*i+1), CANCEL))
+	}
+	framer.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+	waitFrame(t, frames, PingFrameType)
+	assert.Equal(t, conn.Stats().RapidResets, 10)
+	assert.Equal(t, conn.IsClosed(), false)
+
+	// flood exceeds the limit
+	for i := 10; i < 20; i++ {
+		framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, uint32(2*i+1), nil, hb, nil))
+		err := framer.WriteFrame(NewRstStreamFrame(uint32(2*i+1), CANCEL))
+		if err != nil {
+			break
+		}
+	}
+	goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, goaway.ErrorCode, ENHANCE_YOUR_CALM)
+	for range frames {
+	}
+	assert.Equal(t, conn.IsClosed(), true)
+	assert.Equal(t, conn.Stats().EnhanceYourCalm, true)
+}
+
+// refused streams are not counted, they are not opened
+func TestConnRapidResetRefused(t *testing.T) {
+	conn, framer := newTestConn(t)
+	frames := readFrames(framer)
+	conn.CallBack = func(stream *Stream) {}
+	conn.MaxRapidResets = 5
+	go conn.ReadLoop()
+
+	conn.WriteSettings(map[SettingsID]int32{SETTINGS_MAX_CONCURRENT_STREAMS: 1})
+	nextFrame(t, frames)
+
+	hb := getExampleHeaderBlock()
+	framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil))
+	for i := 1; i <= 10; i++ {
+		framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, uint32(2*i+1), nil, hb, nil))
+		rst := waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+		assert.Equal(t, rst.ErrorCode, REFUSED_STREAM)
+	}
+	framer.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+	waitFrame(t, frames, PingFrameType)
+	assert.Equal(t, conn.Stats().RapidResets, 0)
+	assert.Equal(t, conn.IsClosed(), false)
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	conn, framer := newTestConn(t)
+	frames := readFrames(framer)
+	conn.CallBack = func(stream *Stream) {}
+	conn.IdleTimeout = 200 * time.Millisecond
+	go conn.ReadLoop()
+
+	// PING resets the timer
+	time.Sleep(120 * time.Millisecond)
+	framer.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+	waitFrame(t, frames, PingFrameType)
+	time.Sleep(120 * time.Millisecond)
+	assert.Equal(t, conn.IsClosed(), false)
+
+	// open stream is not idle
+	hb := getExampleHeaderBlock()
+	framer.WriteFrame(NewHeadersFrame(END_HEADERS, 1, nil, hb, nil))
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, conn.IsClosed(), false)
+
+	// idle after the stream is closed
+	framer.WriteFrame(NewRstStreamFrame(1, CANCEL))
+	closed := time.Now()
+	goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, goaway.ErrorCode, NO_ERROR)
+	assert.Equal(t, goaway.LastStreamID, uint32(1))
+	if elapsed := time.Since(closed); elapsed < 150*time.Millisecond {
+		t.Errorf("closed in %v before IdleTimeout", elapsed)
+	}
+	for range frames {
+	}
+	assert.Equal(t, conn.IsClosed(), true)
+}
+
+func TestConnIdleTimeoutDraining(t *testing.T) {
+	conn, framer := newTestConn(t)
+	frames := readFrames(framer)
+	conn.CallBack = func(stream *Stream) {}
+	conn.IdleTimeout = 50 * time.Millisecond
+	go conn.ReadLoop()
+
+	hb := getExampleHeaderBlock()
+	framer.WriteFrame(NewHeadersFrame(END_HEADERS, 1, nil, hb, nil))
+	framer.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+	waitFrame(t, frames, PingFrameType)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- conn.Shutdown(context.Background())
+	}()
+	waitFrame(t, frames, GoAwayFrameType)
+
+	// goes idle while Shutdown is draining
+	framer.WriteFrame(NewRstStreamFrame(1, CANCEL))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, <-shutdown, nil)
+
+	// GOAWAY is sent only by Shutdown
+	for frame := range frames {
+		if frame.Header().Type == GoAwayFrameType {
+			t.Errorf("GOAWAY is sent twice: %v", frame)
+		}
+	}
+	assert.Equal(t, conn.IsClosed(), true)
+}
+
+func TestConnControlFlood(t *testing.T) {
+	conn, framer := newTestConn(t)
+	conn.MaxQueuedControlFrames = 100
+	go conn.ReadLoop()
+
+	// sends PINGs, never reads their ACKs
+	go func() {
+		for i := 0; i < 1000; i++ {
+			err := framer.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-conn.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("connection is not closed, %v control frames queued", conn.Stats().QueuedControl)
+	}
+	assert.Equal(t, conn.Stats().ControlFlood, true)
+}
+
+func TestConnGoAwayDebugData(t *testing.T) {
+	for _, c := range []struct {
+		frame  []byte
+		reason string
+	}{
+		// SETTINGS on stream 3
+		{[]byte{0, 0, 0, 0x4, 0, 0, 0, 0, 3}, "SETTINGS frame on stream(3)"},
+		// PADDED DATA with Pad Length 16 in 2 byte payload
+		{[]byte{0, 0, 2, 0, 0x8, 0, 0, 0, 1, 16, 'a'}, "Pad Length(16) is larger than frame.Length(2)"},
+	} {
+		client, server := net.Pipe()
+		conn := NewConn(server, ServerRole)
+		go conn.WriteLoop()
+		go conn.ReadLoop()
+		frames := readFrames(NewFramer(client, client))
+
+		client.Write(c.frame)
+		goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+		assert.Equal(t, goaway.ErrorCode, PROTOCOL_ERROR)
+		assert.Equal(t, string(goaway.AdditionalDebugData), c.reason)
+		client.Close()
+	}
+
+	// long reason is cut
+	conn, framer := newTestConn(t)
+	frames := readFrames(framer)
+	conn.GoAway(0, &ConnectionError{Code: PROTOCOL_ERROR, Reason: strings.Repeat("a", 1000)})
+	goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, len(goaway.AdditionalDebugData), MaxGoAwayDebugData)
+}
+
+func TestConnIdlePriority(t *testing.T) {
+	conn, framer := newTestConn(t)
+	frames := readFrames(framer)
+	conn.CallBack = func(stream *Stream) {}
+	conn.MaxIdlePriorities = 10
+	go conn.ReadLoop()
+
+	// priority of idle stream is used when it is opened
+	framer.WriteFrame(NewPriorityFrame(1, false, 0, 100))
+	hb := getExampleHeaderBlock()
+	framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil))
+
+	// only the latest idle ones are retained
+	for id := uint32(3); id < 1000; id += 2 {
+		framer.WriteFrame(NewPriorityFrame(id, false, 0, 16))
+	}
+	framer.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+	waitFrame(t, frames, PingFrameType)
+
+	conn.Priority.mu.Lock()
+	defer conn.Priority.mu.Unlock()
+	_, weight := dependency(conn.Priority, 1)
+	assert.Equal(t, weight, 101)
+	// root, stream 1 and idle ones
+	assert.Equal(t, len(conn.Priority.nodes), 12)
+}
+
+func TestConnPing(t *testing.T) {
+	conn, framer, frames := newTestClientConn(t, NilSettings)
+
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+	results := make([]chan result, 3)
+	pings := make([]*PingFrame, 3)
+	for i := range results {
+		results[i] = make(chan result, 1)
+		go func(i int) {
+			rtt, err := conn.Ping(context.Background())
+			results[i] <- result{rtt, err}
+		}(i)
+		pings[i] = waitFrame(t, frames, PingFrameType).(*PingFrame)
+	}
+
+	// ACK in reverse order with latency
+	for i := len(pings) - 1; i >= 0; i-- {
+		time.Sleep(50 * time.Millisecond)
+		framer.WriteFrame(NewPingFrame(ACK, 0, pings[i].OpaqueData))
+	}
+	var last time.Duration
+	for i := len(results) - 1; i >= 0; i-- {
+		r := <-results[i]
+		assert.Equal(t, r.err, nil)
+		if r.rtt < last+50*time.Millisecond {
+			t.Errorf("ping(%v) rtt %v should be 50ms longer than %v", i, r.rtt, last)
+		}
+		last = r.rtt
+	}
+	assert.Equal(t, conn.RTT(), last)
+
+	// cancel removes the pending ping
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := conn.Ping(ctx)
+	assert.Equal(t, err, context.DeadlineExceeded)
+	conn.pingMu.Lock()
+	assert.Equal(t, len(conn.pings), 0)
+	conn.pingMu.Unlock()
+}
+
+func TestConnWriteFrame(t *testing.T) {
+	conn, framer := newTestConn(t)
+	frames := readFrames(framer)
+
+	err := conn.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, nextFrame(t, frames).Header().Type, FrameType(PingFrameType))
+
+	conn.Close()
+	err = conn.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+	if err == nil {
+		t.Error("write to closed connection should fail")
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewConn(server, ServerRole)
+
+	readDone := make(chan bool)
+	writeDone := make(chan bool)
+	go func() {
+		conn.ReadLoop()
+		readDone <- true
+	}()
+	go func() {
+		conn.WriteLoop()
+		writeDone <- true
+	}()
+
+	conn.Close()
+	conn.Close() // twice is ok
+
+	for _, done := range []chan bool{readDone, writeDone} {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("loop is not stopped by Close()")
+		}
+	}
+
+	// peer sees closed connection
+	_, err := client.Read(make([]byte, 1))
+	if err == nil {
+		t.Error("connection should be closed")
+	}
+}
+
+func TestConnStreamState(t *testing.T) {
+	hb := getExampleHeaderBlock()
+	headers := func(flags Flag, id uint32) Frame {
+		return NewHeadersFrame(flags+END_HEADERS, id, nil, hb, nil)
+	}
+	data := func(id uint32) Frame {
+		return NewDataFrame(UNSET, id, []byte("data"), nil)
+	}
+
+	// h2spec 5.1
+	var cases = []struct {
+		name   string
+		frames []Frame
+		types  FrameType
+		code   ErrorCode
+	}{
+		{"idle: DATA", []Frame{data(1)}, GoAwayFrameType, PROTOCOL_ERROR},
+		{"idle: RST_STREAM", []Frame{NewRstStreamFrame(1, CANCEL)}, GoAwayFrameType, PROTOCOL_ERROR},
+		{"idle: WINDOW_UPDATE", []Frame{NewWindowUpdateFrame(1, 100)}, GoAwayFrameType, PROTOCOL_ERROR},
+		{"idle: even stream id", []Frame{headers(END_STREAM, 2)}, GoAwayFrameType, PROTOCOL_ERROR},
+		{"lower stream id", []Frame{headers(UNSET, 3), headers(UNSET, 1)}, GoAwayFrameType, PROTOCOL_ERROR},
+		{"skipped stream id: HEADERS", []Frame{headers(UNSET, 5), headers(UNSET, 3)}, GoAwayFrameType, PROTOCOL_ERROR},
+		{"skipped stream id: DATA", []Frame{headers(UNSET, 5), data(3)}, RstStreamFrameType, STREAM_CLOSED},
+		{"reused stream id", []Frame{headers(END_STREAM, 1), NewRstStreamFrame(1, CANCEL), headers(END_STREAM, 3), headers(UNSET, 1)}, RstStreamFrameType, STREAM_CLOSED},
+		{"half closed (remote): DATA", []Frame{headers(END_STREAM, 1), data(1)}, RstStreamFrameType, STREAM_CLOSED},
+		{"closed: DATA", []Frame{headers(UNSET, 1), NewRstStreamFrame(1, CANCEL), data(1)}, RstStreamFrameType, STREAM_CLOSED},
+		{"closed: HEADERS", []Frame{headers(UNSET, 1), NewRstStreamFrame(1, CANCEL), headers(UNSET, 1)}, RstStreamFrameType, STREAM_CLOSED},
+	}
+
+	for _, c := range cases {
+		conn, framer := newTestConn(t)
+		conn.CallBack = func(stream *Stream) {}
+		frames := readFrames(framer)
+		go conn.ReadLoop()
+
+		// PRIORITY on idle stream is valid
+		framer.WriteFrame(NewPriorityFrame(9, false, 0, 16))
+		for _, frame := range c.frames {
+			framer.WriteFrame(frame)
+		}
+
+		frame := nextFrame(t, frames)
+		assert.Equal(t, frame.Header().Type, c.types)
+		switch frame := frame.(type) {
+		case *GoAwayFrame:
+			if frame.ErrorCode != c.code {
+				t.Errorf("%v: got %v want %v", c.name, frame.ErrorCode, c.code)
+			}
+		case *RstStreamFrame:
+			if frame.ErrorCode != c.code {
+				t.Errorf("%v: got %v want %v", c.name, frame.ErrorCode, c.code)
+			}
+		}
+	}
+}
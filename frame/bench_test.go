@@ -0,0 +1,189 @@
+package frame
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Jxck/http2/hpack"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// benchmarks of Framer, which connection uses for frame I/O.
+// run with
+//
+//	go test -run NONE -bench . -benchmem ./frame
+
+// payload sizes: empty, 1KB, 16KB (default MAX_FRAME_SIZE)
+var benchSizes = []int{0, 1024, int(DEFAULT_MAX_FRAME_SIZE)}
+
+// reads frames of the wire repeatedly
+func benchRead(b *testing.B, frame Frame, release func(Frame)) {
+	wire := toBytes(frame)
+	framer := NewFramer(nil, &repeatReader{b: wire})
+
+	b.SetBytes(int64(len(wire)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			b.Fatal(err)
+		}
+		release(f)
+	}
+}
+
+func benchWrite(b *testing.B, frame Frame) {
+	framer := NewFramer(ioutil.Discard, nil)
+
+	b.SetBytes(int64(9 + frame.Header().Length))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := framer.WriteFrame(frame)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadHeadersFrame(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			frame := NewHeadersFrame(END_HEADERS, 1, nil, make([]byte, size), nil)
+			benchRead(b, frame, func(f Frame) {
+				f.(*HeadersFrame).Release()
+			})
+		})
+	}
+}
+
+func BenchmarkWriteHeadersFrame(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			benchWrite(b, NewHeadersFrame(END_HEADERS, 1, nil, make([]byte, size), nil))
+		})
+	}
+}
+
+// typical request header of browser (20 fields)
+var browserHeader = http.Header{
+	":method":                   {"GET"},
+	":scheme":                   {"https"},
+	":authority":                {"www.example.com"},
+	":path":                     {"/index.html"},
+	"Accept":                    {"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+	"Accept-Encoding":           {"gzip, deflate, br"},
+	"Accept-Language":           {"en-US,en;q=0.9,ja;q=0.8"},
+	"Cache-Control":             {"max-age=0"},
+	"Cookie":                    {"session=0123456789abcdef; theme=dark; lang=en"},
+	"If-Modified-Since":         {"Mon, 01 Jan 2024 00:00:00 GMT"},
+	"If-None-Match":             {`"5f3e-1a2b3c4d"`},
+	"Referer":                   {"https://www.example.com/"},
+	"Sec-Ch-Ua":                 {`"Chromium";v="120", "Not_A Brand";v="8"`},
+	"Sec-Ch-Ua-Mobile":          {"?0"},
+	"Sec-Ch-Ua-Platform":        {`"macOS"`},
+	"Sec-Fetch-Dest":            {"document"},
+	"Sec-Fetch-Mode":            {"navigate"},
+	"Sec-Fetch-Site":            {"same-origin"},
+	"Upgrade-Insecure-Requests": {"1"},
+	"User-Agent":                {"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"},
+}
+
+// first: new context every time (literals)
+// repeated: same context (indexed in dynamic table)
+func BenchmarkHeadersFrameEncode(b *testing.B) {
+	b.Run("first", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			frame := NewHeadersFrame(END_HEADERS, 1, nil, nil, nil)
+			frame.Headers = browserHeader
+			frame.Encode(hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE)))
+		}
+	})
+	b.Run("repeated", func(b *testing.B) {
+		ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			frame := NewHeadersFrame(END_HEADERS, 1, nil, nil, nil)
+			frame.Headers = browserHeader
+			frame.Encode(ctx)
+		}
+	})
+}
+
+func BenchmarkReadPaddedDataFrame(b *testing.B) {
+	frame := NewDataFrame(PADDED, 1, make([]byte, 1024), make([]byte, 255))
+	benchRead(b, frame, func(f Frame) {
+		f.(*DataFrame).Release()
+	})
+}
+
+func BenchmarkSettingsRoundTrip(b *testing.B) {
+	settings := NewSettingsFrame(UNSET, 0, map[SettingsID]int32{
+		SETTINGS_HEADER_TABLE_SIZE:      DEFAULT_HEADER_TABLE_SIZE,
+		SETTINGS_MAX_CONCURRENT_STREAMS: DEFAULT_MAX_CONCURRENT_STREAMS,
+		SETTINGS_INITIAL_WINDOW_SIZE:    DEFAULT_INITIAL_WINDOW_SIZE,
+		SETTINGS_MAX_FRAME_SIZE:         DEFAULT_MAX_FRAME_SIZE,
+	})
+	ack := NewSettingsFrame(ACK, 0, map[SettingsID]int32{})
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	framer := NewFramer(buf, buf)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, frame := range []Frame{settings, ack} {
+			err := framer.WriteFrame(frame)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = framer.ReadFrame()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkWindowUpdateRoundTrip(b *testing.B) {
+	frame := NewWindowUpdateFrame(1, 65535)
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	framer := NewFramer(buf, buf)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := framer.WriteFrame(frame)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = framer.ReadFrame()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPingRoundTrip(b *testing.B) {
+	frame := NewPingFrame(UNSET, 0, []byte("deadbeef"))
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	framer := NewFramer(buf, buf)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := framer.WriteFrame(frame)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = framer.ReadFrame()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
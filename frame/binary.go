@@ -0,0 +1,179 @@
+package frame
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler
+// for every frame type.
+// binary is the wire format including 9 byte frame header,
+// and implemented by Read/Write of each frame.
+
+func marshalBinary(frame Frame) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 9+frame.Header().Length))
+	err := frame.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// reads frame header from data and check the type
+func unmarshalHeader(data []byte, types FrameType) (*FrameHeader, error) {
+	fh := new(FrameHeader)
+
+	// data is already in memory, so no limit except 24bit
+	fh.MaxFrameSize = 0xFFFFFF
+	err := fh.Read(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	fh.MaxFrameSize = 0
+
+	if fh.Type != types {
+		return nil, fmt.Errorf("frame type is %v but %v", fh.Type, types)
+	}
+	if len(data) != 9+int(fh.Length) {
+		return nil, fmt.Errorf("frame length is %v but payload is %v byte", fh.Length, len(data)-9)
+	}
+	return fh, nil
+}
+
+func (frame *DataFrame) MarshalBinary() ([]byte, error) {
+	return marshalBinary(frame)
+}
+
+func (frame *DataFrame) UnmarshalBinary(data []byte) (err error) {
+	frame.FrameHeader, err = unmarshalHeader(data, DataFrameType)
+	if err != nil {
+		return err
+	}
+	return frame.Read(bytes.NewReader(data[9:]))
+}
+
+func (frame *HeadersFrame) MarshalBinary() ([]byte, error) {
+	return marshalBinary(frame)
+}
+
+func (frame *HeadersFrame) UnmarshalBinary(data []byte) (err error) {
+	frame.FrameHeader, err = unmarshalHeader(data, HeadersFrameType)
+	if err != nil {
+		return err
+	}
+	return frame.Read(bytes.NewReader(data[9:]))
+}
+
+func (frame *PriorityFrame) MarshalBinary() ([]byte, error) {
+	return marshalBinary(frame)
+}
+
+func (frame *PriorityFrame) UnmarshalBinary(data []byte) (err error) {
+	frame.FrameHeader, err = unmarshalHeader(data, PriorityFrameType)
+	if err != nil {
+		return err
+	}
+	return frame.Read(bytes.NewReader(data[9:]))
+}
+
+func (frame *RstStreamFrame) MarshalBinary() ([]byte, error) {
+	return marshalBinary(frame)
+}
+
+func (frame *RstStreamFrame) UnmarshalBinary(data []byte) (err error) {
+	frame.FrameHeader, err = unmarshalHeader(data, RstStreamFrameType)
+	if err != nil {
+		return err
+	}
+	return frame.Read(bytes.NewReader(data[9:]))
+}
+
+func (frame *SettingsFrame) MarshalBinary() ([]byte, error) {
+	return marshalBinary(frame)
+}
+
+func (frame *SettingsFrame) UnmarshalBinary(data []byte) (err error) {
+	frame.FrameHeader, err = unmarshalHeader(data, SettingsFrameType)
+	if err != nil {
+		return err
+	}
+	return frame.Read(bytes.NewReader(data[9:]))
+}
+
+func (frame *PushPromiseFrame) MarshalBinary() ([]byte, error) {
+	return marshalBinary(frame)
+}
+
+func (frame *PushPromiseFrame) UnmarshalBinary(data []byte) (err error) {
+	frame.FrameHeader, err = unmarshalHeader(data, PushPromiseFrameType)
+	if err != nil {
+		return err
+	}
+	return frame.Read(bytes.NewReader(data[9:]))
+}
+
+func (frame *PingFrame) MarshalBinary() ([]byte, error) {
+	return marshalBinary(frame)
+}
+
+func (frame *PingFrame) UnmarshalBinary(data []byte) (err error) {
+	frame.FrameHeader, err = unmarshalHeader(data, PingFrameType)
+	if err != nil {
+		return err
+	}
+	return frame.Read(bytes.NewReader(data[9:]))
+}
+
+func (frame *GoAwayFrame) MarshalBinary() ([]byte, error) {
+	return marshalBinary(frame)
+}
+
+func (frame *GoAwayFrame) UnmarshalBinary(data []byte) (err error) {
+	frame.FrameHeader, err = unmarshalHeader(data, GoAwayFrameType)
+	if err != nil {
+		return err
+	}
+	return frame.Read(bytes.NewReader(data[9:]))
+}
+
+func (frame *WindowUpdateFrame) MarshalBinary() ([]byte, error) {
+	return marshalBinary(frame)
+}
+
+func (frame *WindowUpdateFrame) UnmarshalBinary(data []byte) (err error) {
+	frame.FrameHeader, err = unmarshalHeader(data, WindowUpdateFrameType)
+	if err != nil {
+		return err
+	}
+	return frame.Read(bytes.NewReader(data[9:]))
+}
+
+func (frame *ContinuationFrame) MarshalBinary() ([]byte, error) {
+	return marshalBinary(frame)
+}
+
+func (frame *ContinuationFrame) UnmarshalBinary(data []byte) (err error) {
+	frame.FrameHeader, err = unmarshalHeader(data, ContinuationFrameType)
+	if err != nil {
+		return err
+	}
+	return frame.Read(bytes.NewReader(data[9:]))
+}
+
+func (frame *UnknownFrame) MarshalBinary() ([]byte, error) {
+	return marshalBinary(frame)
+}
+
+// UnknownFrame accepts any type of frame
+func (frame *UnknownFrame) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < 9 {
+		return io.ErrUnexpectedEOF
+	}
+
+	frame.FrameHeader, err = unmarshalHeader(data, FrameType(data[3]))
+	if err != nil {
+		return err
+	}
+	return frame.Read(bytes.NewReader(data[9:]))
+}
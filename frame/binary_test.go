@@ -0,0 +1,134 @@
+package frame
+
+import (
+	"bytes"
+	"encoding"
+	assert "github.com/Jxck/assertion"
+	"testing"
+	"testing/quick"
+)
+
+type binaryFrame interface {
+	Frame
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// marshal -> unmarshal -> marshal should be the same bytes
+func roundTrip(expected, actual binaryFrame) bool {
+	first, err := expected.MarshalBinary()
+	if err != nil {
+		return false
+	}
+	err = actual.UnmarshalBinary(first)
+	if err != nil {
+		return false
+	}
+	second, err := actual.MarshalBinary()
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(first, second)
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	c := &quick.Config{
+		MaxCountScale: count,
+	}
+
+	var cases = []interface{}{
+		func(streamID uint32, data, padding []byte) bool {
+			if len(padding) > maxPadLength {
+				padding = padding[:maxPadLength]
+			}
+			expected := NewDataFrame(PADDED, streamID>>1, data, padding)
+			return roundTrip(expected, new(DataFrame))
+		},
+		func(streamID uint32, exclusive bool, dependency uint32, weight uint8, hb, padding []byte) bool {
+			if len(padding) > maxPadLength {
+				padding = padding[:maxPadLength]
+			}
+			dt := &DependencyTree{exclusive, dependency >> 1, weight}
+			expected := NewHeadersFrame(END_HEADERS+PRIORITY+PADDED, streamID>>1, dt, hb, padding)
+			return roundTrip(expected, new(HeadersFrame))
+		},
+		func(streamID uint32, exclusive bool, dependency uint32, weight uint8) bool {
+			expected := NewPriorityFrame(streamID>>1, exclusive, dependency>>1, weight)
+			return roundTrip(expected, new(PriorityFrame))
+		},
+		func(streamID uint32, errorCode uint32) bool {
+			expected := NewRstStreamFrame(streamID>>1, ErrorCode(errorCode))
+			return roundTrip(expected, new(RstStreamFrame))
+		},
+		func(tableSize, window int32, push bool) bool {
+			var enablePush int32 = 0
+			if push {
+				enablePush = 1
+			}
+			settings := map[SettingsID]int32{
+				SETTINGS_HEADER_TABLE_SIZE:   tableSize,
+				SETTINGS_ENABLE_PUSH:         enablePush,
+				SETTINGS_INITIAL_WINDOW_SIZE: window & 0x7FFFFFFF,
+			}
+			expected := NewSettingsFrame(UNSET, 0, settings)
+			return roundTrip(expected, new(SettingsFrame))
+		},
+		func(streamID, promisedStreamID uint32, hb, padding []byte) bool {
+			if len(padding) > maxPadLength {
+				padding = padding[:maxPadLength]
+			}
+			expected := NewPushPromiseFrame(END_HEADERS+PADDED, streamID>>1, promisedStreamID>>1, hb, padding)
+			return roundTrip(expected, new(PushPromiseFrame))
+		},
+		func(opaqueData [8]byte) bool {
+			expected := NewPingFrame(ACK, 0, opaqueData[:])
+			return roundTrip(expected, new(PingFrame))
+		},
+		func(lastStreamID, errorCode uint32, debug []byte) bool {
+			expected := NewGoAwayFrame(0, lastStreamID>>1, ErrorCode(errorCode), debug)
+			return roundTrip(expected, new(GoAwayFrame))
+		},
+		func(streamID, increment uint32) bool {
+			expected := NewWindowUpdateFrame(streamID>>1, increment>>1)
+			return roundTrip(expected, new(WindowUpdateFrame))
+		},
+		func(streamID uint32, hb []byte) bool {
+			expected := NewContinuationFrame(END_HEADERS, streamID>>1, hb)
+			return roundTrip(expected, new(ContinuationFrame))
+		},
+		func(types uint8, streamID uint32, payload []byte) bool {
+			fh := NewFrameHeader(uint32(len(payload)), FrameType(types|0x10), UNSET, streamID>>1)
+			expected := &UnknownFrame{fh, payload}
+			return roundTrip(expected, new(UnknownFrame))
+		},
+	}
+
+	for _, f := range cases {
+		if err := quick.Check(f, c); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestUnmarshalBinary(t *testing.T) {
+	wire := hexToBuffer("0000080600000000006465616462656566").Bytes()
+
+	actual := new(PingFrame)
+	err := actual.UnmarshalBinary(wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, actual, NewPingFrame(UNSET, 0, []byte("deadbeef")))
+
+	// type mismatch
+	err = new(GoAwayFrame).UnmarshalBinary(wire)
+	if err == nil {
+		t.Error("should error for type mismatch")
+	}
+
+	// length mismatch
+	err = new(PingFrame).UnmarshalBinary(wire[:len(wire)-1])
+	if err == nil {
+		t.Error("should error for length mismatch")
+	}
+}
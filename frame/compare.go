@@ -0,0 +1,148 @@
+package frame
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Equal reports whether a and b are semantically the same frame.
+func Equal(a, b Frame) bool {
+	return Diff(a, b) == ""
+}
+
+// Diff reports fields which differ between a and b, one line per field.
+// empty string means they are equal.
+//
+// Length of frame header is not compared, because it is
+// recomputed from the payload fields which are compared.
+// Padding is compared only by its length, because its content
+// has no meaning (but counts for flow control).
+func Diff(a, b Frame) string {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return ""
+		}
+		return fmt.Sprintf("frame: %v != %v\n", a, b)
+	}
+
+	if fmt.Sprintf("%T", a) != fmt.Sprintf("%T", b) {
+		return fmt.Sprintf("frame: %T != %T\n", a, b)
+	}
+
+	d := new(differ)
+	ha, hb := a.Header(), b.Header()
+	d.value("Type", ha.Type, hb.Type)
+	d.value("Flags", fmt.Sprintf("%#x", ha.Flags), fmt.Sprintf("%#x", hb.Flags))
+	d.value("StreamID", ha.StreamID, hb.StreamID)
+
+	switch a := a.(type) {
+	case *DataFrame:
+		b := b.(*DataFrame)
+		d.bytes("Data", a.Data, b.Data)
+		d.value("Padding length", len(a.Padding), len(b.Padding))
+	case *HeadersFrame:
+		b := b.(*HeadersFrame)
+		d.tree(a.DependencyTree, b.DependencyTree)
+		d.bytes("HeaderBlockFragment", a.HeaderBlockFragment, b.HeaderBlockFragment)
+		d.value("Padding length", len(a.Padding), len(b.Padding))
+	case *PriorityFrame:
+		b := b.(*PriorityFrame)
+		d.value("Exclusive", a.Exclusive, b.Exclusive)
+		d.value("StreamDependency", a.StreamDependency, b.StreamDependency)
+		d.value("Weight", a.Weight, b.Weight)
+	case *RstStreamFrame:
+		b := b.(*RstStreamFrame)
+		d.value("ErrorCode", a.ErrorCode, b.ErrorCode)
+	case *SettingsFrame:
+		b := b.(*SettingsFrame)
+		d.settings(a.Settings, b.Settings)
+	case *PushPromiseFrame:
+		b := b.(*PushPromiseFrame)
+		d.value("PromisedStreamID", a.PromisedStreamID, b.PromisedStreamID)
+		d.bytes("HeaderBlockFragment", a.HeaderBlockFragment, b.HeaderBlockFragment)
+		d.value("Padding length", len(a.Padding), len(b.Padding))
+	case *PingFrame:
+		b := b.(*PingFrame)
+		d.bytes("OpaqueData", a.OpaqueData, b.OpaqueData)
+	case *GoAwayFrame:
+		b := b.(*GoAwayFrame)
+		d.value("LastStreamID", a.LastStreamID, b.LastStreamID)
+		d.value("ErrorCode", a.ErrorCode, b.ErrorCode)
+		d.bytes("AdditionalDebugData", a.AdditionalDebugData, b.AdditionalDebugData)
+	case *WindowUpdateFrame:
+		b := b.(*WindowUpdateFrame)
+		d.value("WindowSizeIncrement", a.WindowSizeIncrement, b.WindowSizeIncrement)
+	case *ContinuationFrame:
+		b := b.(*ContinuationFrame)
+		d.bytes("HeaderBlockFragment", a.HeaderBlockFragment, b.HeaderBlockFragment)
+	case *UnknownFrame:
+		b := b.(*UnknownFrame)
+		d.bytes("Payload", a.Payload, b.Payload)
+	}
+
+	return d.String()
+}
+
+// collects differences as text
+type differ struct {
+	bytes.Buffer
+}
+
+func (d *differ) value(name string, a, b interface{}) {
+	if a != b {
+		fmt.Fprintf(d, "%s: %v != %v\n", name, a, b)
+	}
+}
+
+// reports length and first different offset
+func (d *differ) bytes(name string, a, b []byte) {
+	if len(a) != len(b) {
+		fmt.Fprintf(d, "%s: length %d != %d\n", name, len(a), len(b))
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			fmt.Fprintf(d, "%s: differ at offset %d (%#02x != %#02x)\n", name, i, a[i], b[i])
+			return
+		}
+	}
+}
+
+func (d *differ) tree(a, b *DependencyTree) {
+	if a == nil || b == nil {
+		if a != b {
+			fmt.Fprintf(d, "DependencyTree: %v != %v\n", a, b)
+		}
+		return
+	}
+	d.value("Exclusive", a.Exclusive, b.Exclusive)
+	d.value("StreamDependency", a.StreamDependency, b.StreamDependency)
+	d.value("Weight", a.Weight, b.Weight)
+}
+
+func (d *differ) settings(a, b map[SettingsID]int32) {
+	ids := make([]int, 0, len(a)+len(b))
+	for id := range a {
+		ids = append(ids, int(id))
+	}
+	for id := range b {
+		if _, ok := a[id]; !ok {
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+
+	for _, i := range ids {
+		id := SettingsID(i)
+		va, oka := a[id]
+		vb, okb := b[id]
+		switch {
+		case !oka:
+			fmt.Fprintf(d, "%v: none != %v\n", id, vb)
+		case !okb:
+			fmt.Fprintf(d, "%v: %v != none\n", id, va)
+		default:
+			d.value(id.String(), va, vb)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package frame
+
+import (
+	assert "github.com/Jxck/assertion"
+	"testing"
+)
+
+func TestEqual(t *testing.T) {
+	var cases = []struct {
+		a, b  Frame
+		equal bool
+	}{
+		{
+			NewDataFrame(END_STREAM, 1, []byte("hello"), nil),
+			NewDataFrame(END_STREAM, 1, []byte("hello"), nil),
+			true,
+		},
+		{
+			// content of padding has no meaning
+			NewDataFrame(PADDED, 1, []byte("hello"), []byte{0, 0, 0}),
+			NewDataFrame(PADDED, 1, []byte("hello"), []byte{1, 2, 3}),
+			true,
+		},
+		{
+			NewDataFrame(PADDED, 1, []byte("hello"), []byte{0, 0, 0}),
+			NewDataFrame(PADDED, 1, []byte("hello"), []byte{0}),
+			false,
+		},
+		{
+			NewDataFrame(UNSET, 1, []byte("hello"), nil),
+			NewDataFrame(END_STREAM, 1, []byte("hello"), nil),
+			false,
+		},
+		{
+			NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_ENABLE_PUSH: 0}),
+			NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_ENABLE_PUSH: 0}),
+			true,
+		},
+		{
+			NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_ENABLE_PUSH: 0}),
+			NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_MAX_CONCURRENT_STREAMS: 0}),
+			false,
+		},
+		{
+			NewHeadersFrame(END_HEADERS, 1, nil, []byte("hb"), nil),
+			NewHeadersFrame(END_HEADERS+PRIORITY, 1, &DependencyTree{false, 0, 16}, []byte("hb"), nil),
+			false,
+		},
+		{
+			NewPingFrame(UNSET, 0, []byte("deadbeef")),
+			NewWindowUpdateFrame(0, 10),
+			false,
+		},
+		{
+			nil, nil, true,
+		},
+	}
+
+	for i, c := range cases {
+		if Equal(c.a, c.b) != c.equal {
+			t.Errorf("case %d: Equal() should be %v\n%s", i, c.equal, Diff(c.a, c.b))
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	var a, b Frame
+	a = NewDataFrame(UNSET, 1, []byte("hello world"), nil)
+	b = NewDataFrame(END_STREAM, 3, []byte("hello World!"), nil)
+
+	expected := "" +
+		"Flags: 0x0 != 0x1\n" +
+		"StreamID: 1 != 3\n" +
+		"Data: length 11 != 12\n" +
+		"Data: differ at offset 6 (0x77 != 0x57)\n"
+	assert.Equal(t, Diff(a, b), expected)
+
+	a = NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_ENABLE_PUSH: 0})
+	b = NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_ENABLE_PUSH: 1, SETTINGS_MAX_FRAME_SIZE: 16384})
+	expected = "" +
+		"SETTINGS_ENABLE_PUSH(2): 0 != 1\n" +
+		"SETTINGS_MAX_FRAME_SIZE(5): none != 16384\n"
+	assert.Equal(t, Diff(a, b), expected)
+}
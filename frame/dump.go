@@ -0,0 +1,92 @@
+package frame
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// DumpFrame returns hex+ASCII dump of the serialized frame,
+// 16 bytes per line with offset, like `hexdump -C`.
+// lines are separated at the end of frame header and
+// the start of padding, and labeled.
+//
+//	header
+//	00000000  00 00 0b 00 08 00 00 00  01                       |.........|
+//	payload
+//	00000009  05 68 65 6c 6c 6f                                 |.hello|
+//	padding
+//	0000000f  00 00 00 00 00                                    |.....|
+func DumpFrame(frame Frame) string {
+	wire := new(bytes.Buffer)
+	err := frame.Write(wire)
+	if err != nil {
+		return fmt.Sprintf("failed to dump %v: %v", frame.Header().Type, err)
+	}
+	b := wire.Bytes()
+
+	var padding int
+	switch frame := frame.(type) {
+	case *DataFrame:
+		padding = len(frame.Padding)
+	case *HeadersFrame:
+		padding = len(frame.Padding)
+	case *PushPromiseFrame:
+		padding = len(frame.Padding)
+	}
+
+	if len(b) < 9 || padding > len(b)-9 {
+		// broken frame, dump as is
+		padding = 0
+	}
+
+	dump := new(bytes.Buffer)
+	offset := 0
+	sections := []struct {
+		name string
+		size int
+	}{
+		{"header", 9},
+		{"payload", len(b) - 9 - padding},
+		{"padding", padding},
+	}
+	for _, s := range sections {
+		if s.size <= 0 || offset+s.size > len(b) {
+			continue
+		}
+		fmt.Fprintln(dump, s.name)
+		dumpLines(dump, offset, b[offset:offset+s.size])
+		offset += s.size
+	}
+	return dump.String()
+}
+
+// writes b 16 bytes per line, offset starts from base
+func dumpLines(dump *bytes.Buffer, base int, b []byte) {
+	for i := 0; i < len(b); i += 16 {
+		line := b[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+
+		fmt.Fprintf(dump, "%08x  ", base+i)
+		for j := 0; j < 16; j++ {
+			if j < len(line) {
+				fmt.Fprintf(dump, "%02x ", line[j])
+			} else {
+				dump.WriteString("   ")
+			}
+			if j == 7 {
+				dump.WriteByte(' ')
+			}
+		}
+
+		dump.WriteString(" |")
+		for _, c := range line {
+			if c < 0x20 || 0x7e < c {
+				c = '.'
+			}
+			dump.WriteByte(c)
+		}
+		dump.WriteString("|\n")
+	}
+}
@@ -0,0 +1,37 @@
+package frame
+
+import (
+	assert "github.com/Jxck/assertion"
+	"strings"
+	"testing"
+)
+
+func TestDumpFrame(t *testing.T) {
+	frame := NewDataFrame(PADDED, 1, []byte("hello"), []byte{0, 0, 0, 0, 0})
+	expected := "" +
+		"header\n" +
+		"00000000  00 00 0b 00 08 00 00 00  01                       |.........|\n" +
+		"payload\n" +
+		"00000009  05 68 65 6c 6c 6f                                 |.hello|\n" +
+		"padding\n" +
+		"0000000f  00 00 00 00 00                                    |.....|\n"
+	assert.Equal(t, DumpFrame(frame), expected)
+}
+
+func TestDumpFrameLines(t *testing.T) {
+	var cases = []Frame{
+		NewGoAwayFrame(0, 1, NO_ERROR, []byte(strings.Repeat("debug", 10))),
+		NewSettingsFrame(ACK, 0, map[SettingsID]int32{}),
+		&UnknownFrame{NewFrameHeader(3, 0xff, UNSET, 0), []byte("abc")},
+	}
+
+	for _, frame := range cases {
+		dump := DumpFrame(frame)
+		if !strings.HasPrefix(dump, "header\n00000000  ") {
+			t.Errorf("%v: invalid dump\n%s", frame.Header().Type, dump)
+		}
+		if strings.Contains(dump, "padding") {
+			t.Errorf("%v: should not have padding\n%s", frame.Header().Type, dump)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package frame
+
+import (
+	"github.com/Jxck/color"
+)
+
+// Formatter decorates String() of frames and error log of this package.
+// default is PlainFormatter, which never writes escape sequence
+// into log files.
+type Formatter interface {
+	// name of frame type
+	Type(s string) string
+	// name of header field
+	Field(s string) string
+	// error message
+	Error(s string) string
+}
+
+var formatter Formatter = PlainFormatter{}
+
+// SetFormatter should be called before any frame is formatted.
+func SetFormatter(f Formatter) {
+	formatter = f
+}
+
+// DisableColor is shorthand for SetFormatter(PlainFormatter{})
+func DisableColor() {
+	SetFormatter(PlainFormatter{})
+}
+
+// without decoration
+type PlainFormatter struct{}
+
+func (PlainFormatter) Type(s string) string  { return s }
+func (PlainFormatter) Field(s string) string { return s }
+func (PlainFormatter) Error(s string) string { return s }
+
+// ANSI color for terminal
+type ColorFormatter struct{}
+
+func (ColorFormatter) Type(s string) string  { return color.Cyan(s) }
+func (ColorFormatter) Field(s string) string { return color.Navy(s) }
+func (ColorFormatter) Error(s string) string { return color.Red(s) }
@@ -0,0 +1,45 @@
+package frame
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func stringFrames() []Frame {
+	headers := NewHeadersFrame(END_HEADERS, 1, nil, []byte("hb"), nil)
+	headers.Headers = http.Header{"Content-Type": []string{"text/plain"}}
+
+	return []Frame{
+		NewDataFrame(END_STREAM, 1, []byte("hello"), nil),
+		headers,
+		NewPriorityFrame(1, false, 3, 255),
+		NewRstStreamFrame(1, CANCEL),
+		NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_ENABLE_PUSH: 0}),
+		NewPushPromiseFrame(END_HEADERS, 1, 2, []byte("hb"), nil),
+		NewPingFrame(ACK, 0, []byte("deadbeef")),
+		NewGoAwayFrame(0, 7, PROTOCOL_ERROR, []byte("debug")),
+		NewWindowUpdateFrame(1, 1000),
+		NewContinuationFrame(END_HEADERS, 1, []byte("hb")),
+		&UnknownFrame{NewFrameHeader(3, 0xff, UNSET, 1), []byte("abc")},
+	}
+}
+
+func TestStringNoColor(t *testing.T) {
+	for _, frame := range stringFrames() {
+		if str := frame.String(); strings.Contains(str, "\x1b") {
+			t.Errorf("%v: should not contain escape sequence %q", frame.Header().Type, str)
+		}
+	}
+}
+
+func TestStringColor(t *testing.T) {
+	SetFormatter(ColorFormatter{})
+	defer DisableColor()
+
+	for _, frame := range stringFrames() {
+		if str := frame.String(); !strings.Contains(str, "\x1b[") {
+			t.Errorf("%v: should be colored %q", frame.Header().Type, str)
+		}
+	}
+}
@@ -3,11 +3,14 @@ package frame
 import (
 	"encoding/binary"
 	"fmt"
-	. "github.com/Jxck/color"
+	"github.com/Jxck/http2/hpack"
 	. "github.com/Jxck/logger"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"sort"
 	"strings"
 )
 
@@ -43,6 +46,9 @@ func (frameType FrameType) String() string {
 		"WINDOW_UPDATE",
 		"CONTINUATION",
 	}
+	if int(frameType) >= len(names) {
+		return fmt.Sprintf("UNKNOWN(%#x)", uint8(frameType))
+	}
 	return names[int(frameType)]
 }
 
@@ -83,20 +89,32 @@ func (e ErrorCode) String() string {
 		"INADEQUATE_SECURITY",
 		"HTTP_1_1_REQUIRED",
 	}
+	if int(e) >= len(errors) {
+		return fmt.Sprintf("UNKNOWN(%#x)", uint32(e))
+	}
 	return errors[int(e)]
 }
 
-type H2Error struct {
-	ErrorCode           ErrorCode
-	AdditiolanDebugData string
+// Connection Error
+// should be sent as GOAWAY and close the connection
+type ConnectionError struct {
+	Code   ErrorCode
+	Reason string
+}
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("connection error: %v(%v)", e.Code, e.Reason)
 }
 
-func (e H2Error) Error() string {
-	return e.ErrorCode.String()
+// Stream Error
+// should be sent as RST_STREAM for the StreamID
+type StreamError struct {
+	StreamID uint32
+	Code     ErrorCode
 }
 
-func (e H2Error) String() string {
-	return fmt.Sprintf("%v(%v)", e.ErrorCode, e.AdditiolanDebugData)
+func (e StreamError) Error() string {
+	return fmt.Sprintf("stream error: stream_id=%d %v", e.StreamID, e.Code)
 }
 
 // Flags
@@ -163,112 +181,105 @@ func NewFrameHeader(length uint32, types FrameType, flags Flag, streamid uint32)
 }
 
 func (fh *FrameHeader) Read(r io.Reader) (err error) {
-	// read 32 bit
-	var first uint32
-	err = binary.Read(r, binary.BigEndian, &first)
+	// read 9 byte
+	var b [9]byte
+	_, err = io.ReadFull(r, b[:])
 	if err != nil {
 		return err
 	}
 
-	// last 8 bit for type
-	fh.Type = FrameType(first & 0xFF)
+	// first 24 bit for length
+	fh.Length = uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	Trace("length = %d", fh.Length)
+
+	// 8 bit for type
+	fh.Type = FrameType(b[3])
 	Trace("type = %s", fh.Type)
 
-	if fh.Type < 0 || 0x9 < fh.Type {
-		Error("ingore this frame")
-		// TODO: ignore this frame or return err ?
-		return
-	}
+	// 8 bit for Flags
+	fh.Flags = Flag(b[4])
+	Trace("flags = %d", fh.Flags)
 
-	// first 24 bit for length
-	fh.Length = first >> 8
-	Trace("length = %d", fh.Length)
+	// last 32 bit for StreamID
+	fh.StreamID = binary.BigEndian.Uint32(b[5:]) & 0x7FFFFFFF
+	Trace("streamId = %d", fh.StreamID)
+
+	// payload length should equal or smaller than MAX_FRAME_SIZE
+	// check this before reading payload, for avoiding huge allocation
+	// which length comes from peer.
+	maxFrameSize := fh.MaxFrameSize
+	if maxFrameSize == 0 {
+		// not negotiated yet
+		maxFrameSize = DEFAULT_MAX_FRAME_SIZE
+	}
+	if int32(fh.Length) > maxFrameSize {
+		msg := fmt.Sprintf("frame size(%v) is larger than MAX_FRAME_SIZE(%v)", fh.Length, maxFrameSize)
+		Error(formatter.Error(msg))
+		return &ConnectionError{FRAME_SIZE_ERROR, msg}
+	}
 
 	// PRIORITY payload length should be 5
 	if fh.Type == PriorityFrameType && fh.Length != 5 {
 		msg := fmt.Sprintf("frame size of PRIORITY should be 5 but %v", fh.Length)
-		Error(Red(msg))
-		return &H2Error{FRAME_SIZE_ERROR, msg}
+		Error(formatter.Error(msg))
+		return &StreamError{fh.StreamID, FRAME_SIZE_ERROR}
 	}
 
 	// RST_STREAM payload length should be 4
 	if fh.Type == RstStreamFrameType && fh.Length != 4 {
 		msg := fmt.Sprintf("frame size of RST_STREAM should be 4 but %v", fh.Length)
-		Error(Red(msg))
-		return &H2Error{FRAME_SIZE_ERROR, msg}
+		Error(formatter.Error(msg))
+		return &ConnectionError{FRAME_SIZE_ERROR, msg}
 	}
 
 	// PING_FRAME payload length should be 8
 	if fh.Type == PingFrameType && fh.Length != 8 {
 		msg := fmt.Sprintf("frame size of PING_FRAME should be 8 but %v", fh.Length)
-		Error(Red(msg))
-		return &H2Error{FRAME_SIZE_ERROR, msg}
+		Error(formatter.Error(msg))
+		return &ConnectionError{FRAME_SIZE_ERROR, msg}
 	}
 
-	// payload length should equal or smaller than MAX_FRAME_SIZE
-	if int32(fh.Length) > fh.MaxFrameSize {
-		msg := fmt.Sprintf("frame size(%v) is larger than MAX_FRAME_SIZE(%v)", fh.Length, fh.MaxFrameSize)
-		Error(Red(msg))
-		return &H2Error{FRAME_SIZE_ERROR, msg}
-	}
-
-	// read 8 bit for Flags
-	err = binary.Read(r, binary.BigEndian, &fh.Flags)
-	if err != nil {
-		return err
-	}
-	Trace("flags = %d", fh.Flags)
-
 	if fh.Type == SettingsFrameType {
 		// SETTINGS ACKs payload length should 0
 		if fh.Flags == ACK && fh.Length > 0 {
 			msg := fmt.Sprintf("frame size of SETTINGS_STREAM should be 0 if ACK set but %v", fh.Length)
-			Error(Red(msg))
-			return &H2Error{FRAME_SIZE_ERROR, msg}
+			Error(formatter.Error(msg))
+			return &ConnectionError{FRAME_SIZE_ERROR, msg}
 		}
 
 		// SETTINGS payload should multiple of 6 octets
 		if fh.Length%6 != 0 {
 			msg := fmt.Sprintf("frame size of SETTINGS_STREAM should multiple of 6 octets but %v", fh.Length)
-			Error(Red(msg))
-			return &H2Error{FRAME_SIZE_ERROR, msg}
+			Error(formatter.Error(msg))
+			return &ConnectionError{FRAME_SIZE_ERROR, msg}
 		}
-
-	}
-
-	// read 32 bit for StreamID
-	var last uint32
-	err = binary.Read(r, binary.BigEndian, &last)
-	if err != nil {
-		return err
 	}
-	fh.StreamID = last & 0x7FFFFFFF
-	Trace("streamId = %d", fh.StreamID)
 
 	return err
 }
 
 func (fh *FrameHeader) Write(w io.Writer) (err error) {
-	// write length + type as 32bit
-	var first uint32 = fh.Length<<8 + uint32(fh.Type)
-	err = binary.Write(w, binary.BigEndian, &first)
-	if err != nil {
-		return err
-	}
+	var b [9]byte
+	fh.pack(b[:])
+	_, err = w.Write(b[:])
+	return err
+}
 
-	// write flags
-	err = binary.Write(w, binary.BigEndian, &fh.Flags)
-	if err != nil {
-		return err
-	}
+// packs header into first 9 byte of b
+func (fh *FrameHeader) pack(b []byte) {
+	// length 24bit
+	b[0] = byte(fh.Length >> 16)
+	b[1] = byte(fh.Length >> 8)
+	b[2] = byte(fh.Length)
 
-	// write stream id
-	err = binary.Write(w, binary.BigEndian, &fh.StreamID)
-	if err != nil {
-		return err
-	}
+	// type
+	b[3] = byte(fh.Type)
 
-	return err
+	// flags
+	b[4] = byte(fh.Flags)
+
+	// stream id
+	binary.BigEndian.PutUint32(b[5:], fh.StreamID)
 }
 
 func (fh *FrameHeader) String() string {
@@ -293,6 +304,7 @@ type DataFrame struct {
 	PadLength uint8
 	Data      []byte
 	Padding   []byte
+	buf       *buffer
 }
 
 func NewDataFrame(flags Flag, streamID uint32, data []byte, padding []byte) *DataFrame {
@@ -319,75 +331,117 @@ func NewDataFrame(flags Flag, streamID uint32, data []byte, padding []byte) *Dat
 }
 
 func (frame *DataFrame) Read(r io.Reader) (err error) {
-	var frameLen uint32 = frame.Length
+	// read frame length bit for payload
+	payload := make([]byte, frame.Length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return err
+	}
+	return frame.parse(payload)
+}
+
+// parse payload into fields
+// Data/Padding are slice of payload (not copied)
+func (frame *DataFrame) parse(payload []byte) (err error) {
 	var padded bool = frame.Flags&PADDED == PADDED
 
 	if padded {
-		// read 8 bit for padding length
-		err = binary.Read(r, binary.BigEndian, &frame.PadLength)
-		if err != nil {
-			return err
+		if len(payload) < 1 {
+			msg := fmt.Sprintf("PADDED frame.Length(%v) has no Pad Length", len(payload))
+			Error(formatter.Error(msg))
+			return &ConnectionError{FRAME_SIZE_ERROR, msg}
 		}
 
-		if uint32(frame.PadLength) > frameLen {
-			msg := fmt.Sprintf("Pad Length(%v) is larger than frame.Length(%v)", frame.PadLength, frameLen)
-			Error(Red(msg))
-			return &H2Error{PROTOCOL_ERROR, msg}
-		}
-
-		frameLen = frameLen - 1 // (remove pad length)
-	}
+		// 8 bit for padding length
+		frame.PadLength = payload[0]
+		payload = payload[1:] // (remove pad length)
 
-	// read frame length bit for data
-	data := make([]byte, frameLen)
-	err = binary.Read(r, binary.BigEndian, &data)
-	if err != nil {
-		return err
-	}
+		if int(frame.PadLength) > len(payload) {
+			msg := fmt.Sprintf("Pad Length(%v) is larger than frame.Length(%v)", frame.PadLength, frame.Length)
+			Error(formatter.Error(msg))
+			return &ConnectionError{PROTOCOL_ERROR, msg}
+		}
 
-	if padded {
 		// data + padding
-		boundary := len(data) - int(frame.PadLength)
-		frame.Data = data[:boundary]
-		frame.Padding = data[boundary:]
+		boundary := len(payload) - int(frame.PadLength)
+		frame.Data = payload[:boundary]
+		frame.Padding = payload[boundary:]
 	} else {
 		// data only
-		frame.Data = data
+		frame.Data = payload
 	}
 
 	return err
 }
 
+// Release returns payload buffer to the pool
+// if the frame was read by Framer.
+// Data and Padding can't be used after Release.
+func (frame *DataFrame) Release() {
+	if frame.buf == nil {
+		return
+	}
+	frame.buf.release()
+	frame.buf = nil
+	frame.Data = nil
+	frame.Padding = nil
+}
+
 func (frame *DataFrame) Write(w io.Writer) (err error) {
+	_, err = frame.WriteTo(w)
+	return err
+}
+
+// WriteTo writes header and payload directly to w
+// without copying Data into other buffer.
+func (frame *DataFrame) WriteTo(w io.Writer) (n int64, err error) {
 	err = frame.FrameHeader.Write(w)
 	if err != nil {
-		return err
+		return n, err
 	}
+	n += 9
 
 	var padded bool = frame.Flags&PADDED == PADDED
+	var m int
 
 	if padded {
 		// write padding length
-		err = binary.Write(w, binary.BigEndian, &frame.PadLength)
+		m, err = w.Write([]byte{frame.PadLength})
+		n += int64(m)
 		if err != nil {
-			return err
+			return n, err
 		}
 	}
 
 	// write data
-	err = binary.Write(w, binary.BigEndian, &frame.Data)
+	m, err = w.Write(frame.Data)
+	n += int64(m)
 	if err != nil {
-		return err
+		return n, err
 	}
 
 	if padded {
 		// write padding data
-		err = binary.Write(w, binary.BigEndian, &frame.Padding)
+		m, err = w.Write(frame.Padding)
+		n += int64(m)
 		if err != nil {
-			return err
+			return n, err
 		}
 	}
-	return err
+	return n, err
+}
+
+// header and payload as net.Buffers
+// for writing them in one call (writev)
+func (frame *DataFrame) buffers() net.Buffers {
+	header := make([]byte, 9, 10)
+	frame.FrameHeader.pack(header)
+
+	if frame.Flags&PADDED == PADDED {
+		header = append(header, frame.PadLength)
+		return net.Buffers{header, frame.Data, frame.Padding}
+	}
+	return net.Buffers{header, frame.Data}
 }
 
 func (frame *DataFrame) Header() *FrameHeader {
@@ -395,7 +449,7 @@ func (frame *DataFrame) Header() *FrameHeader {
 }
 
 func (frame *DataFrame) String() string {
-	str := Cyan("DATA")
+	str := formatter.Type("DATA")
 	str += frame.FrameHeader.String()
 
 	if frame.Flags&END_STREAM == END_STREAM {
@@ -435,6 +489,12 @@ type HeadersFrame struct {
 	HeaderBlockFragment []byte
 	Headers             http.Header
 	Padding             []byte
+	buf                 *buffer
+
+	// HPACK context of the connection.
+	// if set, Headers are encoded into HeaderBlockFragment on Write
+	// when HeaderBlockFragment is nil.
+	HpackContext *hpack.Context
 }
 
 type DependencyTree struct {
@@ -444,6 +504,21 @@ type DependencyTree struct {
 }
 
 func NewHeadersFrame(flags Flag, streamID uint32, dependencyTree *DependencyTree, headerBlockFragment []byte, padding []byte) *HeadersFrame {
+	length := headersLength(flags, headerBlockFragment, padding)
+	fh := NewFrameHeader(length, HeadersFrameType, flags, streamID)
+
+	headersFrame := &HeadersFrame{
+		FrameHeader:         fh,
+		PadLength:           uint8(len(padding)),
+		DependencyTree:      dependencyTree,
+		HeaderBlockFragment: headerBlockFragment,
+		Padding:             padding,
+	}
+
+	return headersFrame
+}
+
+func headersLength(flags Flag, headerBlockFragment []byte, padding []byte) uint32 {
 	var padded bool = flags&PADDED == PADDED
 	var priority bool = flags&PRIORITY == PRIORITY
 
@@ -455,90 +530,294 @@ func NewHeadersFrame(flags Flag, streamID uint32, dependencyTree *DependencyTree
 	if priority {
 		length = length + 5
 	}
+	return uint32(length)
+}
 
-	fh := NewFrameHeader(uint32(length), HeadersFrameType, flags, streamID)
+// Encode encodes Headers into HeaderBlockFragment with
+// HPACK context of the connection, and updates Length.
+// pseudo headers come first, and names are lowercased.
+// connection-specific headers are stripped.
+//
+// HPACK context is shared by all streams of the connection,
+// so frames should be encoded in order of writing.
+func (frame *HeadersFrame) Encode(ctx *hpack.Context) {
+	frame.HeaderBlockFragment = encodeHeaderBlock(ctx, frame.Headers)
+	frame.Length = headersLength(frame.Flags, frame.HeaderBlockFragment, frame.Padding)
+}
 
-	headersFrame := &HeadersFrame{
-		FrameHeader:         fh,
-		PadLength:           uint8(len(padding)),
-		DependencyTree:      dependencyTree,
-		HeaderBlockFragment: headerBlockFragment,
-		Padding:             padding,
+// header block of HEADERS and PUSH_PROMISE
+func encodeHeaderBlock(ctx *hpack.Context, headers http.Header) []byte {
+	headerList := new(hpack.HeaderList)
+
+	// pseudo headers first
+	var pseudo, regular []string
+	for name := range headers {
+		if strings.HasPrefix(name, ":") {
+			pseudo = append(pseudo, name)
+		} else {
+			regular = append(regular, name)
+		}
 	}
+	sort.Strings(pseudo)
+	sort.Strings(regular)
 
-	return headersFrame
+	for _, name := range append(pseudo, regular...) {
+		lower := strings.ToLower(name)
+		if connectionHeaders[lower] {
+			continue
+		}
+		for _, value := range headers[name] {
+			if lower == "te" && value != "trailers" {
+				continue
+			}
+			if lower == "cookie" {
+				for _, crumb := range splitCookie(value) {
+					headerList.Emit(hpack.NewHeaderField(lower, crumb))
+				}
+				continue
+			}
+			headerList.Emit(hpack.NewHeaderField(lower, value))
+		}
+	}
+
+	// Authorization, Proxy-Authorization, short Cookie and Set-Cookie
+	// are "Literal Header Field Never Indexed" by the encoder
+	return ctx.Encode(*headerList)
+}
+
+// encodes Headers if not yet
+func (frame *HeadersFrame) encode() {
+	if frame.HeaderBlockFragment == nil && frame.Headers != nil && frame.HpackContext != nil {
+		frame.Encode(frame.HpackContext)
+	}
+}
+
+// Decode decodes HeaderBlockFragment into Headers (including
+// pseudo headers) with HPACK context of the connection.
+// failure of decoding is COMPRESSION_ERROR.
+//
+// HPACK context is shared by all streams of the connection,
+// so frames should be decoded in order of receiving.
+//
+// header list larger than MaxHeaderListSize is discarded after decoding
+// (for keeping HPACK context), and the stream should be refused.
+func (frame *HeadersFrame) Decode(ctx *hpack.Context) (err error) {
+	frame.Headers, err = decodeHeaderBlock(ctx, frame.HeaderBlockFragment)
+	if err != nil {
+		return err
+	}
+	err = frame.checkHeaderList(ctx.ES)
+	if err != nil {
+		frame.Headers = nil
+		return err
+	}
+	return frame.checkHeaderListSize(&frame.Headers)
+}
+
+// pseudo headers defined in RFC 7540 8.1.2.3, 8.1.2.4
+// and :protocol of extended CONNECT (RFC 8441 4)
+var pseudoHeaders = map[string]bool{
+	":method":    true,
+	":scheme":    true,
+	":authority": true,
+	":path":      true,
+	":status":    true,
+	":protocol":  true,
+}
+
+// connection-specific header fields (RFC 7540 8.1.2.2)
+// TE is allowed only with "trailers"
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// stream is malformed if header list has
+// - unknown pseudo header, or pseudo header after regular one (8.1.2.1)
+// - uppercase name (8.1.2)
+// - connection-specific header (8.1.2.2)
+func (fh *FrameHeader) checkHeaderList(headerList *hpack.HeaderList) error {
+	var regular bool
+	for _, hf := range *headerList {
+		var msg string
+		switch {
+		case strings.ToLower(hf.Name) != hf.Name:
+			msg = fmt.Sprintf("uppercase header name %v", hf.Name)
+		case strings.HasPrefix(hf.Name, ":") && !pseudoHeaders[hf.Name]:
+			msg = fmt.Sprintf("unknown pseudo header %v", hf.Name)
+		case strings.HasPrefix(hf.Name, ":") && regular:
+			msg = fmt.Sprintf("pseudo header %v after regular header", hf.Name)
+		case connectionHeaders[hf.Name]:
+			msg = fmt.Sprintf("connection-specific header %v", hf.Name)
+		case hf.Name == "te" && hf.Value != "trailers":
+			msg = fmt.Sprintf("te header with %q", hf.Value)
+		default:
+			if !strings.HasPrefix(hf.Name, ":") {
+				regular = true
+			}
+			continue
+		}
+		Error(formatter.Error(msg))
+		return &StreamError{fh.StreamID, PROTOCOL_ERROR}
+	}
+	return nil
+}
+
+// size of header list (RFC 7540 6.5.2)
+// sum of name + value + 32 of each header field
+func HeaderListSize(header http.Header) uint32 {
+	var size uint32
+	for name, values := range header {
+		for _, value := range values {
+			size += uint32(len(name) + len(value) + 32)
+		}
+	}
+	return size
+}
+
+// discards header which exceeds MaxHeaderListSize
+func (fh *FrameHeader) checkHeaderListSize(header *http.Header) error {
+	size := HeaderListSize(*header)
+	if fh.MaxHeaderListSize > 0 && size > uint32(fh.MaxHeaderListSize) {
+		*header = nil
+		msg := fmt.Sprintf("header list size(%v) is larger than SETTINGS_MAX_HEADER_LIST_SIZE(%v)", size, fh.MaxHeaderListSize)
+		Error(formatter.Error(msg))
+		return &StreamError{fh.StreamID, REFUSED_STREAM}
+	}
+	return nil
+}
+
+// invalid header block, including EOS or invalid padding
+// of Huffman coded string, is a COMPRESSION_ERROR
+func decodeHeaderBlock(ctx *hpack.Context, headerBlockFragment []byte) (http.Header, error) {
+	headerList, err := ctx.Decoder.Decode(headerBlockFragment)
+	if err != nil {
+		msg := fmt.Sprintf("failed to decode header block(%x): %v", headerBlockFragment, err)
+		Error(formatter.Error(msg))
+		return nil, &ConnectionError{COMPRESSION_ERROR, msg}
+	}
+	ctx.ES = &headerList
+
+	header := headerList.ToHeader()
+	joinCookie(header)
+	return header, nil
+}
+
+// Cookie is split into crumbs on "; " for better compression,
+// and concatenated with "; " on receiving. (RFC 7540 8.1.2.5)
+// "; " in quoted value is not a delimiter.
+func splitCookie(value string) []string {
+	var crumbs []string
+	var quoted bool
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '"':
+			quoted = !quoted
+		case !quoted && strings.HasPrefix(value[i:], "; "):
+			crumbs = append(crumbs, value[start:i])
+			start = i + 2
+			i++
+		}
+	}
+	return append(crumbs, value[start:])
+}
+
+func joinCookie(header http.Header) {
+	if cookie := header["Cookie"]; len(cookie) > 1 {
+		header["Cookie"] = []string{strings.Join(cookie, "; ")}
+	}
 }
 
 func (frame *HeadersFrame) Read(r io.Reader) (err error) {
-	var frameLen uint32 = frame.Length
+	// read frame length bit for payload
+	payload := make([]byte, frame.Length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return err
+	}
+	return frame.parse(payload)
+}
+
+// parse payload into fields
+// HeaderBlockFragment/Padding are slice of payload (not copied)
+func (frame *HeadersFrame) parse(payload []byte) (err error) {
 	var padded bool = frame.Flags&PADDED == PADDED
 	var priority bool = frame.Flags&PRIORITY == PRIORITY
 
 	if padded {
-		err = binary.Read(r, binary.BigEndian, &frame.PadLength)
-		if err != nil {
-			return err
-		}
-
-		if uint32(frame.PadLength) > frameLen {
-			msg := fmt.Sprintf("Pad Length(%v) is larger than frame.Length(%v)", frame.PadLength, frameLen)
-			Error(Red(msg))
-			return &H2Error{PROTOCOL_ERROR, msg}
+		if len(payload) < 1 {
+			msg := fmt.Sprintf("PADDED frame.Length(%v) has no Pad Length", len(payload))
+			Error(formatter.Error(msg))
+			return &ConnectionError{FRAME_SIZE_ERROR, msg}
 		}
 
-		frameLen = frameLen - 1 // remove pad length
+		frame.PadLength = payload[0]
+		payload = payload[1:] // remove pad length
 	}
 
 	if priority {
-		dependencyTree := new(DependencyTree)
-
-		// read 32bit for e + streamdependency
-		var u32 uint32
-		err = binary.Read(r, binary.BigEndian, &u32)
-		if err != nil {
-			return err
+		if len(payload) < 5 {
+			msg := fmt.Sprintf("PRIORITY frame.Length(%v) has no Stream Dependency and Weight", frame.Length)
+			Error(formatter.Error(msg))
+			return &ConnectionError{FRAME_SIZE_ERROR, msg}
 		}
 
+		dependencyTree := new(DependencyTree)
+
+		// 32bit for e + streamdependency
+		u32 := binary.BigEndian.Uint32(payload)
 		if u32&0x80000000 == 0x80000000 {
 			dependencyTree.Exclusive = true
 		}
 		dependencyTree.StreamDependency = u32 & 0x7FFFFFFF
 
-		frameLen = frameLen - 4 // remove stream dependency length
-
-		err = binary.Read(r, binary.BigEndian, &dependencyTree.Weight)
-		if err != nil {
-			return err
-		}
-
 		// add 1 for weight
-		dependencyTree.Weight = dependencyTree.Weight + 1
-		frameLen = frameLen - 1 // remove weight length
+		dependencyTree.Weight = payload[4] + 1
 
-		frame.DependencyTree = dependencyTree
-	}
+		payload = payload[5:] // remove stream dependency and weight length
 
-	// read frame length bit for data
-	data := make([]byte, frameLen)
-	err = binary.Read(r, binary.BigEndian, &data)
-	if err != nil {
-		return err
+		frame.DependencyTree = dependencyTree
 	}
 
 	if padded {
+		if int(frame.PadLength) > len(payload) {
+			msg := fmt.Sprintf("Pad Length(%v) is larger than frame.Length(%v)", frame.PadLength, frame.Length)
+			Error(formatter.Error(msg))
+			return &ConnectionError{PROTOCOL_ERROR, msg}
+		}
+
 		// header block + padding
-		boundary := len(data) - int(frame.PadLength)
-		frame.HeaderBlockFragment = data[:boundary]
-		frame.Padding = data[boundary:]
+		boundary := len(payload) - int(frame.PadLength)
+		frame.HeaderBlockFragment = payload[:boundary]
+		frame.Padding = payload[boundary:]
 	} else {
 		// header block only
-		frame.HeaderBlockFragment = data
+		frame.HeaderBlockFragment = payload
 	}
 
 	return err
 }
 
+// Release returns payload buffer to the pool
+// if the frame was read by Framer.
+// HeaderBlockFragment and Padding can't be used after Release.
+func (frame *HeadersFrame) Release() {
+	if frame.buf == nil {
+		return
+	}
+	frame.buf.release()
+	frame.buf = nil
+	frame.HeaderBlockFragment = nil
+	frame.Padding = nil
+}
+
 func (frame *HeadersFrame) Write(w io.Writer) (err error) {
+	frame.encode()
+
 	err = frame.FrameHeader.Write(w)
 	if err != nil {
 		return err
@@ -590,7 +869,7 @@ func (frame *HeadersFrame) Header() *FrameHeader {
 }
 
 func (frame *HeadersFrame) String() string {
-	str := Cyan("HEADERS")
+	str := formatter.Type("HEADERS")
 	str += frame.FrameHeader.String()
 
 	if frame.Flags&END_STREAM == END_STREAM {
@@ -612,11 +891,11 @@ func (frame *HeadersFrame) String() string {
 	// TODO: ; First response header
 
 	// print pseudo headers first
-	pseudo := []string{":status", ":method", ":scheme", ":authority", ":path"}
+	pseudo := []string{":status", ":method", ":scheme", ":authority", ":path", ":protocol"}
 	for _, name := range pseudo {
 		value := frame.Headers.Get(name)
 		if value != "" {
-			str += fmt.Sprintf("\n%s: %s", Navy(name), value)
+			str += fmt.Sprintf("\n%s: %s", formatter.Field(name), value)
 		}
 	}
 
@@ -624,7 +903,7 @@ func (frame *HeadersFrame) String() string {
 		if strings.HasPrefix(name, ":") {
 			continue
 		}
-		str += fmt.Sprintf("\n%s: %s", Navy(name), strings.Join(value, ","))
+		str += fmt.Sprintf("\n%s: %s", formatter.Field(name), strings.Join(value, ","))
 	}
 
 	return str
@@ -700,7 +979,7 @@ func (frame *PriorityFrame) Header() *FrameHeader {
 }
 
 func (frame *PriorityFrame) String() string {
-	str := Cyan("RRIORITY")
+	str := formatter.Type("RRIORITY")
 	str += frame.FrameHeader.String()
 	str += fmt.Sprintf("\n(Stream Dependency=%d, Weight=%d)", frame.StreamDependency, frame.Weight)
 	return str
@@ -749,9 +1028,9 @@ func (frame *RstStreamFrame) Header() *FrameHeader {
 }
 
 func (frame *RstStreamFrame) String() string {
-	str := Cyan("RST_STREAM")
+	str := formatter.Type("RST_STREAM")
 	str += frame.FrameHeader.String()
-	str += fmt.Sprintf("\n(Error Code=%s(%d))", Red(frame.ErrorCode.String()), frame.ErrorCode)
+	str += fmt.Sprintf("\n(Error Code=%s(%d))", formatter.Error(frame.ErrorCode.String()), frame.ErrorCode)
 	return str
 }
 
@@ -763,23 +1042,25 @@ func (frame *RstStreamFrame) String() string {
 // |                        Value (32)                             |
 // +---------------------------------------------------------------+
 const (
-	DEFAULT_HEADER_TABLE_SIZE      int32 = 4096
-	DEFAULT_ENABLE_PUSH                  = 1
-	DEFAULT_MAX_CONCURRENT_STREAMS       = 2<<30 - 1 // actual infinite but 2^31-1 in this imple
-	DEFAULT_INITIAL_WINDOW_SIZE          = 65535
-	DEFAULT_MAX_FRAME_SIZE               = 16384
-	DEFAULT_MAX_HEADER_LIST_SIZE         = 2<<30 - 1 // actual infinite but 2^31-1 in this imple
+	DEFAULT_HEADER_TABLE_SIZE       int32 = 4096
+	DEFAULT_ENABLE_PUSH                   = 1
+	DEFAULT_MAX_CONCURRENT_STREAMS        = 2<<30 - 1 // actual infinite but 2^31-1 in this imple
+	DEFAULT_INITIAL_WINDOW_SIZE           = 65535
+	DEFAULT_MAX_FRAME_SIZE                = 16384
+	DEFAULT_MAX_HEADER_LIST_SIZE          = 2<<30 - 1 // actual infinite but 2^31-1 in this imple
+	DEFAULT_ENABLE_CONNECT_PROTOCOL       = 0
 )
 
 type SettingsID uint16
 
 const (
-	SETTINGS_HEADER_TABLE_SIZE      SettingsID = 0x1 // 4096
-	SETTINGS_ENABLE_PUSH                       = 0x2 // 1
-	SETTINGS_MAX_CONCURRENT_STREAMS            = 0x3 // (infinite)
-	SETTINGS_INITIAL_WINDOW_SIZE               = 0x4 // 65535
-	SETTINGS_MAX_FRAME_SIZE                    = 0x5 // 65536
-	SETTINGS_MAX_HEADER_LIST_SIZE              = 0x6 // (infinite)
+	SETTINGS_HEADER_TABLE_SIZE       SettingsID = 0x1 // 4096
+	SETTINGS_ENABLE_PUSH                        = 0x2 // 1
+	SETTINGS_MAX_CONCURRENT_STREAMS             = 0x3 // (infinite)
+	SETTINGS_INITIAL_WINDOW_SIZE                = 0x4 // 65535
+	SETTINGS_MAX_FRAME_SIZE                     = 0x5 // 65536
+	SETTINGS_MAX_HEADER_LIST_SIZE               = 0x6 // (infinite)
+	SETTINGS_ENABLE_CONNECT_PROTOCOL            = 0x8 // 0 (RFC 8441)
 )
 
 func (s SettingsID) String() string {
@@ -790,6 +1071,7 @@ func (s SettingsID) String() string {
 		0x4: "SETTINGS_INITIAL_WINDOW_SIZE",
 		0x5: "SETTINGS_MAX_FRAME_SIZE",
 		0x6: "SETTINGS_MAX_HEADER_LIST_SIZE",
+		0x8: "SETTINGS_ENABLE_CONNECT_PROTOCOL",
 	}
 	return fmt.Sprintf("%s(%d)", m[s], s)
 }
@@ -812,40 +1094,45 @@ func NewSettingsFrame(flags Flag, streamID uint32, settings map[SettingsID]int32
 func (frame *SettingsFrame) Read(r io.Reader) (err error) {
 	frame.Settings = make(map[SettingsID]int32)
 
+	var b [6]byte
 	for niv := frame.Length / 6; niv > 0; niv-- {
-		var settingsID SettingsID
-		var value int32
-
-		err = binary.Read(r, binary.BigEndian, &settingsID)
-		if err != nil {
-			return err
-		}
-		err = binary.Read(r, binary.BigEndian, &value)
+		_, err = io.ReadFull(r, b[:])
 		if err != nil {
 			return err
 		}
 
+		settingsID := SettingsID(binary.BigEndian.Uint16(b[:2]))
+		value := int32(binary.BigEndian.Uint32(b[2:]))
+
 		if settingsID == SETTINGS_ENABLE_PUSH {
 			if !(value == 0 || value == 1) {
 				msg := fmt.Sprintf("SETTINGS_ENABLE_PUSH value should be 0 or 1 but %v", value)
-				Error(Red(msg))
-				return &H2Error{PROTOCOL_ERROR, msg}
+				Error(formatter.Error(msg))
+				return &ConnectionError{PROTOCOL_ERROR, msg}
+			}
+		}
+
+		if settingsID == SETTINGS_ENABLE_CONNECT_PROTOCOL {
+			if !(value == 0 || value == 1) {
+				msg := fmt.Sprintf("SETTINGS_ENABLE_CONNECT_PROTOCOL value should be 0 or 1 but %v", value)
+				Error(formatter.Error(msg))
+				return &ConnectionError{PROTOCOL_ERROR, msg}
 			}
 		}
 
 		if settingsID == SETTINGS_INITIAL_WINDOW_SIZE {
 			if value < 0 { // value is int32 = 2^31-1 so over 2^31-1 value became negative value
 				msg := fmt.Sprintf("SETTINGS_INITIAL_WINDOW_SIZE value should be smaller than 2^31-1 but %v", value)
-				Error(Red(msg))
-				return &H2Error{FLOW_CONTROL_ERROR, msg}
+				Error(formatter.Error(msg))
+				return &ConnectionError{FLOW_CONTROL_ERROR, msg}
 			}
 		}
 
 		if settingsID == SETTINGS_MAX_FRAME_SIZE {
 			if value < 16384 || 16777215 < value {
 				msg := fmt.Sprintf("SETTINGS_MAX_FRAME_SIZE value should between initial value is 2^14 (16,384) and maximum 2^24-1 (16,777,215) but %v", value)
-				Error(Red(msg))
-				return &H2Error{PROTOCOL_ERROR, msg}
+				Error(formatter.Error(msg))
+				return &ConnectionError{PROTOCOL_ERROR, msg}
 			}
 		}
 
@@ -855,17 +1142,29 @@ func (frame *SettingsFrame) Read(r io.Reader) (err error) {
 }
 
 func (frame *SettingsFrame) Write(w io.Writer) (err error) {
-	frame.FrameHeader.Write(w)
-	for settingsID, value := range frame.Settings {
-		err = binary.Write(w, binary.BigEndian, &settingsID)
-		if err != nil {
-			return err
-		}
-		err = binary.Write(w, binary.BigEndian, &value)
-		if err != nil {
-			return err
-		}
+	// duplicated ids in received frame are merged into Settings,
+	// so length is recomputed from it.
+	fh := *frame.FrameHeader
+	fh.Length = uint32(6 * len(frame.Settings))
+	err = fh.Write(w)
+	if err != nil {
+		return err
+	}
+
+	// write in order of id, for same bytes every time
+	ids := make([]int, 0, len(frame.Settings))
+	for settingsID := range frame.Settings {
+		ids = append(ids, int(settingsID))
+	}
+	sort.Ints(ids)
+
+	b := make([]byte, 6*len(ids))
+	for i, id := range ids {
+		binary.BigEndian.PutUint16(b[6*i:], uint16(id))
+		binary.BigEndian.PutUint32(b[6*i+2:], uint32(frame.Settings[SettingsID(id)]))
 	}
+
+	_, err = w.Write(b)
 	return err
 }
 
@@ -874,7 +1173,7 @@ func (frame *SettingsFrame) Header() *FrameHeader {
 }
 
 func (frame *SettingsFrame) String() string {
-	str := Cyan("SETTINGS")
+	str := formatter.Type("SETTINGS")
 	str += frame.FrameHeader.String()
 	if frame.Flags == ACK {
 		str += "\n; ACK"
@@ -903,17 +1202,15 @@ type PushPromiseFrame struct {
 	PromisedStreamID    uint32
 	HeaderBlockFragment []byte
 	Padding             []byte
+
+	// promised request, encoded like HeadersFrame
+	Headers      http.Header
+	HpackContext *hpack.Context
 }
 
 func NewPushPromiseFrame(flags Flag, streamID, promisedStreamID uint32, headerBlockFragment, padding []byte) *PushPromiseFrame {
-	var padded bool = flags&PADDED == PADDED
-	length := 4 + len(headerBlockFragment)
-
-	if padded {
-		length = length + len(padding) + 1
-	}
-
-	fh := NewFrameHeader(uint32(length), PushPromiseFrameType, flags, streamID)
+	length := pushPromiseLength(flags, headerBlockFragment, padding)
+	fh := NewFrameHeader(length, PushPromiseFrameType, flags, streamID)
 	frame := &PushPromiseFrame{
 		FrameHeader:         fh,
 		PadLength:           uint8(len(padding)),
@@ -924,46 +1221,90 @@ func NewPushPromiseFrame(flags Flag, streamID, promisedStreamID uint32, headerBl
 	return frame
 }
 
+func pushPromiseLength(flags Flag, headerBlockFragment []byte, padding []byte) uint32 {
+	var padded bool = flags&PADDED == PADDED
+	length := 4 + len(headerBlockFragment)
+
+	if padded {
+		length = length + len(padding) + 1
+	}
+	return uint32(length)
+}
+
+// Encode encodes Headers of promised request into HeaderBlockFragment
+// with HPACK context of the connection, like HeadersFrame.Encode.
+func (frame *PushPromiseFrame) Encode(ctx *hpack.Context) {
+	frame.HeaderBlockFragment = encodeHeaderBlock(ctx, frame.Headers)
+	frame.Length = pushPromiseLength(frame.Flags, frame.HeaderBlockFragment, frame.Padding)
+}
+
+// encodes Headers if not yet
+func (frame *PushPromiseFrame) encode() {
+	if frame.HeaderBlockFragment == nil && frame.Headers != nil && frame.HpackContext != nil {
+		frame.Encode(frame.HpackContext)
+	}
+}
+
+// Decode decodes HeaderBlockFragment into Headers of promised request.
+// failure of decoding is COMPRESSION_ERROR.
+func (frame *PushPromiseFrame) Decode(ctx *hpack.Context) (err error) {
+	frame.Headers, err = decodeHeaderBlock(ctx, frame.HeaderBlockFragment)
+	return err
+}
+
 func (frame *PushPromiseFrame) Read(r io.Reader) (err error) {
-	var frameLen uint32 = frame.Length
 	var padded bool = frame.Flags&PADDED == PADDED
 
+	payload := make([]byte, frame.Length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return err
+	}
+
 	if padded {
-		// read 8 bit for padding length
-		err = binary.Read(r, binary.BigEndian, &frame.PadLength)
-		if err != nil {
-			return err
+		if len(payload) < 1 {
+			msg := fmt.Sprintf("PADDED frame.Length(%v) has no Pad Length", len(payload))
+			Error(formatter.Error(msg))
+			return &ConnectionError{FRAME_SIZE_ERROR, msg}
 		}
-		frameLen = frameLen - 1 // (remove pad length)
+
+		// 8 bit for padding length
+		frame.PadLength = payload[0]
+		payload = payload[1:] // (remove pad length)
 	}
 
-	// read promised stream id
-	err = binary.Read(r, binary.BigEndian, &frame.PromisedStreamID)
-	if err != nil {
-		return err
+	if len(payload) < 4 {
+		msg := fmt.Sprintf("PUSH_PROMISE frame.Length(%v) has no Promised Stream ID", frame.Length)
+		Error(formatter.Error(msg))
+		return &ConnectionError{FRAME_SIZE_ERROR, msg}
 	}
-	frameLen = frameLen - 4 // remove promised stream id length
 
-	// read frame length bit for data
-	data := make([]byte, frameLen)
-	err = binary.Read(r, binary.BigEndian, &data)
-	if err != nil {
-		return err
+	// R+31bit promised stream id
+	frame.PromisedStreamID = binary.BigEndian.Uint32(payload) & 0x7FFFFFFF
+	payload = payload[4:] // remove promised stream id length
+
+	if int(frame.PadLength) > len(payload) {
+		msg := fmt.Sprintf("Pad Length(%v) is larger than frame.Length(%v)", frame.PadLength, frame.Length)
+		Error(formatter.Error(msg))
+		return &ConnectionError{PROTOCOL_ERROR, msg}
 	}
+
 	if padded {
 		// data + padding
-		boundary := len(data) - int(frame.PadLength)
-		frame.HeaderBlockFragment = data[:boundary]
-		frame.Padding = data[boundary:]
+		boundary := len(payload) - int(frame.PadLength)
+		frame.HeaderBlockFragment = payload[:boundary]
+		frame.Padding = payload[boundary:]
 	} else {
 		// data only
-		frame.HeaderBlockFragment = data
+		frame.HeaderBlockFragment = payload
 	}
 
 	return err
 }
 
 func (frame *PushPromiseFrame) Write(w io.Writer) (err error) {
+	frame.encode()
+
 	err = frame.FrameHeader.Write(w)
 	if err != nil {
 		return err
@@ -1006,7 +1347,7 @@ func (frame *PushPromiseFrame) Header() *FrameHeader {
 }
 
 func (frame *PushPromiseFrame) String() string {
-	str := Cyan("PUSH_PROMISE")
+	str := formatter.Type("PUSH_PROMISE")
 	str += frame.FrameHeader.String()
 
 	str += fmt.Sprintf("\npromised streamid=%x", frame.PromisedStreamID)
@@ -1047,8 +1388,9 @@ func NewPingFrame(flags Flag, streamID uint32, opaqueData []byte) *PingFrame {
 
 func (frame *PingFrame) Read(r io.Reader) (err error) {
 	if frame.Length != 8 {
-		Trace("invalid length: %v", frame.Length)
-		return fmt.Errorf("invalid length: %v", frame.Length)
+		msg := fmt.Sprintf("invalid length: %v", frame.Length)
+		Trace(msg)
+		return &ConnectionError{FRAME_SIZE_ERROR, msg}
 	}
 
 	frame.OpaqueData = make([]byte, 8)
@@ -1077,7 +1419,7 @@ func (frame *PingFrame) Header() *FrameHeader {
 }
 
 func (frame *PingFrame) String() string {
-	str := Cyan("PING")
+	str := formatter.Type("PING")
 	str += frame.FrameHeader.String()
 	if frame.Flags == ACK {
 		str += "\n; ACK"
@@ -1159,10 +1501,10 @@ func (frame *GoAwayFrame) Header() *FrameHeader {
 }
 
 func (frame *GoAwayFrame) String() string {
-	str := Cyan("GOAWAY")
+	str := formatter.Type("GOAWAY")
 	str += frame.FrameHeader.String()
 	str += fmt.Sprintf("\n(last_stream_id=%d, error_code=%s(%d), opaque_data(%q))",
-		frame.LastStreamID, Red(frame.ErrorCode.String()), frame.ErrorCode, frame.AdditionalDebugData)
+		frame.LastStreamID, formatter.Error(frame.ErrorCode.String()), frame.ErrorCode, frame.AdditionalDebugData)
 	return str
 }
 
@@ -1188,10 +1530,14 @@ func NewWindowUpdateFrame(streamID, incrementSize uint32) *WindowUpdateFrame {
 }
 
 func (frame *WindowUpdateFrame) Read(r io.Reader) (err error) {
-	err = binary.Read(r, binary.BigEndian, &frame.WindowSizeIncrement)
+	var b [4]byte
+	_, err = io.ReadFull(r, b[:])
 	if err != nil {
 		return err
 	}
+
+	// ignore R bit
+	frame.WindowSizeIncrement = binary.BigEndian.Uint32(b[:]) & 0x7FFFFFFF
 	return err
 }
 
@@ -1201,10 +1547,9 @@ func (frame *WindowUpdateFrame) Write(w io.Writer) (err error) {
 		return err
 	}
 
-	err = binary.Write(w, binary.BigEndian, &frame.WindowSizeIncrement)
-	if err != nil {
-		return err
-	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], frame.WindowSizeIncrement)
+	_, err = w.Write(b[:])
 	return err
 }
 
@@ -1213,7 +1558,7 @@ func (frame *WindowUpdateFrame) Header() *FrameHeader {
 }
 
 func (frame *WindowUpdateFrame) String() string {
-	str := Cyan("WINDOW_UPDATE")
+	str := formatter.Type("WINDOW_UPDATE")
 	str += frame.FrameHeader.String()
 	str += fmt.Sprintf("\n(window_size_increment=%d)", frame.WindowSizeIncrement)
 	return str
@@ -1241,6 +1586,21 @@ func NewContinuationFrame(flags Flag, streamID uint32, headerBlockFragment []byt
 	return frame
 }
 
+// Decode decodes HeaderBlockFragment into Headers
+// same as HeadersFrame.Decode
+func (frame *ContinuationFrame) Decode(ctx *hpack.Context) (err error) {
+	frame.Headers, err = decodeHeaderBlock(ctx, frame.HeaderBlockFragment)
+	if err != nil {
+		return err
+	}
+	err = frame.checkHeaderList(ctx.ES)
+	if err != nil {
+		frame.Headers = nil
+		return err
+	}
+	return frame.checkHeaderListSize(&frame.Headers)
+}
+
 func (frame *ContinuationFrame) Read(r io.Reader) (err error) {
 	frame.HeaderBlockFragment = make([]byte, frame.Length)
 	err = binary.Read(r, binary.BigEndian, &frame.HeaderBlockFragment)
@@ -1264,34 +1624,114 @@ func (frame *ContinuationFrame) Header() *FrameHeader {
 }
 
 func (frame *ContinuationFrame) String() string {
-	str := Cyan("CONTINUATION")
+	str := formatter.Type("CONTINUATION")
 	str += frame.FrameHeader.String()
 	str += fmt.Sprintf("\n(=%x)", frame.HeaderBlockFragment)
 	return str
 }
 
+// UNKNOWN
+//
+// frame of unknown type should be ignored (RFC 7540 4.1)
+// payload is kept as is for proxy or debugging.
+type UnknownFrame struct {
+	*FrameHeader
+	Payload []byte
+}
+
+func (frame *UnknownFrame) Read(r io.Reader) (err error) {
+	frame.Payload = make([]byte, frame.Length)
+	_, err = io.ReadFull(r, frame.Payload)
+	if err != nil {
+		return err
+	}
+	return err
+}
+
+func (frame *UnknownFrame) Write(w io.Writer) (err error) {
+	err = frame.FrameHeader.Write(w)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame.Payload)
+	if err != nil {
+		return err
+	}
+	return err
+}
+
+func (frame *UnknownFrame) Header() *FrameHeader {
+	return frame.FrameHeader
+}
+
+func (frame *UnknownFrame) String() string {
+	str := formatter.Type(frame.Type.String())
+	str += frame.FrameHeader.String()
+	str += fmt.Sprintf("\n(payload=%x)", frame.Payload)
+	return str
+}
+
 // Read
-func ReadFrame(r io.Reader, settings map[SettingsID]int32) (frame Frame, err error) {
+//
+// reads FrameHeader and dispatch to frame of its type.
+// payload of the frame is always consumed to the end,
+// so the next frame can be read from r.
+// frame of unknown type returns as *UnknownFrame.
+func ReadFrame(r io.Reader) (frame Frame, err error) {
+	// MAX_FRAME_SIZE is default value
 	fh := new(FrameHeader)
-	fh.MaxFrameSize = settings[SETTINGS_MAX_FRAME_SIZE]
-	fh.MaxHeaderListSize = settings[SETTINGS_MAX_HEADER_LIST_SIZE]
 
 	err = fh.Read(r)
 	if err != nil {
 		Error("%v", err)
+
+		// stream error is recoverable, so skip the payload
+		// and keep the connection in sync with the next frame
+		if _, ok := err.(*StreamError); ok {
+			io.CopyN(ioutil.Discard, r, int64(fh.Length))
+		}
 		return nil, err
 	}
 
-	newframe, ok := FrameMap[fh.Type]
-	if !ok {
-		return nil, fmt.Errorf("unknown type: %v", fh.Type)
+	return readPayload(r, fh)
+}
+
+// reads payload of frame which header is already read
+func readPayload(r io.Reader, fh *FrameHeader) (frame Frame, err error) {
+	frame = NewFrame(fh)
+
+	// frame can't read over the Length
+	lr := &io.LimitedReader{R: r, N: int64(fh.Length)}
+	err = frame.Read(lr)
+	if err != nil {
+		if lr.N == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			// payload is shorter than the frame requires
+			msg := fmt.Sprintf("payload of %v is too short (length=%v)", fh.Type, fh.Length)
+			Error(formatter.Error(msg))
+			return nil, &ConnectionError{FRAME_SIZE_ERROR, msg}
+		}
+		if err == io.EOF {
+			// closed in the middle of the frame
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
 	}
 
-	frame = newframe(fh)
-	err = frame.Read(r)
+	// discard rest of payload
+	_, err = io.Copy(ioutil.Discard, lr)
 	if err != nil {
 		return nil, err
 	}
 
 	return frame, nil
 }
+
+// returns frame of the type in FrameHeader
+// or UnknownFrame if type is unknown
+func NewFrame(fh *FrameHeader) Frame {
+	newframe, ok := FrameMap[fh.Type]
+	if !ok {
+		return &UnknownFrame{FrameHeader: fh}
+	}
+	return newframe(fh)
+}
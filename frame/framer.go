@@ -0,0 +1,409 @@
+package frame
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/Jxck/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// how Framer writes header and payload of a frame
+type WriteMode int
+
+const (
+	// write header and payload separately (default)
+	WriteDirect WriteMode = iota
+	// write DATA as net.Buffers, which uses writev(2) on *net.TCPConn
+	WriteBuffers
+	// copy frame into scratch buffer and write it once,
+	// one TLS record per frame on *tls.Conn
+	WriteScratch
+)
+
+// Framer reads/writes frames from/to connection
+// with keeping SETTINGS_MAX_FRAME_SIZE of both side.
+// connection should use only ReadFrame/WriteFrame of Framer.
+type Framer struct {
+	w  io.Writer
+	r  io.Reader
+	wm sync.Mutex // serialize writes
+
+	// SETTINGS_MAX_FRAME_SIZE advertised by us
+	maxReadFrameSize int32
+	// SETTINGS_MAX_FRAME_SIZE advertised by peer
+	maxWriteFrameSize int32
+	// SETTINGS_MAX_HEADER_LIST_SIZE advertised by us
+	maxHeaderListSize int32
+
+	// how to write frame
+	WriteMode WriteMode
+	scratch   bytes.Buffer
+
+	// validate CONTINUATION follows HEADERS/PUSH_PROMISE on the same stream
+	CheckContinuation bool
+	// stream id waiting for CONTINUATION (0 is not waiting)
+	continuationStreamID uint32
+
+	// concatenate CONTINUATIONs into preceding HEADERS/PUSH_PROMISE
+	// so that ReadFrame returns whole header block at once
+	AssembleHeaders bool
+	// limit of assembled header block, for avoiding memory exhaustion
+	MaxHeaderBlockSize uint32
+	// limit of time to read CONTINUATIONs after HEADERS/PUSH_PROMISE
+	// without END_HEADERS, as read deadline of reader which has
+	// SetReadDeadline like net.Conn. 0 is no limit.
+	HeaderBlockTimeout time.Duration
+}
+
+func NewFramer(w io.Writer, r io.Reader) *Framer {
+	return &Framer{
+		w:                  w,
+		r:                  r,
+		maxReadFrameSize:   DEFAULT_MAX_FRAME_SIZE,
+		maxWriteFrameSize:  DEFAULT_MAX_FRAME_SIZE,
+		maxHeaderListSize:  DEFAULT_MAX_HEADER_LIST_SIZE,
+		CheckContinuation:  true,
+		MaxHeaderBlockSize: 1 << 20,
+	}
+}
+
+// SETTINGS_MAX_FRAME_SIZE which we advertised
+func (fr *Framer) SetMaxReadFrameSize(size int32) {
+	Debug("framer max read frame size %v", size)
+	fr.maxReadFrameSize = size
+}
+
+// SETTINGS_MAX_FRAME_SIZE which peer advertised
+func (fr *Framer) SetMaxWriteFrameSize(size int32) {
+	Debug("framer max write frame size %v", size)
+	fr.wm.Lock()
+	fr.maxWriteFrameSize = size
+	fr.wm.Unlock()
+}
+
+// SETTINGS_MAX_HEADER_LIST_SIZE which we advertised
+// frames read by Framer have it in MaxHeaderListSize,
+// and Decode of them enforces it.
+func (fr *Framer) SetMaxHeaderListSize(size int32) {
+	Debug("framer max header list size %v", size)
+	fr.maxHeaderListSize = size
+}
+
+func (fr *Framer) MaxHeaderListSize() int32 {
+	return fr.maxHeaderListSize
+}
+
+func (fr *Framer) MaxReadFrameSize() int32 {
+	return fr.maxReadFrameSize
+}
+
+func (fr *Framer) MaxWriteFrameSize() int32 {
+	fr.wm.Lock()
+	defer fr.wm.Unlock()
+	return fr.maxWriteFrameSize
+}
+
+// reads next frame from connection
+// larger frame than SETTINGS_MAX_FRAME_SIZE are rejected before
+// reading its payload.
+//
+// if AssembleHeaders, CONTINUATIONs are not returned but
+// appended to HEADERS/PUSH_PROMISE, which has END_HEADERS then.
+//
+// payload of DATA and HEADERS are read into buffer from pool.
+// call Release() of the frame after use of Data/HeaderBlockFragment,
+// then the buffer will be reused by next frame.
+// if Release() is not called, the buffer just collected by GC.
+func (fr *Framer) ReadFrame() (frame Frame, err error) {
+	frame, err = fr.readFrame()
+	if err != nil || !fr.AssembleHeaders {
+		return frame, err
+	}
+
+	var fragment *[]byte
+	switch frame := frame.(type) {
+	case *HeadersFrame:
+		fragment = &frame.HeaderBlockFragment
+	case *PushPromiseFrame:
+		fragment = &frame.HeaderBlockFragment
+	default:
+		return frame, nil
+	}
+	if frame.Header().Flags&END_HEADERS == END_HEADERS {
+		return frame, nil
+	}
+
+	// HeaderBlockFragment of HEADERS is in pooled buffer, so copy it
+	headerBlock := append([]byte(nil), *fragment...)
+	if fr.HeaderBlockTimeout > 0 {
+		if r, ok := fr.r.(interface{ SetReadDeadline(time.Time) error }); ok {
+			r.SetReadDeadline(time.Now().Add(fr.HeaderBlockTimeout))
+			defer r.SetReadDeadline(time.Time{})
+		}
+	}
+	for {
+		// checkOrder rejects anything except CONTINUATION on the same stream
+		next, err := fr.readFrame()
+		if err != nil {
+			if os.IsTimeout(err) {
+				msg := fmt.Sprintf("header block is not completed in %v", fr.HeaderBlockTimeout)
+				Error(formatter.Error(msg))
+				return nil, &ConnectionError{PROTOCOL_ERROR, msg}
+			}
+			if _, ok := err.(*StreamError); ok {
+				msg := fmt.Sprintf("invalid frame while waiting CONTINUATION: %v", err)
+				Error(formatter.Error(msg))
+				return nil, &ConnectionError{PROTOCOL_ERROR, msg}
+			}
+			return nil, err
+		}
+		// not checked if CheckContinuation is off (RFC 7540 6.10)
+		continuation, ok := next.(*ContinuationFrame)
+		if !ok || continuation.StreamID != frame.Header().StreamID {
+			msg := fmt.Sprintf("%v on stream(%v) while waiting CONTINUATION on stream(%v)", next.Header().Type, next.Header().StreamID, frame.Header().StreamID)
+			Error(formatter.Error(msg))
+			return nil, &ConnectionError{PROTOCOL_ERROR, msg}
+		}
+
+		size := len(headerBlock) + len(continuation.HeaderBlockFragment)
+		if uint32(size) > fr.MaxHeaderBlockSize {
+			msg := fmt.Sprintf("header block size(%v) is larger than %v", size, fr.MaxHeaderBlockSize)
+			Error(formatter.Error(msg))
+			return nil, &ConnectionError{ENHANCE_YOUR_CALM, msg}
+		}
+		headerBlock = append(headerBlock, continuation.HeaderBlockFragment...)
+
+		if continuation.Flags&END_HEADERS == END_HEADERS {
+			break
+		}
+	}
+
+	// as if it was received in one frame
+	fh := frame.Header()
+	fh.Length += uint32(len(headerBlock) - len(*fragment))
+	fh.Flags |= END_HEADERS
+	*fragment = headerBlock
+	return frame, nil
+}
+
+func (fr *Framer) readFrame() (frame Frame, err error) {
+	fh := new(FrameHeader)
+	fh.MaxFrameSize = fr.maxReadFrameSize
+	fh.MaxHeaderListSize = fr.maxHeaderListSize
+
+	err = fh.Read(fr.r)
+	if err != nil {
+		if _, ok := err.(*StreamError); ok {
+			io.CopyN(ioutil.Discard, fr.r, int64(fh.Length))
+		}
+		return nil, err
+	}
+
+	err = fr.checkOrder(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	frame = NewFrame(fh)
+	switch frame := frame.(type) {
+	case *DataFrame:
+		frame.buf, err = fr.readPooled(fh)
+		if err != nil {
+			return nil, err
+		}
+		err = frame.parse(frame.buf.b[:fh.Length])
+	case *HeadersFrame:
+		frame.buf, err = fr.readPooled(fh)
+		if err != nil {
+			return nil, err
+		}
+		err = frame.parse(frame.buf.b[:fh.Length])
+	default:
+		return readPayload(fr.r, fh)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// reads payload into buffer from pool
+func (fr *Framer) readPooled(fh *FrameHeader) (buf *buffer, err error) {
+	buf = getBuffer(fr.maxReadFrameSize)
+	_, err = io.ReadFull(fr.r, buf.b[:fh.Length])
+	if err != nil {
+		buf.release()
+		if err == io.EOF {
+			// closed in the middle of the frame
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writes frame to connection
+// safe to call from multiple goroutines.
+//
+// HEADERS and PUSH_PROMISE larger than peer's MAX_FRAME_SIZE is split
+// into CONTINUATIONs, which are written without interleaving.
+func (fr *Framer) WriteFrame(frame Frame) (err error) {
+	fr.wm.Lock()
+	defer fr.wm.Unlock()
+
+	// HPACK context is shared by the connection,
+	// so header blocks are encoded here in order of writing.
+	switch frame := frame.(type) {
+	case *HeadersFrame:
+		frame.encode()
+		if int32(frame.Length) > fr.maxWriteFrameSize {
+			return fr.writeSplitHeaders(frame.FrameHeader, frame.HeaderBlockFragment, func(fragment []byte) Frame {
+				return NewHeadersFrame(frame.Flags&^END_HEADERS, frame.StreamID, frame.DependencyTree, fragment, frame.Padding)
+			})
+		}
+	case *PushPromiseFrame:
+		frame.encode()
+		if int32(frame.Length) > fr.maxWriteFrameSize {
+			return fr.writeSplitHeaders(frame.FrameHeader, frame.HeaderBlockFragment, func(fragment []byte) Frame {
+				return NewPushPromiseFrame(frame.Flags&^END_HEADERS, frame.StreamID, frame.PromisedStreamID, fragment, frame.Padding)
+			})
+		}
+	}
+
+	length := frame.Header().Length
+	if int32(length) > fr.maxWriteFrameSize {
+		return fmt.Errorf("frame size(%v) is larger than peer's MAX_FRAME_SIZE(%v)", length, fr.maxWriteFrameSize)
+	}
+
+	return fr.write(frame)
+}
+
+// writes first frame with first fragment of header block,
+// and CONTINUATIONs with the rest. only last one has END_HEADERS.
+// first makes HEADERS or PUSH_PROMISE of the fragment.
+func (fr *Framer) writeSplitHeaders(fh *FrameHeader, headerBlock []byte, first func(fragment []byte) Frame) (err error) {
+	maxFrameSize := int(fr.maxWriteFrameSize)
+
+	// padding, priority and promised stream id are in first frame
+	size := maxFrameSize - (int(fh.Length) - len(headerBlock))
+	if size <= 0 {
+		return fmt.Errorf("padding of %v is larger than peer's MAX_FRAME_SIZE(%v)", fh.Type, maxFrameSize)
+	}
+
+	err = fr.write(first(headerBlock[:size]))
+	if err != nil {
+		return err
+	}
+	headerBlock = headerBlock[size:]
+
+	for len(headerBlock) > 0 {
+		var flags Flag = UNSET
+		size = len(headerBlock)
+		if size > maxFrameSize {
+			size = maxFrameSize
+		} else {
+			flags = fh.Flags & END_HEADERS
+		}
+
+		err = fr.write(NewContinuationFrame(flags, fh.StreamID, headerBlock[:size]))
+		if err != nil {
+			return err
+		}
+		headerBlock = headerBlock[size:]
+	}
+	return nil
+}
+
+// writes frame in WriteMode, caller should hold wm
+func (fr *Framer) write(frame Frame) (err error) {
+	switch fr.WriteMode {
+	case WriteBuffers:
+		if frame, ok := frame.(*DataFrame); ok {
+			buffers := frame.buffers()
+			_, err = buffers.WriteTo(fr.w)
+			return err
+		}
+		// other frames are small enough to copy
+		fallthrough
+	case WriteScratch:
+		fr.scratch.Reset()
+		err = frame.Write(&fr.scratch)
+		if err != nil {
+			return err
+		}
+		_, err = fr.w.Write(fr.scratch.Bytes())
+		return err
+	}
+
+	// write directly if possible
+	if wt, ok := frame.(io.WriterTo); ok {
+		_, err = wt.WriteTo(fr.w)
+		return err
+	}
+
+	return frame.Write(fr.w)
+}
+
+// HEADERS/PUSH_PROMISE without END_HEADERS should be followed by
+// CONTINUATION on the same stream, and nothing else.
+func (fr *Framer) checkOrder(fh *FrameHeader) error {
+	if !fr.CheckContinuation {
+		return nil
+	}
+
+	if fr.continuationStreamID != 0 {
+		if fh.Type != ContinuationFrameType || fh.StreamID != fr.continuationStreamID {
+			msg := fmt.Sprintf("%v frame on stream(%v) while waiting CONTINUATION on stream(%v)", fh.Type, fh.StreamID, fr.continuationStreamID)
+			Error(formatter.Error(msg))
+			return &ConnectionError{PROTOCOL_ERROR, msg}
+		}
+	} else if fh.Type == ContinuationFrameType {
+		msg := fmt.Sprintf("CONTINUATION frame on stream(%v) without HEADERS", fh.StreamID)
+		Error(formatter.Error(msg))
+		return &ConnectionError{PROTOCOL_ERROR, msg}
+	}
+
+	switch fh.Type {
+	case HeadersFrameType, PushPromiseFrameType, ContinuationFrameType:
+		if fh.Flags&END_HEADERS == END_HEADERS {
+			fr.continuationStreamID = 0
+		} else {
+			fr.continuationStreamID = fh.StreamID
+		}
+	}
+	return nil
+}
+
+// payload buffer in the pool
+type buffer struct {
+	b    []byte
+	pool *sync.Pool
+}
+
+func (buf *buffer) release() {
+	buf.pool.Put(buf)
+}
+
+// pools of payload buffer keyed by max frame size
+var (
+	poolsLock sync.Mutex
+	pools     = make(map[int32]*sync.Pool)
+)
+
+func getBuffer(maxFrameSize int32) *buffer {
+	poolsLock.Lock()
+	pool, ok := pools[maxFrameSize]
+	if !ok {
+		pool = new(sync.Pool)
+		pool.New = func() interface{} {
+			return &buffer{make([]byte, maxFrameSize), pool}
+		}
+		pools[maxFrameSize] = pool
+	}
+	poolsLock.Unlock()
+	return pool.Get().(*buffer)
+}
@@ -0,0 +1,573 @@
+package frame
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	assert "github.com/Jxck/assertion"
+	"github.com/Jxck/http2/hpack"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFramerReadWrite(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	framer := NewFramer(buf, buf)
+
+	expected := []Frame{
+		NewHeadersFrame(END_HEADERS, 1, nil, []byte("header block"), nil),
+		NewDataFrame(END_STREAM, 1, []byte("hello world"), nil),
+		NewWindowUpdateFrame(0, 1000),
+	}
+
+	for _, frame := range expected {
+		err := framer.WriteFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, frame := range expected {
+		actual, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := Diff(actual, frame); diff != "" {
+			t.Errorf("%v\n%s", frame.Header().Type, diff)
+		}
+	}
+}
+
+func TestFramerRelease(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	framer := NewFramer(buf, buf)
+
+	framer.WriteFrame(NewDataFrame(UNSET, 1, []byte("first"), nil))
+	framer.WriteFrame(NewDataFrame(UNSET, 1, []byte("second"), nil))
+
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := frame.(*DataFrame)
+	assert.Equal(t, first.Data, []byte("first"))
+
+	first.Release()
+	assert.Equal(t, first.Data, []byte(nil))
+	first.Release() // twice is ok
+
+	frame, err = framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, frame.(*DataFrame).Data, []byte("second"))
+}
+
+func TestFramerMaxReadFrameSize(t *testing.T) {
+	data := make([]byte, DEFAULT_MAX_FRAME_SIZE+1)
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	NewDataFrame(UNSET, 1, data, nil).Write(buf)
+
+	// default 16384
+	framer := NewFramer(nil, bytes.NewReader(buf.Bytes()))
+	_, err := framer.ReadFrame()
+	var connectionError *ConnectionError
+	if !errors.As(err, &connectionError) {
+		t.Fatalf("got %v want ConnectionError", err)
+	}
+	assert.Equal(t, connectionError.Code, FRAME_SIZE_ERROR)
+
+	// advertised larger size
+	framer = NewFramer(nil, bytes.NewReader(buf.Bytes()))
+	framer.SetMaxReadFrameSize(DEFAULT_MAX_FRAME_SIZE * 2)
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, frame.(*DataFrame).Data, data)
+}
+
+func TestFramerMaxWriteFrameSize(t *testing.T) {
+	data := make([]byte, DEFAULT_MAX_FRAME_SIZE+1)
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	framer := NewFramer(buf, nil)
+
+	err := framer.WriteFrame(NewDataFrame(UNSET, 1, data, nil))
+	if err == nil {
+		t.Fatal("should not write frame larger than peer's MAX_FRAME_SIZE")
+	}
+	assert.Equal(t, buf.Len(), 0)
+
+	framer.SetMaxWriteFrameSize(DEFAULT_MAX_FRAME_SIZE * 2)
+	err = framer.WriteFrame(NewDataFrame(UNSET, 1, data, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFramerContinuation(t *testing.T) {
+	var cases = []struct {
+		frames []Frame
+		valid  bool
+	}{
+		{
+			[]Frame{
+				NewHeadersFrame(UNSET, 1, nil, []byte("header"), nil),
+				NewContinuationFrame(UNSET, 1, []byte("block")),
+				NewContinuationFrame(END_HEADERS, 1, []byte("fragment")),
+				NewDataFrame(END_STREAM, 1, []byte("data"), nil),
+			}, true,
+		},
+		{
+			[]Frame{
+				NewHeadersFrame(UNSET, 1, nil, []byte("header"), nil),
+				NewDataFrame(END_STREAM, 1, []byte("data"), nil),
+			}, false,
+		},
+		{
+			[]Frame{
+				NewHeadersFrame(UNSET, 1, nil, []byte("header"), nil),
+				NewContinuationFrame(END_HEADERS, 3, []byte("block")),
+			}, false,
+		},
+		{
+			[]Frame{
+				NewContinuationFrame(END_HEADERS, 1, []byte("block")),
+			}, false,
+		},
+	}
+
+	for i, c := range cases {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		framer := NewFramer(buf, buf)
+		for _, frame := range c.frames {
+			framer.WriteFrame(frame)
+		}
+
+		var err error
+		for range c.frames {
+			_, err = framer.ReadFrame()
+			if err != nil {
+				break
+			}
+		}
+
+		if c.valid && err != nil {
+			t.Errorf("case %d: got %v want no error", i, err)
+		}
+		var connectionError *ConnectionError
+		if !c.valid && !errors.As(err, &connectionError) {
+			t.Errorf("case %d: got %v want ConnectionError", i, err)
+		}
+	}
+}
+
+func TestFramerAssembleHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Add(":method", "GET")
+	header.Add(":path", "/")
+	header.Add("x-test", strings.Repeat("a", 100))
+	encoded := NewHeadersFrame(END_HEADERS, 1, nil, nil, nil)
+	encoded.Headers = header
+	encoded.Encode(hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE)))
+	hb := encoded.HeaderBlockFragment
+
+	// split header block in the middle of field
+	buf := bytes.NewBuffer(make([]byte, 0))
+	framer := NewFramer(buf, buf)
+	framer.AssembleHeaders = true
+	framer.WriteFrame(NewHeadersFrame(PADDED, 1, nil, hb[:10], []byte{0, 0}))
+	framer.WriteFrame(NewContinuationFrame(UNSET, 1, hb[10:50]))
+	framer.WriteFrame(NewContinuationFrame(END_HEADERS, 1, hb[50:]))
+	framer.WriteFrame(NewPushPromiseFrame(UNSET, 1, 2, hb[:20], nil))
+	framer.WriteFrame(NewContinuationFrame(END_HEADERS, 1, hb[20:]))
+	framer.WriteFrame(NewDataFrame(END_STREAM, 1, []byte("data"), nil))
+
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := frame.(*HeadersFrame)
+	assert.Equal(t, headers.Flags, Flag(END_HEADERS+PADDED))
+	assert.Equal(t, headers.HeaderBlockFragment, hb)
+	assert.Equal(t, headers.Length, uint32(1+len(hb)+2))
+	err = headers.Decode(hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, headers.Headers.Get("x-test"), header.Get("x-test"))
+
+	frame, err = framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushPromise := frame.(*PushPromiseFrame)
+	assert.Equal(t, pushPromise.Flags, Flag(END_HEADERS))
+	assert.Equal(t, pushPromise.HeaderBlockFragment, hb)
+	assert.Equal(t, pushPromise.Length, uint32(4+len(hb)))
+
+	frame, err = framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, frame.Header().Type, DataFrameType)
+}
+
+func TestFramerSplitHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Add(":status", "200")
+	for i := 0; i < 100; i++ {
+		header.Add("Set-Cookie", fmt.Sprintf("%03d=%s", i, strings.Repeat("a", 1000)))
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	framer := NewFramer(buf, buf)
+	framer.SetMaxWriteFrameSize(DEFAULT_MAX_FRAME_SIZE)
+
+	expected := NewHeadersFrame(END_STREAM+END_HEADERS+PADDED, 1, nil, nil, make([]byte, 10))
+	expected.Headers = header
+	expected.HpackContext = hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	err := framer.WriteFrame(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// data of other stream should follow whole header block
+	framer.WriteFrame(NewDataFrame(END_STREAM, 3, []byte("data"), nil))
+
+	// HEADERS, CONTINUATION..., DATA
+	var frames []Frame
+	for buf.Len() > 0 {
+		frame, err := ReadFrame(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	if len(frames) < 3 {
+		t.Fatalf("header block should be split but %v frames", len(frames))
+	}
+
+	headers := frames[0].(*HeadersFrame)
+	assert.Equal(t, headers.Flags, Flag(END_STREAM+PADDED))
+	assert.Equal(t, len(headers.Padding), 10)
+	headerBlock := headers.HeaderBlockFragment
+
+	last := len(frames) - 2
+	for i, frame := range frames[1 : last+1] {
+		continuation := frame.(*ContinuationFrame)
+		if continuation.Length > DEFAULT_MAX_FRAME_SIZE {
+			t.Errorf("CONTINUATION(%v) is larger than MAX_FRAME_SIZE", continuation.Length)
+		}
+		var flags Flag = UNSET
+		if i+1 == last {
+			flags = END_HEADERS
+		}
+		assert.Equal(t, continuation.Flags, flags)
+		headerBlock = append(headerBlock, continuation.HeaderBlockFragment...)
+	}
+	assert.Equal(t, headerBlock, expected.HeaderBlockFragment)
+	assert.Equal(t, frames[len(frames)-1].Header().Type, DataFrameType)
+}
+
+func TestFramerSplitPushPromise(t *testing.T) {
+	header := http.Header{}
+	header.Add(":method", "GET")
+	header.Add(":path", "/pushed")
+	for i := 0; i < 100; i++ {
+		header.Add("x-data", fmt.Sprintf("%03d=%s", i, strings.Repeat("a", 1000)))
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	framer := NewFramer(buf, buf)
+	framer.SetMaxWriteFrameSize(DEFAULT_MAX_FRAME_SIZE)
+
+	expected := NewPushPromiseFrame(END_HEADERS+PADDED, 1, 2, nil, make([]byte, 10))
+	expected.Headers = header
+	expected.HpackContext = hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	err := framer.WriteFrame(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	framer.WriteFrame(NewDataFrame(END_STREAM, 1, []byte("data"), nil))
+
+	// PUSH_PROMISE, CONTINUATION..., DATA
+	var frames []Frame
+	for buf.Len() > 0 {
+		frame, err := ReadFrame(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	if len(frames) < 3 {
+		t.Fatalf("header block should be split but %v frames", len(frames))
+	}
+
+	// promised stream id and padding are only in PUSH_PROMISE
+	pushPromise := frames[0].(*PushPromiseFrame)
+	assert.Equal(t, pushPromise.Flags, Flag(PADDED))
+	assert.Equal(t, pushPromise.PromisedStreamID, uint32(2))
+	assert.Equal(t, len(pushPromise.Padding), 10)
+	if pushPromise.Length > DEFAULT_MAX_FRAME_SIZE {
+		t.Errorf("PUSH_PROMISE(%v) is larger than MAX_FRAME_SIZE", pushPromise.Length)
+	}
+	headerBlock := pushPromise.HeaderBlockFragment
+
+	last := len(frames) - 2
+	for i, frame := range frames[1 : last+1] {
+		continuation := frame.(*ContinuationFrame)
+		if continuation.Length > DEFAULT_MAX_FRAME_SIZE {
+			t.Errorf("CONTINUATION(%v) is larger than MAX_FRAME_SIZE", continuation.Length)
+		}
+		var flags Flag = UNSET
+		if i+1 == last {
+			flags = END_HEADERS
+		}
+		assert.Equal(t, continuation.Flags, flags)
+		headerBlock = append(headerBlock, continuation.HeaderBlockFragment...)
+	}
+	assert.Equal(t, headerBlock, expected.HeaderBlockFragment)
+	assert.Equal(t, frames[len(frames)-1].Header().Type, DataFrameType)
+
+	// peer's decoder keeps in sync with the encoder
+	decoder := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	decoder.Decode(headerBlock)
+	assert.Equal(t, decoder.ES.ToHeader(), header)
+}
+
+func TestFramerMaxHeaderBlockSize(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	framer := NewFramer(buf, buf)
+	framer.AssembleHeaders = true
+	framer.MaxHeaderBlockSize = 1024
+
+	framer.WriteFrame(NewHeadersFrame(UNSET, 1, nil, make([]byte, 512), nil))
+	framer.WriteFrame(NewContinuationFrame(UNSET, 1, make([]byte, 512)))
+	framer.WriteFrame(NewContinuationFrame(END_HEADERS, 1, make([]byte, 512)))
+
+	_, err := framer.ReadFrame()
+	var connectionError *ConnectionError
+	if !errors.As(err, &connectionError) {
+		t.Fatalf("got %v want ConnectionError", err)
+	}
+	assert.Equal(t, connectionError.Code, ENHANCE_YOUR_CALM)
+}
+
+// without CheckContinuation, other frame in header block is still rejected
+func TestFramerAssembleHeadersUnchecked(t *testing.T) {
+	for _, next := range []Frame{
+		NewPingFrame(UNSET, 0, []byte("deadbeef")),
+		NewContinuationFrame(END_HEADERS, 3, []byte("block")),
+	} {
+		buf := bytes.NewBuffer(make([]byte, 0))
+		framer := NewFramer(buf, buf)
+		framer.CheckContinuation = false
+		framer.AssembleHeaders = true
+
+		framer.WriteFrame(NewHeadersFrame(UNSET, 1, nil, []byte("header"), nil))
+		framer.WriteFrame(next)
+
+		_, err := framer.ReadFrame()
+		var connectionError *ConnectionError
+		if !errors.As(err, &connectionError) {
+			t.Fatalf("got %v want ConnectionError", err)
+		}
+		assert.Equal(t, connectionError.Code, PROTOCOL_ERROR)
+	}
+}
+
+func TestFramerHeaderBlockTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	writer := NewFramer(client, client)
+	framer := NewFramer(server, server)
+	framer.AssembleHeaders = true
+	framer.HeaderBlockTimeout = 100 * time.Millisecond
+
+	// fast split is assembled, and deadline is cleared after that
+	go func() {
+		writer.WriteFrame(NewHeadersFrame(UNSET, 1, nil, []byte("header"), nil))
+		writer.WriteFrame(NewContinuationFrame(END_HEADERS, 1, []byte("block")))
+		time.Sleep(200 * time.Millisecond)
+		writer.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+	}()
+	frame, err := framer.ReadFrame()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(frame.(*HeadersFrame).HeaderBlockFragment), "headerblock")
+	frame, err = framer.ReadFrame()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frame.Header().Type, FrameType(PingFrameType))
+
+	// stalls without END_HEADERS
+	go writer.WriteFrame(NewHeadersFrame(UNSET, 3, nil, []byte("header"), nil))
+	_, err = framer.ReadFrame()
+	var connectionError *ConnectionError
+	if !errors.As(err, &connectionError) {
+		t.Fatalf("got %v want ConnectionError", err)
+	}
+	assert.Equal(t, connectionError.Code, PROTOCOL_ERROR)
+}
+
+func BenchmarkFramerReadDataFrame(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			frame := NewDataFrame(UNSET, 1, make([]byte, size), nil)
+			benchRead(b, frame, func(f Frame) {
+				f.(*DataFrame).Release()
+			})
+		})
+	}
+}
+
+func BenchmarkFramerWriteDataFrame(b *testing.B) {
+	// 100MB body in 16KB frames
+	body := make([]byte, 100*1024*1024)
+	size := int(DEFAULT_MAX_FRAME_SIZE)
+	framer := NewFramer(ioutil.Discard, nil)
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for data := body; len(data) > 0; data = data[size:] {
+			err := framer.WriteFrame(NewDataFrame(UNSET, 1, data[:size], nil))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestFramerWriteMode(t *testing.T) {
+	var cases = []struct {
+		mode   WriteMode
+		writes int
+	}{
+		{WriteDirect, 2},
+		{WriteBuffers, 2}, // no writev for non net.Conn
+		{WriteScratch, 1},
+	}
+
+	for _, c := range cases {
+		w := new(countWriter)
+		framer := NewFramer(w, nil)
+		framer.WriteMode = c.mode
+
+		frame := NewDataFrame(END_STREAM, 1, []byte("hello"), nil)
+		err := framer.WriteFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, w.writes, c.writes)
+		assert.Equal(t, w.Bytes(), toBytes(frame))
+	}
+}
+
+func BenchmarkFramerWriteMode(b *testing.B) {
+	var modes = []struct {
+		name string
+		mode WriteMode
+	}{
+		{"Direct", WriteDirect},
+		{"Buffers", WriteBuffers},
+		{"Scratch", WriteScratch},
+	}
+
+	// 10k small DATA frames to TCP connection
+	for _, m := range modes {
+		b.Run(m.name, func(b *testing.B) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Skip(err)
+			}
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				io.Copy(ioutil.Discard, conn)
+			}()
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			framer := NewFramer(conn, nil)
+			framer.WriteMode = m.mode
+			frame := NewDataFrame(UNSET, 1, []byte("hello world"), nil)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 10000; j++ {
+					framer.WriteFrame(frame)
+				}
+			}
+		})
+	}
+}
+
+func TestFramerConcurrentWrite(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	framer := NewFramer(buf, buf)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(id uint32) {
+			defer wg.Done()
+			framer.WriteFrame(NewDataFrame(UNSET, id, []byte("hello world"), nil))
+		}(uint32(i*2 + 1))
+	}
+	wg.Wait()
+
+	// every frame should be written without interleaving
+	for i := 0; i < 100; i++ {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, frame.(*DataFrame).Data, []byte("hello world"))
+	}
+}
+
+// Helper
+func toBytes(frame Frame) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	frame.Write(buf)
+	return buf.Bytes()
+}
+
+// counts Write calls
+type countWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+// reads b repeatedly
+type repeatReader struct {
+	b   []byte
+	off int
+}
+
+func (r *repeatReader) Read(p []byte) (n int, err error) {
+	n = copy(p, r.b[r.off:])
+	r.off = (r.off + n) % len(r.b)
+	return n, nil
+}
@@ -0,0 +1,90 @@
+package frame
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzReadFrame(f *testing.F) {
+	// valid frames of every type
+	seeds := []Frame{
+		NewDataFrame(END_STREAM, 1, []byte("hello"), nil),
+		NewDataFrame(PADDED, 1, []byte("hello"), []byte{0, 0, 0}),
+		NewHeadersFrame(END_HEADERS, 1, nil, []byte("header block"), nil),
+		NewHeadersFrame(END_HEADERS+PRIORITY+PADDED, 1, &DependencyTree{true, 3, 16}, []byte("header block"), []byte{0, 0}),
+		NewPriorityFrame(1, false, 3, 255),
+		NewRstStreamFrame(1, CANCEL),
+		NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_ENABLE_PUSH: 0, SETTINGS_MAX_FRAME_SIZE: 16384}),
+		NewSettingsFrame(ACK, 0, map[SettingsID]int32{}),
+		NewPushPromiseFrame(END_HEADERS, 1, 2, []byte("header block"), nil),
+		NewPushPromiseFrame(END_HEADERS+PADDED, 1, 2, []byte("header block"), []byte{0}),
+		NewPingFrame(ACK, 0, []byte("deadbeef")),
+		NewGoAwayFrame(0, 7, PROTOCOL_ERROR, []byte("debug")),
+		NewWindowUpdateFrame(1, 1000),
+		NewContinuationFrame(END_HEADERS, 1, []byte("header block")),
+		&UnknownFrame{NewFrameHeader(3, 0xff, UNSET, 1), []byte("abc")},
+	}
+	for _, frame := range seeds {
+		f.Add(toBytes(frame))
+	}
+
+	// tricky cases
+	f.Add(hexToBuffer("000003000800000001ff6869").Bytes())                   // DATA pad length > payload
+	f.Add(hexToBuffer("000000000800000001").Bytes())                         // DATA padded without pad length
+	f.Add(hexToBuffer("000003012800000001ff0000").Bytes())                   // HEADERS priority shorter than 5
+	f.Add(hexToBuffer("00000704000000000000020000000000").Bytes())           // SETTINGS not multiple of 6
+	f.Add(hexToBuffer("00000c040000000000000200000000000200000001").Bytes()) // SETTINGS duplicated id
+	f.Add(hexToBuffer("000006040100000000000200000000").Bytes())             // SETTINGS ACK with payload
+	f.Add(hexToBuffer("000004050c0000000100000002").Bytes())                 // PUSH_PROMISE too short
+	f.Add(hexToBuffer("000003080000000001000000").Bytes())                   // WINDOW_UPDATE too short
+	f.Add(hexToBuffer("ffffff000000000001").Bytes())                         // larger than max frame size
+	f.Add(hexToBuffer("0000000700000000000000000000000000").Bytes())         // GOAWAY too short
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, err := ReadFrame(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		fh := frame.Header()
+		if fh.Length > uint32(DEFAULT_MAX_FRAME_SIZE) {
+			t.Fatalf("%v: length %v is larger than max frame size", fh.Type, fh.Length)
+		}
+		if size := payloadSize(frame); size > int(fh.Length) {
+			t.Fatalf("%v: payload fields %v byte is larger than length %v", fh.Type, size, fh.Length)
+		}
+
+		// re-serialize and parse again
+		wire := toBytes(frame)
+		again, err := ReadFrame(bytes.NewReader(wire))
+		if err != nil {
+			t.Fatalf("%v: failed to read re-serialized frame %x: %v", fh.Type, wire, err)
+		}
+		if diff := Diff(again, frame); diff != "" {
+			t.Fatalf("%v: re-serialized frame differs\n%s", fh.Type, diff)
+		}
+	})
+}
+
+// sum of variable length fields
+func payloadSize(frame Frame) int {
+	switch frame := frame.(type) {
+	case *DataFrame:
+		return len(frame.Data) + len(frame.Padding)
+	case *HeadersFrame:
+		return len(frame.HeaderBlockFragment) + len(frame.Padding)
+	case *PushPromiseFrame:
+		return len(frame.HeaderBlockFragment) + len(frame.Padding)
+	case *PingFrame:
+		return len(frame.OpaqueData)
+	case *GoAwayFrame:
+		return len(frame.AdditionalDebugData)
+	case *ContinuationFrame:
+		return len(frame.HeaderBlockFragment)
+	case *UnknownFrame:
+		return len(frame.Payload)
+	case *SettingsFrame:
+		return 6 * len(frame.Settings)
+	}
+	return 0
+}
@@ -0,0 +1,97 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/hex"
+	assert "github.com/Jxck/assertion"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// golden frames in testdata/*.hex are written by Framer of
+// golang.org/x/net/http2 (see testdata/golden.go and header of each),
+// so they catch disagreement of the wire format with it.
+// parse them into expected frame, and write expected frame
+// into the identical bytes.
+func TestGolden(t *testing.T) {
+	hb := func(s string) []byte {
+		b, _ := hex.DecodeString(s)
+		return b
+	}
+	padding := func(n int) []byte {
+		return make([]byte, n)
+	}
+
+	var cases = []struct {
+		file     string
+		expected Frame
+	}{
+		{"data", NewDataFrame(END_STREAM, 1, []byte("hello world"), nil)},
+		{"data_padded", NewDataFrame(END_STREAM+PADDED, 1, []byte("ping"), padding(7))},
+		{"headers", NewHeadersFrame(END_HEADERS, 1, nil,
+			hb("885f87497ca58ae819aa5c0231316196c361be940b8a6a22541004e28105c135700d298b46ff"), nil)},
+		{"headers_padded", NewHeadersFrame(END_HEADERS+PADDED, 1, nil,
+			hb("838486418b089d5c0b8170dc0bc0781f53032a2f2a907a8aaa69d29ac4c0576dd5c10f0d0134"), padding(7))},
+		{"headers_priority", NewHeadersFrame(END_STREAM+END_HEADERS+PRIORITY, 13, &DependencyTree{false, 11, 16},
+			hb("82048560719ec4ff86418b089d5c0b8170dc0bc0781f53032a2f2a907a8aaa69d29ac4c0576dd5c1"), nil)},
+		{"headers_priority_padded", NewHeadersFrame(END_HEADERS+PADDED+PRIORITY, 13, &DependencyTree{false, 11, 16},
+			hb("838486418b089d5c0b8170dc0bc0781f53032a2f2a907a8aaa69d29ac4c0576dd5c10f0d0130"), padding(7))},
+		{"priority", NewPriorityFrame(3, false, 0, 200)},
+		{"priority_dependency", NewPriorityFrame(9, false, 7, 0)},
+		{"rst_stream", NewRstStreamFrame(1, INTERNAL_ERROR)},
+		{"settings", NewSettingsFrame(UNSET, 0, map[SettingsID]int32{
+			SETTINGS_MAX_CONCURRENT_STREAMS: 100,
+			SETTINGS_INITIAL_WINDOW_SIZE:    65535,
+		})},
+		{"settings_ack", NewSettingsFrame(ACK, 0, map[SettingsID]int32{})},
+		{"ping_ack", NewPingFrame(ACK, 0, []byte("h2golden"))},
+		{"goaway", NewGoAwayFrame(0, 0, NO_ERROR, nil)},
+		{"goaway_last_stream", NewGoAwayFrame(0, 1, NO_ERROR, nil)},
+		{"window_update", NewWindowUpdateFrame(0, 983041)},
+	}
+
+	for _, c := range cases {
+		golden := readGolden(t, c.file)
+
+		// parse
+		actual, err := ReadFrame(bytes.NewReader(golden))
+		if err != nil {
+			t.Errorf("%s: %v", c.file, err)
+			continue
+		}
+		if diff := Diff(actual, c.expected); diff != "" {
+			t.Errorf("%s: parsed frame differs\n%s", c.file, diff)
+		}
+		assert.Equal(t, actual.Header().Length, c.expected.Header().Length)
+
+		// serialize
+		wire := toBytes(c.expected)
+		if !bytes.Equal(wire, golden) {
+			t.Errorf("%s: serialized bytes differ\ngot  %x\nwant %x", c.file, wire, golden)
+		}
+	}
+}
+
+// reads hex in file, lines start with # are comment
+func readGolden(t *testing.T, name string) []byte {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name+".hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var str string
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		str += strings.TrimSpace(line)
+	}
+
+	golden, err := hex.DecodeString(str)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return golden
+}
@@ -0,0 +1,446 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// json.Marshaler and json.Unmarshaler for every frame type.
+//
+//	{"type":"HEADERS","stream_id":5,"flags":["END_HEADERS"],"length":123,"headers":{...}}
+//
+// binary fields are base64 encoded (as encoding/json does for []byte),
+// flags, error code and settings id are rendered as names.
+// length is ignored in unmarshal, and recomputed from payload.
+type jsonFrame struct {
+	Type     string   `json:"type"`
+	StreamID uint32   `json:"stream_id"`
+	Flags    []string `json:"flags"`
+	Length   uint32   `json:"length"`
+
+	// DATA
+	Data []byte `json:"data,omitempty"`
+	// HEADERS, PUSH_PROMISE, CONTINUATION
+	HeaderBlockFragment []byte      `json:"header_block_fragment,omitempty"`
+	Headers             http.Header `json:"headers,omitempty"`
+	// DATA, HEADERS, PUSH_PROMISE
+	Padding []byte `json:"padding,omitempty"`
+	// HEADERS, PRIORITY
+	Priority *jsonPriority `json:"priority,omitempty"`
+	// RST_STREAM, GOAWAY
+	ErrorCode string `json:"error_code,omitempty"`
+	// SETTINGS
+	Settings map[string]int32 `json:"settings,omitempty"`
+	// PUSH_PROMISE
+	PromisedStreamID uint32 `json:"promised_stream_id,omitempty"`
+	// PING
+	OpaqueData []byte `json:"opaque_data,omitempty"`
+	// GOAWAY
+	LastStreamID        uint32 `json:"last_stream_id,omitempty"`
+	AdditionalDebugData []byte `json:"additional_debug_data,omitempty"`
+	// WINDOW_UPDATE
+	WindowSizeIncrement uint32 `json:"window_size_increment,omitempty"`
+	// unknown type
+	Payload []byte `json:"payload,omitempty"`
+}
+
+type jsonPriority struct {
+	Exclusive        bool   `json:"exclusive"`
+	StreamDependency uint32 `json:"stream_dependency"`
+	Weight           uint8  `json:"weight"`
+}
+
+func marshalJSON(frame Frame) ([]byte, error) {
+	fh := frame.Header()
+	j := &jsonFrame{
+		Type:     fh.Type.String(),
+		StreamID: fh.StreamID,
+		Flags:    flagNames(fh.Type, fh.Flags),
+		Length:   fh.Length,
+	}
+
+	switch frame := frame.(type) {
+	case *DataFrame:
+		j.Data = frame.Data
+		j.Padding = frame.Padding
+	case *HeadersFrame:
+		if tree := frame.DependencyTree; tree != nil {
+			j.Priority = &jsonPriority{tree.Exclusive, tree.StreamDependency, tree.Weight}
+		}
+		j.HeaderBlockFragment = frame.HeaderBlockFragment
+		j.Headers = frame.Headers
+		j.Padding = frame.Padding
+	case *PriorityFrame:
+		j.Priority = &jsonPriority{frame.Exclusive, frame.StreamDependency, frame.Weight}
+	case *RstStreamFrame:
+		j.ErrorCode = frame.ErrorCode.String()
+	case *SettingsFrame:
+		j.Settings = make(map[string]int32, len(frame.Settings))
+		for id, value := range frame.Settings {
+			j.Settings[settingsName(id)] = value
+		}
+	case *PushPromiseFrame:
+		j.PromisedStreamID = frame.PromisedStreamID
+		j.HeaderBlockFragment = frame.HeaderBlockFragment
+		j.Padding = frame.Padding
+	case *PingFrame:
+		j.OpaqueData = frame.OpaqueData
+	case *GoAwayFrame:
+		j.LastStreamID = frame.LastStreamID
+		j.ErrorCode = frame.ErrorCode.String()
+		j.AdditionalDebugData = frame.AdditionalDebugData
+	case *WindowUpdateFrame:
+		j.WindowSizeIncrement = frame.WindowSizeIncrement
+	case *ContinuationFrame:
+		j.HeaderBlockFragment = frame.HeaderBlockFragment
+		j.Headers = frame.Headers
+	case *UnknownFrame:
+		j.Payload = frame.Payload
+	}
+
+	return json.Marshal(j)
+}
+
+// reconstructs frame from json via constructor of its type
+func unmarshalJSON(data []byte) (Frame, error) {
+	j := new(jsonFrame)
+	err := json.Unmarshal(data, j)
+	if err != nil {
+		return nil, err
+	}
+
+	types, err := parseFrameType(j.Type)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := parseFlags(types, j.Flags)
+	if err != nil {
+		return nil, err
+	}
+
+	var errorCode ErrorCode
+	if j.ErrorCode != "" {
+		errorCode, err = parseErrorCode(j.ErrorCode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var priority = new(jsonPriority)
+	if j.Priority != nil {
+		priority = j.Priority
+	}
+
+	switch types {
+	case DataFrameType:
+		return NewDataFrame(flags, j.StreamID, j.Data, j.Padding), nil
+	case HeadersFrameType:
+		var tree *DependencyTree
+		if j.Priority != nil {
+			tree = &DependencyTree{priority.Exclusive, priority.StreamDependency, priority.Weight}
+		}
+		frame := NewHeadersFrame(flags, j.StreamID, tree, j.HeaderBlockFragment, j.Padding)
+		frame.Headers = j.Headers
+		return frame, nil
+	case PriorityFrameType:
+		return NewPriorityFrame(j.StreamID, priority.Exclusive, priority.StreamDependency, priority.Weight), nil
+	case RstStreamFrameType:
+		return NewRstStreamFrame(j.StreamID, errorCode), nil
+	case SettingsFrameType:
+		settings := make(map[SettingsID]int32, len(j.Settings))
+		for name, value := range j.Settings {
+			id, err := parseSettingsID(name)
+			if err != nil {
+				return nil, err
+			}
+			settings[id] = value
+		}
+		return NewSettingsFrame(flags, j.StreamID, settings), nil
+	case PushPromiseFrameType:
+		return NewPushPromiseFrame(flags, j.StreamID, j.PromisedStreamID, j.HeaderBlockFragment, j.Padding), nil
+	case PingFrameType:
+		return NewPingFrame(flags, j.StreamID, j.OpaqueData), nil
+	case GoAwayFrameType:
+		return NewGoAwayFrame(j.StreamID, j.LastStreamID, errorCode, j.AdditionalDebugData), nil
+	case WindowUpdateFrameType:
+		return NewWindowUpdateFrame(j.StreamID, j.WindowSizeIncrement), nil
+	case ContinuationFrameType:
+		frame := NewContinuationFrame(flags, j.StreamID, j.HeaderBlockFragment)
+		frame.Headers = j.Headers
+		return frame, nil
+	}
+
+	fh := NewFrameHeader(uint32(len(j.Payload)), types, flags, j.StreamID)
+	return &UnknownFrame{fh, j.Payload}, nil
+}
+
+// unmarshal json and check the type of frame
+func unmarshalJSONAs(data []byte, types FrameType) (Frame, error) {
+	frame, err := unmarshalJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	if frame.Header().Type != types {
+		return nil, fmt.Errorf("frame type is %v but %v", frame.Header().Type, types)
+	}
+	return frame, nil
+}
+
+// name of flags depends on frame type
+// (0x1 is END_STREAM for DATA but ACK for PING).
+// unknown bits are rendered in hex.
+func flagNames(types FrameType, flags Flag) []string {
+	names := []string{}
+	for bit := Flag(1); bit != 0; bit <<= 1 {
+		if flags&bit == 0 {
+			continue
+		}
+		name, ok := flagName(types, bit)
+		if !ok {
+			name = fmt.Sprintf("%#x", uint8(bit))
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func flagName(types FrameType, bit Flag) (string, bool) {
+	switch {
+	case bit == END_STREAM && (types == DataFrameType || types == HeadersFrameType):
+		return "END_STREAM", true
+	case bit == ACK && (types == SettingsFrameType || types == PingFrameType):
+		return "ACK", true
+	case bit == END_HEADERS && (types == HeadersFrameType || types == PushPromiseFrameType || types == ContinuationFrameType):
+		return "END_HEADERS", true
+	case bit == PADDED && (types == DataFrameType || types == HeadersFrameType || types == PushPromiseFrameType):
+		return "PADDED", true
+	case bit == PRIORITY && types == HeadersFrameType:
+		return "PRIORITY", true
+	}
+	return "", false
+}
+
+func parseFlags(types FrameType, names []string) (flags Flag, err error) {
+	for _, name := range names {
+		bit, err := parseFlag(types, name)
+		if err != nil {
+			return 0, err
+		}
+		flags |= bit
+	}
+	return flags, nil
+}
+
+func parseFlag(types FrameType, name string) (Flag, error) {
+	for bit := Flag(1); bit != 0; bit <<= 1 {
+		if n, ok := flagName(types, bit); ok && n == name {
+			return bit, nil
+		}
+	}
+	bit, err := strconv.ParseUint(name, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid flag %q for %v", name, types)
+	}
+	return Flag(bit), nil
+}
+
+func parseFrameType(name string) (FrameType, error) {
+	for types := DataFrameType; types <= ContinuationFrameType; types++ {
+		if types.String() == name {
+			return types, nil
+		}
+	}
+	var types uint8
+	_, err := fmt.Sscanf(name, "UNKNOWN(%v)", &types)
+	if err != nil {
+		return 0, fmt.Errorf("invalid frame type %q", name)
+	}
+	return FrameType(types), nil
+}
+
+func parseErrorCode(name string) (ErrorCode, error) {
+	for code := NO_ERROR; code <= HTTP_1_1_REQUIRED; code++ {
+		if code.String() == name {
+			return code, nil
+		}
+	}
+	var code uint32
+	_, err := fmt.Sscanf(name, "UNKNOWN(%v)", &code)
+	if err != nil {
+		return 0, fmt.Errorf("invalid error code %q", name)
+	}
+	return ErrorCode(code), nil
+}
+
+// SETTINGS_ENABLE_PUSH(2) -> SETTINGS_ENABLE_PUSH
+// unknown id is rendered as number
+func settingsName(id SettingsID) string {
+	name := strings.SplitN(id.String(), "(", 2)[0]
+	if name == "" {
+		return strconv.Itoa(int(id))
+	}
+	return name
+}
+
+func parseSettingsID(name string) (SettingsID, error) {
+	for id := SETTINGS_HEADER_TABLE_SIZE; id <= SETTINGS_ENABLE_CONNECT_PROTOCOL; id++ {
+		if settingsName(id) == name {
+			return id, nil
+		}
+	}
+	id, err := strconv.ParseUint(name, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid settings id %q", name)
+	}
+	return SettingsID(id), nil
+}
+
+func (frame *DataFrame) MarshalJSON() ([]byte, error) {
+	return marshalJSON(frame)
+}
+
+func (frame *DataFrame) UnmarshalJSON(data []byte) error {
+	f, err := unmarshalJSONAs(data, DataFrameType)
+	if err != nil {
+		return err
+	}
+	*frame = *f.(*DataFrame)
+	return nil
+}
+
+func (frame *HeadersFrame) MarshalJSON() ([]byte, error) {
+	return marshalJSON(frame)
+}
+
+func (frame *HeadersFrame) UnmarshalJSON(data []byte) error {
+	f, err := unmarshalJSONAs(data, HeadersFrameType)
+	if err != nil {
+		return err
+	}
+	*frame = *f.(*HeadersFrame)
+	return nil
+}
+
+func (frame *PriorityFrame) MarshalJSON() ([]byte, error) {
+	return marshalJSON(frame)
+}
+
+func (frame *PriorityFrame) UnmarshalJSON(data []byte) error {
+	f, err := unmarshalJSONAs(data, PriorityFrameType)
+	if err != nil {
+		return err
+	}
+	*frame = *f.(*PriorityFrame)
+	return nil
+}
+
+func (frame *RstStreamFrame) MarshalJSON() ([]byte, error) {
+	return marshalJSON(frame)
+}
+
+func (frame *RstStreamFrame) UnmarshalJSON(data []byte) error {
+	f, err := unmarshalJSONAs(data, RstStreamFrameType)
+	if err != nil {
+		return err
+	}
+	*frame = *f.(*RstStreamFrame)
+	return nil
+}
+
+func (frame *SettingsFrame) MarshalJSON() ([]byte, error) {
+	return marshalJSON(frame)
+}
+
+func (frame *SettingsFrame) UnmarshalJSON(data []byte) error {
+	f, err := unmarshalJSONAs(data, SettingsFrameType)
+	if err != nil {
+		return err
+	}
+	*frame = *f.(*SettingsFrame)
+	return nil
+}
+
+func (frame *PushPromiseFrame) MarshalJSON() ([]byte, error) {
+	return marshalJSON(frame)
+}
+
+func (frame *PushPromiseFrame) UnmarshalJSON(data []byte) error {
+	f, err := unmarshalJSONAs(data, PushPromiseFrameType)
+	if err != nil {
+		return err
+	}
+	*frame = *f.(*PushPromiseFrame)
+	return nil
+}
+
+func (frame *PingFrame) MarshalJSON() ([]byte, error) {
+	return marshalJSON(frame)
+}
+
+func (frame *PingFrame) UnmarshalJSON(data []byte) error {
+	f, err := unmarshalJSONAs(data, PingFrameType)
+	if err != nil {
+		return err
+	}
+	*frame = *f.(*PingFrame)
+	return nil
+}
+
+func (frame *GoAwayFrame) MarshalJSON() ([]byte, error) {
+	return marshalJSON(frame)
+}
+
+func (frame *GoAwayFrame) UnmarshalJSON(data []byte) error {
+	f, err := unmarshalJSONAs(data, GoAwayFrameType)
+	if err != nil {
+		return err
+	}
+	*frame = *f.(*GoAwayFrame)
+	return nil
+}
+
+func (frame *WindowUpdateFrame) MarshalJSON() ([]byte, error) {
+	return marshalJSON(frame)
+}
+
+func (frame *WindowUpdateFrame) UnmarshalJSON(data []byte) error {
+	f, err := unmarshalJSONAs(data, WindowUpdateFrameType)
+	if err != nil {
+		return err
+	}
+	*frame = *f.(*WindowUpdateFrame)
+	return nil
+}
+
+func (frame *ContinuationFrame) MarshalJSON() ([]byte, error) {
+	return marshalJSON(frame)
+}
+
+func (frame *ContinuationFrame) UnmarshalJSON(data []byte) error {
+	f, err := unmarshalJSONAs(data, ContinuationFrameType)
+	if err != nil {
+		return err
+	}
+	*frame = *f.(*ContinuationFrame)
+	return nil
+}
+
+func (frame *UnknownFrame) MarshalJSON() ([]byte, error) {
+	return marshalJSON(frame)
+}
+
+// UnknownFrame accepts any type of frame, as raw payload
+func (frame *UnknownFrame) UnmarshalJSON(data []byte) error {
+	f, err := unmarshalJSON(data)
+	if err != nil {
+		return err
+	}
+	var payload = new(bytes.Buffer)
+	f.Write(payload)
+	*frame = UnknownFrame{f.Header(), payload.Bytes()[9:]}
+	return nil
+}
@@ -0,0 +1,76 @@
+package frame
+
+import (
+	"encoding/json"
+	assert "github.com/Jxck/assertion"
+	"net/http"
+	"testing"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	frame := NewHeadersFrame(END_HEADERS, 5, nil, []byte("hb"), nil)
+	frame.Headers = http.Header{":method": []string{"GET"}}
+
+	actual, err := json.Marshal(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"type":"HEADERS","stream_id":5,"flags":["END_HEADERS"],"length":2,` +
+		`"header_block_fragment":"aGI=","headers":{":method":["GET"]}}`
+	assert.Equal(t, string(actual), expected)
+
+	settings := NewSettingsFrame(ACK, 0, map[SettingsID]int32{})
+	actual, err = json.Marshal(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(actual), `{"type":"SETTINGS","stream_id":0,"flags":["ACK"],"length":0}`)
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	var cases = []struct {
+		frame  Frame
+		actual Frame
+	}{
+		{NewDataFrame(END_STREAM+PADDED, 1, []byte("hello"), []byte{0, 0}), new(DataFrame)},
+		{NewHeadersFrame(END_HEADERS+PRIORITY, 1, &DependencyTree{true, 3, 16}, []byte("hb"), nil), new(HeadersFrame)},
+		{NewPriorityFrame(1, false, 3, 255), new(PriorityFrame)},
+		{NewRstStreamFrame(1, CANCEL), new(RstStreamFrame)},
+		{NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_ENABLE_PUSH: 0, 0xff: 10}), new(SettingsFrame)},
+		{NewPushPromiseFrame(END_HEADERS, 1, 2, []byte("hb"), nil), new(PushPromiseFrame)},
+		{NewPingFrame(ACK, 0, []byte("deadbeef")), new(PingFrame)},
+		{NewGoAwayFrame(0, 7, ErrorCode(0xff), []byte("debug")), new(GoAwayFrame)},
+		{NewWindowUpdateFrame(1, 1000), new(WindowUpdateFrame)},
+		{NewContinuationFrame(END_HEADERS+0x80, 1, []byte("hb")), new(ContinuationFrame)},
+		{&UnknownFrame{NewFrameHeader(3, 0xff, 0x1, 1), []byte("abc")}, new(UnknownFrame)},
+	}
+
+	for _, c := range cases {
+		b, err := json.Marshal(c.frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.Unmarshal(b, c.actual)
+		if err != nil {
+			t.Fatalf("%s: %v", b, err)
+		}
+		if diff := Diff(c.actual, c.frame); diff != "" {
+			t.Errorf("%s\n%s", b, diff)
+		}
+		assert.Equal(t, c.actual.Header().Length, c.frame.Header().Length)
+	}
+}
+
+func TestUnmarshalJSONError(t *testing.T) {
+	var cases = []string{
+		`{"type":"PING","stream_id":0,"flags":[],"opaque_data":"ZGVhZGJlZWY="}`,        // type mismatch
+		`{"type":"WINDOW_UPDATE","stream_id":0,"flags":["END_STREAM"]}`,                // invalid flag
+		`{"type":"WINDOW_UPDATE","stream_id":0,"flags":[],"error_code":"NO_SUCH_ERR"}`, // invalid error code
+	}
+	for _, c := range cases {
+		err := json.Unmarshal([]byte(c), new(WindowUpdateFrame))
+		if err == nil {
+			t.Errorf("should fail to unmarshal %s", c)
+		}
+	}
+}
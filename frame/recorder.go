@@ -0,0 +1,187 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// direction of recorded frame
+type Direction uint8
+
+const (
+	Recv Direction = iota
+	Send
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Recv:
+		return "recv"
+	case Send:
+		return "send"
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", uint8(d))
+}
+
+// Recorder wraps reader/writer of connection, and records
+// every frame read/written through it into log.
+// use it as reader/writer of Framer.
+//
+// log is sequence of records below,
+// frame is raw bytes including frame header.
+//
+//	+---------------+
+//	|Direction (8)  |
+//	+---------------+-----------------------------------------------+
+//	|                      Timestamp (64) UnixNano                  |
+//	+---------------------------------------------------------------+
+//	|                           Length (32)                         |
+//	+---------------------------------------------------------------+
+//	|                           Frame (*)                         ...
+//	+---------------------------------------------------------------+
+type Recorder struct {
+	r   io.Reader
+	w   io.Writer
+	log io.Writer
+	mu  sync.Mutex // log is shared by both direction
+
+	// bytes of frame which is not completed yet
+	rbuf []byte
+	wbuf []byte
+
+	// first error of writing log, recording stops after that
+	err error
+}
+
+func NewRecorder(r io.Reader, w io.Writer, log io.Writer) *Recorder {
+	return &Recorder{
+		r:   r,
+		w:   w,
+		log: log,
+	}
+}
+
+func (rec *Recorder) Read(p []byte) (n int, err error) {
+	n, err = rec.r.Read(p)
+	rec.record(Recv, &rec.rbuf, p[:n])
+	return n, err
+}
+
+func (rec *Recorder) Write(p []byte) (n int, err error) {
+	n, err = rec.w.Write(p)
+	rec.record(Send, &rec.wbuf, p[:n])
+	return n, err
+}
+
+// read deadline of the reader, for Framer.HeaderBlockTimeout
+func (rec *Recorder) SetReadDeadline(t time.Time) error {
+	r, ok := rec.r.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return fmt.Errorf("reader doesn't support read deadline")
+	}
+	return r.SetReadDeadline(t)
+}
+
+// error of writing log if any
+func (rec *Recorder) Err() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.err
+}
+
+// frame may be read/written in several call,
+// so buffers bytes until whole frame arrives.
+func (rec *Recorder) record(dir Direction, buf *[]byte, p []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.err != nil {
+		return
+	}
+
+	*buf = append(*buf, p...)
+	for len(*buf) >= 9 {
+		// length 24bit
+		length := int((*buf)[0])<<16 | int((*buf)[1])<<8 | int((*buf)[2])
+		if len(*buf) < 9+length {
+			return
+		}
+
+		rec.err = writeRecord(rec.log, dir, time.Now(), (*buf)[:9+length])
+		if rec.err != nil {
+			return
+		}
+		*buf = append((*buf)[:0], (*buf)[9+length:]...)
+	}
+}
+
+func writeRecord(w io.Writer, dir Direction, t time.Time, frame []byte) error {
+	var b [13]byte
+	b[0] = byte(dir)
+	binary.BigEndian.PutUint64(b[1:9], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(b[9:13], uint32(len(frame)))
+
+	_, err := w.Write(b[:])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+// Replay reads log written by Recorder and calls fn
+// for each frame in recorded order.
+func Replay(r io.Reader, fn func(dir Direction, f Frame)) error {
+	var b [13]byte
+	for {
+		_, err := io.ReadFull(r, b[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		dir := Direction(b[0])
+		length := binary.BigEndian.Uint32(b[9:13])
+
+		// 24bit length + header
+		if length < 9 || length > 9+0xFFFFFF {
+			return fmt.Errorf("invalid record length %v", length)
+		}
+
+		raw := make([]byte, length)
+		_, err = io.ReadFull(r, raw)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		frame, err := replayFrame(raw)
+		if err != nil {
+			return err
+		}
+		fn(dir, frame)
+	}
+}
+
+// parses recorded frame
+// its size was accepted by connection, so no limit except 24bit.
+func replayFrame(raw []byte) (Frame, error) {
+	fh := new(FrameHeader)
+	fh.MaxFrameSize = 0xFFFFFF
+
+	r := bytes.NewReader(raw)
+	err := fh.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	fh.MaxFrameSize = 0
+	return readPayload(r, fh)
+}
@@ -0,0 +1,69 @@
+package frame
+
+import (
+	"bytes"
+	assert "github.com/Jxck/assertion"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRecorderReplay(t *testing.T) {
+	wire := bytes.NewBuffer(make([]byte, 0))
+	log := bytes.NewBuffer(make([]byte, 0))
+
+	rec := NewRecorder(wire, wire, log)
+	framer := NewFramer(rec, rec)
+
+	sent := []Frame{
+		NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_ENABLE_PUSH: 0}),
+		NewHeadersFrame(END_HEADERS, 1, nil, []byte("header block"), nil),
+		NewDataFrame(END_STREAM+PADDED, 1, []byte("hello world"), []byte{0, 0, 0}),
+	}
+	for _, frame := range sent {
+		err := framer.WriteFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range sent {
+		_, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rec.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// all frames are sent, then received
+	var i int
+	err := Replay(log, func(dir Direction, frame Frame) {
+		expected := sent[i%len(sent)]
+		if i < len(sent) {
+			assert.Equal(t, dir, Send)
+		} else {
+			assert.Equal(t, dir, Recv)
+		}
+		if diff := Diff(frame, expected); diff != "" {
+			t.Errorf("%v %v\n%s", dir, expected.Header().Type, diff)
+		}
+		i++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, i, len(sent)*2)
+}
+
+func TestReplayTruncated(t *testing.T) {
+	log := bytes.NewBuffer(make([]byte, 0))
+	raw := toBytes(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+	writeRecord(log, Send, time.Now(), raw)
+
+	b := log.Bytes()
+	err := Replay(bytes.NewReader(b[:len(b)-1]), func(dir Direction, frame Frame) {
+		t.Error("should not replay truncated frame")
+	})
+	assert.Equal(t, err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,128 @@
+// generates golden frames in testdata/*.hex with Framer of
+// golang.org/x/net/http2, so they are written by other implementation
+// than this package. run it in frame/testdata of a module which
+// requires golang.org/x/net, and record its version in generator.
+//
+//	go run golden.go v0.57.0
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/net/http2"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+type golden struct {
+	file    string
+	section string
+	write   func(fr *http2.Framer) error
+}
+
+func hb(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return b
+}
+
+// header block fragments are opaque for Framer, given as is
+var goldens = []golden{
+	{"data", "6.1", func(fr *http2.Framer) error {
+		return fr.WriteData(1, true, []byte("hello world"))
+	}},
+	{"data_padded", "6.1", func(fr *http2.Framer) error {
+		return fr.WriteDataPadded(1, true, []byte("ping"), make([]byte, 7))
+	}},
+	{"headers", "6.2", func(fr *http2.Framer) error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: hb("885f87497ca58ae819aa5c0231316196c361be940b8a6a22541004e28105c135700d298b46ff"),
+			EndHeaders:    true,
+		})
+	}},
+	{"headers_padded", "6.2", func(fr *http2.Framer) error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: hb("838486418b089d5c0b8170dc0bc0781f53032a2f2a907a8aaa69d29ac4c0576dd5c10f0d0134"),
+			EndHeaders:    true,
+			PadLength:     7,
+		})
+	}},
+	// weight of PriorityParam is weight-1 on the wire
+	{"headers_priority", "6.2", func(fr *http2.Framer) error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      13,
+			BlockFragment: hb("82048560719ec4ff86418b089d5c0b8170dc0bc0781f53032a2f2a907a8aaa69d29ac4c0576dd5c1"),
+			EndStream:     true,
+			EndHeaders:    true,
+			Priority:      http2.PriorityParam{StreamDep: 11, Weight: 15},
+		})
+	}},
+	{"headers_priority_padded", "6.2", func(fr *http2.Framer) error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      13,
+			BlockFragment: hb("838486418b089d5c0b8170dc0bc0781f53032a2f2a907a8aaa69d29ac4c0576dd5c10f0d0130"),
+			EndHeaders:    true,
+			PadLength:     7,
+			Priority:      http2.PriorityParam{StreamDep: 11, Weight: 15},
+		})
+	}},
+	{"priority", "6.3", func(fr *http2.Framer) error {
+		return fr.WritePriority(3, http2.PriorityParam{Weight: 200})
+	}},
+	{"priority_dependency", "6.3", func(fr *http2.Framer) error {
+		return fr.WritePriority(9, http2.PriorityParam{StreamDep: 7})
+	}},
+	{"rst_stream", "6.4", func(fr *http2.Framer) error {
+		return fr.WriteRSTStream(1, http2.ErrCodeInternal)
+	}},
+	{"settings", "6.5", func(fr *http2.Framer) error {
+		return fr.WriteSettings(
+			http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 100},
+			http2.Setting{ID: http2.SettingInitialWindowSize, Val: 65535},
+		)
+	}},
+	{"settings_ack", "6.5", func(fr *http2.Framer) error {
+		return fr.WriteSettingsAck()
+	}},
+	{"ping_ack", "6.7", func(fr *http2.Framer) error {
+		var data [8]byte
+		copy(data[:], "h2golden")
+		return fr.WritePing(true, data)
+	}},
+	{"goaway", "6.8", func(fr *http2.Framer) error {
+		return fr.WriteGoAway(0, http2.ErrCodeNo, nil)
+	}},
+	{"goaway_last_stream", "6.8", func(fr *http2.Framer) error {
+		return fr.WriteGoAway(1, http2.ErrCodeNo, nil)
+	}},
+	{"window_update", "6.9", func(fr *http2.Framer) error {
+		return fr.WriteWindowUpdate(0, 983041)
+	}},
+}
+
+func main() {
+	if len(os.Args) < 2 || !strings.HasPrefix(os.Args[1], "v") {
+		log.Fatal("usage: go run golden.go <version of golang.org/x/net>")
+	}
+	version := os.Args[1]
+
+	for _, g := range goldens {
+		var buf bytes.Buffer
+		err := g.write(http2.NewFramer(&buf, nil))
+		if err != nil {
+			log.Fatalf("%s: %v", g.file, err)
+		}
+		content := fmt.Sprintf("# generated by golang.org/x/net/http2.Framer %s (testdata/golden.go)\n# RFC 7540 %s\n%x\n", version, g.section, buf.Bytes())
+		err = ioutil.WriteFile(g.file+".hex", []byte(content), 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
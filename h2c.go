@@ -0,0 +1,195 @@
+package http2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	. "github.com/Jxck/http2/frame"
+	. "github.com/Jxck/logger"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// h2c is HTTP/2 over cleartext TCP with prior knowledge (RFC 7540 3.4).
+// Server.ServeConn serves it on plaintext conn as it is, and H2CHandler
+// takes it over from http.Server, which reads the first line of
+// connection preface as "PRI * HTTP/2.0" request.
+//
+// HTTP/1.1 request with "Upgrade: h2c" is answered by 101 and
+// served as stream 1 of the connection (RFC 7540 3.2).
+// other requests go to h, s is DefaultServer if nil.
+func H2CHandler(h http.Handler, s *Server) http.Handler {
+	if s == nil {
+		s = DefaultServer
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil && headerHasToken(r.Header, "Upgrade", "h2c") {
+			upgradeH2C(w, r, h, s)
+			return
+		}
+		if r.Method != "PRI" || r.RequestURI != "*" || r.ProtoMajor != 2 || r.ProtoMinor != 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "h2c is not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			Error("%v", err)
+			return
+		}
+
+		// rest of connection preface follows the request headers
+		rest := CONNECTION_PREFACE[strings.Index(CONNECTION_PREFACE, "SM"):]
+		buf := make([]byte, len(rest))
+		if _, err := io.ReadFull(rw, buf); err != nil || string(buf) != rest {
+			Error("invalid h2c connection preface %q", buf)
+			conn.Close()
+			return
+		}
+		s.ServeConn(&h2cConn{conn, io.MultiReader(strings.NewReader(CONNECTION_PREFACE), rw)}, &ServeConnOpts{
+			Handler: h,
+			Context: r.Context(),
+		})
+	})
+}
+
+// net.Conn which reads connection preface consumed by http.Server
+// again, and data buffered by it before the connection
+type h2cConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *h2cConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// HTTP/1.1 request upgraded to h2c
+type h2cUpgrade struct {
+	settings map[SettingsID]int32
+	header   http.Header
+	body     []byte
+}
+
+// HTTP2-Settings is the payload of SETTINGS frame in base64url,
+// exactly one of it is required to upgrade (RFC 7540 3.2.1).
+// the request is served by HTTP/1.1 without it, or body too large
+// to buffer. invalid settings is 400.
+func upgradeH2C(w http.ResponseWriter, r *http.Request, h http.Handler, s *Server) {
+	values := r.Header["Http2-Settings"]
+	if len(values) != 1 || !headerHasToken(r.Header, "Connection", "HTTP2-Settings") {
+		h.ServeHTTP(w, r)
+		return
+	}
+	settings, err := decodeSettings(values[0])
+	if err != nil {
+		Error("invalid HTTP2-Settings %q: %v", values[0], err)
+		http.Error(w, "invalid HTTP2-Settings", http.StatusBadRequest)
+		return
+	}
+
+	// whole body is received before switching protocols
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxUpgradeBodySize+1))
+	if err != nil {
+		Error("%v", err)
+		return
+	}
+	if int64(len(body)) > MaxUpgradeBodySize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		h.ServeHTTP(w, r)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		Error("%v", err)
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		Error("%v", err)
+		conn.Close()
+		return
+	}
+
+	// client sends connection preface after 101, it may be buffered already
+	s.ServeConn(&h2cConn{conn, rw}, &ServeConnOpts{
+		Handler: h,
+		Context: r.Context(),
+		upgrade: &h2cUpgrade{
+			settings: settings,
+			header:   upgradeHeader(r),
+			body:     body,
+		},
+	})
+}
+
+func decodeSettings(value string) (map[SettingsID]int32, error) {
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload)%6 != 0 {
+		return nil, fmt.Errorf("SETTINGS payload length %v is not multiple of 6", len(payload))
+	}
+	frame := NewSettingsFrame(UNSET, 0, NilSettings)
+	frame.Length = uint32(len(payload))
+	err = frame.Read(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	return frame.Settings, nil
+}
+
+// header of stream 1 from HTTP/1.1 request, without
+// connection-specific fields (RFC 7540 8.1.2.2)
+func upgradeHeader(r *http.Request) http.Header {
+	header := make(http.Header)
+	for name, values := range r.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range []string{"Connection", "Upgrade", "Http2-Settings", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Host"} {
+		header.Del(name)
+	}
+	if header.Get("Te") != "trailers" {
+		header.Del("Te")
+	}
+	header[":method"] = []string{r.Method}
+	header[":scheme"] = []string{"http"}
+	header[":authority"] = []string{r.Host}
+	header[":path"] = []string{r.URL.RequestURI()}
+	return header
+}
+
+// comma separated token in header, case insensitive
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	assert "github.com/Jxck/assertion"
+	. "github.com/Jxck/http2/frame"
+	"github.com/Jxck/http2/hpack"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestH2CHandler(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%v %v %v", r.Proto, r.URL.Scheme, r.URL.Path)
+	})
+	hs := &http.Server{Handler: H2CHandler(handler, &Server{})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.Serve(ln)
+	defer hs.Close()
+
+	// client with prior knowledge sends connection preface first
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := NewClientConn(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.WriteLoop()
+	go conn.ReadLoop()
+
+	header := http.Header{
+		":method":    {"GET"},
+		":scheme":    {"http"},
+		":authority": {ln.Addr().String()},
+		":path":      {"/h2c"},
+	}
+	response := make(chan string, 1)
+	_, err = conn.OpenStream(header, true, func(stream *Stream) {
+		body, _ := ioutil.ReadAll(stream.Bucket.Body)
+		response <- stream.Bucket.Headers.Get(":status") + " " + string(body)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-response:
+		assert.Equal(t, got, "200 HTTP/2.0 http /h2c")
+	case <-time.After(3 * time.Second):
+		t.Fatal("response timeout")
+	}
+
+	// HTTP/1.1 goes to handler as usual
+	res, err := http.Get("http://" + ln.Addr().String() + "/h1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, string(body), "HTTP/1.1  /h1")
+}
+
+// sends HTTP/1.1 request with "Upgrade: h2c", and connection preface
+// right after it without waiting 101
+func dialUpgrade(t *testing.T, addr, method, body string, settings string) (*http.Response, *Framer) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	request := fmt.Sprintf("%v /up HTTP/1.1\r\nHost: %v\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: %v\r\nContent-Length: %v\r\n\r\n%v", method, addr, settings, len(body), body)
+	c.Write([]byte(request + CONNECTION_PREFACE))
+
+	r := bufio.NewReader(c)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, NewFramer(c, r)
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%v %v %v %v %s", r.Proto, r.Method, r.URL.Scheme, r.URL.Path, body)
+	})
+	hs := &http.Server{Handler: H2CHandler(handler, &Server{})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.Serve(ln)
+	defer hs.Close()
+
+	// SETTINGS_INITIAL_WINDOW_SIZE: 16
+	settings := base64.RawURLEncoding.EncodeToString([]byte{0, 4, 0, 0, 0, 16})
+	cases := []struct {
+		method, body string
+	}{
+		{"GET", ""},
+		{"POST", "request body"},
+	}
+	for _, c := range cases {
+		res, framer := dialUpgrade(t, ln.Addr().String(), c.method, c.body, settings)
+		assert.Equal(t, res.StatusCode, http.StatusSwitchingProtocols)
+		assert.Equal(t, res.Header.Get("Upgrade"), "h2c")
+		frames := readFrames(framer)
+		framer.WriteFrame(NewSettingsFrame(UNSET, 0, NilSettings))
+
+		// response on stream 1, within the window of HTTP2-Settings
+		ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+		headers := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+		assert.Equal(t, headers.StreamID, uint32(1))
+		assert.Equal(t, headers.Decode(ctx), nil)
+		assert.Equal(t, headers.Headers.Get(":status"), "200")
+
+		want := fmt.Sprintf("HTTP/2.0 %v http /up %v", c.method, c.body)
+		var body []byte
+		for len(body) < len(want) {
+			data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+			if len(data.Data) > 16 {
+				t.Fatalf("DATA %v exceeds window 16", len(data.Data))
+			}
+			body = append(body, data.Data...)
+			framer.WriteFrame(NewWindowUpdateFrame(1, uint32(len(data.Data))))
+		}
+		assert.Equal(t, string(body), want)
+	}
+
+	// invalid HTTP2-Settings, SETTINGS_ENABLE_PUSH: 2
+	invalid := base64.RawURLEncoding.EncodeToString([]byte{0, 2, 0, 0, 0, 2})
+	for _, settings := range []string{invalid, "!!"} {
+		res, _ := dialUpgrade(t, ln.Addr().String(), "GET", "", settings)
+		assert.Equal(t, res.StatusCode, http.StatusBadRequest)
+	}
+}
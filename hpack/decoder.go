@@ -0,0 +1,238 @@
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrTruncated       = errors.New("hpack: truncated header block")
+	ErrIntegerOverflow = errors.New("hpack: integer overflow")
+)
+
+// DecodingError is a decoding failure, which is a
+// COMPRESSION_ERROR of the connection (RFC 7540 4.3)
+type DecodingError struct {
+	Err error
+}
+
+func (e DecodingError) Error() string {
+	return fmt.Sprintf("decoding error: %v", e.Err)
+}
+
+// Decoder decodes header block into header list,
+// with a dynamic table of its own.
+type Decoder struct {
+	table dynamicTable
+
+	// upper limit of the size which encoder can update to,
+	// SETTINGS_HEADER_TABLE_SIZE of ours.
+	maxSizeLimit uint32
+
+	// limit is lowered below the size of table, so next
+	// header block should start with size update (RFC 7541 4.2)
+	updateRequired bool
+
+	// reused for Huffman decoding, only the string is allocated
+	buf []byte
+}
+
+// size is initial max size of dynamic table, and limit of it.
+// on a connection it is 4096 until peer acknowledges our
+// SETTINGS_HEADER_TABLE_SIZE, see SetMaxTableSizeLimit.
+func NewDecoder(size uint32) *Decoder {
+	return &Decoder{
+		table:        dynamicTable{maxSize: size},
+		maxSizeLimit: size,
+	}
+}
+
+// changes the limit of size update, when peer acknowledges
+// our SETTINGS_HEADER_TABLE_SIZE. table is kept until encoder
+// updates it, which is required if the limit is smaller than table.
+func (d *Decoder) SetMaxTableSizeLimit(limit uint32) {
+	d.maxSizeLimit = limit
+	if limit < d.table.maxSize {
+		d.updateRequired = true
+	}
+}
+
+// size of dynamic table, which is sum of entry size
+func (d *Decoder) TableSize() uint32 {
+	return d.table.size
+}
+
+// number of entries in dynamic table
+func (d *Decoder) TableLen() int {
+	return d.table.len()
+}
+
+// decodes a complete header block
+func (d *Decoder) Decode(wire []byte) (HeaderList, error) {
+	if d.updateRequired && (len(wire) == 0 || wire[0]&0xe0 != 0x20) {
+		return nil, DecodingError{fmt.Errorf("dynamic table size update to %v is not sent", d.maxSizeLimit)}
+	}
+	headerList := HeaderList{}
+	for len(wire) > 0 {
+		var hf *HeaderField
+		var err error
+
+		b := wire[0]
+		switch {
+		case b&0x80 == 0x80:
+			// Indexed Header Field (RFC 7541 6.1)
+			hf, wire, err = d.readIndexed(wire)
+		case b&0xc0 == 0x40:
+			// Literal Header Field with Incremental Indexing (RFC 7541 6.2.1)
+			hf, wire, err = d.readLiteral(wire, 6)
+			if err == nil {
+				d.table.add(hf)
+			}
+		case b&0xe0 == 0x20:
+			// Dynamic Table Size Update (RFC 7541 6.3)
+			// which is only allowed at the head of block (RFC 7541 4.2)
+			if len(headerList) > 0 {
+				return nil, DecodingError{errors.New("dynamic table size update after header field")}
+			}
+			wire, err = d.readSizeUpdate(wire)
+		case b&0xf0 == 0x10:
+			// Literal Header Field Never Indexed (RFC 7541 6.2.3)
+			// which is kept on re-encoding
+			hf, wire, err = d.readLiteral(wire, 4)
+			if err == nil {
+				hf.Sensitive = true
+			}
+		default:
+			// Literal Header Field without Indexing (RFC 7541 6.2.2)
+			hf, wire, err = d.readLiteral(wire, 4)
+		}
+		if err != nil {
+			return nil, DecodingError{err}
+		}
+		if hf != nil {
+			headerList.Emit(hf)
+		}
+	}
+	return headerList, nil
+}
+
+func (d *Decoder) readIndexed(wire []byte) (*HeaderField, []byte, error) {
+	index, wire, err := readInt(wire, 7)
+	if err != nil {
+		return nil, nil, err
+	}
+	hf, err := d.at(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewHeaderField(hf.Name, hf.Value), wire, nil
+}
+
+func (d *Decoder) readLiteral(wire []byte, n uint8) (*HeaderField, []byte, error) {
+	index, wire, err := readInt(wire, n)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var name string
+	if index > 0 {
+		hf, err := d.at(index)
+		if err != nil {
+			return nil, nil, err
+		}
+		name = hf.Name
+	} else {
+		name, wire, err = d.readString(wire)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	value, wire, err := d.readString(wire)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewHeaderField(name, value), wire, nil
+}
+
+func (d *Decoder) readSizeUpdate(wire []byte) ([]byte, error) {
+	size, wire, err := readInt(wire, 5)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(d.maxSizeLimit) {
+		return nil, fmt.Errorf("dynamic table size update(%v) is larger than limit(%v)", size, d.maxSizeLimit)
+	}
+	d.table.setMaxSize(uint32(size))
+	d.updateRequired = false
+	return wire, nil
+}
+
+// entry of index in static table and dynamic table (RFC 7541 2.3.3)
+func (d *Decoder) at(index uint64) (*HeaderField, error) {
+	if index == 0 || index > uint64(len(staticTable)+d.table.len()) {
+		return nil, fmt.Errorf("invalid index(%v)", index)
+	}
+	if index <= uint64(len(staticTable)) {
+		return &staticTable[index-1], nil
+	}
+	return d.table.get(int(index) - len(staticTable)), nil
+}
+
+// Integer Representation (RFC 7541 5.1)
+// larger than 32 bit is overflow.
+func readInt(wire []byte, n uint8) (uint64, []byte, error) {
+	if len(wire) == 0 {
+		return 0, nil, ErrTruncated
+	}
+	max := uint64(1)<<n - 1
+	i := uint64(wire[0]) & max
+	wire = wire[1:]
+	if i < max {
+		return i, wire, nil
+	}
+
+	var m uint
+	for len(wire) > 0 {
+		b := wire[0]
+		wire = wire[1:]
+		i += uint64(b&0x7f) << m
+		if i > 1<<32-1 {
+			return 0, nil, ErrIntegerOverflow
+		}
+		if b&0x80 == 0 {
+			return i, wire, nil
+		}
+		m += 7
+		if m > 28 {
+			return 0, nil, ErrIntegerOverflow
+		}
+	}
+	return 0, nil, ErrTruncated
+}
+
+// String Literal (RFC 7541 5.2)
+func (d *Decoder) readString(wire []byte) (string, []byte, error) {
+	if len(wire) == 0 {
+		return "", nil, ErrTruncated
+	}
+	huffman := wire[0]&0x80 == 0x80
+	length, wire, err := readInt(wire, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(wire)) < length {
+		return "", nil, ErrTruncated
+	}
+
+	s, wire := wire[:length], wire[length:]
+	if !huffman {
+		return string(s), wire, nil
+	}
+	buf, err := HuffmanDecode(d.buf[:0], s)
+	if err != nil {
+		return "", nil, err
+	}
+	d.buf = buf
+	return string(buf), wire, nil
+}
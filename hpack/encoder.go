@@ -0,0 +1,171 @@
+package hpack
+
+import (
+	"strings"
+	"sync"
+)
+
+// Encoder encodes header list into header block,
+// with a dynamic table of its own.
+type Encoder struct {
+	// string literals are Huffman encoded when it is shorter
+	Huffman bool
+
+	// names of fields sent as Literal Header Field Never Indexed
+	Sensitive map[string]bool
+
+	// table size is changed by SETTINGS in read loop,
+	// while write loop is encoding.
+	mu    sync.Mutex
+	table dynamicTable
+
+	// Dynamic Table Size Update to be sent at the head of next block
+	// minSize is the smallest size since last block (RFC 7541 4.2)
+	updating bool
+	minSize  uint32
+}
+
+// size is initial max size of dynamic table,
+// which is SETTINGS_HEADER_TABLE_SIZE of the peer.
+func NewEncoder(size uint32) *Encoder {
+	return &Encoder{
+		Huffman: true,
+		Sensitive: map[string]bool{
+			"authorization":       true,
+			"proxy-authorization": true,
+		},
+		table: dynamicTable{maxSize: size},
+	}
+}
+
+// marks field of the name as sensitive
+func (e *Encoder) SetSensitive(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Sensitive[strings.ToLower(name)] = true
+}
+
+// short cookie is easy to guess by brute force (RFC 7541 7.1.3),
+// set-cookie is never referred from later requests.
+func (e *Encoder) neverIndexed(hf *HeaderField) bool {
+	switch {
+	case hf.Sensitive, e.Sensitive[hf.Name]:
+		return true
+	case hf.Name == "cookie":
+		return len(hf.Value) < 20
+	case hf.Name == "set-cookie":
+		return true
+	}
+	return false
+}
+
+// size of dynamic table, which is sum of entry size
+func (e *Encoder) TableSize() uint32 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.table.size
+}
+
+// number of entries in dynamic table
+func (e *Encoder) TableLen() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.table.len()
+}
+
+// changes max size of dynamic table,
+// which is notified to the decoder at the head of next block.
+func (e *Encoder) SetMaxTableSize(size uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.updating || size < e.minSize {
+		e.minSize = size
+	}
+	e.updating = true
+	e.table.setMaxSize(size)
+}
+
+// appends header block of headerList to dst
+func (e *Encoder) Encode(dst []byte, headerList HeaderList) []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.updating {
+		// golang.org/x/net rejects the second update unless the first
+		// one emptied the table, so smaller size is signaled as 0.
+		if e.minSize < e.table.maxSize {
+			maxSize := e.table.maxSize
+			e.table.setMaxSize(0)
+			e.table.maxSize = maxSize
+			dst = appendInt(dst, 0x20, 5, 0)
+		}
+		dst = appendInt(dst, 0x20, 5, uint64(e.table.maxSize))
+		e.updating = false
+	}
+	for _, hf := range headerList {
+		dst = e.encodeField(dst, hf)
+	}
+	return dst
+}
+
+func (e *Encoder) encodeField(dst []byte, hf *HeaderField) []byte {
+	index, nameOnly := e.table.search(hf)
+	neverIndexed := e.neverIndexed(hf)
+
+	// Indexed Header Field (RFC 7541 6.1)
+	// static table is public, so is used for sensitive field too.
+	// otherwise index is used for the name
+	if index > 0 && !nameOnly && (!neverIndexed || index <= len(staticTable)) {
+		return appendInt(dst, 0x80, 7, uint64(index))
+	}
+
+	// Literal Header Field Never Indexed (RFC 7541 6.2.3)
+	// Literal Header Field with Incremental Indexing (RFC 7541 6.2.1)
+	// Literal Header Field without Indexing (RFC 7541 6.2.2)
+	// if it can't be in the table
+	var prefix byte
+	var n uint8
+	if neverIndexed {
+		prefix, n = 0x10, 4
+	} else if hf.Size() <= e.table.maxSize {
+		prefix, n = 0x40, 6
+		e.table.add(NewHeaderField(hf.Name, hf.Value))
+	} else {
+		prefix, n = 0x00, 4
+	}
+
+	if index > 0 {
+		dst = appendInt(dst, prefix, n, uint64(index))
+	} else {
+		dst = append(dst, prefix)
+		dst = e.appendString(dst, hf.Name)
+	}
+	return e.appendString(dst, hf.Value)
+}
+
+// String Literal (RFC 7541 5.2)
+func (e *Encoder) appendString(dst []byte, s string) []byte {
+	if e.Huffman {
+		if length := HuffmanEncodeLength(s); length < len(s) {
+			dst = appendInt(dst, 0x80, 7, uint64(length))
+			return HuffmanEncode(dst, s)
+		}
+	}
+	dst = appendInt(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// Integer Representation (RFC 7541 5.1)
+// prefix is the bits before n bit prefix of the integer.
+func appendInt(dst []byte, prefix byte, n uint8, i uint64) []byte {
+	max := uint64(1)<<n - 1
+	if i < max {
+		return append(dst, prefix|byte(i))
+	}
+	dst = append(dst, prefix|byte(max))
+	i -= max
+	for i >= 128 {
+		dst = append(dst, byte(i&0x7f|0x80))
+		i >>= 7
+	}
+	return append(dst, byte(i))
+}
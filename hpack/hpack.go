@@ -0,0 +1,87 @@
+// Package hpack implements HPACK, header compression for HTTP/2 (RFC 7541).
+package hpack
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Header Field
+// Sensitive field is never indexed by encoders, including
+// intermediaries re-encoding it (RFC 7541 7.1.3).
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+func NewHeaderField(name, value string) *HeaderField {
+	return &HeaderField{Name: name, Value: value}
+}
+
+// size of entry in table is name + value + 32 (RFC 7541 4.1)
+func (h *HeaderField) Size() uint32 {
+	return uint32(len(h.Name) + len(h.Value) + 32)
+}
+
+func (h *HeaderField) String() string {
+	return fmt.Sprintf("%s: %s", h.Name, h.Value)
+}
+
+// Header List
+type HeaderList []*HeaderField
+
+func (hl *HeaderList) Emit(hf *HeaderField) {
+	*hl = append(*hl, hf)
+}
+
+func (hl HeaderList) ToHeader() http.Header {
+	header := make(http.Header)
+	for _, hf := range hl {
+		header.Add(hf.Name, hf.Value)
+	}
+	return header
+}
+
+// names are lower cased (RFC 7540 8.1.2)
+func ToHeaderList(header http.Header) *HeaderList {
+	hl := HeaderList{}
+	for name, values := range header {
+		for _, value := range values {
+			hl.Emit(NewHeaderField(strings.ToLower(name), value))
+		}
+	}
+	return &hl
+}
+
+// Context holds a pair of Encoder and Decoder for one direction
+// of a connection, and Emitted Set of last decoded header block.
+type Context struct {
+	Encoder *Encoder
+	Decoder *Decoder
+	ES      *HeaderList
+}
+
+// size is SETTINGS_HEADER_TABLE_SIZE for both of table
+func NewContext(size uint32) *Context {
+	return &Context{
+		Encoder: NewEncoder(size),
+		Decoder: NewDecoder(size),
+		ES:      &HeaderList{},
+	}
+}
+
+func (c *Context) Encode(headerList HeaderList) []byte {
+	return c.Encoder.Encode(nil, headerList)
+}
+
+// decodes header block into ES
+// panics on invalid header block
+func (c *Context) Decode(wire []byte) {
+	headerList, err := c.Decoder.Decode(wire)
+	if err != nil {
+		panic(err)
+	}
+	c.ES = &headerList
+}
@@ -0,0 +1,155 @@
+package hpack
+
+import (
+	"errors"
+)
+
+var (
+	ErrHuffmanEOS     = errors.New("hpack: EOS in huffman-encoded string")
+	ErrHuffmanPadding = errors.New("hpack: invalid padding of huffman-encoded string")
+)
+
+// length of s after Huffman encoding, in octets
+func HuffmanEncodeLength(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		n += int(huffmanCodeLen[s[i]])
+	}
+	return (n + 7) / 8
+}
+
+// appends Huffman encoded s to dst (RFC 7541 5.2)
+// last octet is padded with most significant bits of EOS.
+func HuffmanEncode(dst []byte, s string) []byte {
+	var bits uint64 // pending bits, aligned to lsb
+	var n uint      // number of pending bits
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		bits = bits<<huffmanCodeLen[c] | uint64(huffmanCodes[c])
+		n += uint(huffmanCodeLen[c])
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(bits>>n))
+		}
+	}
+	if n > 0 {
+		dst = append(dst, byte(bits<<(8-n)|0xff>>n))
+	}
+	return dst
+}
+
+// Huffman decoding is a state machine which reads 4 bits at a time.
+// a state is an internal node of the Huffman tree, 0 is the root.
+// since the shortest code is 5 bits, at most one symbol is emitted
+// per 4 bits.
+type huffmanTransition struct {
+	next  uint8
+	sym   byte
+	flags uint8
+}
+
+const (
+	huffmanEmit uint8 = 1 << iota // sym is decoded
+	huffmanFail                   // EOS is decoded
+)
+
+var (
+	huffmanTransitions [256][16]huffmanTransition
+
+	// states which can end the string, where the bits since last symbol
+	// are at most 7 bits of 1, the most significant bits of EOS.
+	huffmanAccept [256]bool
+)
+
+func init() {
+	// Huffman tree including EOS (256), nodes[0] is the root
+	type node struct {
+		children [2]int // index of nodes, 0 means none
+		sym      int    // -1 on internal node
+		state    uint8
+	}
+	nodes := []node{{sym: -1}}
+	for sym := 0; sym <= 256; sym++ {
+		code, length := uint32(0x3fffffff), uint8(30) // EOS
+		if sym < 256 {
+			code, length = huffmanCodes[sym], huffmanCodeLen[sym]
+		}
+		n := 0
+		for length > 0 {
+			length--
+			bit := code >> length & 1
+			if nodes[n].children[bit] == 0 {
+				nodes = append(nodes, node{sym: -1})
+				nodes[n].children[bit] = len(nodes) - 1
+			}
+			n = nodes[n].children[bit]
+		}
+		nodes[n].sym = sym
+	}
+
+	// numbering states of internal nodes, and its accepting
+	// by walking all ones path from the root
+	var state uint8
+	for i := range nodes {
+		if nodes[i].sym < 0 {
+			nodes[i].state = state
+			state++
+		}
+	}
+	n := 0
+	for depth := 0; depth <= 7; depth++ {
+		huffmanAccept[nodes[n].state] = true
+		n = nodes[n].children[1]
+	}
+
+	for i := range nodes {
+		if nodes[i].sym >= 0 {
+			continue
+		}
+		for nibble := 0; nibble < 16; nibble++ {
+			t := huffmanTransition{}
+			n := i
+			for shift := 3; shift >= 0; shift-- {
+				n = nodes[n].children[nibble>>uint(shift)&1]
+				if sym := nodes[n].sym; sym == 256 {
+					t.flags |= huffmanFail
+					break
+				} else if sym >= 0 {
+					t.sym = byte(sym)
+					t.flags |= huffmanEmit
+					n = 0
+				}
+			}
+			t.next = nodes[n].state
+			huffmanTransitions[nodes[i].state][nibble] = t
+		}
+	}
+}
+
+// decodes Huffman encoded b (RFC 7541 5.2) and appends to dst.
+// EOS in the string, and padding which is longer than 7 bits
+// or is not the most significant bits of EOS, are errors.
+func HuffmanDecode(dst, b []byte) ([]byte, error) {
+	var state uint8
+	for _, c := range b {
+		t := huffmanTransitions[state][c>>4]
+		if t.flags&huffmanFail != 0 {
+			return nil, ErrHuffmanEOS
+		}
+		if t.flags&huffmanEmit != 0 {
+			dst = append(dst, t.sym)
+		}
+		t = huffmanTransitions[t.next][c&0x0f]
+		if t.flags&huffmanFail != 0 {
+			return nil, ErrHuffmanEOS
+		}
+		if t.flags&huffmanEmit != 0 {
+			dst = append(dst, t.sym)
+		}
+		state = t.next
+	}
+	if !huffmanAccept[state] {
+		return nil, ErrHuffmanPadding
+	}
+	return dst, nil
+}
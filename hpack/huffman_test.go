@@ -0,0 +1,169 @@
+package hpack
+
+import (
+	assert "github.com/Jxck/assertion"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// RFC 7541 Appendix C.4 and C.6
+var huffmanCases = []struct {
+	str  string
+	wire []byte
+}{
+	{"www.example.com", dehex("f1e3 c2e5 f23a 6ba0 ab90 f4ff")},
+	{"no-cache", dehex("a8eb 1064 9cbf")},
+	{"custom-key", dehex("25a8 49e9 5ba9 7d7f")},
+	{"custom-value", dehex("25a8 49e9 5bb8 e8b4 bf")},
+	{"302", dehex("6402")},
+	{"private", dehex("aec3 771a 4b")},
+	{"Mon, 21 Oct 2013 20:13:21 GMT", dehex("d07a be94 1054 d444 a820 0595 040b 8166 e082 a62d 1bff")},
+	{"https://www.example.com", dehex("9d29 ad17 1863 c78f 0b97 c8e9 ae82 ae43 d3")},
+	{"gzip", dehex("9bd9 ab")},
+	{"foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1",
+		dehex("94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07")},
+}
+
+func TestHuffmanEncode(t *testing.T) {
+	for _, c := range huffmanCases {
+		assert.Equal(t, HuffmanEncode(nil, c.str), c.wire)
+		assert.Equal(t, HuffmanEncodeLength(c.str), len(c.wire))
+	}
+}
+
+func TestHuffmanDecode(t *testing.T) {
+	for _, c := range huffmanCases {
+		b, err := HuffmanDecode(nil, c.wire)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, string(b), c.str)
+	}
+}
+
+func TestHuffmanDecodeError(t *testing.T) {
+	cases := []struct {
+		name string
+		wire []byte
+		err  error
+	}{
+		// "a" is 00011, padded with 3 bits of 1
+		{"valid padding", dehex("1f"), nil},
+		{"padding is not 1", dehex("1e"), ErrHuffmanPadding},
+		{"padding is 8 bits", dehex("1f ff"), ErrHuffmanPadding},
+		{"incomplete symbol", dehex("00"), ErrHuffmanPadding},
+		{"EOS", dehex("ffff fffc"), ErrHuffmanEOS},
+		{"EOS after symbol", dehex("1fff ffff ff"), ErrHuffmanEOS},
+	}
+
+	for _, c := range cases {
+		_, err := HuffmanDecode(nil, c.wire)
+		if err != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+// invalid Huffman string is a decoding error of the block
+func TestDecodeHuffmanError(t *testing.T) {
+	// :path with value "a" and 8 bits of padding
+	_, err := NewDecoder(4096).Decode(dehex("04 82 1fff"))
+	assert.Equal(t, err, DecodingError{ErrHuffmanPadding})
+}
+
+// only the output string is allocated
+func TestHuffmanDecodeAllocs(t *testing.T) {
+	str := strings.Repeat("custom-value", 4096/12)
+	wire := appendInt(nil, 0x80, 7, uint64(HuffmanEncodeLength(str)))
+	wire = HuffmanEncode(wire, str)
+
+	decoder := NewDecoder(4096)
+	allocs := testing.AllocsPerRun(100, func() {
+		s, _, err := decoder.readString(wire)
+		if err != nil || s != str {
+			t.Fatal(s, err)
+		}
+	})
+	assert.Equal(t, allocs, float64(1))
+}
+
+func TestHuffmanQuickCheck(t *testing.T) {
+	f := func(s string) bool {
+		b, err := HuffmanDecode(nil, HuffmanEncode(nil, s))
+		return err == nil && string(b) == s
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// H bit is set only if Huffman coding is shorter
+func TestEncodeHuffmanOption(t *testing.T) {
+	field := HeaderList{pair("custom-key", "custom-value")}
+
+	encoder := NewEncoder(4096)
+	assert.Equal(t, encoder.Encode(nil, field), dehex("40 88 25a849e95ba97d7f 89 25a849e95bb8e8b4bf"))
+
+	encoder = NewEncoder(4096)
+	encoder.Huffman = false
+	assert.Equal(t, encoder.Encode(nil, field), dehex("40 0a 637573746f6d2d6b6579 0c 637573746f6d2d76616c7565"))
+
+	// "\x00" is 13 bits in Huffman, so sent as is
+	encoder = NewEncoder(4096)
+	assert.Equal(t, encoder.Encode(nil, HeaderList{pair("a", "\x00")}), dehex("40 01 61 01 00"))
+}
+
+func BenchmarkHuffmanEncode(b *testing.B) {
+	s := strings.Repeat("Mon, 21 Oct 2013 20:13:21 GMT", 32)
+	buf := make([]byte, 0, len(s))
+
+	b.SetBytes(int64(len(s)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = HuffmanEncode(buf[:0], s)
+	}
+}
+
+func BenchmarkHuffmanDecode(b *testing.B) {
+	wire := HuffmanEncode(nil, strings.Repeat("Mon, 21 Oct 2013 20:13:21 GMT", 32))
+	buf := make([]byte, 0, len(wire)*2)
+
+	b.SetBytes(int64(len(wire)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, _ = HuffmanDecode(buf[:0], wire)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	headerList := HeaderList{
+		pair(":method", "GET"),
+		pair(":scheme", "https"),
+		pair(":path", "/index.html"),
+		pair(":authority", "www.example.com"),
+		pair("user-agent", "Mozilla/5.0 (X11; Linux x86_64) Gecko/20100101 Firefox/118.0"),
+		pair("accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"),
+	}
+
+	b.Run("repeated", func(b *testing.B) {
+		encoder := NewEncoder(4096)
+		buf := make([]byte, 0, 1024)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf = encoder.Encode(buf[:0], headerList)
+		}
+	})
+
+	for _, huffman := range []bool{true, false} {
+		b.Run(map[bool]string{true: "huffman", false: "raw"}[huffman], func(b *testing.B) {
+			buf := make([]byte, 0, 1024)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				encoder := NewEncoder(4096)
+				encoder.Huffman = huffman
+				buf = encoder.Encode(buf[:0], headerList)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package hpack
+
+// Static Table (RFC 7541 Appendix A)
+// index of the table starts from 1, staticTable[0] is index 1.
+var staticTable = [...]HeaderField{
+	{Name: ":authority", Value: ""},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset", Value: ""},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language", Value: ""},
+	{Name: "accept-ranges", Value: ""},
+	{Name: "accept", Value: ""},
+	{Name: "access-control-allow-origin", Value: ""},
+	{Name: "age", Value: ""},
+	{Name: "allow", Value: ""},
+	{Name: "authorization", Value: ""},
+	{Name: "cache-control", Value: ""},
+	{Name: "content-disposition", Value: ""},
+	{Name: "content-encoding", Value: ""},
+	{Name: "content-language", Value: ""},
+	{Name: "content-length", Value: ""},
+	{Name: "content-location", Value: ""},
+	{Name: "content-range", Value: ""},
+	{Name: "content-type", Value: ""},
+	{Name: "cookie", Value: ""},
+	{Name: "date", Value: ""},
+	{Name: "etag", Value: ""},
+	{Name: "expect", Value: ""},
+	{Name: "expires", Value: ""},
+	{Name: "from", Value: ""},
+	{Name: "host", Value: ""},
+	{Name: "if-match", Value: ""},
+	{Name: "if-modified-since", Value: ""},
+	{Name: "if-none-match", Value: ""},
+	{Name: "if-range", Value: ""},
+	{Name: "if-unmodified-since", Value: ""},
+	{Name: "last-modified", Value: ""},
+	{Name: "link", Value: ""},
+	{Name: "location", Value: ""},
+	{Name: "max-forwards", Value: ""},
+	{Name: "proxy-authenticate", Value: ""},
+	{Name: "proxy-authorization", Value: ""},
+	{Name: "range", Value: ""},
+	{Name: "referer", Value: ""},
+	{Name: "refresh", Value: ""},
+	{Name: "retry-after", Value: ""},
+	{Name: "server", Value: ""},
+	{Name: "set-cookie", Value: ""},
+	{Name: "strict-transport-security", Value: ""},
+	{Name: "transfer-encoding", Value: ""},
+	{Name: "user-agent", Value: ""},
+	{Name: "vary", Value: ""},
+	{Name: "via", Value: ""},
+	{Name: "www-authenticate", Value: ""},
+}
@@ -0,0 +1,93 @@
+package hpack
+
+// indices of static table, for encoder not to scan the table
+var (
+	staticByName      = map[string][]int{}
+	staticByNameValue = map[pairKey]int{}
+)
+
+type pairKey struct {
+	name, value string
+}
+
+func init() {
+	for i, hf := range staticTable {
+		staticByName[hf.Name] = append(staticByName[hf.Name], i+1)
+		staticByNameValue[pairKey{hf.Name, hf.Value}] = i + 1
+	}
+}
+
+// Dynamic Table (RFC 7541 2.3.2)
+// entries are in FIFO, newest is entries[len-1] and has index 62.
+type dynamicTable struct {
+	entries HeaderList
+	size    uint32 // sum of entry size
+	maxSize uint32
+}
+
+func (t *dynamicTable) len() int {
+	return len(t.entries)
+}
+
+// index is 1 origin, from the newest
+func (t *dynamicTable) get(index int) *HeaderField {
+	return t.entries[len(t.entries)-index]
+}
+
+// evicts from the oldest, until size fits to maxSize (RFC 7541 4.4)
+// entry larger than maxSize empties the table and is not added.
+func (t *dynamicTable) add(hf *HeaderField) {
+	size := hf.Size()
+	if size > t.maxSize {
+		t.evict(0)
+		return
+	}
+	t.evict(t.maxSize - size)
+	t.entries = append(t.entries, hf)
+	t.size += size
+}
+
+// changing max size evicts entries (RFC 7541 4.3)
+func (t *dynamicTable) setMaxSize(maxSize uint32) {
+	t.maxSize = maxSize
+	t.evict(maxSize)
+}
+
+func (t *dynamicTable) evict(size uint32) {
+	n := 0
+	for t.size > size {
+		t.size -= t.entries[n].Size()
+		t.entries[n] = nil
+		n++
+	}
+	if n > 0 {
+		t.entries = append(t.entries[:0], t.entries[n:]...)
+	}
+}
+
+// searches static and dynamic table.
+// returns index of the exact match, or of the first entry
+// which has same name with nameOnly, or 0 if nothing matches.
+// dynamic table is small enough to scan from the newest.
+func (t *dynamicTable) search(hf *HeaderField) (index int, nameOnly bool) {
+	indices, ok := staticByName[hf.Name]
+	if ok {
+		if i, ok := staticByNameValue[pairKey{hf.Name, hf.Value}]; ok {
+			return i, false
+		}
+		index = indices[0]
+	}
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		e := t.entries[i]
+		if e.Name != hf.Name {
+			continue
+		}
+		if e.Value == hf.Value {
+			return len(staticTable) + len(t.entries) - i, false
+		}
+		if index == 0 {
+			index = len(staticTable) + len(t.entries) - i
+		}
+	}
+	return index, index != 0
+}
@@ -0,0 +1,265 @@
+package hpack
+
+import (
+	assert "github.com/Jxck/assertion"
+	xhpack "golang.org/x/net/http2/hpack"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// entry of size
+func sized(name string, size int) *HeaderField {
+	return pair(name, strings.Repeat("v", size-len(name)-32))
+}
+
+func TestDynamicTableEviction(t *testing.T) {
+	// name + value + 32
+	assert.Equal(t, pair("custom-key", "custom-value").Size(), uint32(54))
+
+	table := dynamicTable{maxSize: 100}
+	table.add(sized("a", 40))
+	table.add(sized("b", 40))
+	assert.Equal(t, entries(table), HeaderList{sized("b", 40), sized("a", 40)})
+	assert.Equal(t, table.size, uint32(80))
+
+	// oldest is evicted first
+	table.add(sized("c", 40))
+	assert.Equal(t, entries(table), HeaderList{sized("c", 40), sized("b", 40)})
+	assert.Equal(t, table.size, uint32(80))
+
+	// as many as needed
+	table.add(sized("d", 90))
+	assert.Equal(t, entries(table), HeaderList{sized("d", 90)})
+	assert.Equal(t, table.size, uint32(90))
+
+	// exactly max size is added
+	table.add(sized("e", 100))
+	assert.Equal(t, entries(table), HeaderList{sized("e", 100)})
+	assert.Equal(t, table.size, uint32(100))
+
+	// larger than max size empties the table, and is not added
+	table.add(sized("f", 40))
+	table.add(sized("g", 101))
+	assert.Equal(t, table.len(), 0)
+	assert.Equal(t, table.size, uint32(0))
+
+	// smaller max size evicts from the oldest
+	table.add(sized("h", 40))
+	table.add(sized("i", 40))
+	table.setMaxSize(50)
+	assert.Equal(t, entries(table), HeaderList{sized("i", 40)})
+	table.setMaxSize(0)
+	assert.Equal(t, table.len(), 0)
+	assert.Equal(t, table.size, uint32(0))
+}
+
+func TestTableSize(t *testing.T) {
+	encoder := NewEncoder(256)
+	decoder := NewDecoder(256)
+	decode := func(headerList HeaderList) {
+		_, err := decoder.Decode(encoder.Encode(nil, headerList))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, decoder.TableSize(), encoder.TableSize())
+		assert.Equal(t, decoder.TableLen(), encoder.TableLen())
+	}
+
+	decode(HeaderList{sized("a", 100), sized("b", 100)})
+	assert.Equal(t, encoder.TableSize(), uint32(200))
+	assert.Equal(t, encoder.TableLen(), 2)
+
+	decode(HeaderList{sized("c", 100)})
+	assert.Equal(t, encoder.TableSize(), uint32(200))
+	assert.Equal(t, encoder.TableLen(), 2)
+
+	// sent without indexing, table is kept
+	decode(HeaderList{sized("d", 257)})
+	assert.Equal(t, encoder.TableLen(), 2)
+
+	// size update evicts both side
+	encoder.SetMaxTableSize(150)
+	decode(HeaderList{})
+	assert.Equal(t, encoder.TableSize(), uint32(100))
+	assert.Equal(t, encoder.TableLen(), 1)
+
+	// literal with incremental indexing, larger than the table
+	_, err := decoder.Decode(dehex("40 01 61 7f 80 01" + strings.Repeat("76", 255)))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decoder.TableSize(), uint32(0))
+	assert.Equal(t, decoder.TableLen(), 0)
+}
+
+// contents of dynamic table of x/net decoder,
+// by referring each index from 62.
+func xnetEntries(t *testing.T, decoder *xhpack.Decoder, n int) HeaderList {
+	t.Helper()
+
+	var wire []byte
+	for i := 0; i < n; i++ {
+		wire = appendInt(wire, 0x80, 7, uint64(len(staticTable)+1+i))
+	}
+	fields, err := decoder.DecodeFull(wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hl := HeaderList{}
+	for _, f := range fields {
+		hl.Emit(pair(f.Name, f.Value))
+	}
+
+	// no more entry
+	_, err = decoder.DecodeFull(appendInt(nil, 0x80, 7, uint64(len(staticTable)+1+n)))
+	if err == nil {
+		t.Fatalf("x/net has more than %d entries", n)
+	}
+	decoder.Close()
+	return hl
+}
+
+// name and value only
+func plain(hl HeaderList) HeaderList {
+	plain := HeaderList{}
+	for _, hf := range hl {
+		plain.Emit(pair(hf.Name, hf.Value))
+	}
+	return plain
+}
+
+// random field, its size is up to 300 and sometimes over 4096
+func randomField(r *rand.Rand) *HeaderField {
+	names := []string{"a", "b", "c", "cookie", "authorization", ":path", "user-agent"}
+	size := r.Intn(300)
+	if r.Intn(20) == 0 {
+		size = 4096 + r.Intn(100)
+	}
+	return pair(names[r.Intn(len(names))], strings.Repeat(string(rune('a'+r.Intn(26))), size))
+}
+
+// every representation on the wire is decoded to the same fields,
+// with the same dynamic table as x/net.
+func TestDecoderTableWithXNet(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	decoder := NewDecoder(4096)
+	xdecoder := xhpack.NewDecoder(4096, nil)
+
+	// number of entries while making a block, to refer valid index
+	shadow := dynamicTable{maxSize: 4096}
+	for i := 0; i < 500; i++ {
+		var wire []byte
+		if r.Intn(5) == 0 {
+			size := r.Intn(4097)
+			wire = appendInt(wire, 0x20, 5, uint64(size))
+			shadow.setMaxSize(uint32(size))
+		}
+		for j := r.Intn(8); j > 0; j-- {
+			hf := randomField(r)
+			index := 1 + r.Intn(len(staticTable))
+			switch r.Intn(6) {
+			case 0:
+				// indexed, static or dynamic
+				index = 1 + r.Intn(len(staticTable)+shadow.len())
+				wire = appendInt(wire, 0x80, 7, uint64(index))
+				continue
+			case 1:
+				// literal with incremental indexing, indexed name
+				wire = appendInt(wire, 0x40, 6, uint64(index))
+				shadow.add(pair(staticTable[index-1].Name, hf.Value))
+			case 2:
+				// literal with incremental indexing, new name
+				wire = append(wire, 0x40)
+				wire = appendInt(wire, 0x00, 7, uint64(len(hf.Name)))
+				wire = append(wire, hf.Name...)
+				shadow.add(hf)
+			case 3:
+				// literal without indexing
+				wire = appendInt(wire, 0x00, 4, uint64(index))
+			case 4:
+				// literal never indexed
+				wire = appendInt(wire, 0x10, 4, uint64(index))
+			case 5:
+				// Huffman coded value
+				wire = appendInt(wire, 0x40, 6, uint64(index))
+				wire = appendInt(wire, 0x80, 7, uint64(HuffmanEncodeLength(hf.Value)))
+				wire = HuffmanEncode(wire, hf.Value)
+				shadow.add(pair(staticTable[index-1].Name, hf.Value))
+				continue
+			}
+			wire = appendInt(wire, 0x00, 7, uint64(len(hf.Value)))
+			wire = append(wire, hf.Value...)
+		}
+
+		headerList, err := decoder.Decode(wire)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		fields, err := xdecoder.DecodeFull(wire)
+		if err != nil {
+			t.Fatalf("step %d: x/net: %v", i, err)
+		}
+		expected := HeaderList{}
+		for _, f := range fields {
+			expected.Emit(&HeaderField{Name: f.Name, Value: f.Value, Sensitive: f.Sensitive})
+		}
+		assert.Equal(t, headerList, expected)
+		assert.Equal(t, entries(decoder.table), xnetEntries(t, xdecoder, decoder.TableLen()))
+
+		size := uint32(0)
+		for _, hf := range decoder.table.entries {
+			size += hf.Size()
+		}
+		assert.Equal(t, decoder.TableSize(), size)
+		if t.Failed() {
+			t.Fatalf("step %d", i)
+		}
+	}
+}
+
+// x/net decoder follows our encoder, including size updates
+func TestEncoderTableWithXNet(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	encoder := NewEncoder(4096)
+	xdecoder := xhpack.NewDecoder(4096, nil)
+
+	for i := 0; i < 500; i++ {
+		for j := r.Intn(3); j > 0 && r.Intn(4) == 0; j-- {
+			encoder.SetMaxTableSize(uint32(r.Intn(4097)))
+		}
+		headerList := HeaderList{}
+		for j := r.Intn(8); j > 0; j-- {
+			headerList.Emit(randomField(r))
+		}
+
+		fields, err := xdecoder.DecodeFull(encoder.Encode(nil, headerList))
+		if err != nil {
+			t.Fatalf("step %d: x/net: %v", i, err)
+		}
+		decoded := HeaderList{}
+		for _, f := range fields {
+			decoded.Emit(pair(f.Name, f.Value))
+		}
+		assert.Equal(t, decoded, plain(headerList))
+		assert.Equal(t, entries(encoder.table), xnetEntries(t, xdecoder, encoder.TableLen()))
+		if t.Failed() {
+			t.Fatalf("step %d", i)
+		}
+	}
+}
+
+// shrinking and growing before next block
+func TestSizeUpdateWithXNet(t *testing.T) {
+	encoder := NewEncoder(4096)
+	xdecoder := xhpack.NewDecoder(4096, nil)
+
+	headerList := HeaderList{sized("a", 40), sized("b", 40)}
+	_, err := xdecoder.DecodeFull(encoder.Encode(nil, headerList))
+	assert.Equal(t, err, nil)
+
+	encoder.SetMaxTableSize(50)
+	encoder.SetMaxTableSize(4096)
+	wire := encoder.Encode(nil, headerList)
+	assert.Equal(t, wire[:4], dehex("20 3fe1 1f"))
+
+	_, err = xdecoder.DecodeFull(wire)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, entries(encoder.table), xnetEntries(t, xdecoder, encoder.TableLen()))
+}
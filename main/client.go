@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/Jxck/http2"
+	"github.com/Jxck/http2/frame"
 	"github.com/Jxck/logger"
 	"io/ioutil"
 	"net/http"
@@ -27,6 +28,7 @@ func init() {
 		f.Parse(f.Args()[1:])
 	}
 	logger.Level(loglevel)
+	frame.SetFormatter(frame.ColorFormatter{}) // for terminal
 }
 
 func main() {
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/Jxck/http2"
+	"github.com/Jxck/http2/frame"
 	"github.com/Jxck/logger"
 	"net/http"
 	"os"
@@ -15,6 +16,8 @@ var (
 	dir      string
 	key      string
 	cert     string
+	dump     bool
+	capture  string
 )
 
 func init() {
@@ -23,11 +26,15 @@ func init() {
 	f.StringVar(&dir, "d", ".", "document root")
 	f.StringVar(&key, "key", "keys/key.pem", "ssl key")
 	f.StringVar(&cert, "cert", "keys/cert.pem", "ssl cert")
+	f.BoolVar(&dump, "dump", false, "log frames as hex dump")
+	f.StringVar(&capture, "capture", "", "directory to record frames of each connection")
 	f.Parse(os.Args[1:])
 	for 0 < f.NArg() {
 		f.Parse(f.Args()[1:])
 	}
 	logger.Level(loglevel)
+	frame.SetFormatter(frame.ColorFormatter{}) // for terminal
+	http2.FrameDump = dump
 }
 
 func main() {
@@ -49,17 +56,16 @@ $ go run main/server.go 3000
 	// setup TLS config
 	config := &tls.Config{
 		InsecureSkipVerify: true,
-		NextProtos:         []string{http2.VERSION},
 	}
 
-	// setup Server
+	// setup Server, which negotiates h2 and http/1.1
 	server := &http.Server{
 		Addr:           port,
 		Handler:        handler,
 		MaxHeaderBytes: http.DefaultMaxHeaderBytes,
 		TLSConfig:      config,
-		TLSNextProto:   http2.TLSNextProto,
 	}
+	http2.ConfigureServer(server, &http2.Server{CaptureDir: capture})
 
 	fmt.Println("server starts at localhost", port)
 	fmt.Println(server.ListenAndServeTLS(cert, key))
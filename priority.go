@@ -0,0 +1,210 @@
+package http2
+
+import (
+	"fmt"
+	. "github.com/Jxck/http2/frame"
+	. "github.com/Jxck/logger"
+	"sync"
+)
+
+// weight of stream without priority (RFC 7540 5.3.5)
+const DEFAULT_WEIGHT = 16
+
+// PriorityTree is dependency tree of streams (RFC 7540 5.3)
+// stream 0 is the root, and each stream depends on its parent
+// with weight 1-256.
+//
+// WriteLoop asks Next for the stream to send DATA, which is
+// a ready stream whose ancestors are not ready, and bandwidth is
+// shared by siblings in proportion to their weights.
+type PriorityTree struct {
+	mu    sync.Mutex
+	root  *priorityNode
+	nodes map[uint32]*priorityNode
+}
+
+type priorityNode struct {
+	id       uint32
+	weight   int
+	parent   *priorityNode
+	children map[uint32]*priorityNode
+
+	// bytes sent by the subtree divided by weight.
+	// sibling with smallest one is the next to send.
+	vtime float64
+}
+
+func NewPriorityTree() *PriorityTree {
+	root := &priorityNode{
+		children: make(map[uint32]*priorityNode),
+	}
+	return &PriorityTree{
+		root:  root,
+		nodes: map[uint32]*priorityNode{0: root},
+	}
+}
+
+// weight of PRIORITY frame is 0-255 on the wire
+func priorityWeight(weight uint8) int {
+	return int(weight) + 1
+}
+
+// weight of HEADERS is added 1 by Framer,
+// so 256 overflows to 0
+func headersWeight(weight uint8) int {
+	if weight == 0 {
+		return 256
+	}
+	return int(weight)
+}
+
+// sets priority of the stream, adding it if not exists (RFC 7540 5.3.3)
+// dependency on stream not in the tree gives default priority (RFC 7540 5.3.1)
+// depending on itself is stream error of PROTOCOL_ERROR.
+func (tree *PriorityTree) Set(id, dependency uint32, weight int, exclusive bool) error {
+	if id == dependency {
+		msg := fmt.Sprintf("stream(%v) depends on itself", id)
+		Error("%v", msg)
+		return &StreamError{StreamID: id, Code: PROTOCOL_ERROR}
+	}
+
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	parent, ok := tree.nodes[dependency]
+	if !ok {
+		Debug("stream(%v) depends on unknown stream(%v)", id, dependency)
+		parent, weight, exclusive = tree.root, DEFAULT_WEIGHT, false
+	}
+
+	node, ok := tree.nodes[id]
+	if ok {
+		// dependency on its descendant moves the descendant
+		// to former parent of the stream first, not to make a cycle
+		for ancestor := parent; ancestor != tree.root; ancestor = ancestor.parent {
+			if ancestor == node {
+				Debug("move stream(%v) to stream(%v)", parent.id, node.parent.id)
+				delete(parent.parent.children, parent.id)
+				parent.parent = node.parent
+				node.parent.children[parent.id] = parent
+				break
+			}
+		}
+		delete(node.parent.children, id)
+	} else {
+		node = &priorityNode{
+			id:       id,
+			children: make(map[uint32]*priorityNode),
+		}
+		tree.nodes[id] = node
+	}
+	node.weight = weight
+
+	// exclusive dependency makes the stream
+	// sole child of parent, and others become its children
+	if exclusive {
+		for childID, child := range parent.children {
+			delete(parent.children, childID)
+			child.parent = node
+			node.children[childID] = child
+		}
+	}
+
+	// starts from the smallest one of siblings,
+	// not to take all bandwidth until it catches up
+	node.vtime = 0
+	first := true
+	for _, sibling := range parent.children {
+		if first || sibling.vtime < node.vtime {
+			node.vtime = sibling.vtime
+			first = false
+		}
+	}
+
+	node.parent = parent
+	parent.children[id] = node
+	Trace("stream(%v) depends on stream(%v) weight(%v) exclusive(%v)", id, parent.id, weight, exclusive)
+	return nil
+}
+
+// adds the stream with default priority, if not exists
+func (tree *PriorityTree) Add(id uint32) {
+	tree.mu.Lock()
+	_, ok := tree.nodes[id]
+	tree.mu.Unlock()
+	if !ok {
+		tree.Set(id, 0, DEFAULT_WEIGHT, false)
+	}
+}
+
+// removes closed stream, its children move to its parent
+// and share its weight in proportion (RFC 7540 5.3.4)
+func (tree *PriorityTree) Remove(id uint32) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	node, ok := tree.nodes[id]
+	if !ok || node == tree.root {
+		return
+	}
+	delete(tree.nodes, id)
+	delete(node.parent.children, id)
+
+	sum := 0
+	for _, child := range node.children {
+		sum += child.weight
+	}
+	for childID, child := range node.children {
+		child.weight = node.weight * child.weight / sum
+		if child.weight < 1 {
+			child.weight = 1
+		}
+		child.parent = node.parent
+		node.parent.children[childID] = child
+	}
+}
+
+// stream which should send next, among the ready ones.
+// false if no stream is ready.
+func (tree *PriorityTree) Next(ready func(id uint32) bool) (uint32, bool) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	node := tree.root.next(ready)
+	if node == nil {
+		return 0, false
+	}
+	return node.id, true
+}
+
+// ready node itself, or the one of the child with
+// smallest vtime which has ready descendant
+func (node *priorityNode) next(ready func(id uint32) bool) *priorityNode {
+	if node.id != 0 && ready(node.id) {
+		return node
+	}
+	var found, from *priorityNode
+	for _, child := range node.children {
+		if from != nil && child.vtime >= from.vtime {
+			continue
+		}
+		if next := child.next(ready); next != nil {
+			found, from = next, child
+		}
+	}
+	return found
+}
+
+// records size of DATA sent by the stream
+func (tree *PriorityTree) Sent(id uint32, size int) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	node, ok := tree.nodes[id]
+	if !ok {
+		return
+	}
+	for ; node != tree.root; node = node.parent {
+		node.vtime += float64(size) / float64(node.weight)
+	}
+}
@@ -0,0 +1,116 @@
+package http2
+
+import (
+	assert "github.com/Jxck/assertion"
+	. "github.com/Jxck/http2/frame"
+	"testing"
+)
+
+// parent id and weight of the stream
+func dependency(tree *PriorityTree, id uint32) (uint32, int) {
+	node := tree.nodes[id]
+	return node.parent.id, node.weight
+}
+
+func TestPriorityTreeSet(t *testing.T) {
+	tree := NewPriorityTree()
+	tree.Add(1)
+	tree.Add(3)
+	tree.Set(5, 1, 32, false)
+
+	parent, weight := dependency(tree, 5)
+	assert.Equal(t, parent, uint32(1))
+	assert.Equal(t, weight, 32)
+
+	// unknown dependency is default priority
+	tree.Set(7, 9, 100, true)
+	parent, weight = dependency(tree, 7)
+	assert.Equal(t, parent, uint32(0))
+	assert.Equal(t, weight, DEFAULT_WEIGHT)
+
+	// exclusive takes siblings as children
+	tree.Set(9, 0, 64, true)
+	for _, id := range []uint32{1, 3, 7} {
+		parent, _ = dependency(tree, id)
+		assert.Equal(t, parent, uint32(9))
+	}
+	assert.Equal(t, len(tree.root.children), 1)
+
+	// children of removed stream share its weight
+	tree.Set(11, 5, 10, false)
+	tree.Set(13, 5, 30, false)
+	tree.Remove(5)
+	parent, weight = dependency(tree, 11)
+	assert.Equal(t, parent, uint32(1))
+	assert.Equal(t, weight, 8)
+	parent, weight = dependency(tree, 13)
+	assert.Equal(t, parent, uint32(1))
+	assert.Equal(t, weight, 24)
+}
+
+func TestPriorityTreeNext(t *testing.T) {
+	tree := NewPriorityTree()
+	tree.Set(1, 0, 16, false)
+	tree.Set(3, 1, 220, false)
+	tree.Set(5, 1, 36, false)
+
+	ready := map[uint32]bool{1: true, 3: true, 5: true}
+	next := func(id uint32) bool { return ready[id] }
+
+	// parent goes first
+	id, ok := tree.Next(next)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, id, uint32(1))
+
+	// then children share by weight
+	ready[1] = false
+	sent := map[uint32]int{}
+	for i := 0; i < 256; i++ {
+		id, _ := tree.Next(next)
+		sent[id] += 100
+		tree.Sent(id, 100)
+	}
+	if n := sent[3] / 100; n < 219 || n > 221 {
+		t.Errorf("got %v:%v want 220:36", sent[3]/100, sent[5]/100)
+	}
+
+	ready[3], ready[5] = false, false
+	_, ok = tree.Next(next)
+	assert.Equal(t, ok, false)
+}
+
+func TestPriorityTreeSelfDependency(t *testing.T) {
+	tree := NewPriorityTree()
+	tree.Add(1)
+
+	err := tree.Set(1, 1, DEFAULT_WEIGHT, false)
+	streamError, ok := err.(*StreamError)
+	if !ok {
+		t.Fatalf("got %v want StreamError", err)
+	}
+	assert.Equal(t, streamError.Code, PROTOCOL_ERROR)
+
+	// priority is not changed
+	parent, _ := dependency(tree, 1)
+	assert.Equal(t, parent, uint32(0))
+}
+
+func TestPriorityTreeCycle(t *testing.T) {
+	// A(1) -> B(3) -> C(5)
+	tree := NewPriorityTree()
+	tree.Set(1, 0, 16, false)
+	tree.Set(3, 1, 16, false)
+	tree.Set(5, 3, 16, false)
+
+	// A depends on C, then C moves to former parent of A
+	err := tree.Set(1, 5, 16, false)
+	assert.Equal(t, err, nil)
+
+	parent, _ := dependency(tree, 5)
+	assert.Equal(t, parent, uint32(0))
+	parent, _ = dependency(tree, 1)
+	assert.Equal(t, parent, uint32(5))
+	parent, _ = dependency(tree, 3)
+	assert.Equal(t, parent, uint32(1))
+	assert.Equal(t, len(tree.root.children), 1)
+}
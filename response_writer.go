@@ -3,21 +3,46 @@ package http2
 import (
 	"bytes"
 	"fmt"
+	. "github.com/Jxck/color"
+	. "github.com/Jxck/http2/frame"
+	. "github.com/Jxck/logger"
 	"net/http"
+	neturl "net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type ResponseWriter struct {
-	status int
-	header http.Header
-	body   *bytes.Buffer
+	status  int
+	header  http.Header
+	body    *bytes.Buffer
+	stream  *Stream
+	request *http.Request // origin of pushed request
+
+	// header is copied at WriteHeader, and changes after it
+	// are not sent except trailers
+	wroteHeader bool
+	sentHeader  http.Header
+
+	// HEADERS is sent by Flush before handler returns
+	headerSent bool
+
+	// closed when handler returns, stops CloseNotify
+	handlerDone chan struct{}
+
+	// body written to response of HEAD, which is not sent
+	discarded int64
 }
 
-func NewResponseWriter() *ResponseWriter {
+func NewResponseWriter(stream *Stream) *ResponseWriter {
 	return &ResponseWriter{
-		status: 0,
-		header: make(http.Header),
-		body:   bytes.NewBuffer([]byte{}),
+		status:      0,
+		header:      make(http.Header),
+		body:        bytes.NewBuffer([]byte{}),
+		stream:      stream,
+		handlerDone: make(chan struct{}),
 	}
 }
 
@@ -25,20 +50,315 @@ func (r *ResponseWriter) Header() http.Header {
 	return r.header
 }
 
+// fails after the stream is closed, by RST_STREAM for example
+// Write without WriteHeader is 200, and status without body
+// fails with http.ErrBodyNotAllowed like net/http.
 func (r *ResponseWriter) Write(b []byte) (int, error) {
-	if r.status == 0 {
+	if r.stream != nil && r.stream.Context().Err() != nil {
+		return 0, r.stream.Err()
+	}
+	if !r.wroteHeader {
 		r.WriteHeader(http.StatusOK)
 	}
-	return r.body.Write(b)
+	if !bodyAllowed(r.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	// response of HEAD has no body, only its length is counted
+	if r.request != nil && r.request.Method == "HEAD" {
+		r.discarded += int64(len(b))
+		return len(b), nil
+	}
+	// large b is buffered by chunk and flushed, so memory is bounded
+	// and Write blocks while the peer reads slower than the handler
+	n := 0
+	for {
+		chunk := b
+		if len(chunk) > MaxQueuedData {
+			chunk = chunk[:MaxQueuedData]
+		}
+		r.body.Write(chunk)
+		n += len(chunk)
+		b = b[len(chunk):]
+
+		var err error
+		switch {
+		case r.tunnel():
+			// tunnel of CONNECT sends data as it is written
+			err = r.flush()
+		case r.body.Len() > ResponseBufferSize:
+			// large body is not buffered, but its tail is kept
+			// for the last DATA with END_STREAM
+			err = r.flushKeeping(ResponseBufferSize)
+		}
+		if err != nil || len(b) == 0 {
+			return n, err
+		}
+	}
 }
 
+// only the first call is applied, and header is fixed at this time.
+// 1xx except 101 is sent immediately as interim response, and
+// final response follows it like net/http (RFC 7540 8.1)
 func (r *ResponseWriter) WriteHeader(status int) {
+	if r.wroteHeader {
+		Error("superfluous WriteHeader(%v) after WriteHeader(%v)", status, r.status)
+		return
+	}
+	// same as net/http
+	if status < 100 || status > 999 {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", status))
+	}
+	if status < 200 && status != http.StatusSwitchingProtocols {
+		r.sendInformational(status)
+		return
+	}
+	r.wroteHeader = true
 	r.status = status
+	r.sentHeader = r.header.Clone()
+
+	// peer of CONNECT waits 2xx before sending data (RFC 7540 8.3)
+	if r.tunnel() {
+		r.flush()
+	}
+}
+
+// 2xx of CONNECT makes the stream a tunnel, DATA of both directions
+// are read from Request.Body and written to ResponseWriter concurrently
+func (r *ResponseWriter) tunnel() bool {
+	return r.request != nil && r.request.Method == "CONNECT" && r.status >= 200 && r.status < 300
+}
+
+// http.Flusher, sends HEADERS if not yet and buffered body as DATA
+// without END_STREAM. it blocks while peer's window is not enough.
+func (r *ResponseWriter) Flush() {
+	r.flush()
+}
+
+func (r *ResponseWriter) flush() error {
+	return r.flushKeeping(0)
+}
+
+// sends buffered body except the last keep bytes
+func (r *ResponseWriter) flushKeeping(keep int) error {
+	if r.stream == nil {
+		return nil
+	}
+	if r.stream.Context().Err() != nil {
+		return r.stream.Err()
+	}
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.headerSent {
+		if err := r.sendHeader(false); err != nil {
+			return err
+		}
+	}
+	if r.body.Len() <= keep {
+		return nil
+	}
+
+	// sent data is not copied, so buffer is not reused
+	buffered := r.body.Bytes()
+	data := buffered[:len(buffered)-keep]
+	r.body = bytes.NewBuffer(append([]byte{}, buffered[len(data):]...))
+	if err := r.stream.WriteData(data, false); err != nil {
+		Error("stream(%v) closed while flushing response: %v", r.stream.ID, err)
+		return err
+	}
+	return nil
+}
+
+// interim HEADERS has current header without END_STREAM.
+// it shares HPACK context with final response in order of writing.
+func (r *ResponseWriter) sendInformational(status int) {
+	if r.stream == nil || r.stream.Context().Err() != nil {
+		return
+	}
+	header := r.header.Clone()
+	header.Add(":status", strconv.Itoa(status))
+	r.writeHeaders(header, false)
+}
+
+// 100 Continue of Expect: 100-continue has only :status.
+// it is not needed after final response, or the whole body
+func (r *ResponseWriter) sendContinue() {
+	if r.wroteHeader || r.stream.Context().Err() != nil || r.stream.CurrentState() != OPEN {
+		return
+	}
+	r.writeHeaders(http.Header{":status": {"100"}}, false)
+}
+
+// sends response header as HEADERS Frame
+// encoded with HPACK when it is written to the connection.
+// header list is converted without connection-specific headers (RFC 7540 8.1.2.2)
+func (r *ResponseWriter) sendHeader(endStream bool) error {
+	// declared trailers are not sent in header
+	r.trailer()
+	// Date like net/http, unless handler sets it or suppresses it with nil
+	if _, ok := r.sentHeader["Date"]; !ok {
+		r.sentHeader.Set("Date", httpDate(time.Now()))
+	}
+	r.sentHeader.Add(":status", strconv.Itoa(r.status))
+	r.headerSent = true
+
+	Info("\n%s", Aqua((r.String())))
+	return r.writeHeaders(r.sentHeader, endStream)
+}
+
+// fails with resetting the stream if header exceeds
+// peer's SETTINGS_MAX_HEADER_LIST_SIZE
+func (r *ResponseWriter) writeHeaders(header http.Header, endStream bool) error {
+	maxHeaderListSize := r.stream.Settings.Peer(SETTINGS_MAX_HEADER_LIST_SIZE)
+	if size := HeaderListSize(header); size > uint32(maxHeaderListSize) {
+		msg := fmt.Sprintf("response header list size(%v) is larger than peer's SETTINGS_MAX_HEADER_LIST_SIZE(%v)", size, maxHeaderListSize)
+		Error("%v", msg)
+		r.stream.Write(NewRstStreamFrame(r.stream.ID, INTERNAL_ERROR))
+		return &StreamError{StreamID: r.stream.ID, Code: INTERNAL_ERROR}
+	}
+
+	var flags Flag = END_HEADERS
+	if endStream {
+		flags += END_STREAM
+	}
+	headersFrame := NewHeadersFrame(flags, r.stream.ID, nil, nil, nil)
+	headersFrame.Headers = header
+	headersFrame.HpackContext = r.stream.PeerHpackContext
+	r.stream.Write(headersFrame)
+	return nil
+}
+
+// http.CloseNotifier for legacy handlers, Request.Context() is preferred.
+// notified when the stream is reset or the connection is closed
+// before handler returns.
+func (r *ResponseWriter) CloseNotify() <-chan bool {
+	notify := make(chan bool, 1)
+	if r.stream == nil {
+		return notify
+	}
+	go func() {
+		select {
+		case <-r.stream.Context().Done():
+			notify <- true
+		case <-r.handlerDone:
+		}
+	}()
+	return notify
+}
+
+// IMF-fixdate of Date header (RFC 7231 7.1.1.1),
+// formatted once a second for responses in it like net/http
+var dateCache struct {
+	sync.Mutex
+	unix  int64
+	value string
+}
+
+func httpDate(now time.Time) string {
+	dateCache.Lock()
+	defer dateCache.Unlock()
+	if unix := now.Unix(); unix != dateCache.unix || dateCache.value == "" {
+		dateCache.unix = unix
+		dateCache.value = now.UTC().Format(http.TimeFormat)
+	}
+	return dateCache.value
+}
+
+// 1xx, 204 and 304 have no body (RFC 7230 3.3.3)
+func bodyAllowed(status int) bool {
+	switch {
+	case status >= 100 && status < 200:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// http.Pusher, promised request is served by the handler on new stream.
+// response is sent after handler returns or Flush, so PUSH_PROMISE goes
+// before the response which refers the target (RFC 7540 8.2.1).
+// fails with http.ErrNotSupported if peer disables push,
+// or on pushed stream.
+func (r *ResponseWriter) Push(target string, opts *http.PushOptions) error {
+	if r.stream == nil || r.stream.push == nil || r.request == nil {
+		return http.ErrNotSupported
+	}
+	if opts == nil {
+		opts = new(http.PushOptions)
+	}
+
+	// promised request should be safe and cacheable (RFC 7540 8.2)
+	method := opts.Method
+	if method == "" {
+		method = "GET"
+	}
+	if method != "GET" && method != "HEAD" {
+		return fmt.Errorf("method %v cannot be pushed", method)
+	}
+
+	// target is absolute path, or URL of the same scheme
+	url, err := neturl.Parse(target)
+	if err != nil {
+		return err
+	}
+	scheme, authority := r.request.URL.Scheme, r.request.Host
+	if url.Scheme != "" || url.Host != "" {
+		if url.Scheme != scheme || url.Host == "" {
+			return fmt.Errorf("target %v cannot be pushed on %v", target, scheme)
+		}
+		authority = url.Host
+	} else if !strings.HasPrefix(target, "/") {
+		return fmt.Errorf("target %v should be absolute path", target)
+	}
+
+	header := make(http.Header)
+	for name, values := range opts.Header {
+		header[name] = values
+	}
+	header[":method"] = []string{method}
+	header[":scheme"] = []string{scheme}
+	header[":authority"] = []string{authority}
+	header[":path"] = []string{url.RequestURI()}
+	return r.stream.push(header)
+}
+
+// takes trailer out of header, which is declared by Trailer header
+// or has http.TrailerPrefix like net/http. values are set after WriteHeader.
+// pseudo header is not allowed in trailer (RFC 7540 8.1.2.1)
+func (r *ResponseWriter) trailer() http.Header {
+	trailer := make(http.Header)
+	add := func(name string, values []string) {
+		if strings.HasPrefix(name, ":") {
+			Error("pseudo header %v in trailer is ignored", name)
+			return
+		}
+		if len(values) > 0 {
+			trailer[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	for _, value := range r.sentHeader["Trailer"] {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			add(name, r.header[name])
+			delete(r.sentHeader, name)
+		}
+	}
+	for name, values := range r.header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			add(strings.TrimPrefix(name, http.TrailerPrefix), values)
+			delete(r.sentHeader, name)
+		}
+	}
+	return trailer
 }
 
 func (r ResponseWriter) String() (str string) {
 	str += fmt.Sprintf("HTTP/1.1 %d %s", r.status, http.StatusText(r.status))
-	for name, value := range r.header {
+	for name, value := range r.sentHeader {
 		if strings.HasPrefix(name, ":") {
 			continue
 		}
@@ -1,17 +1,24 @@
 package http2
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	. "github.com/Jxck/color"
-	"github.com/Jxck/hpack"
 	. "github.com/Jxck/http2/frame"
 	. "github.com/Jxck/logger"
 	"log"
 	"net"
 	"net/http"
 	neturl "net/url"
+	"os"
+	"path/filepath"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 func init() {
@@ -28,31 +35,431 @@ var TLSNextProtoHandler = func(server *http.Server, conn *tls.Conn, handler http
 	return // return closes connection
 }
 
+// Server keeps connections it handles, for Shutdown
+type Server struct {
+	// keepalive of connections, see Conn.ReadIdleTimeout
+	// 0 of PingTimeout is default
+	ReadIdleTimeout time.Duration
+	PingTimeout     time.Duration
+
+	// see Conn.WriteTimeout and Conn.IdleTimeout
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// see Conn.ReadHeaderTimeout, 0 is default
+	ReadHeaderTimeout time.Duration
+
+	// see Conn.SettingsTimeout, 0 is default
+	SettingsTimeout time.Duration
+
+	// see Conn.MaxRapidResets and Conn.RapidResetWindow, 0 is default
+	MaxRapidResets   int
+	RapidResetWindow time.Duration
+
+	// see Conn.MaxQueuedControlFrames, 0 is default
+	MaxQueuedControlFrames int
+
+	// SETTINGS sent to peer, merged into DefaultSettings.
+	// nil is default, and fields below override it.
+	Settings map[SettingsID]int32
+
+	// advertised as SETTINGS_MAX_CONCURRENT_STREAMS, 0 is default
+	MaxConcurrentStreams uint32
+
+	// limit of request header list, advertised as
+	// SETTINGS_MAX_HEADER_LIST_SIZE. 0 is no limit.
+	// larger request is answered by 431
+	MaxHeaderBytes int
+
+	// same as MaxHeaderBytes, they should not differ if both set
+	MaxHeaderListSize uint32
+
+	// advertised as SETTINGS_MAX_FRAME_SIZE, larger frame
+	// from peer is FRAME_SIZE_ERROR. 0 is default
+	MaxReadFrameSize uint32
+
+	// receive window of each stream, advertised as
+	// SETTINGS_INITIAL_WINDOW_SIZE. 0 is default
+	InitialStreamWindow uint32
+
+	// receive window of connection, which is raised by WINDOW_UPDATE
+	// after SETTINGS. it can't be smaller than 65535, 0 is default
+	InitialConnWindow uint32
+
+	// HPACK table of request headers, advertised as
+	// SETTINGS_HEADER_TABLE_SIZE. 0 is default,
+	// Settings can set 0 to disable dynamic table
+	HeaderTableSize uint32
+
+	// see Conn.MaxConcurrentPushes, 0 is default.
+	// Push of handler is not supported if DisablePush.
+	MaxConcurrentPushes int
+	DisablePush         bool
+
+	// see Conn.BadRequest
+	BadRequest bool
+
+	// limit of request body of each stream, 0 is no limit.
+	// declared content-length over it is answered by 413 without handler,
+	// and handler reading over it gets http.MaxBytesError
+	MaxRequestBodyBytes int64
+
+	// ALPN identifiers served as HTTP/2 besides "h2",
+	// like "h2-14" of drafts for clients in transition
+	DraftProtos []string
+
+	// serves TLS connection which RFC 7540 9.2 prohibits,
+	// like TLS 1.1 or banned cipher suites, for lab setups.
+	// otherwise it is closed with INADEQUATE_SECURITY
+	PermitInsecureTLS bool
+
+	// directory to record frames of each connection (see frame.Recorder)
+	// empty is not recording
+	CaptureDir string
+
+	mu       sync.Mutex
+	conns    map[*Conn]struct{}
+	shutdown bool
+}
+
+// used by TLSNextProto and HandleTLSConnection
+var DefaultServer = &Server{}
+
 func HandleTLSConnection(conn net.Conn, handler http.Handler) {
+	DefaultServer.HandleTLSConnection(conn, handler)
+}
+
+// ConfigureServer makes hs serve "h2" and DraftProtos of s
+// negotiated by ALPN with s, nil is DefaultServer.
+// Shutdown of hs starts Shutdown of s, and waits its connections closed.
+// it fails for invalid SETTINGS or limits of s.
+func ConfigureServer(hs *http.Server, s *Server) error {
+	if s == nil {
+		s = DefaultServer
+	}
+	err := s.validate()
+	if err != nil {
+		return err
+	}
+	if hs.TLSConfig == nil {
+		hs.TLSConfig = new(tls.Config)
+	}
+	// h2 is preferred to drafts, and http/1.1 is kept as net/http does
+	accepted := append([]string{VERSION}, s.DraftProtos...)
+	var missing []string
+	for _, proto := range accepted {
+		if !containsString(hs.TLSConfig.NextProtos, proto) {
+			missing = append(missing, proto)
+		}
+	}
+	protos := append(missing, hs.TLSConfig.NextProtos...)
+	if !containsString(protos, "http/1.1") {
+		protos = append(protos, "http/1.1")
+	}
+	hs.TLSConfig.NextProtos = protos
+
+	if hs.TLSNextProto == nil {
+		hs.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	for _, proto := range accepted {
+		hs.TLSNextProto[proto] = func(hs *http.Server, conn *tls.Conn, handler http.Handler) {
+			Notice(Yellow("New Connection from %s"), conn.RemoteAddr())
+			s.HandleTLSConnection(conn, handler)
+		}
+	}
+	// called in its own goroutine, hs.Shutdown waits connections
+	hs.RegisterOnShutdown(func() {
+		s.Shutdown(context.Background())
+	})
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// SETTINGS of server's connection
+func (server *Server) settings() map[SettingsID]int32 {
+	settings := CopySettings(DefaultSettings)
+	for id, value := range server.Settings {
+		settings[id] = value
+	}
+	// server doesn't send SETTINGS_ENABLE_PUSH
+	delete(settings, SETTINGS_ENABLE_PUSH)
+	if server.MaxConcurrentStreams > 0 {
+		settings[SETTINGS_MAX_CONCURRENT_STREAMS] = int32(server.MaxConcurrentStreams)
+	}
+	if server.MaxHeaderBytes > 0 {
+		settings[SETTINGS_MAX_HEADER_LIST_SIZE] = int32(server.MaxHeaderBytes)
+	}
+	if server.MaxHeaderListSize > 0 {
+		settings[SETTINGS_MAX_HEADER_LIST_SIZE] = int32(server.MaxHeaderListSize)
+	}
+	if server.MaxReadFrameSize > 0 {
+		settings[SETTINGS_MAX_FRAME_SIZE] = int32(server.MaxReadFrameSize)
+	}
+	if server.InitialStreamWindow > 0 {
+		settings[SETTINGS_INITIAL_WINDOW_SIZE] = int32(server.InitialStreamWindow)
+	}
+	if server.HeaderTableSize > 0 {
+		settings[SETTINGS_HEADER_TABLE_SIZE] = int32(server.HeaderTableSize)
+	}
+	return settings
+}
+
+// checks SETTINGS and limits, which peer would treat as error
+func (server *Server) validate() error {
+	if server.MaxHeaderBytes > 0 && server.MaxHeaderListSize > 0 && int64(server.MaxHeaderBytes) != int64(server.MaxHeaderListSize) {
+		return fmt.Errorf("MaxHeaderBytes %v and MaxHeaderListSize %v differ", server.MaxHeaderBytes, server.MaxHeaderListSize)
+	}
+	if server.InitialConnWindow > 0 && (server.InitialConnWindow < DEFAULT_INITIAL_WINDOW_SIZE || int64(server.InitialConnWindow) > MAX_WINDOW_SIZE) {
+		return fmt.Errorf("InitialConnWindow %v should be between 65535 and 2^31-1", server.InitialConnWindow)
+	}
+	for id, value := range server.settings() {
+		// values over 2^31-1 get negative
+		if value < 0 {
+			return fmt.Errorf("%v %v exceeds 2^31-1", id, uint32(value))
+		}
+		switch id {
+		case SETTINGS_MAX_FRAME_SIZE:
+			if value < DEFAULT_MAX_FRAME_SIZE || value > 1<<24-1 {
+				return fmt.Errorf("%v %v should be between 2^14 and 2^24-1", id, value)
+			}
+		case SETTINGS_ENABLE_CONNECT_PROTOCOL:
+			if value != 0 && value != 1 {
+				return fmt.Errorf("%v %v should be 0 or 1", id, value)
+			}
+		}
+	}
+	return nil
+}
+
+// false if the server is shutting down
+func (server *Server) track(conn *Conn) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.shutdown {
+		return false
+	}
+	if server.conns == nil {
+		server.conns = make(map[*Conn]struct{})
+	}
+	server.conns[conn] = struct{}{}
+	return true
+}
+
+func (server *Server) untrack(conn *Conn) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	delete(server.conns, conn)
+}
+
+// shuts down all connections gracefully by Conn.Shutdown,
+// and new connections are closed. returns ctx.Err() if
+// connections are closed before streams complete.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.shutdown = true
+	conns := make([]*Conn, 0, len(server.conns))
+	for conn := range server.conns {
+		conns = append(conns, conn)
+	}
+	server.mu.Unlock()
+
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn *Conn) {
+			errs <- conn.Shutdown(ctx)
+		}(conn)
+	}
+	var err error
+	for range conns {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// options of Server.ServeConn
+type ServeConnOpts struct {
+	// nil is http.DefaultServeMux
+	Handler http.Handler
+
+	// parent of request contexts, nil is context.Background()
+	Context context.Context
+
+	// HTTP/1.1 request upgraded to h2c, served as stream 1
+	upgrade *h2cUpgrade
+}
+
+// ServeConn serves HTTP/2 on c, which is already negotiated like
+// TLS terminated by other process, until the connection closes.
+// it reads connection preface and sends SETTINGS first.
+// it may be called concurrently from accept loop, opts may be nil.
+func (server *Server) ServeConn(c net.Conn, opts *ServeConnOpts) {
+	if opts == nil {
+		opts = new(ServeConnOpts)
+	}
+	var handler http.Handler = http.DefaultServeMux
+	ctx := context.Background()
+	if opts.Handler != nil {
+		handler = opts.Handler
+	}
+	if opts.Context != nil {
+		ctx = opts.Context
+	}
+	server.serveConn(ctx, c, handler, opts.upgrade)
+}
+
+func (server *Server) HandleTLSConnection(conn net.Conn, handler http.Handler) {
 	Info("Handle TLS Connection")
+	server.serveConn(context.Background(), conn, handler, nil)
+}
+
+func (server *Server) serveConn(ctx context.Context, conn net.Conn, handler http.Handler, upgrade *h2cUpgrade) {
 	// do not call "defer conn.Close()" only retun function
 
-	Conn := NewConn(conn) // convert net.Conn to http2.Conn
+	// ConfigureServer reports it, but ServeConn can't
+	if err := server.validate(); err != nil {
+		Error("%v", err)
+		conn.Close()
+		return
+	}
+
+	Conn := newConn(ctx, conn, ServerRole) // convert net.Conn to http2.Conn
 
 	// http.Handler が req, res を必要とするので
 	// stream がそれを生成して、その stream を渡すことで
 	// req/res が用意できたタイミングで handler を呼ぶコールバックを
 	// 生成し Conn に持っておく。
-	Conn.CallBack = HandlerCallBack(handler)
+	Conn.CallBack = handlerCallBack(handler, conn)
+
+	Conn.ReadIdleTimeout = server.ReadIdleTimeout
+	if server.PingTimeout > 0 {
+		Conn.PingTimeout = server.PingTimeout
+	}
+	Conn.WriteTimeout = server.WriteTimeout
+	Conn.BadRequest = server.BadRequest
+	Conn.MaxRequestBodyBytes = server.MaxRequestBodyBytes
+	if server.MaxConcurrentPushes > 0 {
+		Conn.MaxConcurrentPushes = server.MaxConcurrentPushes
+	}
+	if server.DisablePush {
+		Conn.MaxConcurrentPushes = 0
+	}
+	Conn.IdleTimeout = server.IdleTimeout
+	if server.ReadHeaderTimeout > 0 {
+		Conn.ReadHeaderTimeout = server.ReadHeaderTimeout
+	}
+	if server.SettingsTimeout > 0 {
+		Conn.SettingsTimeout = server.SettingsTimeout
+	}
+	if server.MaxRapidResets > 0 {
+		Conn.MaxRapidResets = server.MaxRapidResets
+	}
+	if server.RapidResetWindow > 0 {
+		Conn.RapidResetWindow = server.RapidResetWindow
+	}
+	if server.MaxQueuedControlFrames > 0 {
+		Conn.MaxQueuedControlFrames = server.MaxQueuedControlFrames
+	}
+
+	// connection is served without recording, if capture fails
+	if server.CaptureDir != "" {
+		name := fmt.Sprintf("%d.h2cap", time.Now().UnixNano())
+		file, err := os.Create(filepath.Join(server.CaptureDir, name))
+		if err != nil {
+			Error("record frames: %v", err)
+		} else {
+			defer file.Close()
+			Notice("record frames to %v", file.Name())
+			Conn.Record(file)
+		}
+	}
+
+	// HTTP2-Settings of h2c upgrade is SETTINGS of peer,
+	// acknowledged by 101 response (RFC 7540 3.2.1)
+	if upgrade != nil {
+		err := Conn.applyPeerSettings(upgrade.settings)
+		if err != nil {
+			Error("%v", err)
+			Conn.Close()
+			return
+		}
+	}
 
 	err := Conn.ReadMagic()
 	if err != nil {
 		Error("%v", err)
+		Conn.Close()
 		return
 	}
 
-	// 別 goroutine で WriteChann に送った
-	// frame を書き込むループを回す
-	go Conn.WriteLoop()
+	// TLS is checked after preface, so peer can read GOAWAY
+	if !server.PermitInsecureTLS {
+		if connectionError := tlsSecurityError(conn); connectionError != nil {
+			Error("%v", connectionError)
+			Conn.GoAway(0, connectionError)
+			Conn.Close()
+			return
+		}
+	}
 
 	// send default settings to id 0
-	settingsFrame := NewSettingsFrame(UNSET, 0, DefaultSettings)
-	Conn.WriteChan <- settingsFrame
+	// before WriteLoop starts, so it goes first.
+	// it is written while reading, since peer may be writing
+	// its SETTINGS too on unbuffered conn like net.Pipe
+	settings := server.settings()
+	Conn.Framer.SetMaxReadFrameSize(settings[SETTINGS_MAX_FRAME_SIZE])
+	Conn.Framer.SetMaxHeaderListSize(settings[SETTINGS_MAX_HEADER_LIST_SIZE])
+	// connection window is not in SETTINGS,
+	// it is raised before peer knows by WINDOW_UPDATE
+	var connWindowIncrement int32
+	if server.InitialConnWindow > 0 {
+		connWindowIncrement = Conn.Window.UpdateLocalInitialSize(int32(server.InitialConnWindow))
+	}
+	go func() {
+		err := Conn.WriteSettings(settings)
+		if err != nil {
+			Error("%v", err)
+			Conn.Close()
+			return
+		}
+		if connWindowIncrement > 0 {
+			err := Conn.WriteFrame(NewWindowUpdateFrame(0, uint32(connWindowIncrement)))
+			if err != nil {
+				Error("%v", err)
+				Conn.Close()
+				return
+			}
+		}
+
+		// 別 goroutine で WriteChann に送った
+		// frame を書き込むループを回す
+		Conn.WriteLoop()
+	}()
+
+	if !server.track(Conn) {
+		Info("close connection after shutdown")
+		Conn.Close()
+		return
+	}
+	defer server.untrack(Conn)
+
+	if upgrade != nil {
+		err := Conn.upgradeStream(upgrade.header, upgrade.body)
+		if err != nil {
+			Error("%v", err)
+			Conn.Close()
+			return
+		}
+	}
 
 	// 送られてきた frame を読み出すループを回す
 	// ここで block する。
@@ -61,23 +468,193 @@ func HandleTLSConnection(conn net.Conn, handler http.Handler) {
 	// 読み込んだフレームでエラーがあったら、
 	// ReadLoop を抜けてここに来る。
 	// その場合、 Close() を呼ぶ。
-	// これはストリームやチャネルを閉じるだけで、
-	// net.Conn は close しない
+	// ストリームと net.Conn を閉じる
 	Conn.Close()
 
 	Info("return TLSNextProto will close connection")
 	return
 }
 
+// validates pseudo headers of request (RFC 7540 8.1.2.3)
+// malformed request is stream error of PROTOCOL_ERROR.
+func ValidateRequestHeader(streamID uint32, header http.Header) error {
+	var msg string
+	for _, name := range []string{":method", ":scheme", ":path", ":authority", ":protocol"} {
+		if len(header[name]) > 1 {
+			msg = fmt.Sprintf("duplicated pseudo header %v", name)
+		}
+	}
+	// Host may be sent with :authority, but must not differ (RFC 7540 8.1.2.3)
+	if authority := header[":authority"]; len(authority) > 0 {
+		for _, host := range header["Host"] {
+			if !strings.EqualFold(host, authority[0]) {
+				msg = fmt.Sprintf("Host %v differs from :authority %v", host, authority[0])
+			}
+		}
+	}
+	switch {
+	case msg != "":
+	case len(header[":status"]) > 0:
+		msg = "request has response pseudo header :status"
+	case len(header[":method"]) == 0:
+		msg = "request lacks :method"
+	case len(header[":protocol"]) > 0 && header.Get(":method") != "CONNECT":
+		msg = ":protocol is only for CONNECT"
+	case header.Get(":method") == "CONNECT" && len(header[":protocol"]) == 0:
+		// CONNECT has only :authority (RFC 7540 8.3)
+		// extended CONNECT has :scheme and :path as other requests (RFC 8441 4)
+		if len(header[":authority"]) == 0 || len(header[":scheme"]) > 0 || len(header[":path"]) > 0 {
+			msg = "CONNECT request should have only :authority"
+		}
+	case len(header[":scheme"]) == 0:
+		msg = "request lacks :scheme"
+	case !validScheme(header.Get(":scheme")):
+		msg = fmt.Sprintf("request has invalid :scheme %q", header.Get(":scheme"))
+	case len(header[":path"]) == 0:
+		msg = "request lacks :path"
+	case header.Get(":path") == "":
+		msg = "request has empty :path"
+	case header.Get(":path") == "*" && header.Get(":method") != "OPTIONS":
+		msg = "asterisk-form :path is only for OPTIONS"
+	case header.Get(":path") != "*" && !strings.HasPrefix(header.Get(":path"), "/"):
+		msg = "request has :path not in origin-form"
+	case len(header["Content-Length"]) > 1:
+		msg = "request has multiple content-length"
+	case len(header["Content-Length"]) == 1 && util.ContentLength(header) < 0:
+		msg = fmt.Sprintf("request has invalid content-length %q", header.Get("Content-Length"))
+	}
+	if msg == "" {
+		return nil
+	}
+	Error("malformed request: %v", msg)
+	return &StreamError{StreamID: streamID, Code: PROTOCOL_ERROR}
+}
+
+// malformed request is stream error of PROTOCOL_ERROR (RFC 7540 8.1.2.6),
+// or 400 by Conn.BadRequest. other streams of the connection go on.
+func malformedRequest(stream *Stream) {
+	if stream.badRequest {
+		reject(stream, http.StatusBadRequest)
+		return
+	}
+	stream.Write(NewRstStreamFrame(stream.ID, PROTOCOL_ERROR))
+}
+
+// answers the request by status without handler,
+// rest of request body is stopped by RST_STREAM(NO_ERROR)
+func reject(stream *Stream, status int) {
+	res := NewResponseWriter(stream)
+	res.WriteHeader(status)
+	if res.sendHeader(true) == nil && stream.CurrentState() == HALF_CLOSED_LOCAL {
+		stream.Bucket.Body.CloseWithError(ErrBodyClosed)
+		stream.Write(NewRstStreamFrame(stream.ID, NO_ERROR))
+	}
+}
+
+// :scheme is not only http and https, like gateway to other scheme.
+// scheme = ALPHA *( ALPHA / DIGIT / "+" / "-" / "." ) (RFC 3986 3.1)
+func validScheme(scheme string) bool {
+	if scheme == "" {
+		return false
+	}
+	for i, c := range scheme {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Request.URL from pseudo headers, its String() is the target URI.
+// asterisk-form is URL of only Path "*", and CONNECT is of only Host
+// like net/http. extended CONNECT has full URL.
+func requestURL(method, scheme, authority, path string) (*neturl.URL, error) {
+	if method == "CONNECT" && path == "" {
+		return &neturl.URL{Host: authority}, nil
+	}
+	if path == "*" {
+		return &neturl.URL{Path: "*"}, nil
+	}
+	url, err := neturl.ParseRequestURI(path)
+	if err != nil {
+		return nil, err
+	}
+	url.Scheme = scheme
+	url.Host = authority
+	return url, nil
+}
+
+// runs handler, recovering its panic not to kill other streams
+// of the connection. http.ErrAbortHandler is returned without
+// logging stack like net/http.
+func serveHTTP(handler http.Handler, res http.ResponseWriter, req *http.Request) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if r == http.ErrAbortHandler {
+			err = http.ErrAbortHandler
+			return
+		}
+		Error("panic serving %v: %v\n%s", req.URL, r, debug.Stack())
+		err = fmt.Errorf("panic: %v", r)
+	}()
+	handler.ServeHTTP(res, req)
+	return nil
+}
+
 // handler を受け取って、将来 stream が渡されたら
 // その Bucket につめられた Headers/Data フレームから
 // req/res を作って handler を実行する関数を生成
 func HandlerCallBack(handler http.Handler) CallBack {
+	return handlerCallBack(handler, nil)
+}
+
+// request has RemoteAddr of conn, and TLS if it is *tls.Conn
+func handlerCallBack(handler http.Handler, conn net.Conn) CallBack {
 	return func(stream *Stream) {
 		header := stream.Bucket.Headers
 		body := stream.Bucket.Body
 
+		// request header over our SETTINGS_MAX_HEADER_LIST_SIZE or
+		// malformed one is discarded by conn, and answered without handler
+		if stream.rejected > 0 {
+			reject(stream, stream.rejected)
+			return
+		}
+
+		err := ValidateRequestHeader(stream.ID, header)
+		if err != nil {
+			malformedRequest(stream)
+			return
+		}
+
+		// extended CONNECT is allowed by our SETTINGS_ENABLE_CONNECT_PROTOCOL,
+		// and :protocol is left in Request.Header for handler (RFC 8441 4)
+		if len(header[":protocol"]) > 0 && stream.Settings.Local(SETTINGS_ENABLE_CONNECT_PROTOCOL) == 0 {
+			Error("malformed request: :protocol without SETTINGS_ENABLE_CONNECT_PROTOCOL")
+			malformedRequest(stream)
+			return
+		}
+
+		// declared body over MaxRequestBodyBytes is not read
+		if stream.maxBody > 0 && util.ContentLength(header) > stream.maxBody {
+			Error("content-length of stream(%v) exceeds %v bytes", stream.ID, stream.maxBody)
+			reject(stream, http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// request converted from HTTP/1.1 has Host instead of :authority,
+		// which is Request.Host and removed from Request.Header like net/http
 		authority := header.Get(":authority")
+		if authority == "" {
+			authority = header.Get("Host")
+		}
+		header.Del("Host")
 		method := header.Get(":method")
 		path := header.Get(":path")
 		scheme := header.Get(":scheme")
@@ -87,92 +664,183 @@ func HandlerCallBack(handler http.Handler) CallBack {
 		header.Del(":path")
 		header.Del(":scheme")
 
-		rawurl := fmt.Sprintf("%s://%s%s", scheme, authority, path)
-		url, err := neturl.ParseRequestURI(rawurl)
+		url, err := requestURL(method, scheme, authority, path)
 		if err != nil {
-			Fatal("%v", err)
+			Error("malformed request: %v", err)
+			malformedRequest(stream)
+			return
 		}
 
 		req := &http.Request{
 			Method:           method,
 			URL:              url,
-			Proto:            "HTTP/1.1",
-			ProtoMajor:       1,
-			ProtoMinor:       1,
+			Proto:            "HTTP/2.0",
+			ProtoMajor:       2,
+			ProtoMinor:       0,
 			Header:           header,
+			Trailer:          stream.Bucket.Trailer,
 			Body:             body,
-			ContentLength:    int64(body.Buffer.Len()),
+			ContentLength:    util.ContentLength(header),
 			TransferEncoding: []string{}, // TODO:
 			Close:            false,
 			Host:             authority,
 		}
+		if conn != nil {
+			req.RemoteAddr = conn.RemoteAddr().String()
+		}
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			req.TLS = &state
+		}
+		req = req.WithContext(stream.Context())
 
 		Info("\n%s", Lime(util.RequestString(req)))
 
 		// Handle HTTP using handler
-		res := NewResponseWriter()
-		handler.ServeHTTP(res, req)
-		responseHeader := res.Header()
-		responseHeader.Add(":status", strconv.Itoa(res.status))
-
-		Info("\n%s", Aqua((res.String())))
+		res := NewResponseWriter(stream)
+		res.request = req
+
+		// client waits 100 Continue until handler reads the body,
+		// if handler responds without reading, the body is reset after it
+		if strings.EqualFold(header.Get("Expect"), "100-continue") {
+			header.Del("Expect")
+			body.OnFirstRead = res.sendContinue
+		}
+		err = serveHTTP(handler, res, req)
+		close(res.handlerDone)
+		if err == http.ErrAbortHandler {
+			stream.Write(NewRstStreamFrame(stream.ID, INTERNAL_ERROR))
+			return
+		}
+		if err != nil {
+			// flushed response can not be replaced
+			if res.headerSent {
+				stream.Write(NewRstStreamFrame(stream.ID, INTERNAL_ERROR))
+				return
+			}
+			// response is buffered and not sent yet,
+			// so it is replaced with 500
+			res = NewResponseWriter(stream)
+			res.WriteHeader(http.StatusInternalServerError)
+		}
 
-		// Send response headers as HEADERS Frame
-		headerList := hpack.ToHeaderList(responseHeader)
-		headerBlockFragment := stream.HpackContext.Encode(*headerList)
-		Debug("%v", headerList)
+		// aborted by RST_STREAM or connection error
+		if stream.Context().Err() != nil {
+			Error("stream(%v) closed before response", stream.ID)
+			return
+		}
 
-		headersFrame := NewHeadersFrame(END_HEADERS, stream.ID, nil, headerBlockFragment, nil)
-		headersFrame.Headers = responseHeader
+		// request body over MaxRequestBodyBytes is cut off, and handler
+		// which got the error by Read is answered by 413 if the response
+		// is not sent yet. handler which stopped reading before it, like
+		// with smaller http.MaxBytesReader, keeps its response and the
+		// rest of the body is reset below.
+		var maxBytesError *http.MaxBytesError
+		if errors.As(body.ReadErr(), &maxBytesError) {
+			if res.headerSent {
+				stream.Write(NewRstStreamFrame(stream.ID, CANCEL))
+				return
+			}
+			res = NewResponseWriter(stream)
+			res.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
 
-		stream.Write(headersFrame)
+		// handler without Write nor WriteHeader is 200
+		if !res.wroteHeader {
+			res.WriteHeader(http.StatusOK)
+		}
 
-		// Send response body as DATA Frame
-		// each DataFrame has data in window size
+		// Send response headers as HEADERS Frame, if not flushed
+		// without body and trailer, HEADERS ends the stream
+		trailer := res.trailer()
 		data := res.body.Bytes()
-		maxFrameSize := stream.PeerSettings[SETTINGS_MAX_FRAME_SIZE]
-		rest := int32(len(data))
-		frameSize := rest
-
-		// MaxFrameSize を基準に考え、そこから送れるサイズまで減らして行く
-		for {
-			Debug("rest data size(%v), current peer(%v) window(%v)", rest, stream.ID, stream.Window)
-
-			// 送り終わってれば終わり
-			if rest == 0 {
-				break
+		flushed := res.headerSent
+		// whole body is known if it is not flushed, so content-length is set
+		// unless handler sets it like http.ServeContent.
+		// HEAD has content-length of body which GET would have.
+		if !flushed && bodyAllowed(res.status) && res.sentHeader.Get("Content-Length") == "" {
+			if req.Method != "HEAD" {
+				res.sentHeader.Set("Content-Length", strconv.Itoa(len(data)))
+			} else if res.discarded > 0 {
+				res.sentHeader.Set("Content-Length", strconv.FormatInt(res.discarded, 10))
 			}
-
-			frameSize = stream.Window.Consumable(rest)
-
-			if frameSize <= 0 {
-				continue
+		}
+		if !flushed {
+			err = res.sendHeader(len(data) == 0 && len(trailer) == 0)
+			if err != nil {
+				return
 			}
+		}
 
-			// MaxFrameSize より大きいなら切り詰める
-			if frameSize > maxFrameSize {
-				frameSize = maxFrameSize
+		// Send response body as DATA Frame
+		// buffered writes of handler are sent together,
+		// split in peer's SETTINGS_MAX_FRAME_SIZE and window size
+		// trailer ends the stream instead of the last DATA,
+		// and empty DATA ends the flushed stream without them
+		if len(data) > 0 || flushed && len(trailer) == 0 {
+			err = stream.WriteData(data, len(trailer) == 0)
+			if err != nil {
+				Error("stream(%v) closed while sending response: %v", stream.ID, err)
+				return
 			}
+		}
 
-			Debug("send %v/%v data", frameSize, rest)
-
-			// ここまでに算出した frameSize 分のデータを DATA Frame を作って送る
-			dataToSend := make([]byte, frameSize)
-			copy(dataToSend, data[:frameSize])
-			dataFrame := NewDataFrame(UNSET, stream.ID, dataToSend, nil)
-			stream.Write(dataFrame)
-
-			// 送った分を削る
-			rest -= frameSize
-			copy(data, data[frameSize:])
-			data = data[:rest]
+		if len(trailer) > 0 {
+			trailerFrame := NewHeadersFrame(END_STREAM+END_HEADERS, stream.ID, nil, nil, nil)
+			trailerFrame.Headers = trailer
+			trailerFrame.HpackContext = stream.PeerHpackContext
+			stream.Write(trailerFrame)
+		}
 
-			// Peer の Window Size を減らす
-			stream.Window.ConsumePeer(frameSize)
+		// handler may return before the request body ends,
+		// rest of it is stopped by RST_STREAM(NO_ERROR) (RFC 7540 8.1)
+		if stream.CurrentState() == HALF_CLOSED_LOCAL {
+			Debug("stream(%v) responded before request body ends", stream.ID)
+			body.CloseWithError(ErrBodyClosed)
+			stream.Write(NewRstStreamFrame(stream.ID, NO_ERROR))
 		}
+	}
+}
 
-		// End Stream in empty DATA Frame
-		endDataFrame := NewDataFrame(END_STREAM, stream.ID, nil, nil)
-		stream.Write(endDataFrame)
+// cipher suites of RFC 7540 Appendix A, which crypto/tls implements
+var prohibitedCipherSuites = map[uint16]bool{
+	tls.TLS_RSA_WITH_RC4_128_SHA:                true,
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:           true,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            true,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            true,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         true,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         true,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         true,
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    true,
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:          true,
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:     true,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      true,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: true,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   true,
+}
+
+// checks TLS of conn by RFC 7540 9.2, nil if conn is not TLS.
+// crypto/tls does neither compression nor renegotiation as server.
+// SNI is not required, since client connecting to IP address can't send it.
+func tlsSecurityError(conn net.Conn) *ConnectionError {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	var msg string
+	switch {
+	case state.Version < tls.VersionTLS12:
+		msg = fmt.Sprintf("TLS version 0x%x is lower than TLS 1.2", state.Version)
+	case prohibitedCipherSuites[state.CipherSuite]:
+		msg = fmt.Sprintf("prohibited cipher suite %s", tls.CipherSuiteName(state.CipherSuite))
+	case !state.NegotiatedProtocolIsMutual:
+		msg = "protocol is not negotiated by ALPN"
+	default:
+		return nil
 	}
+	return &ConnectionError{Code: INADEQUATE_SECURITY, Reason: msg}
 }
@@ -0,0 +1,2946 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	assert "github.com/Jxck/assertion"
+	. "github.com/Jxck/http2/frame"
+	"github.com/Jxck/http2/hpack"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateRequestHeader(t *testing.T) {
+	// h2spec 8.1.2.3
+	var cases = []struct {
+		header http.Header
+		ok     bool
+	}{
+		{http.Header{":method": {"GET"}, ":scheme": {"http"}, ":path": {"/"}}, true},
+		{http.Header{":method": {"CONNECT"}, ":authority": {"example.com:443"}}, true},
+		{http.Header{":scheme": {"http"}, ":path": {"/"}}, false},
+		{http.Header{":method": {"GET"}, ":path": {"/"}}, false},
+		{http.Header{":method": {"GET"}, ":scheme": {"http"}}, false},
+		{http.Header{":method": {"GET"}, ":scheme": {"http"}, ":path": {""}}, false},
+		{http.Header{":method": {"GET", "GET"}, ":scheme": {"http"}, ":path": {"/"}}, false},
+		{http.Header{":method": {"GET"}, ":scheme": {"http"}, ":path": {"/"}, ":status": {"200"}}, false},
+		{http.Header{":method": {"CONNECT"}, ":scheme": {"http"}, ":path": {"/"}}, false},
+		{http.Header{":method": {"OPTIONS"}, ":scheme": {"http"}, ":path": {"*"}}, true},
+		// extended CONNECT (RFC 8441 4)
+		{http.Header{":method": {"CONNECT"}, ":protocol": {"websocket"}, ":scheme": {"https"}, ":path": {"/chat"}, ":authority": {"example.com"}}, true},
+		{http.Header{":method": {"CONNECT"}, ":protocol": {"websocket"}, ":authority": {"example.com"}}, false},
+		{http.Header{":method": {"GET"}, ":protocol": {"websocket"}, ":scheme": {"https"}, ":path": {"/chat"}}, false},
+		{http.Header{":method": {"GET"}, ":scheme": {"coap+tcp"}, ":path": {"/"}}, true},
+		{http.Header{":method": {"GET"}, ":scheme": {""}, ":path": {"/"}}, false},
+		{http.Header{":method": {"GET"}, ":scheme": {"1http"}, ":path": {"/"}}, false},
+		{http.Header{":method": {"GET"}, ":scheme": {"http:"}, ":path": {"/"}}, false},
+		{http.Header{":method": {"GET"}, ":scheme": {"http"}, ":path": {"*"}}, false},
+		{http.Header{":method": {"GET"}, ":scheme": {"http"}, ":path": {"index.html"}}, false},
+		{http.Header{":method": {"GET"}, ":scheme": {"http"}, ":path": {"http://example.com/"}}, false},
+		// Host and :authority
+		{http.Header{":method": {"GET"}, ":scheme": {"http"}, ":path": {"/"}, "Host": {"example.com"}}, true},
+		{http.Header{":method": {"GET"}, ":scheme": {"http"}, ":path": {"/"}, ":authority": {"example.com"}, "Host": {"Example.com"}}, true},
+		{http.Header{":method": {"GET"}, ":scheme": {"http"}, ":path": {"/"}, ":authority": {"example.com"}, "Host": {"example.org"}}, false},
+		{http.Header{":method": {"GET"}, ":scheme": {"http"}, ":path": {"/"}, ":authority": {"example.com:443"}, "Host": {"example.com"}}, false},
+		// content-length
+		{http.Header{":method": {"POST"}, ":scheme": {"http"}, ":path": {"/"}, "Content-Length": {"5"}}, true},
+		{http.Header{":method": {"POST"}, ":scheme": {"http"}, ":path": {"/"}, "Content-Length": {"five"}}, false},
+		{http.Header{":method": {"POST"}, ":scheme": {"http"}, ":path": {"/"}, "Content-Length": {"-1"}}, false},
+		{http.Header{":method": {"POST"}, ":scheme": {"http"}, ":path": {"/"}, "Content-Length": {"5", "5"}}, false},
+	}
+
+	for _, c := range cases {
+		err := ValidateRequestHeader(1, c.header)
+		if c.ok {
+			if err != nil {
+				t.Errorf("%v: got %v want nil", c.header, err)
+			}
+			continue
+		}
+		streamError, ok := err.(*StreamError)
+		if !ok {
+			t.Errorf("%v: got %v want StreamError", c.header, err)
+			continue
+		}
+		if streamError.Code != PROTOCOL_ERROR {
+			t.Errorf("%v: got %v want PROTOCOL_ERROR", c.header, streamError.Code)
+		}
+	}
+}
+
+func TestMalformedRequest(t *testing.T) {
+	headers := func(header http.Header) func() []Frame {
+		return func() []Frame {
+			frame := postHeaders(1)
+			frame.Flags += END_STREAM
+			for name, values := range header {
+				if values == nil {
+					delete(frame.Headers, name)
+				} else {
+					frame.Headers[name] = values
+				}
+			}
+			return []Frame{frame}
+		}
+	}
+
+	// RFC 7540 8.1.2.6
+	cases := []struct {
+		name    string
+		frames  func() []Frame
+		request bool // answered by 400 on BadRequest, or reset
+	}{
+		{"missing :method", headers(http.Header{":method": nil}), true},
+		{"relative :path", headers(http.Header{":path": {"index.html"}}), true},
+		{"invalid content-length", headers(http.Header{"content-length": {"five"}}), true},
+		{"uppercase header name", func() []Frame {
+			// literal "X-Upper: v" without indexing
+			hb := append(getExampleHeaderBlock(), 0x00, 7)
+			hb = append(append(hb, "X-Upper"...), 1, 'v')
+			return []Frame{NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)}
+		}, true},
+		{"connection-specific header", func() []Frame {
+			hb := append(getExampleHeaderBlock(), 0x00, 10)
+			hb = append(append(hb, "connection"...), 5)
+			hb = append(hb, "close"...)
+			return []Frame{NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)}
+		}, true},
+		// body is reset, even if 400 is preferred
+		{"content-length mismatch", func() []Frame {
+			frame := postHeaders(1)
+			frame.Headers["content-length"] = []string{"10"}
+			return []Frame{frame, NewDataFrame(END_STREAM, 1, []byte("hello"), nil)}
+		}, false},
+	}
+
+	for _, c := range cases {
+		for _, badRequest := range []bool{false, true} {
+			writes, frames := serveTest(t, &Server{BadRequest: badRequest}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(ioutil.Discard, r.Body)
+			}))
+			writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+			for _, frame := range c.frames() {
+				writes <- frame
+			}
+			// other stream of the connection is not affected
+			hb := getExampleHeaderBlock()
+			writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 3, nil, hb, nil)
+
+			ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+			results := map[uint32]string{}
+			for len(results) < 2 {
+				switch frame := nextFrame(t, frames).(type) {
+				case *HeadersFrame:
+					assert.Equal(t, frame.Decode(ctx), nil)
+					results[frame.StreamID] = frame.Headers.Get(":status")
+				case *RstStreamFrame:
+					results[frame.StreamID] = frame.ErrorCode.String()
+				case *GoAwayFrame:
+					t.Fatalf("%v: connection is closed by %v", c.name, frame.ErrorCode)
+				}
+			}
+
+			want := ErrorCode(PROTOCOL_ERROR).String()
+			if badRequest && c.request {
+				want = "400"
+			}
+			if results[1] != want {
+				t.Errorf("%v (BadRequest %v): got %v want %v", c.name, badRequest, results[1], want)
+			}
+			assert.Equal(t, results[3], "200")
+		}
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	cases := []struct {
+		authority, host string // empty is absent
+		want            string // empty is malformed
+	}{
+		{"example.com:8443", "", "example.com:8443"},
+		{"[::1]:8443", "", "[::1]:8443"},
+		{"example.com", "example.com", "example.com"},
+		// HTTP/1.1 upgraded request
+		{"", "example.org", "example.org"},
+		{"example.com", "example.org", ""},
+	}
+
+	for _, c := range cases {
+		requests := make(chan *http.Request, 1)
+		writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r
+		}))
+		writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+		headers := postHeaders(1)
+		headers.Flags += END_STREAM
+		headers.Headers[":method"] = []string{"GET"}
+		delete(headers.Headers, ":authority")
+		if c.authority != "" {
+			headers.Headers[":authority"] = []string{c.authority}
+		}
+		if c.host != "" {
+			headers.Headers["host"] = []string{c.host}
+		}
+		writes <- headers
+
+		if c.want == "" {
+			rst := waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+			assert.Equal(t, rst.ErrorCode, ErrorCode(PROTOCOL_ERROR))
+			continue
+		}
+		select {
+		case r := <-requests:
+			assert.Equal(t, r.Host, c.want)
+			assert.Equal(t, r.URL.Host, c.want)
+			assert.Equal(t, len(r.Header["Host"]), 0)
+		case <-time.After(time.Second):
+			t.Fatalf("%v: request timeout", c.authority)
+		}
+	}
+}
+
+func TestRequestURL(t *testing.T) {
+	cases := []struct {
+		method, path string
+		url          string // empty is malformed
+		urlPath      string
+		query        string
+	}{
+		{"GET", "/", "https://example.com/", "/", ""},
+		{"GET", "/search?q=go&lang=ja", "https://example.com/search?q=go&lang=ja", "/search", "q=go&lang=ja"},
+		{"GET", "/a%2Fb/%E3%81%82?q=%20", "https://example.com/a%2Fb/%E3%81%82?q=%20", "/a/b/あ", "q=%20"},
+		{"OPTIONS", "*", "*", "*", ""},
+		{"GET", "*", "", "", ""},
+		{"GET", "", "", "", ""},
+		{"GET", "/bad%zz", "", "", ""},
+	}
+
+	for _, c := range cases {
+		requests := make(chan *http.Request, 1)
+		writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r
+		}))
+		writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+		headers := postHeaders(1)
+		headers.Flags += END_STREAM
+		headers.Headers[":method"] = []string{c.method}
+		headers.Headers[":path"] = []string{c.path}
+		writes <- headers
+
+		if c.url == "" {
+			rst := waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+			assert.Equal(t, rst.ErrorCode, ErrorCode(PROTOCOL_ERROR))
+			continue
+		}
+		select {
+		case r := <-requests:
+			assert.Equal(t, r.URL.String(), c.url)
+			assert.Equal(t, r.URL.Path, c.urlPath)
+			assert.Equal(t, r.URL.RawQuery, c.query)
+		case <-time.After(time.Second):
+			t.Fatalf("%v %v: request timeout", c.method, c.path)
+		}
+	}
+}
+
+func TestRequestScheme(t *testing.T) {
+	cases := []struct {
+		method, scheme string // empty scheme is absent
+		url            string // empty is malformed
+	}{
+		{"GET", "https", "https://example.com/"},
+		{"GET", "http", "http://example.com/"},
+		{"GET", "ws", "ws://example.com/"},
+		{"GET", "", ""},
+		// CONNECT has neither :scheme nor :path
+		{"CONNECT", "", "//example.com"},
+	}
+
+	for _, c := range cases {
+		requests := make(chan *http.Request, 1)
+		writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r
+		}))
+		writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+		headers := postHeaders(1)
+		headers.Flags += END_STREAM
+		headers.Headers[":method"] = []string{c.method}
+		delete(headers.Headers, ":scheme")
+		if c.scheme != "" {
+			headers.Headers[":scheme"] = []string{c.scheme}
+		}
+		if c.method == "CONNECT" {
+			delete(headers.Headers, ":path")
+		}
+		writes <- headers
+
+		if c.url == "" {
+			rst := waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+			assert.Equal(t, rst.ErrorCode, ErrorCode(PROTOCOL_ERROR))
+			continue
+		}
+		select {
+		case r := <-requests:
+			assert.Equal(t, r.URL.Scheme, c.scheme)
+			assert.Equal(t, r.URL.String(), c.url)
+		case <-time.After(time.Second):
+			t.Fatalf("%v %v: request timeout", c.method, c.scheme)
+		}
+	}
+}
+
+func TestConnectTunnel(t *testing.T) {
+	targets := make(chan string, 1)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		targets <- r.Host
+		// echo
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, r.Body)
+	}))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+	// CONNECT has neither :scheme nor :path (RFC 7540 8.3)
+	headers := NewHeadersFrame(END_HEADERS, 1, nil, nil, nil)
+	headers.Headers = http.Header{
+		":method":    {"CONNECT"},
+		":authority": {"echo.example.com:7"},
+	}
+	headers.HpackContext = hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	writes <- headers
+
+	// 2xx is sent before tunneled data
+	ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	response := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+	assert.Equal(t, response.Header().Flags, Flag(END_HEADERS))
+	assert.Equal(t, response.Decode(ctx), nil)
+	assert.Equal(t, response.Headers.Get(":status"), "200")
+	assert.Equal(t, <-targets, "echo.example.com:7")
+
+	for _, message := range []string{"ping", "pong"} {
+		writes <- NewDataFrame(UNSET, 1, []byte(message), nil)
+		data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+		assert.Equal(t, data.Header().Flags, Flag(UNSET))
+		assert.Equal(t, string(data.Data), message)
+	}
+
+	// END_STREAM of client closes the tunnel
+	writes <- NewDataFrame(END_STREAM, 1, nil, nil)
+	data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+	assert.Equal(t, data.Header().Flags, Flag(END_STREAM))
+	assert.Equal(t, len(data.Data), 0)
+}
+
+func TestExtendedConnect(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+		message := make([]byte, 4)
+		io.ReadFull(r.Body, message)
+		w.Write(append([]byte("echo "), message...))
+	}))
+
+	// server allows extended CONNECT
+	settings := waitFrame(t, frames, SettingsFrameType).(*SettingsFrame)
+	assert.Equal(t, settings.Settings[SETTINGS_ENABLE_CONNECT_PROTOCOL], int32(1))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+	headers := NewHeadersFrame(END_HEADERS, 1, nil, nil, nil)
+	headers.Headers = http.Header{
+		":method":               {"CONNECT"},
+		":protocol":             {"websocket"},
+		":scheme":               {"https"},
+		":authority":            {"example.com"},
+		":path":                 {"/chat"},
+		"sec-websocket-version": {"13"},
+	}
+	headers.HpackContext = hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	writes <- headers
+
+	r := <-requests
+	assert.Equal(t, r.Method, "CONNECT")
+	assert.Equal(t, r.Header.Get(":protocol"), "websocket")
+	assert.Equal(t, r.URL.String(), "https://example.com/chat")
+
+	ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	response := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+	assert.Equal(t, response.Decode(ctx), nil)
+	assert.Equal(t, response.Headers.Get(":status"), "200")
+
+	// both directions on the stream
+	data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+	assert.Equal(t, string(data.Data), "hello")
+	writes <- NewDataFrame(UNSET, 1, []byte("ping"), nil)
+	data = waitFrame(t, frames, DataFrameType).(*DataFrame)
+	assert.Equal(t, string(data.Data), "echo ping")
+}
+
+func TestCompressionErrorGoAway(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	called := make(chan bool, 4)
+	aborted := make(chan bool, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- true
+		select {
+		case <-r.Context().Done():
+			aborted <- true
+		case <-time.After(3 * time.Second):
+			aborted <- false
+		}
+	})
+	go HandleTLSConnection(server, handler)
+
+	// frames from server until the connection is closed
+	framer := NewFramer(client, client)
+	frames := readFrames(framer)
+
+	client.Write([]byte(CONNECTION_PREFACE))
+	framer.WriteFrame(NewSettingsFrame(UNSET, 0, NilSettings))
+
+	hb := getExampleHeaderBlock()
+	framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil))
+	<-called
+
+	// index 127 is past the dynamic table, and the frames after it
+	// are not processed. written from other goroutine, since
+	// the server may close the connection without reading them.
+	go func() {
+		framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, 3, nil, []byte{0xff, 0x00}, nil))
+		framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, 5, nil, hb, nil))
+		framer.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+	}()
+
+	var goaway *GoAwayFrame
+	for frame := range frames {
+		switch frame := frame.(type) {
+		case *GoAwayFrame:
+			goaway = frame
+		case *PingFrame:
+			t.Error("PING after the bad block is answered")
+		case *HeadersFrame:
+			if frame.StreamID == 5 {
+				t.Error("HEADERS after the bad block is answered")
+			}
+		}
+	}
+
+	if goaway == nil {
+		t.Fatal("connection closed without GOAWAY")
+	}
+	if goaway.ErrorCode != COMPRESSION_ERROR {
+		t.Errorf("got %v want COMPRESSION_ERROR", goaway.ErrorCode)
+	}
+	if goaway.LastStreamID != 1 {
+		t.Errorf("got last stream id %v want 1", goaway.LastStreamID)
+	}
+
+	if !<-aborted {
+		t.Error("in-flight handler should be aborted")
+	}
+	if len(called) > 0 {
+		t.Error("handler is called for the stream after the bad block")
+	}
+}
+
+// client side of HandleTLSConnection after preface.
+// frames are written from other goroutine, not to block reading
+// invalid Huffman padding reaches the peer as COMPRESSION_ERROR
+func TestHuffmanPaddingGoAway(t *testing.T) {
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+	// :path "a" with 8 bits of padding
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, []byte{0x04, 0x82, 0x1f, 0xff}, nil)
+
+	goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, goaway.ErrorCode, COMPRESSION_ERROR)
+}
+
+func newTestServer(t *testing.T, handler http.Handler) (chan Frame, chan Frame) {
+	return serveTest(t, &Server{}, handler)
+}
+
+func serveTest(t *testing.T, s *Server, handler http.Handler) (chan Frame, chan Frame) {
+	client, server := net.Pipe()
+	go s.HandleTLSConnection(server, handler)
+
+	framer := NewFramer(client, client)
+	frames := readFrames(framer)
+	writes := make(chan Frame, 64)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case frame := <-writes:
+				framer.WriteFrame(frame)
+			case <-done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		client.Close()
+	})
+
+	client.Write([]byte(CONNECTION_PREFACE))
+	return writes, frames
+}
+
+// POST request HEADERS without END_STREAM
+func postHeaders(id uint32) *HeadersFrame {
+	headers := NewHeadersFrame(END_HEADERS, id, nil, nil, nil)
+	headers.Headers = http.Header{
+		":method":    {"POST"},
+		":scheme":    {"https"},
+		":authority": {"example.com"},
+		":path":      {"/"},
+	}
+	headers.HpackContext = hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	return headers
+}
+
+// uploads body within window of connection and stream,
+// returns channel closed after END_STREAM is sent
+func upload(writes chan Frame, id uint32, body []byte, connWindow, streamWindow *Window) chan bool {
+	uploaded := make(chan bool)
+	go func() {
+		for len(body) > 0 {
+			size := int32(len(body))
+			if size > DEFAULT_MAX_FRAME_SIZE {
+				size = DEFAULT_MAX_FRAME_SIZE
+			}
+			size = streamWindow.AcquirePeer(size, nil)
+			connSize := connWindow.AcquirePeer(size, nil)
+			streamWindow.UpdatePeer(size - connSize)
+			writes <- NewDataFrame(UNSET, id, body[:connSize], nil)
+			body = body[connSize:]
+		}
+		writes <- NewDataFrame(END_STREAM, id, nil, nil)
+		close(uploaded)
+	}()
+	return uploaded
+}
+
+// waits connection is handled by the server
+func waitTracked(t *testing.T, server *Server) {
+	for i := 0; i < 100; i++ {
+		server.mu.Lock()
+		n := len(server.conns)
+		server.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("connection is not tracked")
+}
+
+func TestServerShutdown(t *testing.T) {
+	for _, n := range []int{0, 1, 5} {
+		server := &Server{}
+		started, release := make(chan bool, n), make(chan struct{})
+		writes, frames := serveTest(t, server, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- true
+			<-release
+			w.Write([]byte("done"))
+		}))
+		writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+		waitTracked(t, server)
+
+		hb := getExampleHeaderBlock()
+		for i := 0; i < n; i++ {
+			writes <- NewHeadersFrame(END_STREAM+END_HEADERS, uint32(2*i+1), nil, hb, nil)
+			<-started
+		}
+
+		done := make(chan error)
+		go func() {
+			done <- server.Shutdown(context.Background())
+		}()
+
+		goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+		assert.Equal(t, goaway.ErrorCode, NO_ERROR)
+		if n > 0 {
+			assert.Equal(t, goaway.LastStreamID, uint32(2*n-1))
+
+			// new stream after GOAWAY is refused
+			writes <- NewHeadersFrame(END_STREAM+END_HEADERS, uint32(2*n+1), nil, hb, nil)
+			rst := waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+			assert.Equal(t, rst.StreamID, uint32(2*n+1))
+			assert.Equal(t, rst.ErrorCode, REFUSED_STREAM)
+		}
+
+		// in-flight streams complete before close
+		close(release)
+		completed := 0
+		for frame := range frames {
+			if frame, ok := frame.(*DataFrame); ok && frame.Flags&END_STREAM == END_STREAM {
+				completed++
+			}
+		}
+		assert.Equal(t, completed, n)
+
+		select {
+		case err := <-done:
+			assert.Equal(t, err, nil)
+		case <-time.After(time.Second):
+			t.Fatal("shutdown timeout")
+		}
+	}
+}
+
+func TestConfigureServer(t *testing.T) {
+	started, release := make(chan bool, 1), make(chan struct{})
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		w.Write([]byte("done"))
+	})}
+	err := ConfigureServer(hs, &Server{MaxConcurrentStreams: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, hs.TLSConfig.NextProtos, []string{VERSION, "http/1.1"})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.ServeTLS(ln, "keys/cert.pem", "keys/key.pem")
+
+	tc, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{VERSION},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	framer := NewFramer(tc, tc)
+	frames := readFrames(framer)
+	tc.Write([]byte(CONNECTION_PREFACE))
+	framer.WriteFrame(NewSettingsFrame(UNSET, 0, NilSettings))
+
+	settings := waitFrame(t, frames, SettingsFrameType).(*SettingsFrame)
+	assert.Equal(t, settings.Settings[SETTINGS_MAX_CONCURRENT_STREAMS], int32(10))
+	if _, ok := settings.Settings[SETTINGS_ENABLE_PUSH]; ok {
+		t.Error("server should not send SETTINGS_ENABLE_PUSH")
+	}
+
+	hb := getExampleHeaderBlock()
+	framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil))
+	<-started
+
+	// Shutdown of http.Server drains HTTP/2 connection
+	done := make(chan error)
+	go func() {
+		done <- hs.Shutdown(context.Background())
+	}()
+	goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, goaway.ErrorCode, NO_ERROR)
+	assert.Equal(t, goaway.LastStreamID, uint32(1))
+
+	framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, 3, nil, hb, nil))
+	rst := waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+	assert.Equal(t, rst.StreamID, uint32(3))
+	assert.Equal(t, rst.ErrorCode, REFUSED_STREAM)
+
+	close(release)
+	data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+	assert.Equal(t, string(data.Data), "done")
+	select {
+	case err := <-done:
+		assert.Equal(t, err, nil)
+	case <-time.After(3 * time.Second):
+		t.Fatal("shutdown timeout")
+	}
+}
+
+func TestConfigureServerALPN(t *testing.T) {
+	hs := &http.Server{Handler: http.NotFoundHandler()}
+	ConfigureServer(hs, &Server{DraftProtos: []string{"h2-14"}})
+	assert.Equal(t, hs.TLSConfig.NextProtos, []string{VERSION, "h2-14", "http/1.1"})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.ServeTLS(ln, "keys/cert.pem", "keys/key.pem")
+	defer hs.Close()
+
+	cases := []struct {
+		offered    []string
+		negotiated string
+	}{
+		{[]string{"h2", "http/1.1"}, "h2"},
+		{[]string{"http/1.1", "h2"}, "h2"},
+		{[]string{"h2-14"}, "h2-14"},
+		{[]string{"http/1.1"}, "http/1.1"},
+	}
+	for _, c := range cases {
+		tc, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         c.offered,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.ConnectionState().NegotiatedProtocol, c.negotiated)
+
+		// served as HTTP/2, which sends SETTINGS first
+		if c.negotiated != "http/1.1" {
+			framer := NewFramer(tc, tc)
+			frames := readFrames(framer)
+			tc.Write([]byte(CONNECTION_PREFACE))
+			framer.WriteFrame(NewSettingsFrame(UNSET, 0, NilSettings))
+			assert.Equal(t, nextFrame(t, frames).Header().Type, FrameType(SettingsFrameType))
+		}
+		tc.Close()
+	}
+}
+
+func TestInadequateSecurity(t *testing.T) {
+	for _, permit := range []bool{false, true} {
+		hs := &http.Server{
+			Handler: http.NotFoundHandler(),
+			TLSConfig: &tls.Config{
+				CipherSuites: []uint16{
+					tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+					tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+				},
+			},
+		}
+		ConfigureServer(hs, &Server{PermitInsecureTLS: permit})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go hs.ServeTLS(ln, "keys/cert.pem", "keys/key.pem")
+
+		// banned by RFC 7540 Appendix A
+		tc, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{VERSION},
+			MaxVersion:         tls.VersionTLS12,
+			CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		framer := NewFramer(tc, tc)
+		frames := readFrames(framer)
+		tc.Write([]byte(CONNECTION_PREFACE))
+		framer.WriteFrame(NewSettingsFrame(UNSET, 0, NilSettings))
+
+		frame := nextFrame(t, frames)
+		if permit {
+			assert.Equal(t, frame.Header().Type, FrameType(SettingsFrameType))
+		} else {
+			goaway, ok := frame.(*GoAwayFrame)
+			if !ok {
+				t.Fatalf("got %v want GOAWAY", frame)
+			}
+			assert.Equal(t, goaway.ErrorCode, ErrorCode(INADEQUATE_SECURITY))
+		}
+		tc.Close()
+		hs.Close()
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	type key struct{}
+	server := &Server{}
+	opts := &ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%v %v", r.Context().Value(key{}), r.URL.Path)
+		}),
+		Context: context.WithValue(context.Background(), key{}, "base"),
+	}
+
+	// connections accepted concurrently, both ends are net.Pipe
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, c := net.Pipe()
+			go server.ServeConn(c, opts)
+
+			conn, err := NewClientConn(client, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			go conn.WriteLoop()
+			go conn.ReadLoop()
+
+			path := fmt.Sprintf("/%v", i)
+			header := http.Header{
+				":method":    {"GET"},
+				":scheme":    {"http"},
+				":authority": {"example.com"},
+				":path":      {path},
+			}
+			response := make(chan string, 1)
+			_, err = conn.OpenStream(header, true, func(stream *Stream) {
+				body, _ := ioutil.ReadAll(stream.Bucket.Body)
+				response <- stream.Bucket.Headers.Get(":status") + " " + string(body)
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			select {
+			case got := <-response:
+				assert.Equal(t, got, "200 base "+path)
+			case <-time.After(3 * time.Second):
+				t.Error("response timeout")
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestServerSettings(t *testing.T) {
+	server := &Server{
+		MaxConcurrentStreams: 10,
+		MaxHeaderListSize:    8 << 10,
+		MaxReadFrameSize:     1 << 20,
+		InitialStreamWindow:  1 << 20,
+		InitialConnWindow:    4 << 20,
+		HeaderTableSize:      1 << 10,
+	}
+	received := make(chan int, 1)
+	writes, frames := serveTest(t, server, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- len(body)
+	}))
+
+	// first SETTINGS on the wire, and WINDOW_UPDATE for connection
+	settings := nextFrame(t, frames).(*SettingsFrame)
+	assert.Equal(t, settings.Settings[SETTINGS_MAX_CONCURRENT_STREAMS], int32(10))
+	assert.Equal(t, settings.Settings[SETTINGS_MAX_HEADER_LIST_SIZE], int32(8<<10))
+	assert.Equal(t, settings.Settings[SETTINGS_MAX_FRAME_SIZE], int32(1<<20))
+	assert.Equal(t, settings.Settings[SETTINGS_INITIAL_WINDOW_SIZE], int32(1<<20))
+	assert.Equal(t, settings.Settings[SETTINGS_HEADER_TABLE_SIZE], int32(1<<10))
+	update := nextFrame(t, frames).(*WindowUpdateFrame)
+	assert.Equal(t, update.StreamID, uint32(0))
+	assert.Equal(t, update.WindowSizeIncrement, uint32(4<<20-DEFAULT_INITIAL_WINDOW_SIZE))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	writes <- NewSettingsFrame(ACK, 0, NilSettings)
+
+	// body beyond default windows is sent without waiting WINDOW_UPDATE,
+	// and smaller header table is notified at the head of the block
+	headers := postHeaders(1)
+	headers.HpackContext.Encoder.SetMaxTableSize(1 << 10)
+	writes <- headers
+	for i := 0; i < 48; i++ {
+		writes <- NewDataFrame(UNSET, 1, make([]byte, DEFAULT_MAX_FRAME_SIZE), nil)
+	}
+	writes <- NewDataFrame(END_STREAM, 1, nil, nil)
+	select {
+	case n := <-received:
+		assert.Equal(t, n, 48*DEFAULT_MAX_FRAME_SIZE)
+	case <-time.After(3 * time.Second):
+		t.Fatal("request body is not received")
+	}
+	for {
+		switch frame := nextFrame(t, frames).(type) {
+		case *GoAwayFrame:
+			t.Fatalf("unexpected GOAWAY(%v)", frame.ErrorCode)
+		case *RstStreamFrame:
+			t.Fatalf("unexpected RST_STREAM(%v)", frame.ErrorCode)
+		case *HeadersFrame:
+			assert.Equal(t, frame.Decode(hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))), nil)
+			assert.Equal(t, frame.Headers.Get(":status"), "200")
+			return
+		}
+	}
+}
+
+// peer uses 4096 octets of header table until it ACKs our smaller
+// SETTINGS_HEADER_TABLE_SIZE, and updates the table after that
+func TestHeaderTableSizeBeforeAck(t *testing.T) {
+	server := &Server{HeaderTableSize: 100}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Custom")))
+	})
+
+	// entry of x-custom is larger than 100 octets
+	value := strings.Repeat("v", 100)
+	request := func(encoder *hpack.Encoder, id uint32) Frame {
+		hb := encoder.Encode(nil, hpack.HeaderList{
+			hpack.NewHeaderField(":method", "GET"),
+			hpack.NewHeaderField(":scheme", "https"),
+			hpack.NewHeaderField(":authority", "example.com"),
+			hpack.NewHeaderField(":path", "/"),
+			hpack.NewHeaderField("x-custom", value),
+		})
+		return NewHeadersFrame(END_STREAM+END_HEADERS, id, nil, hb, nil)
+	}
+	response := func(frames chan Frame, id uint32) string {
+		for {
+			switch frame := nextFrame(t, frames).(type) {
+			case *DataFrame:
+				if frame.StreamID == id && len(frame.Data) > 0 {
+					return string(frame.Data)
+				}
+			case *GoAwayFrame:
+				t.Fatalf("unexpected GOAWAY(%v)", frame.ErrorCode)
+			}
+		}
+	}
+
+	encoder := hpack.NewEncoder(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	writes, frames := serveTest(t, server, handler)
+	settings := waitFrame(t, frames, SettingsFrameType).(*SettingsFrame)
+	assert.Equal(t, settings.Settings[SETTINGS_HEADER_TABLE_SIZE], int32(100))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+	// x-custom is indexed, and referred by the next block
+	writes <- request(encoder, 1)
+	assert.Equal(t, response(frames, 1), value)
+	writes <- request(encoder, 3)
+	assert.Equal(t, response(frames, 3), value)
+
+	writes <- NewSettingsFrame(ACK, 0, NilSettings)
+	encoder.SetMaxTableSize(100)
+	writes <- request(encoder, 5)
+	assert.Equal(t, response(frames, 5), value)
+
+	// size update is required after ACK
+	encoder = hpack.NewEncoder(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	writes, frames = serveTest(t, server, handler)
+	waitFrame(t, frames, SettingsFrameType)
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	writes <- NewSettingsFrame(ACK, 0, NilSettings)
+	writes <- request(encoder, 1)
+	goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, goaway.ErrorCode, COMPRESSION_ERROR)
+}
+
+func TestServerSettingsInvalid(t *testing.T) {
+	cases := []*Server{
+		{MaxReadFrameSize: 1 << 10},
+		{MaxReadFrameSize: 1 << 24},
+		{InitialStreamWindow: 1 << 31},
+		{InitialConnWindow: 1 << 10},
+		{InitialConnWindow: 1 << 31},
+		{MaxConcurrentStreams: 1 << 31},
+		{MaxHeaderBytes: 1 << 10, MaxHeaderListSize: 1 << 11},
+		{Settings: map[SettingsID]int32{SETTINGS_ENABLE_CONNECT_PROTOCOL: 2}},
+	}
+	for _, s := range cases {
+		hs := &http.Server{}
+		if ConfigureServer(hs, s) == nil {
+			t.Errorf("%+v should be invalid", s)
+		}
+		if hs.TLSNextProto != nil {
+			t.Errorf("%+v should not configure server", s)
+		}
+	}
+	err := ConfigureServer(&http.Server{}, &Server{MaxHeaderBytes: 1 << 10, MaxHeaderListSize: 1 << 10})
+	assert.Equal(t, err, nil)
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	server := &Server{}
+	started := make(chan bool, 1)
+	writes, frames := serveTest(t, server, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-r.Context().Done()
+	}))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	waitTracked(t, server)
+
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+	<-started
+
+	// stream doesn't complete until the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, server.Shutdown(ctx), context.DeadlineExceeded)
+	for range frames {
+	}
+}
+
+func TestConnSendFlowControl(t *testing.T) {
+	body := make([]byte, 1<<20)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+
+	// stream window is enough, only connection window limits
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 1 << 30})
+
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	received, window := 0, DEFAULT_INITIAL_WINDOW_SIZE
+	for {
+		switch frame := nextFrame(t, frames).(type) {
+		case *SettingsFrame:
+			if frame.Flags != ACK {
+				writes <- NewSettingsFrame(ACK, 0, NilSettings)
+			}
+		case *DataFrame:
+			length := len(frame.Data)
+			window -= length
+			if window < 0 {
+				t.Fatalf("connection window exceeded by %v", -window)
+			}
+			received += length
+
+			// trickle updates
+			for length > 0 {
+				increment := 1000
+				if length < increment {
+					increment = length
+				}
+				writes <- NewWindowUpdateFrame(0, uint32(increment))
+				window += increment
+				length -= increment
+			}
+
+			if frame.Flags&END_STREAM == END_STREAM {
+				if received != len(body) {
+					t.Errorf("got %v want %v bytes", received, len(body))
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestPriorityWeight(t *testing.T) {
+	body := make([]byte, 1<<20)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 1 << 30})
+
+	// sibling streams of weight 220 and 36
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS+PRIORITY, 1, &DependencyTree{StreamDependency: 0, Weight: 220}, hb, nil)
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS+PRIORITY, 3, &DependencyTree{StreamDependency: 0, Weight: 36}, hb, nil)
+
+	// initial connection window goes to whichever comes first,
+	// then both streams have queued DATA after their HEADERS.
+	// it is counted too, since weight applies from the first DATA
+	received := map[uint32]int{}
+	initial, total, responses := DEFAULT_INITIAL_WINDOW_SIZE, 0, 0
+	for total < 512*1024 {
+		switch frame := nextFrame(t, frames).(type) {
+		case *SettingsFrame:
+			if frame.Flags != ACK {
+				writes <- NewSettingsFrame(ACK, 0, NilSettings)
+			}
+		case *HeadersFrame:
+			responses++
+		case *DataFrame:
+			length := len(frame.Data)
+			received[frame.StreamID] += length
+			if initial > 0 {
+				initial -= length
+				if initial > 0 {
+					continue
+				}
+				for responses < 2 {
+					if _, ok := nextFrame(t, frames).(*HeadersFrame); ok {
+						responses++
+					}
+				}
+				time.Sleep(50 * time.Millisecond)
+				writes <- NewWindowUpdateFrame(0, uint32(DEFAULT_INITIAL_WINDOW_SIZE))
+				continue
+			}
+			total += length
+			writes <- NewWindowUpdateFrame(0, uint32(length))
+		}
+	}
+
+	ratio := float64(received[1]) / float64(received[3])
+	if ratio < 4 || ratio > 9 {
+		t.Errorf("got %v:%v want about 6:1", received[1], received[3])
+	}
+}
+
+func TestPrioritySelfDependency(t *testing.T) {
+	called := make(chan bool, 2)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- true
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+	// HEADERS depending on itself
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS+PRIORITY, 1, &DependencyTree{StreamDependency: 1, Weight: 16}, hb, nil)
+	rst := waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+	assert.Equal(t, rst.StreamID, uint32(1))
+	assert.Equal(t, rst.ErrorCode, PROTOCOL_ERROR)
+
+	// PRIORITY depending on itself
+	writes <- postHeaders(3)
+	<-called
+	writes <- NewPriorityFrame(3, false, 3, 15)
+	rst = waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+	assert.Equal(t, rst.StreamID, uint32(3))
+	assert.Equal(t, rst.ErrorCode, PROTOCOL_ERROR)
+
+	// handler is called only for stream 3
+	select {
+	case <-called:
+		t.Error("handler is called for reset stream")
+	default:
+	}
+}
+
+func TestRstStreamMidBody(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+		if first {
+			w.Write(make([]byte, 1<<20))
+			return
+		}
+		w.Write(make([]byte, 1000))
+	}))
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 1 << 30})
+	for waitFrame(t, frames, SettingsFrameType).Header().Flags != ACK {
+	}
+	base := runtime.NumGoroutine()
+
+	// stream 1 uses up connection window, and the rest is queued
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+	for received := 0; received < DEFAULT_INITIAL_WINDOW_SIZE; {
+		if frame, ok := nextFrame(t, frames).(*DataFrame); ok {
+			received += len(frame.Data)
+		}
+	}
+	writes <- NewRstStreamFrame(1, CANCEL)
+
+	// goroutines of the stream finish
+	for i := 0; runtime.NumGoroutine() > base; i++ {
+		if i == 100 {
+			t.Fatalf("%v goroutines are left", runtime.NumGoroutine()-base)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// queued DATA is discarded without consuming the window
+	writes <- NewWindowUpdateFrame(0, uint32(DEFAULT_INITIAL_WINDOW_SIZE))
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 3, nil, hb, nil)
+	received := 0
+	for {
+		frame, ok := nextFrame(t, frames).(*DataFrame)
+		if !ok {
+			continue
+		}
+		if frame.StreamID != 3 {
+			t.Fatalf("DATA of stream(%v) after RST_STREAM", frame.StreamID)
+		}
+		received += len(frame.Data)
+		if frame.Flags&END_STREAM == END_STREAM {
+			break
+		}
+	}
+	assert.Equal(t, received, 1000)
+}
+
+func TestRstStreamHandler(t *testing.T) {
+	started, errs := make(chan bool), make(chan error, 1)
+	writes, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		started <- true
+		<-r.Context().Done()
+		_, err := w.Write([]byte("world"))
+		errs <- err
+	}))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+	<-started
+	writes <- NewRstStreamFrame(1, CANCEL)
+
+	select {
+	case err := <-errs:
+		streamError, ok := err.(*StreamError)
+		if !ok {
+			t.Fatalf("got %v want StreamError", err)
+		}
+		assert.Equal(t, streamError.Code, CANCEL)
+	case <-time.After(time.Second):
+		t.Fatal("handler is not canceled")
+	}
+}
+
+func TestRequestContextCanceled(t *testing.T) {
+	for _, teardown := range []string{"RST_STREAM", "connection close"} {
+		started, canceled := make(chan bool), make(chan bool, 1)
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			notify := w.(http.CloseNotifier).CloseNotify()
+			started <- true
+			<-r.Context().Done()
+			canceled <- <-notify
+		})
+
+		client, server := net.Pipe()
+		go (&Server{}).HandleTLSConnection(server, handler)
+		framer := NewFramer(client, client)
+		readFrames(framer)
+		client.Write([]byte(CONNECTION_PREFACE))
+		framer.WriteFrame(NewSettingsFrame(UNSET, 0, NilSettings))
+		hb := getExampleHeaderBlock()
+		framer.WriteFrame(NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil))
+		<-started
+
+		switch teardown {
+		case "RST_STREAM":
+			framer.WriteFrame(NewRstStreamFrame(1, CANCEL))
+		case "connection close":
+			client.Close()
+		}
+
+		select {
+		case notified := <-canceled:
+			assert.Equal(t, notified, true)
+		case <-time.After(time.Second):
+			t.Errorf("%v: handler is not canceled", teardown)
+		}
+		client.Close()
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/panic":
+			w.Write([]byte("hello"))
+			panic("handler panic")
+		case "/abort":
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte("hello"))
+	}))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+	get := func(id uint32, path string) {
+		headers := NewHeadersFrame(END_STREAM+END_HEADERS, id, nil, nil, nil)
+		headers.Headers = http.Header{
+			":method":    {"GET"},
+			":scheme":    {"https"},
+			":authority": {"example.com"},
+			":path":      {path},
+		}
+		headers.HpackContext = hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+		writes <- headers
+	}
+	get(1, "/panic")
+	get(3, "/abort")
+	get(5, "/")
+
+	decoder := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	status := map[uint32]string{}
+	for len(status) < 3 {
+		select {
+		case frame := <-frames:
+			switch frame := frame.(type) {
+			case *HeadersFrame:
+				frame.Decode(decoder)
+				status[frame.StreamID] = frame.Headers.Get(":status")
+			case *RstStreamFrame:
+				assert.Equal(t, frame.ErrorCode, INTERNAL_ERROR)
+				status[frame.StreamID] = "RST_STREAM"
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %v", status)
+		}
+	}
+	// connection is still alive
+	assert.Equal(t, status[1], "500")
+	assert.Equal(t, status[3], "RST_STREAM")
+	assert.Equal(t, status[5], "200")
+}
+
+func TestDataAfterEndStream(t *testing.T) {
+	errs := make(chan error, 1)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		_, err := w.Write([]byte("hello"))
+		errs <- err
+	}))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+	for i := 0; i < 3; i++ {
+		writes <- NewDataFrame(UNSET, 1, make([]byte, DEFAULT_MAX_FRAME_SIZE), nil)
+	}
+
+	// DATA is counted in connection window, updated at half consumed
+	var rst *RstStreamFrame
+	var update *WindowUpdateFrame
+	for rst == nil || update == nil {
+		switch frame := nextFrame(t, frames).(type) {
+		case *RstStreamFrame:
+			if rst == nil {
+				rst = frame
+			}
+		case *WindowUpdateFrame:
+			if frame.StreamID == 0 {
+				update = frame
+			}
+		}
+	}
+	assert.Equal(t, rst.StreamID, uint32(1))
+	assert.Equal(t, rst.ErrorCode, STREAM_CLOSED)
+	assert.Equal(t, update.WindowSizeIncrement, uint32(2*DEFAULT_MAX_FRAME_SIZE))
+
+	// handler is canceled
+	select {
+	case err := <-errs:
+		streamError, ok := err.(*StreamError)
+		if !ok {
+			t.Fatalf("got %v want StreamError", err)
+		}
+		assert.Equal(t, streamError.Code, STREAM_CLOSED)
+	case <-time.After(time.Second):
+		t.Fatal("handler is not canceled")
+	}
+}
+
+func TestRequestTrailer(t *testing.T) {
+	type result struct {
+		body    string
+		trailer http.Header
+		err     error
+	}
+	results := make(chan result, 1)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Trailer is filled after body is read
+		body, err := ioutil.ReadAll(r.Body)
+		trailer := http.Header{}
+		for name, values := range r.Trailer {
+			trailer[name] = values
+		}
+		results <- result{string(body), trailer, err}
+	}))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+	trailers := []struct {
+		flags   Flag
+		trailer http.Header
+		want    http.Header
+		code    ErrorCode
+	}{
+		{END_STREAM, http.Header{"grpc-status": {"0"}, "grpc-message": {"OK"}}, http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"OK"}}, NO_ERROR},
+		// declared but not sent
+		{END_STREAM, nil, http.Header{"Grpc-Status": nil, "Grpc-Message": nil}, NO_ERROR},
+		{END_STREAM, http.Header{":status": {"200"}}, nil, PROTOCOL_ERROR},
+		{UNSET, http.Header{"grpc-status": {"0"}}, nil, PROTOCOL_ERROR},
+	}
+	for i, c := range trailers {
+		id := uint32(2*i + 1)
+		ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+		headers := postHeaders(id)
+		headers.Headers.Set("trailer", "grpc-status, grpc-message")
+		headers.HpackContext = ctx
+		writes <- headers
+		if c.trailer == nil {
+			writes <- NewDataFrame(END_STREAM, id, []byte("hello"), nil)
+		} else {
+			writes <- NewDataFrame(UNSET, id, []byte("hello"), nil)
+			trailer := NewHeadersFrame(c.flags+END_HEADERS, id, nil, nil, nil)
+			trailer.Headers = c.trailer
+			trailer.HpackContext = ctx
+			writes <- trailer
+		}
+
+		res := <-results
+		if c.code == NO_ERROR {
+			assert.Equal(t, res.err, nil)
+			assert.Equal(t, res.body, "hello")
+			assert.Equal(t, res.trailer, c.want)
+			continue
+		}
+		rst := waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+		assert.Equal(t, rst.StreamID, id)
+		assert.Equal(t, rst.ErrorCode, c.code)
+		if res.err == nil {
+			t.Errorf("malformed trailer %v is read", c.trailer)
+		}
+	}
+}
+
+func TestRequestFields(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("keys/cert.pem", "keys/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{VERSION},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	requests := make(chan *http.Request, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		(&Server{}).HandleTLSConnection(conn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			requests <- r
+		}))
+	}()
+
+	tc, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{VERSION},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	framer := NewFramer(tc, tc)
+	readFrames(framer)
+	tc.Write([]byte(CONNECTION_PREFACE))
+	framer.WriteFrame(NewSettingsFrame(UNSET, 0, NilSettings))
+
+	// with content-length, and without it on the same HPACK context
+	post := postHeaders(1)
+	post.Headers["content-length"] = []string{"5"}
+	framer.WriteFrame(post)
+	framer.WriteFrame(NewDataFrame(END_STREAM, 1, []byte("hello"), nil))
+	get := postHeaders(3)
+	get.Flags += END_STREAM
+	get.Headers[":method"] = []string{"GET"}
+	get.HpackContext = post.HpackContext
+	framer.WriteFrame(get)
+
+	lengths := map[string]int64{}
+	for i := 0; i < 2; i++ {
+		var r *http.Request
+		select {
+		case r = <-requests:
+		case <-time.After(3 * time.Second):
+			t.Fatal("request timeout")
+		}
+		lengths[r.Method] = r.ContentLength
+		assert.Equal(t, r.Proto, "HTTP/2.0")
+		assert.Equal(t, r.ProtoMajor, 2)
+		assert.Equal(t, r.ProtoMinor, 0)
+		assert.Equal(t, r.RemoteAddr, tc.LocalAddr().String())
+		if r.TLS == nil {
+			t.Fatal("request lacks TLS")
+		}
+		assert.Equal(t, r.TLS.NegotiatedProtocol, VERSION)
+		assert.Equal(t, r.TLS.HandshakeComplete, true)
+	}
+	assert.Equal(t, lengths, map[string]int64{"POST": 5, "GET": -1})
+}
+
+func TestExpectContinue(t *testing.T) {
+	for _, read := range []bool{true, false} {
+		expects := make(chan []string, 1)
+		writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			expects <- r.Header["Expect"]
+			if read {
+				body, _ := ioutil.ReadAll(r.Body)
+				w.Write(body)
+				return
+			}
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}))
+		writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+		headers := postHeaders(1)
+		headers.Headers["expect"] = []string{"100-continue"}
+		writes <- headers
+		assert.Equal(t, len(<-expects), 0)
+
+		// client waits 100 Continue before sending body
+		ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+		response := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+		assert.Equal(t, response.Decode(ctx), nil)
+		if !read {
+			// responded without reading, body is not requested
+			assert.Equal(t, response.Headers.Get(":status"), "413")
+			rst := waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+			assert.Equal(t, rst.ErrorCode, ErrorCode(NO_ERROR))
+			continue
+		}
+		assert.Equal(t, response.Header().Flags, Flag(END_HEADERS))
+		assert.Equal(t, response.Headers.Get(":status"), "100")
+		writes <- NewDataFrame(END_STREAM, 1, []byte("hello"), nil)
+
+		response = waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+		assert.Equal(t, response.Decode(ctx), nil)
+		assert.Equal(t, response.Headers.Get(":status"), "200")
+		data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+		assert.Equal(t, string(data.Data), "hello")
+	}
+}
+
+func TestConnRecvFlowControl(t *testing.T) {
+	// echo handler
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+
+	// response is not limited
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 1 << 30})
+	writes <- NewWindowUpdateFrame(0, 1<<30)
+	writes <- postHeaders(1)
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<18) // 4MB
+	connWindow, streamWindow := NewWindowDefault(), NewWindowDefault()
+	uploaded := upload(writes, 1, body, connWindow, streamWindow)
+
+	var echo bytes.Buffer
+	for {
+		switch frame := nextFrame(t, frames).(type) {
+		case *SettingsFrame:
+			if frame.Flags != ACK {
+				writes <- NewSettingsFrame(ACK, 0, NilSettings)
+			}
+		case *WindowUpdateFrame:
+			if frame.StreamID == 0 {
+				connWindow.UpdatePeer(int32(frame.WindowSizeIncrement))
+			} else {
+				streamWindow.UpdatePeer(int32(frame.WindowSizeIncrement))
+			}
+		case *DataFrame:
+			echo.Write(frame.Data)
+			if frame.Flags&END_STREAM == END_STREAM {
+				<-uploaded
+				if !bytes.Equal(echo.Bytes(), body) {
+					t.Errorf("got %v want %v bytes", echo.Len(), len(body))
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestStreamRecvFlowControl(t *testing.T) {
+	// handler reads nothing until read is closed
+	read := make(chan bool)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-read
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(w, n)
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	writes <- postHeaders(1)
+
+	body := make([]byte, 1<<20)
+	connWindow, streamWindow := NewWindowDefault(), NewWindowDefault()
+	uploaded := upload(writes, 1, body, connWindow, streamWindow)
+
+	reading := false
+	for {
+		var frame Frame
+		select {
+		case frame = <-frames:
+		case <-time.After(200 * time.Millisecond):
+			// sender stalls at stream window
+			select {
+			case <-uploaded:
+				t.Fatal("upload should stall until handler reads")
+			default:
+			}
+			assert.Equal(t, streamWindow.Consumable(1), int32(0))
+			close(read)
+			reading = true
+			continue
+		}
+
+		switch frame := frame.(type) {
+		case *SettingsFrame:
+			if frame.Flags != ACK {
+				writes <- NewSettingsFrame(ACK, 0, NilSettings)
+			}
+		case *WindowUpdateFrame:
+			if frame.StreamID == 0 {
+				connWindow.UpdatePeer(int32(frame.WindowSizeIncrement))
+			} else {
+				if !reading {
+					t.Fatal("stream WINDOW_UPDATE before handler reads")
+				}
+				streamWindow.UpdatePeer(int32(frame.WindowSizeIncrement))
+			}
+		case *DataFrame:
+			if len(frame.Data) > 0 {
+				<-uploaded
+				assert.Equal(t, string(frame.Data), fmt.Sprint(len(body)))
+				return
+			}
+		}
+	}
+}
+
+// samples heap in background, until the returned function is
+// called. it returns growth of the peak since this is called.
+func sampleHeap() func() uint64 {
+	var base runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&base)
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var stats runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > peak {
+				peak = stats.HeapAlloc
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		<-sampled
+		if peak < base.HeapAlloc {
+			return 0
+		}
+		return peak - base.HeapAlloc
+	}
+}
+
+func TestRequestBodyStreaming(t *testing.T) {
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(w, n)
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	writes <- postHeaders(1)
+
+	// 100MB body from the same chunk, not to hold it in memory
+	const size = 100 << 20
+	chunk := make([]byte, DEFAULT_MAX_FRAME_SIZE)
+	connWindow, streamWindow := NewWindowDefault(), NewWindowDefault()
+	go func() {
+		for sent := 0; sent < size; {
+			n := int32(len(chunk))
+			if rest := int32(size - sent); n > rest {
+				n = rest
+			}
+			n = streamWindow.AcquirePeer(n, nil)
+			connSize := connWindow.AcquirePeer(n, nil)
+			streamWindow.UpdatePeer(n - connSize)
+			writes <- NewDataFrame(UNSET, 1, chunk[:connSize], nil)
+			sent += int(connSize)
+		}
+		writes <- NewDataFrame(END_STREAM, 1, nil, nil)
+	}()
+
+	// heap is sampled while uploading
+	grown := sampleHeap()
+
+	for {
+		var frame Frame
+		select {
+		case frame = <-frames:
+		case <-time.After(10 * time.Second):
+			t.Fatal("upload timeout")
+		}
+		switch frame := frame.(type) {
+		case *SettingsFrame:
+			if frame.Flags != ACK {
+				writes <- NewSettingsFrame(ACK, 0, NilSettings)
+			}
+		case *WindowUpdateFrame:
+			if frame.StreamID == 0 {
+				connWindow.UpdatePeer(int32(frame.WindowSizeIncrement))
+			} else {
+				streamWindow.UpdatePeer(int32(frame.WindowSizeIncrement))
+			}
+		case *DataFrame:
+			if len(frame.Data) > 0 {
+				heap := grown()
+				assert.Equal(t, string(frame.Data), fmt.Sprint(size))
+				if heap > 32<<20 {
+					t.Errorf("heap grows %vMB while uploading %vMB", heap>>20, size>>20)
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestResponseBeforeRequestBody(t *testing.T) {
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	writes <- postHeaders(1)
+	writes <- NewDataFrame(UNSET, 1, make([]byte, 100), nil)
+
+	data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+	assert.Equal(t, data.Header().Flags, Flag(END_STREAM))
+	assert.Equal(t, string(data.Data), "ok")
+
+	// rest of the body is stopped after the response
+	rst := waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+	assert.Equal(t, rst.StreamID, uint32(1))
+	assert.Equal(t, rst.ErrorCode, ErrorCode(NO_ERROR))
+
+	// DATA in flight is ignored, not reset again
+	writes <- NewDataFrame(UNSET, 1, make([]byte, 100), nil)
+	writes <- NewDataFrame(END_STREAM, 1, nil, nil)
+	writes <- NewPingFrame(UNSET, 0, []byte("deadbeef"))
+	for {
+		switch frame := nextFrame(t, frames).(type) {
+		case *RstStreamFrame:
+			t.Fatalf("RST_STREAM(%v) after RST_STREAM", frame.ErrorCode)
+		case *PingFrame:
+			return
+		}
+	}
+}
+
+// uploads body of size within windows to server limiting it,
+// returns status of the response and code of RST_STREAM which ends it
+func uploadOverLimit(t *testing.T, limit int64, handler http.Handler, contentLength bool, size int) (status string, code ErrorCode, sent int) {
+	writes, frames := serveTest(t, &Server{MaxRequestBodyBytes: limit}, handler)
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	headers := postHeaders(1)
+	if contentLength {
+		headers.Headers["content-length"] = []string{strconv.Itoa(size)}
+	}
+	writes <- headers
+
+	connWindow, streamWindow := NewWindowDefault(), NewWindowDefault()
+	ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	for {
+		for sent < size {
+			n := int32(size - sent)
+			if n > DEFAULT_MAX_FRAME_SIZE {
+				n = DEFAULT_MAX_FRAME_SIZE
+			}
+			n = streamWindow.TryAcquirePeer(n)
+			connSize := connWindow.TryAcquirePeer(n)
+			streamWindow.UpdatePeer(n - connSize)
+			if connSize == 0 {
+				break
+			}
+			sent += int(connSize)
+			var flags Flag = UNSET
+			if sent == size {
+				flags = END_STREAM
+			}
+			writes <- NewDataFrame(flags, 1, make([]byte, connSize), nil)
+		}
+
+		switch frame := nextFrame(t, frames).(type) {
+		case *SettingsFrame:
+			if frame.Flags != ACK {
+				writes <- NewSettingsFrame(ACK, 0, NilSettings)
+			}
+		case *WindowUpdateFrame:
+			if frame.StreamID == 0 {
+				connWindow.UpdatePeer(int32(frame.WindowSizeIncrement))
+			} else {
+				streamWindow.UpdatePeer(int32(frame.WindowSizeIncrement))
+			}
+		case *HeadersFrame:
+			assert.Equal(t, frame.Decode(ctx), nil)
+			status = frame.Headers.Get(":status")
+		case *RstStreamFrame:
+			return status, frame.ErrorCode, sent
+		}
+	}
+}
+
+func TestMaxRequestBodyBytes(t *testing.T) {
+	const limit = 60 << 10
+	errs := make(chan error, 1)
+	read := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.Copy(ioutil.Discard, r.Body)
+		errs <- err
+		w.Write([]byte("ok"))
+	})
+
+	// declared content-length over the limit, without handler
+	status, code, sent := uploadOverLimit(t, limit, read, true, 1<<20)
+	assert.Equal(t, status, "413")
+	assert.Equal(t, code, ErrorCode(NO_ERROR))
+	select {
+	case err := <-errs:
+		t.Errorf("handler is called and got %v", err)
+	default:
+	}
+	if sent > DEFAULT_INITIAL_WINDOW_SIZE {
+		t.Errorf("sent %v bytes over the initial window", sent)
+	}
+
+	// cut off after buffered, window is not granted
+	// for the buffered body read after that
+	status, code, sent = uploadOverLimit(t, limit, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		read(w, r)
+		time.Sleep(50 * time.Millisecond)
+	}), false, 1<<20)
+	assert.Equal(t, status, "413")
+	assert.Equal(t, code, ErrorCode(NO_ERROR))
+	maxBytesError, ok := (<-errs).(*http.MaxBytesError)
+	if !ok {
+		t.Fatalf("handler should get http.MaxBytesError")
+	}
+	assert.Equal(t, maxBytesError.Limit, int64(limit))
+	if sent > DEFAULT_INITIAL_WINDOW_SIZE {
+		t.Errorf("sent %v bytes over the initial window", sent)
+	}
+
+	// flushed response can not be replaced
+	status, code, _ = uploadOverLimit(t, limit, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		read(w, r)
+	}), false, 1<<20)
+	assert.Equal(t, status, "200")
+	assert.Equal(t, code, ErrorCode(CANCEL))
+	<-errs
+
+	// waits until the upload reaches the cutoff of the server
+	cutoff := func(r *http.Request) {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if _, ok := r.Body.(*Body).Err().(*http.MaxBytesError); ok {
+				return
+			}
+		}
+		t.Error("request body is not cut off")
+	}
+
+	// smaller limit of handler is applied first,
+	// and its response is kept after the cutoff
+	status, code, _ = uploadOverLimit(t, limit, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.Copy(ioutil.Discard, http.MaxBytesReader(w, r.Body, 10<<10))
+		errs <- err
+		cutoff(r)
+		w.WriteHeader(http.StatusBadRequest)
+	}), false, 1<<20)
+	assert.Equal(t, status, "400")
+	assert.Equal(t, code, ErrorCode(NO_ERROR))
+	maxBytesError, ok = (<-errs).(*http.MaxBytesError)
+	if !ok {
+		t.Fatalf("handler should get http.MaxBytesError")
+	}
+	assert.Equal(t, maxBytesError.Limit, int64(10<<10))
+
+	// handler which doesn't read the body
+	status, code, _ = uploadOverLimit(t, limit, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cutoff(r)
+		w.WriteHeader(http.StatusAccepted)
+	}), false, 1<<20)
+	assert.Equal(t, status, "202")
+	assert.Equal(t, code, ErrorCode(NO_ERROR))
+}
+
+func TestStreamWindowExceeded(t *testing.T) {
+	read := make(chan bool)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-read
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer close(read)
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	writes <- postHeaders(1)
+
+	// handler reads nothing, and DATA goes over the stream window
+	for sent := 0; sent <= DEFAULT_INITIAL_WINDOW_SIZE; sent += DEFAULT_MAX_FRAME_SIZE {
+		writes <- NewDataFrame(UNSET, 1, make([]byte, DEFAULT_MAX_FRAME_SIZE), nil)
+	}
+
+	rst := waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+	assert.Equal(t, rst.StreamID, uint32(1))
+	assert.Equal(t, rst.ErrorCode, ErrorCode(FLOW_CONTROL_ERROR))
+}
+
+// skips frames until the type
+func waitFrame(t *testing.T, frames chan Frame, types FrameType) Frame {
+	for {
+		frame := nextFrame(t, frames)
+		if frame.Header().Type == types {
+			return frame
+		}
+	}
+}
+
+func TestResponseBodyStreaming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams 256MB")
+	}
+	// 256MB body from the same chunk, not to hold it in memory
+	const size = 256 << 20
+	chunk := make([]byte, 1<<20)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for sent := 0; sent < size; sent += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}))
+
+	// stream window is enough, so only connection window
+	// returned by the slow reader holds the writer
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 1<<31 - 1})
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	// heap is sampled while downloading
+	grown := sampleHeap()
+
+	received, pending, updates := 0, 0, 0
+	for {
+		var frame Frame
+		select {
+		case frame = <-frames:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("download timeout at %vMB", received>>20)
+		}
+		switch frame := frame.(type) {
+		case *SettingsFrame:
+			if frame.Flags != ACK {
+				writes <- NewSettingsFrame(ACK, 0, NilSettings)
+			}
+		case *DataFrame:
+			received += len(frame.Data)
+			pending += len(frame.Data)
+			// window is returned by half, and the reader pauses sometimes
+			if pending >= DEFAULT_INITIAL_WINDOW_SIZE/2 {
+				if updates++; updates%512 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				writes <- NewWindowUpdateFrame(0, uint32(pending))
+				pending = 0
+			}
+			if frame.Flags&END_STREAM == END_STREAM {
+				heap := grown()
+				assert.Equal(t, received, size)
+				if heap > 32<<20 {
+					t.Errorf("heap grows %vMB while downloading %vMB", heap>>20, size>>20)
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestResponseWriteReset(t *testing.T) {
+	written := make(chan error, 1)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 1<<20)
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				written <- err
+				return
+			}
+		}
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 1<<31 - 1})
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	// writer blocked by connection window is released by RST_STREAM
+	waitFrame(t, frames, DataFrameType)
+	writes <- NewRstStreamFrame(1, CANCEL)
+	go func() {
+		for range frames {
+		}
+	}()
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Error("Write to reset stream should fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writer is not released by RST_STREAM")
+	}
+}
+
+func TestInitialWindowSizeChange(t *testing.T) {
+	body := make([]byte, 200)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 100})
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+	assert.Equal(t, len(data.Data), 100)
+
+	// window gets 50 - 100 = -50, and 0 after WINDOW_UPDATE
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 50})
+	writes <- NewWindowUpdateFrame(1, 50)
+	timeout := time.After(100 * time.Millisecond)
+	for waiting := true; waiting; {
+		select {
+		case frame := <-frames:
+			if frame.Header().Type == DataFrameType {
+				t.Fatalf("DATA is sent with negative window %v", frame)
+			}
+		case <-timeout:
+			waiting = false
+		}
+	}
+
+	// recovers to positive
+	writes <- NewWindowUpdateFrame(1, 60)
+	data = waitFrame(t, frames, DataFrameType).(*DataFrame)
+	assert.Equal(t, len(data.Data), 60)
+}
+
+// our smaller SETTINGS_INITIAL_WINDOW_SIZE applies at ACK,
+// DATA before it is within the default window
+func TestLocalInitialWindowSizeAck(t *testing.T) {
+	read := make(chan int, 1)
+	writes, frames := serveTest(t, &Server{InitialStreamWindow: 1 << 14}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.ReadFull(r.Body, make([]byte, DEFAULT_INITIAL_WINDOW_SIZE))
+		read <- n
+		ioutil.ReadAll(r.Body)
+	}))
+	settings := waitFrame(t, frames, SettingsFrameType).(*SettingsFrame)
+	assert.Equal(t, settings.Settings[SETTINGS_INITIAL_WINDOW_SIZE], int32(1<<14))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	writes <- postHeaders(1)
+	body := make([]byte, DEFAULT_INITIAL_WINDOW_SIZE)
+	for len(body) > 0 {
+		size := DEFAULT_MAX_FRAME_SIZE
+		if size > len(body) {
+			size = len(body)
+		}
+		writes <- NewDataFrame(UNSET, 1, body[:size], nil)
+		body = body[size:]
+	}
+	assert.Equal(t, <-read, DEFAULT_INITIAL_WINDOW_SIZE)
+
+	// window is recovered after ACK, even if all is read
+	writes <- NewSettingsFrame(ACK, 0, NilSettings)
+	granted := 0
+	timeout := time.After(100 * time.Millisecond)
+	for waiting := true; waiting; {
+		select {
+		case frame := <-frames:
+			switch frame := frame.(type) {
+			case *WindowUpdateFrame:
+				if frame.StreamID == 1 {
+					granted += int(frame.WindowSizeIncrement)
+				}
+			case *RstStreamFrame:
+				t.Fatalf("RST_STREAM(%v)", frame.ErrorCode)
+			}
+		case <-timeout:
+			waiting = false
+		}
+	}
+	// peer's window is 65535 - 65535 + granted + (1<<14 - 65535),
+	// which gets 1<<14 since all is read
+	assert.Equal(t, granted, int(DEFAULT_INITIAL_WINDOW_SIZE))
+}
+
+func TestStreamWriteTimeout(t *testing.T) {
+	body := make([]byte, 200)
+	ctxs := make(chan context.Context, 1)
+	server := &Server{WriteTimeout: 100 * time.Millisecond}
+	writes, frames := serveTest(t, server, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// thinking longer than WriteTimeout is not a timeout
+		time.Sleep(200 * time.Millisecond)
+		w.Write(body)
+		ctxs <- r.Context()
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 100})
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+	assert.Equal(t, len(data.Data), 100)
+	sent := time.Now()
+
+	// never sends WINDOW_UPDATE
+	rst := waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+	assert.Equal(t, rst.ErrorCode, CANCEL)
+	if elapsed := time.Since(sent); elapsed < 50*time.Millisecond {
+		t.Errorf("reset in %v before WriteTimeout", elapsed)
+	}
+	ctx := <-ctxs
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream is not closed")
+	}
+
+	// connection is alive
+	writes <- NewPingFrame(UNSET, 0, []byte("deadbeef"))
+	waitFrame(t, frames, PingFrameType)
+}
+
+func TestInitialWindowSizeOverflow(t *testing.T) {
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	writes <- postHeaders(1)
+
+	// stream window gets 2^31-1, then +1 by SETTINGS
+	writes <- NewWindowUpdateFrame(1, 1<<31-1-DEFAULT_INITIAL_WINDOW_SIZE)
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: DEFAULT_INITIAL_WINDOW_SIZE + 1})
+
+	goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, goaway.ErrorCode, FLOW_CONTROL_ERROR)
+}
+
+func TestWindowUpdateOverflow(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	})
+
+	// h2spec 6.9.1: stream window
+	writes, frames := newTestServer(t, handler)
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	writes <- postHeaders(1)
+	writes <- NewWindowUpdateFrame(1, 1<<31-1)
+	writes <- NewWindowUpdateFrame(1, 1<<31-1)
+	rst := waitFrame(t, frames, RstStreamFrameType).(*RstStreamFrame)
+	assert.Equal(t, rst.StreamID, uint32(1))
+	assert.Equal(t, rst.ErrorCode, FLOW_CONTROL_ERROR)
+
+	// connection is still available
+	writes <- NewPingFrame(UNSET, 0, []byte("deadbeef"))
+	waitFrame(t, frames, PingFrameType)
+
+	// h2spec 6.9.1: connection window
+	writes, frames = newTestServer(t, handler)
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	writes <- NewWindowUpdateFrame(0, 1<<31-1)
+	writes <- NewWindowUpdateFrame(0, 1<<31-1)
+	goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, goaway.ErrorCode, FLOW_CONTROL_ERROR)
+}
+
+func TestResponseDataFrames(t *testing.T) {
+	body := make([]byte, 100*1024)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{
+		SETTINGS_MAX_FRAME_SIZE:      16384,
+		SETTINGS_INITIAL_WINDOW_SIZE: 1 << 30,
+	})
+	writes <- NewWindowUpdateFrame(0, 1<<30)
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	headers := waitFrame(t, frames, HeadersFrameType)
+	assert.Equal(t, headers.Header().Flags, Flag(END_HEADERS))
+
+	received := 0
+	for {
+		data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+		if len(data.Data) > 16384 || len(data.Data) == 0 {
+			t.Fatalf("invalid DATA size %v", len(data.Data))
+		}
+		received += len(data.Data)
+		if data.Flags&END_STREAM == END_STREAM {
+			break
+		}
+	}
+	// END_STREAM only on the last
+	assert.Equal(t, received, len(body))
+}
+
+func TestResponseWithoutBody(t *testing.T) {
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	headers := waitFrame(t, frames, HeadersFrameType)
+	assert.Equal(t, headers.Header().Flags, Flag(END_STREAM+END_HEADERS))
+}
+
+func TestResponseStatus(t *testing.T) {
+	cases := []struct {
+		status int
+		body   string // empty is not allowed
+	}{
+		{http.StatusCreated, "body"},
+		{http.StatusNoContent, ""},
+		{http.StatusNotModified, ""},
+		{http.StatusNotFound, "body"},
+		{http.StatusInternalServerError, "body"},
+		// without WriteHeader
+		{0, "body"},
+	}
+
+	for _, c := range cases {
+		written := make(chan error, 1)
+		writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Before", "sent")
+			w.Header().Set("Connection", "close")
+			if c.status != 0 {
+				w.WriteHeader(c.status)
+			}
+			// header is fixed at WriteHeader or first Write
+			w.Header().Set("X-After", "after WriteHeader")
+			_, err := w.Write([]byte("body"))
+			written <- err
+			w.Header().Set("X-Last", "not sent")
+			w.WriteHeader(http.StatusTeapot)
+		}))
+
+		writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+		hb := getExampleHeaderBlock()
+		writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+		status := c.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+		headers := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+		assert.Equal(t, headers.Decode(ctx), nil)
+		assert.Equal(t, headers.Headers.Get(":status"), strconv.Itoa(status))
+		assert.Equal(t, headers.Headers.Get("x-before"), "sent")
+		// without WriteHeader, header is fixed at Write
+		if c.status == 0 {
+			assert.Equal(t, headers.Headers.Get("x-after"), "after WriteHeader")
+		} else {
+			assert.Equal(t, len(headers.Headers["X-After"]), 0)
+		}
+		assert.Equal(t, len(headers.Headers["X-Last"]), 0)
+		// connection-specific header is not allowed (RFC 7540 8.1.2.2)
+		assert.Equal(t, len(headers.Headers["Connection"]), 0)
+
+		if c.body == "" {
+			assert.Equal(t, <-written, http.ErrBodyNotAllowed)
+			assert.Equal(t, headers.Header().Flags, Flag(END_STREAM+END_HEADERS))
+			continue
+		}
+		assert.Equal(t, <-written, nil)
+		assert.Equal(t, headers.Header().Flags, Flag(END_HEADERS))
+		data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+		assert.Equal(t, data.Header().Flags, Flag(END_STREAM))
+		assert.Equal(t, string(data.Data), c.body)
+	}
+}
+
+func TestResponseInformational(t *testing.T) {
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Add("Link", "</script.js>; rel=preload; as=script")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Write([]byte("ok"))
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	// interim and final responses share HPACK context
+	ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	links := []int{1, 2, 2}
+	statuses := []string{"103", "103", "200"}
+	for i, status := range statuses {
+		headers := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+		assert.Equal(t, headers.Header().Flags, Flag(END_HEADERS))
+		assert.Equal(t, headers.Decode(ctx), nil)
+		assert.Equal(t, headers.Headers.Get(":status"), status)
+		assert.Equal(t, len(headers.Headers["Link"]), links[i])
+	}
+	data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+	assert.Equal(t, data.Header().Flags, Flag(END_STREAM))
+	assert.Equal(t, string(data.Data), "ok")
+}
+
+func TestResponseDate(t *testing.T) {
+	cases := []struct {
+		set  bool
+		date []string
+		want string // empty is absent
+	}{
+		{false, nil, "now"},
+		{true, []string{"Sun, 06 Nov 1994 08:49:37 GMT"}, "Sun, 06 Nov 1994 08:49:37 GMT"},
+		// nil suppresses it like net/http
+		{true, nil, ""},
+	}
+
+	for _, c := range cases {
+		writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c.set {
+				w.Header()["Date"] = c.date
+			}
+		}))
+		writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+		hb := getExampleHeaderBlock()
+		writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+		ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+		headers := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+		assert.Equal(t, headers.Decode(ctx), nil)
+		switch c.want {
+		case "now":
+			date, err := http.ParseTime(headers.Headers.Get("date"))
+			if err != nil || time.Since(date) > 5*time.Second {
+				t.Errorf("invalid Date %q: %v", headers.Headers.Get("date"), err)
+			}
+		default:
+			assert.Equal(t, headers.Headers.Get("date"), c.want)
+		}
+	}
+
+	// formatted once a second
+	now := time.Now().Truncate(time.Second)
+	assert.Equal(t, httpDate(now.Add(100*time.Millisecond)), httpDate(now.Add(900*time.Millisecond)))
+	assert.Equal(t, httpDate(now.Add(time.Second)), now.Add(time.Second).UTC().Format(http.TimeFormat))
+}
+
+func TestResponseContentLength(t *testing.T) {
+	cases := []struct {
+		handler func(w http.ResponseWriter)
+		want    []string
+	}{
+		{func(w http.ResponseWriter) { w.Write([]byte("hello")) }, []string{"5"}},
+		{func(w http.ResponseWriter) {}, []string{"0"}},
+		{func(w http.ResponseWriter) {
+			w.Header().Set("Content-Length", "5")
+			w.Write([]byte("hello"))
+		}, []string{"5"}},
+		{func(w http.ResponseWriter) { w.WriteHeader(http.StatusNoContent) }, nil},
+		// streamed
+		{func(w http.ResponseWriter) {
+			w.Write([]byte("hello"))
+			w.(http.Flusher).Flush()
+		}, nil},
+		{func(w http.ResponseWriter) { w.Write(make([]byte, ResponseBufferSize+1)) }, nil},
+	}
+
+	for i, c := range cases {
+		handler := c.handler
+		writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler(w)
+		}))
+		writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+		hb := getExampleHeaderBlock()
+		writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+		ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+		headers := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+		assert.Equal(t, headers.Decode(ctx), nil)
+		if got := headers.Headers["Content-Length"]; len(got) != len(c.want) || len(got) > 0 && got[0] != c.want[0] {
+			t.Errorf("case %v: got content-length %v want %v", i, got, c.want)
+		}
+	}
+}
+
+func TestRequestHeaderTooLarge(t *testing.T) {
+	called := make(chan string, 2)
+	writes, frames := serveTest(t, &Server{MaxHeaderBytes: 64 << 10}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- r.Header.Get("Cookie")
+	}))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+	// 80KB cookie is split into CONTINUATIONs
+	headers := postHeaders(1)
+	headers.Flags += END_STREAM
+	headers.Headers["cookie"] = []string{strings.Repeat("a", 80<<10)}
+	writes <- headers
+
+	ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	response := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+	assert.Equal(t, response.StreamID, uint32(1))
+	assert.Equal(t, response.Header().Flags, Flag(END_STREAM+END_HEADERS))
+	assert.Equal(t, response.Decode(ctx), nil)
+	assert.Equal(t, response.Headers.Get(":status"), "431")
+
+	// handler is not called, and HPACK context is still in sync
+	next := postHeaders(3)
+	next.Flags += END_STREAM
+	next.HpackContext = headers.HpackContext
+	next.Headers["cookie"] = []string{"small"}
+	writes <- next
+	response = waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+	assert.Equal(t, response.StreamID, uint32(3))
+	assert.Equal(t, response.Decode(ctx), nil)
+	assert.Equal(t, response.Headers.Get(":status"), "200")
+	assert.Equal(t, <-called, "small")
+}
+
+func TestResponseEmpty(t *testing.T) {
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Empty", "true")
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	// handler without Write nor WriteHeader is 200
+	ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	headers := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+	assert.Equal(t, headers.Header().Flags, Flag(END_STREAM+END_HEADERS))
+	assert.Equal(t, headers.Decode(ctx), nil)
+	assert.Equal(t, headers.Headers.Get(":status"), "200")
+	assert.Equal(t, headers.Headers.Get("x-empty"), "true")
+}
+
+func TestResponseHead(t *testing.T) {
+	written := make(chan int, 1)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := w.Write([]byte("body"))
+		written <- n
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	headers := postHeaders(1)
+	headers.Flags += END_STREAM
+	headers.Headers[":method"] = []string{"HEAD"}
+	writes <- headers
+
+	// body of HEAD is discarded, but counted
+	ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	response := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+	assert.Equal(t, response.Header().Flags, Flag(END_STREAM+END_HEADERS))
+	assert.Equal(t, response.Decode(ctx), nil)
+	assert.Equal(t, response.Headers.Get("content-length"), "4")
+	assert.Equal(t, <-written, 4)
+}
+
+func TestResponseHeadFileServer(t *testing.T) {
+	info, err := os.Stat("sample/person.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes, frames := newTestServer(t, http.FileServer(http.Dir("sample")))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+
+	headers := postHeaders(1)
+	headers.Flags += END_STREAM
+	headers.Headers[":method"] = []string{"HEAD"}
+	headers.Headers[":path"] = []string{"/person.html"}
+	writes <- headers
+
+	ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	response := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+	assert.Equal(t, response.Header().Flags, Flag(END_STREAM+END_HEADERS))
+	assert.Equal(t, response.Decode(ctx), nil)
+	assert.Equal(t, response.Headers.Get(":status"), "200")
+	assert.Equal(t, response.Headers.Get("content-length"), strconv.FormatInt(info.Size(), 10))
+
+	// nothing follows HEADERS, peer's window is not consumed
+	select {
+	case frame := <-frames:
+		if frame.Header().Type == DataFrameType {
+			t.Fatalf("response of HEAD has DATA %v", frame)
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestResponseFlush(t *testing.T) {
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("second"))
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	headers := waitFrame(t, frames, HeadersFrameType)
+	assert.Equal(t, headers.Header().Flags, Flag(END_HEADERS))
+
+	// flushed before handler returns
+	first := waitFrame(t, frames, DataFrameType).(*DataFrame)
+	flushed := time.Now()
+	assert.Equal(t, first.Header().Flags, Flag(UNSET))
+	assert.Equal(t, string(first.Data), "first")
+
+	second := waitFrame(t, frames, DataFrameType).(*DataFrame)
+	if elapsed := time.Since(flushed); elapsed < 50*time.Millisecond {
+		t.Errorf("second DATA is not delayed by handler: %v", elapsed)
+	}
+	assert.Equal(t, second.Header().Flags, Flag(END_STREAM))
+	assert.Equal(t, string(second.Data), "second")
+}
+
+func TestResponseTrailer(t *testing.T) {
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("hello"))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "OK")
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	// HPACK context of response is shared by headers and trailer
+	ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	headers := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+	assert.Equal(t, headers.Header().Flags, Flag(END_HEADERS))
+	assert.Equal(t, headers.Decode(ctx), nil)
+	assert.Equal(t, headers.Headers.Get(":status"), "200")
+	assert.Equal(t, len(headers.Headers["Grpc-Status"]), 0)
+	assert.Equal(t, len(headers.Headers["trailer:grpc-message"]), 0)
+
+	data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+	assert.Equal(t, data.Header().Flags, Flag(UNSET))
+	assert.Equal(t, string(data.Data), "hello")
+
+	trailer := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+	assert.Equal(t, trailer.Header().Flags, Flag(END_STREAM+END_HEADERS))
+	assert.Equal(t, trailer.Decode(ctx), nil)
+	assert.Equal(t, trailer.Headers.Get("grpc-status"), "0")
+	assert.Equal(t, trailer.Headers.Get("grpc-message"), "OK")
+}
+
+func TestServerPush(t *testing.T) {
+	pushed := make(chan error, 1)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			fmt.Fprintf(w, "%v %v", r.Method, r.URL.Path)
+			return
+		}
+		pushed <- w.(http.Pusher).Push("/style.css", nil)
+		w.Write([]byte("index"))
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	// header blocks are decoded in order of receiving
+	ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	var promise *PushPromiseFrame
+	bodies := map[uint32]string{}
+	for ended := 0; ended < 2; {
+		switch frame := nextFrame(t, frames).(type) {
+		case *PushPromiseFrame:
+			assert.Equal(t, frame.Decode(ctx), nil)
+			promise = frame
+		case *HeadersFrame:
+			assert.Equal(t, frame.Decode(ctx), nil)
+			assert.Equal(t, frame.Headers.Get(":status"), "200")
+			if promise == nil {
+				t.Fatalf("HEADERS of stream(%v) before PUSH_PROMISE", frame.StreamID)
+			}
+		case *DataFrame:
+			if promise == nil {
+				t.Fatalf("DATA of stream(%v) before PUSH_PROMISE", frame.StreamID)
+			}
+			bodies[frame.StreamID] += string(frame.Data)
+			if frame.Flags&END_STREAM == END_STREAM {
+				ended++
+			}
+		}
+	}
+	assert.Equal(t, <-pushed, nil)
+
+	// promised request on even stream id
+	assert.Equal(t, promise.StreamID, uint32(1))
+	assert.Equal(t, promise.PromisedStreamID, uint32(2))
+	assert.Equal(t, promise.Headers, http.Header{
+		":method":    {"GET"},
+		":scheme":    {"https"},
+		":authority": {"www.example.com"},
+		":path":      {"/style.css"},
+	})
+	assert.Equal(t, bodies, map[uint32]string{1: "index", 2: "GET /style.css"})
+}
+
+func TestServerPushLimit(t *testing.T) {
+	pushed := make(chan error, 3)
+	active, release := make(chan struct{}), make(chan struct{})
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big":
+			w.Write(make([]byte, 1024))
+		case "/slow":
+			<-release
+		case "/":
+			pusher := w.(http.Pusher)
+			pushed <- pusher.Push("/slow", nil)
+			pushed <- pusher.Push("/big", nil)
+			<-active
+			pushed <- pusher.Push("/c", nil)
+			close(release)
+		}
+	}))
+
+	// response DATA of pushed stream is blocked by window
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{
+		SETTINGS_MAX_CONCURRENT_STREAMS: 1,
+		SETTINGS_INITIAL_WINDOW_SIZE:    0,
+	})
+	for waitFrame(t, frames, SettingsFrameType).Header().Flags != ACK {
+	}
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	// reserved stream(2) is not counted
+	assert.Equal(t, <-pushed, nil)
+	assert.Equal(t, <-pushed, nil)
+
+	// stream(4) counts after its HEADERS
+	for {
+		if frame, ok := nextFrame(t, frames).(*HeadersFrame); ok && frame.StreamID == 4 {
+			break
+		}
+	}
+	close(active)
+	assert.Equal(t, <-pushed, ErrPushLimit)
+}
+
+func TestServerPushEnable(t *testing.T) {
+	pushed := make(chan error, 1)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			pushed <- w.(http.Pusher).Push("/style.css", nil)
+		}
+	}))
+	hb := getExampleHeaderBlock()
+
+	// waits response, and PUSH_PROMISE before it if any
+	promised := func(id uint32) bool {
+		writes <- NewHeadersFrame(END_STREAM+END_HEADERS, id, nil, hb, nil)
+		promise := false
+		for {
+			switch frame := nextFrame(t, frames).(type) {
+			case *PushPromiseFrame:
+				promise = true
+			case *HeadersFrame:
+				if frame.StreamID == id {
+					return promise
+				}
+			}
+		}
+	}
+
+	// push is disabled by SETTINGS_ENABLE_PUSH
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_ENABLE_PUSH: 0})
+	assert.Equal(t, promised(1), false)
+	assert.Equal(t, <-pushed, http.ErrNotSupported)
+
+	// and enabled again
+	writes <- NewSettingsFrame(UNSET, 0, map[SettingsID]int32{SETTINGS_ENABLE_PUSH: 1})
+	assert.Equal(t, promised(3), true)
+	assert.Equal(t, <-pushed, nil)
+}
+
+func TestServerDisablePush(t *testing.T) {
+	pushed := make(chan error, 1)
+	writes, frames := serveTest(t, &Server{DisablePush: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushed <- w.(http.Pusher).Push("/style.css", nil)
+	}))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	// peer enables push, but server doesn't
+	headers := waitFrame(t, frames, HeadersFrameType)
+	assert.Equal(t, headers.Header().StreamID, uint32(1))
+	assert.Equal(t, <-pushed, http.ErrNotSupported)
+}
+
+func TestServerPushCancel(t *testing.T) {
+	canceled := make(chan bool, 1)
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			select {
+			case <-r.Context().Done():
+				canceled <- true
+			case <-time.After(time.Second):
+				canceled <- false
+			}
+			return
+		}
+		w.(http.Pusher).Push("/style.css", nil)
+		w.Write([]byte("index"))
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM+END_HEADERS, 1, nil, hb, nil)
+
+	// client doesn't want the promised stream
+	promise := waitFrame(t, frames, PushPromiseFrameType).(*PushPromiseFrame)
+	writes <- NewRstStreamFrame(promise.PromisedStreamID, CANCEL)
+	assert.Equal(t, <-canceled, true)
+
+	// response of the parent is not affected
+	data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+	assert.Equal(t, data.StreamID, uint32(1))
+	assert.Equal(t, string(data.Data), "index")
+}
+
+func TestPushPromiseFromClient(t *testing.T) {
+	writes, frames := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_HEADERS, 1, nil, hb, nil)
+
+	// client cannot push (RFC 7540 8.2)
+	writes <- NewPushPromiseFrame(END_HEADERS, 1, 2, nil, nil)
+	goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, goaway.ErrorCode, ErrorCode(PROTOCOL_ERROR))
+}
+
+// only connections of the server with CaptureDir are recorded
+func TestCaptureDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, server := range []*Server{{CaptureDir: dir}, {}} {
+		writes, frames := serveTest(t, server, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+		headers := postHeaders(1)
+		headers.Flags += END_STREAM
+		writes <- headers
+		waitFrame(t, frames, HeadersFrameType)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.h2cap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(files), 1)
+	info, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() == 0 {
+		t.Error("frames are not recorded")
+	}
+}
+
+// connection is served without recording, if CaptureDir is not writable
+func TestCaptureDirError(t *testing.T) {
+	server := &Server{CaptureDir: filepath.Join(t.TempDir(), "missing")}
+	writes, frames := serveTest(t, server, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	headers := postHeaders(1)
+	headers.Flags += END_STREAM
+	writes <- headers
+
+	response := waitFrame(t, frames, HeadersFrameType).(*HeadersFrame)
+	assert.Equal(t, response.Decode(hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))), nil)
+	assert.Equal(t, response.Headers.Get(":status"), "200")
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	server := &Server{ReadHeaderTimeout: 100 * time.Millisecond}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	// connection preface is not sent
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.HandleTLSConnection(conn, handler)
+	frames := readFrames(NewFramer(client, client))
+	goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, goaway.ErrorCode, PROTOCOL_ERROR)
+
+	// SETTINGS is not sent after preface
+	_, frames = serveTest(t, server, handler)
+	goaway = waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, goaway.ErrorCode, PROTOCOL_ERROR)
+
+	// CONTINUATION is not sent
+	writes, frames := serveTest(t, server, handler)
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	hb := getExampleHeaderBlock()
+	writes <- NewHeadersFrame(END_STREAM, 1, nil, hb[:10], nil)
+	goaway = waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, goaway.ErrorCode, PROTOCOL_ERROR)
+	for range frames {
+	}
+
+	// fast split after longer than the timeout is not affected
+	writes, frames = serveTest(t, server, handler)
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	time.Sleep(200 * time.Millisecond)
+	writes <- NewHeadersFrame(END_STREAM, 1, nil, hb[:10], nil)
+	writes <- NewContinuationFrame(END_HEADERS, 1, hb[10:])
+	data := waitFrame(t, frames, DataFrameType).(*DataFrame)
+	assert.Equal(t, string(data.Data), "hello")
+}
+
+func TestServerSettingsTimeout(t *testing.T) {
+	server := &Server{SettingsTimeout: 100 * time.Millisecond}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// SETTINGS of server is not acknowledged,
+	// GOAWAY comes before the default timeout
+	writes, frames := serveTest(t, server, handler)
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, goaway.ErrorCode, SETTINGS_TIMEOUT)
+}
+
+func TestServerMaxRapidResets(t *testing.T) {
+	server := &Server{MaxRapidResets: 2}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+
+	writes, frames := serveTest(t, server, handler)
+	writes <- NewSettingsFrame(UNSET, 0, NilSettings)
+	for i := 0; i < 3; i++ {
+		headers := postHeaders(uint32(2*i + 1))
+		headers.Flags += END_STREAM
+		writes <- headers
+		writes <- NewRstStreamFrame(uint32(2*i+1), CANCEL)
+	}
+	goaway := waitFrame(t, frames, GoAwayFrameType).(*GoAwayFrame)
+	assert.Equal(t, goaway.ErrorCode, ENHANCE_YOUR_CALM)
+}
+
+func TestServerMaxQueuedControlFrames(t *testing.T) {
+	server := &Server{MaxQueuedControlFrames: 10}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.HandleTLSConnection(conn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// sends PINGs, never reads their ACKs
+	closed := make(chan error, 1)
+	go func() {
+		framer := NewFramer(client, client)
+		client.Write([]byte(CONNECTION_PREFACE))
+		framer.WriteFrame(NewSettingsFrame(UNSET, 0, NilSettings))
+		for i := 0; i < 100; i++ {
+			err := framer.WriteFrame(NewPingFrame(UNSET, 0, []byte("deadbeef")))
+			if err != nil {
+				closed <- err
+				return
+			}
+		}
+		closed <- nil
+	}()
+
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Error("connection is not closed by flood")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("flood timeout")
+	}
+}
+
+func TestReadMagic(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewConn(server, ServerRole)
+
+	// preface in several segments
+	go func() {
+		preface := []byte(CONNECTION_PREFACE)
+		client.Write(preface[:3])
+		client.Write(preface[3:16])
+		client.Write(preface[16:])
+	}()
+
+	err := conn.ReadMagic()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTP1RequestRejected(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan bool)
+	go func() {
+		HandleTLSConnection(server, http.NotFoundHandler())
+		done <- true
+	}()
+	go client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+
+	framer := NewFramer(client, client)
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	goaway, ok := frame.(*GoAwayFrame)
+	if !ok {
+		t.Fatalf("got %v want GOAWAY", frame)
+	}
+	if goaway.ErrorCode != PROTOCOL_ERROR {
+		t.Errorf("got %v want PROTOCOL_ERROR", goaway.ErrorCode)
+	}
+
+	// connection is closed
+	_, err = framer.ReadFrame()
+	if err == nil {
+		t.Error("connection should be closed")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("HandleTLSConnection does not return")
+	}
+}
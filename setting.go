@@ -2,6 +2,9 @@ package http2
 
 import (
 	. "github.com/Jxck/http2/frame"
+	. "github.com/Jxck/logger"
+	"sync"
+	"time"
 )
 
 const (
@@ -14,10 +17,174 @@ const (
 var DefaultSettings = map[SettingsID]int32{
 	SETTINGS_HEADER_TABLE_SIZE: DEFAULT_HEADER_TABLE_SIZE,
 	// SETTINGS_ENABLE_PUSH:            DEFAULT_ENABLE_PUSH, // server dosen't send this
-	SETTINGS_MAX_CONCURRENT_STREAMS: DEFAULT_MAX_CONCURRENT_STREAMS,
+	SETTINGS_MAX_CONCURRENT_STREAMS: 100, // limits handlers running on a connection
 	SETTINGS_INITIAL_WINDOW_SIZE:    DEFAULT_INITIAL_WINDOW_SIZE,
 	SETTINGS_MAX_FRAME_SIZE:         DEFAULT_MAX_FRAME_SIZE,
 	SETTINGS_MAX_HEADER_LIST_SIZE:   DEFAULT_MAX_HEADER_LIST_SIZE,
+	// server accepts extended CONNECT for WebSocket (RFC 8441 3)
+	SETTINGS_ENABLE_CONNECT_PROTOCOL: 1,
 }
 
 var NilSettings = make(map[SettingsID]int32, 0)
+
+// copy of settings, for each connection to modify
+func CopySettings(settings map[SettingsID]int32) map[SettingsID]int32 {
+	copied := make(map[SettingsID]int32, len(settings))
+	for id, value := range settings {
+		copied[id] = value
+	}
+	return copied
+}
+
+// limit of header block assembled from HEADERS and CONTINUATIONs
+var MaxHeaderBlockSize uint32 = 1 << 20
+
+// ratio of initial window size, receive window smaller than that
+// is recovered by WINDOW_UPDATE (0.5 sends it at half consumed)
+var WindowUpdateRatio = 0.5
+
+// timeout of ACK for our SETTINGS
+var SettingsTimeout = 5 * time.Second
+
+// timeout of reading connection preface and SETTINGS of peer,
+// and CONTINUATIONs of header block
+var ReadHeaderTimeout = 10 * time.Second
+
+// timeout of ACK for keepalive PING
+var PingTimeout = 15 * time.Second
+
+// streams of peer reset within RapidResetWindow after opened,
+// more than MaxRapidResets in the window closes the connection
+var MaxRapidResets = 100
+var RapidResetWindow = time.Second
+
+// response body buffered before HEADERS is sent, its content-length is
+// set when handler returns. larger body is flushed as it is written.
+var ResponseBufferSize = 4 << 10
+
+// DATA of a stream queued while the connection window is exhausted.
+// writer of the stream blocks beyond this, so a large body is not
+// held in memory for a slow peer.
+var MaxQueuedData = 64 << 10
+
+// request body of h2c upgrade is buffered before 101,
+// larger one is served by HTTP/1.1 without upgrade
+var MaxUpgradeBodySize int64 = 1 << 20
+
+// pushed streams not closed yet on a connection
+var MaxConcurrentPushes = 100
+
+// priorities of idle or closed streams kept by PRIORITY frame
+var MaxIdlePriorities = 100
+
+// length of reason in GOAWAY debug data
+var MaxGoAwayDebugData = 256
+
+// control frames waiting to be written, more than that closes the connection
+var MaxQueuedControlFrames = 10000
+
+// log frames as hex dump instead of String() in verbose log
+var FrameDump = false
+
+// initial values of SETTINGS before any exchange (RFC 7540 6.5.2)
+func InitialSettings() map[SettingsID]int32 {
+	return map[SettingsID]int32{
+		SETTINGS_HEADER_TABLE_SIZE:       DEFAULT_HEADER_TABLE_SIZE,
+		SETTINGS_ENABLE_PUSH:             DEFAULT_ENABLE_PUSH,
+		SETTINGS_MAX_CONCURRENT_STREAMS:  DEFAULT_MAX_CONCURRENT_STREAMS,
+		SETTINGS_INITIAL_WINDOW_SIZE:     DEFAULT_INITIAL_WINDOW_SIZE,
+		SETTINGS_MAX_FRAME_SIZE:          DEFAULT_MAX_FRAME_SIZE,
+		SETTINGS_MAX_HEADER_LIST_SIZE:    DEFAULT_MAX_HEADER_LIST_SIZE,
+		SETTINGS_ENABLE_CONNECT_PROTOCOL: DEFAULT_ENABLE_CONNECT_PROTOCOL,
+	}
+}
+
+// Settings holds SETTINGS of both endpoints of a connection.
+//
+// ours are applied to our side when sent (we accept them from then),
+// and known to be applied by peer when acknowledged (RFC 7540 6.5.3).
+// ACKs come in order of sending, so unacknowledged ones are queued.
+type Settings struct {
+	mu      sync.RWMutex
+	local   map[SettingsID]int32   // sent (including unacknowledged)
+	acked   map[SettingsID]int32   // acknowledged by peer
+	pending []map[SettingsID]int32 // waiting ACK, oldest first
+	peer    map[SettingsID]int32
+}
+
+func NewSettings() *Settings {
+	return &Settings{
+		local: InitialSettings(),
+		acked: InitialSettings(),
+		peer:  InitialSettings(),
+	}
+}
+
+// our value, which may not be acknowledged yet
+func (s *Settings) Local(id SettingsID) int32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.local[id]
+}
+
+// our value acknowledged by peer
+func (s *Settings) Acked(id SettingsID) int32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.acked[id]
+}
+
+// peer's value
+func (s *Settings) Peer(id SettingsID) int32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.peer[id]
+}
+
+// count of our SETTINGS waiting ACK
+func (s *Settings) Unacked() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.pending)
+}
+
+// records our SETTINGS sent to peer
+func (s *Settings) Send(settings map[SettingsID]int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, value := range settings {
+		s.local[id] = value
+	}
+	s.pending = append(s.pending, CopySettings(settings))
+}
+
+// applies oldest unacknowledged SETTINGS.
+// returns false for unexpected ACK.
+func (s *Settings) Ack() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return false
+	}
+	for id, value := range s.pending[0] {
+		s.acked[id] = value
+	}
+	s.pending = s.pending[1:]
+	return true
+}
+
+// applies SETTINGS received from peer at once,
+// returns previous values of changed ones.
+func (s *Settings) ApplyPeer(settings map[SettingsID]int32) (previous map[SettingsID]int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous = make(map[SettingsID]int32)
+	for id, value := range settings {
+		Trace("peer %v: %v -> %v", id, s.peer[id], value)
+		if s.peer[id] != value {
+			previous[id] = s.peer[id]
+		}
+		s.peer[id] = value
+	}
+	return previous
+}
@@ -0,0 +1,36 @@
+package http2
+
+import (
+	assert "github.com/Jxck/assertion"
+	. "github.com/Jxck/http2/frame"
+	"testing"
+)
+
+func TestSettings(t *testing.T) {
+	settings := NewSettings()
+	assert.Equal(t, settings.Local(SETTINGS_INITIAL_WINDOW_SIZE), int32(DEFAULT_INITIAL_WINDOW_SIZE))
+	assert.Equal(t, settings.Peer(SETTINGS_MAX_FRAME_SIZE), int32(DEFAULT_MAX_FRAME_SIZE))
+
+	// ours are acknowledged in order of sending
+	settings.Send(map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 100})
+	settings.Send(map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 200})
+	assert.Equal(t, settings.Local(SETTINGS_INITIAL_WINDOW_SIZE), int32(200))
+	assert.Equal(t, settings.Acked(SETTINGS_INITIAL_WINDOW_SIZE), int32(DEFAULT_INITIAL_WINDOW_SIZE))
+	assert.Equal(t, settings.Unacked(), 2)
+
+	assert.Equal(t, settings.Ack(), true)
+	assert.Equal(t, settings.Acked(SETTINGS_INITIAL_WINDOW_SIZE), int32(100))
+	assert.Equal(t, settings.Ack(), true)
+	assert.Equal(t, settings.Acked(SETTINGS_INITIAL_WINDOW_SIZE), int32(200))
+	assert.Equal(t, settings.Ack(), false)
+	assert.Equal(t, settings.Unacked(), 0)
+
+	// peer's
+	previous := settings.ApplyPeer(map[SettingsID]int32{
+		SETTINGS_MAX_FRAME_SIZE:         DEFAULT_MAX_FRAME_SIZE,
+		SETTINGS_MAX_CONCURRENT_STREAMS: 100,
+	})
+	assert.Equal(t, settings.Peer(SETTINGS_MAX_CONCURRENT_STREAMS), int32(100))
+	assert.Equal(t, len(previous), 1)
+	assert.Equal(t, previous[SETTINGS_MAX_CONCURRENT_STREAMS], int32(DEFAULT_MAX_CONCURRENT_STREAMS))
+}
@@ -90,6 +90,9 @@ func (c Context) String() string {
 //     ES: END_STREAM flag
 //     R:  RST_STREAM frame
 func (stream *Stream) ChangeState(frame Frame, context Context) (err error) {
+	// send from handler and recv from conn race
+	stream.stateMu.Lock()
+	defer stream.stateMu.Unlock()
 
 	header := frame.Header()
 	types := header.Type
@@ -98,6 +101,10 @@ func (stream *Stream) ChangeState(frame Frame, context Context) (err error) {
 
 	Trace("change state(%v) with %v frame type(%v)", state, context, types)
 
+	if types == RstStreamFrameType && context == SEND {
+		stream.resetSent = true
+	}
+
 	if types == SettingsFrameType ||
 		types == GoAwayFrameType {
 		// not a type for consider
@@ -158,6 +165,11 @@ func (stream *Stream) ChangeState(frame Frame, context Context) (err error) {
 	case RESERVED_LOCAL:
 		// H
 		if types == HeadersFrameType && context == SEND {
+			// response without body ends with the HEADERS
+			if flags&END_STREAM == END_STREAM {
+				stream.changeState(CLOSED)
+				return
+			}
 			stream.changeState(HALF_CLOSED_REMOTE)
 			return
 		}
@@ -167,9 +179,22 @@ func (stream *Stream) ChangeState(frame Frame, context Context) (err error) {
 			stream.changeState(CLOSED)
 			return
 		}
+
+		// P, and WINDOW_UPDATE of peer for the response
+		// other frames of peer are PROTOCOL_ERROR (RFC 7540 5.1)
+		if types == PriorityFrameType ||
+			(types == WindowUpdateFrameType && context == RECV) {
+
+			// valid frame
+			return
+		}
 	case RESERVED_REMOTE:
 		// H
 		if types == HeadersFrameType && context == RECV {
+			if flags&END_STREAM == END_STREAM {
+				stream.changeState(CLOSED)
+				return
+			}
 			stream.changeState(HALF_CLOSED_LOCAL)
 			return
 		}
@@ -179,6 +204,14 @@ func (stream *Stream) ChangeState(frame Frame, context Context) (err error) {
 			stream.changeState(CLOSED)
 			return
 		}
+
+		// P, and WINDOW_UPDATE for the response to come
+		if types == PriorityFrameType ||
+			(types == WindowUpdateFrameType && context == SEND) {
+
+			// valid frame
+			return
+		}
 	case HALF_CLOSED_LOCAL:
 
 		if context == SEND {
@@ -247,7 +280,7 @@ func (stream *Stream) ChangeState(frame Frame, context Context) (err error) {
 
 			msg := fmt.Sprintf("invalid frame type %v at %v state", types, state)
 			Error(Red(msg))
-			return &H2Error{STREAM_CLOSED, msg}
+			return &StreamError{StreamID: stream.ID, Code: STREAM_CLOSED}
 		}
 	case CLOSED:
 
@@ -267,18 +300,35 @@ func (stream *Stream) ChangeState(frame Frame, context Context) (err error) {
 				return
 			}
 
+			// frames peer sent before receiving our RST_STREAM
+			// are ignored (RFC 7540 5.1)
+			if stream.resetSent {
+				Debug("ignore %v after RST_STREAM of stream(%v)", types, stream.ID)
+				return
+			}
+
 			msg := fmt.Sprintf("invalid frame type %v at %v state", types, state)
 			Error(Red(msg))
-			return &H2Error{STREAM_CLOSED, msg}
+			return &StreamError{StreamID: stream.ID, Code: STREAM_CLOSED}
 		}
 	}
 
 	msg := fmt.Sprintf("invalid frame type %v at %v state", types, state)
 	Error(Red(msg))
-	return &H2Error{PROTOCOL_ERROR, msg}
+	return &ConnectionError{Code: PROTOCOL_ERROR, Reason: msg}
+}
+
+// State with lock, use this while the stream is sending
+func (stream *Stream) CurrentState() State {
+	stream.stateMu.Lock()
+	defer stream.stateMu.Unlock()
+	return stream.State
 }
 
 func (stream *Stream) changeState(state State) {
 	Info("change stream (%d) state (%s -> %s)", stream.ID, stream.State, Pink(state.String()))
+	if state == CLOSED && stream.State != CLOSED && stream.onClose != nil {
+		stream.onClose()
+	}
 	stream.State = state
 }
@@ -1,60 +1,116 @@
 package http2
 
 import (
-	"github.com/Jxck/hpack"
+	"context"
+	"errors"
+	"fmt"
 	. "github.com/Jxck/http2/frame"
+	"github.com/Jxck/http2/hpack"
 	. "github.com/Jxck/logger"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 func init() {
 	log.SetFlags(log.Lshortfile)
 }
 
+var ErrWriteTimeout = errors.New("stream is blocked by flow control over WriteTimeout")
+
 type Stream struct {
-	ID           uint32
-	State        State
-	Window       *Window
-	ReadChan     chan Frame
-	WriteChan    chan Frame
-	Settings     map[SettingsID]int32
-	PeerSettings map[SettingsID]int32
-	HpackContext *hpack.Context
-	CallBack     CallBack
-	Bucket       *Bucket
-	Closed       bool
+	ID               uint32
+	State            State
+	stateMu          sync.Mutex
+	writeMu          sync.Mutex // state change and send of Write
+	Window           *Window
+	WriteChan        chan Frame
+	Settings         *Settings
+	HpackContext     *hpack.Context
+	PeerHpackContext *hpack.Context
+	CallBack         CallBack
+	Bucket           *Bucket
+	Closed           bool
+	called           bool                           // CallBack is called with headers
+	onClose          func()                         // called once when the state gets CLOSED
+	err              error                          // reason of Close
+	onReset          func()                         // called when RST_STREAM is sent or received
+	resetSent        bool                           // frames after sending RST_STREAM are ignored
+	contentLength    int64                          // declared by content-length, -1 if not
+	received         int64                          // DATA payload received, without padding
+	noBody           bool                           // response of HEAD has content-length without body
+	rejected         int                            // status of request discarded by conn, answered without handler
+	badRequest       bool                           // malformed request is answered by 400, see Conn.BadRequest
+	maxBody          int64                          // request body over it is discarded, see Conn.MaxRequestBodyBytes
+	overLimit        bool                           // DATA over maxBody is received
+	holdConn         func(length int32)             // connection window of response in body is
+	releaseConn      func(length int32)             // released as it is read on client, see Conn.WindowHold
+	push             func(header http.Header) error // server push on the stream of peer
+	WriteTimeout     time.Duration
+	ctx              context.Context
+	cancel           context.CancelFunc // cancels ctx on Close
+	closeOnce        sync.Once
+
+	// 1xx response before the final one, nil on server
+	informational func(status int, header http.Header) error
+
+	// DATA waiting connection window in conn.WriteLoop
+	queuedMu sync.Mutex
+	queued   int
+	dequeued chan struct{} // closed when queued DATA is taken
 }
 
 type Bucket struct {
 	Headers http.Header
 	Body    *Body
+
+	// filled before Body returns io.EOF,
+	// keys declared by Trailer header exist with nil from the first.
+	Trailer http.Header
 }
 
 func NewBucket() *Bucket {
 	return &Bucket{
 		Headers: make(http.Header),
-		Body:    new(Body),
+		Body:    NewBody(),
+		Trailer: make(http.Header),
 	}
 }
 
 type CallBack func(stream *Stream)
 
-func NewStream(id uint32, writeChan chan Frame, settings, peerSettings map[SettingsID]int32, hpackContext *hpack.Context, callback CallBack) *Stream {
+func NewStream(id uint32, writeChan chan Frame, settings *Settings, hpackContext, peerHpackContext *hpack.Context, callback CallBack) *Stream {
 	stream := &Stream{
-		ID:           id,
-		State:        IDLE,
-		Window:       NewWindow(settings[SETTINGS_INITIAL_WINDOW_SIZE], peerSettings[SETTINGS_INITIAL_WINDOW_SIZE]),
-		ReadChan:     make(chan Frame),
-		WriteChan:    writeChan,
-		Settings:     settings,
-		PeerSettings: peerSettings,
-		HpackContext: hpackContext,
-		CallBack:     callback,
-		Bucket:       NewBucket(),
-		Closed:       false,
-	}
-	go stream.ReadLoop()
+		ID:               id,
+		State:            IDLE,
+		Window:           NewWindow(settings.Acked(SETTINGS_INITIAL_WINDOW_SIZE), settings.Peer(SETTINGS_INITIAL_WINDOW_SIZE)),
+		WriteChan:        writeChan,
+		Settings:         settings,
+		HpackContext:     hpackContext,
+		PeerHpackContext: peerHpackContext,
+		CallBack:         callback,
+		Bucket:           NewBucket(),
+		Closed:           false,
+		contentLength:    -1,
+		dequeued:         make(chan struct{}),
+	}
+	stream.ctx, stream.cancel = context.WithCancel(context.Background())
+
+	// stream window is recovered as the body is read,
+	// so peer can't send more than the window to reader slower than it.
+	// after END_STREAM of peer, only connection window is.
+	stream.Bucket.Body.OnRead = func(n int) {
+		if state := stream.CurrentState(); state != HALF_CLOSED_REMOTE && state != CLOSED {
+			stream.WindowUpdate(int32(n))
+		}
+		if stream.releaseConn != nil {
+			stream.releaseConn(int32(n))
+		}
+	}
 	return stream
 }
 
@@ -63,74 +119,331 @@ func (stream *Stream) Read(f Frame) {
 
 	switch frame := f.(type) {
 	case *HeadersFrame:
-		// Decode Headers
-		header := stream.DecodeHeader(frame.HeaderBlockFragment)
-		frame.Headers = header
+		// Headers are decoded by conn
+		header := frame.Headers
 
-		for name, values := range header {
-			for _, value := range values {
-				stream.Bucket.Headers.Add(name, value)
-			}
+		// header block is no longer needed
+		frame.Release()
+
+		// HEADERS after the first one has trailer
+		if stream.called {
+			stream.readTrailer(header, frame.Header().Flags&END_STREAM == END_STREAM)
+			return
+		}
+
+		if stream.informational != nil && isInformational(header) {
+			stream.readInformational(header, frame.Header().Flags&END_STREAM == END_STREAM)
+			return
 		}
 
+		if frame.Header().Flags&END_HEADERS == END_HEADERS {
+			stream.readHeader(header)
+		}
 		if frame.Header().Flags&END_STREAM == END_STREAM {
-			go stream.CallBack(stream)
+			stream.endStream()
 		}
 	case *DataFrame:
-		length := int32(frame.Header().Length)
-		stream.WindowUpdate(length)
+		// buffered body is bounded by the window we advertised
+		if int64(frame.Header().Length) > int64(stream.Window.Receivable())-int64(stream.Bucket.Body.Len()) {
+			Error("DATA of stream(%v) exceeds window", stream.ID)
+			frame.Release()
+			stream.Write(NewRstStreamFrame(stream.ID, FLOW_CONTROL_ERROR))
+			stream.CloseWithError(&StreamError{StreamID: stream.ID, Code: FLOW_CONTROL_ERROR})
+			return
+		}
+
+		// padding is never read, so recover it now
+		padding := int32(frame.Header().Length) - int32(len(frame.Data))
+		if padding > 0 {
+			stream.WindowUpdate(padding)
+		}
+
+		// DATA over content-length is malformed
+		stream.received += int64(len(frame.Data))
+		if stream.contentLength >= 0 && stream.received > stream.contentLength {
+			frame.Release()
+			stream.malformed(fmt.Sprintf("DATA over content-length %v", stream.contentLength))
+			return
+		}
+		if stream.maxBody > 0 && stream.received > stream.maxBody {
+			stream.discard(frame)
+			return
+		}
 
+		// held before Write, reader may release it soon
+		if stream.holdConn != nil {
+			stream.holdConn(int32(len(frame.Data)))
+		}
 		_, err := stream.Bucket.Body.Write(frame.Data)
 		if err != nil {
-			Fatal("%v", err)
+			// body is closed by reader, discard data
+			Debug("discard DATA of stream(%v): %v", stream.ID, err)
+			stream.WindowUpdate(int32(len(frame.Data)))
+			if stream.releaseConn != nil {
+				stream.releaseConn(int32(len(frame.Data)))
+			}
 		}
 
+		// data is copied to body
+		frame.Release()
+
 		if frame.Header().Flags&END_STREAM == END_STREAM {
-			stream.CallBack(stream)
+			stream.endStream()
 		}
-	case *RstStreamFrame:
-		Debug("close stream by RST_STREAM")
-		Error("RST_STREAM(%v)", frame.ErrorCode)
-		stream.Close()
 	case *PingFrame:
 		Debug("response to PING")
 		pong := NewPingFrame(ACK, stream.ID, frame.OpaqueData)
 		stream.Write(pong)
-	case *WindowUpdateFrame:
-		Info("Window Update %d byte stream(%v)", frame.WindowSizeIncrement, stream.ID)
-		stream.Window.UpdatePeer(int32(frame.WindowSizeIncrement))
 	case *ContinuationFrame:
-		// Decode Headers
-		header := stream.DecodeHeader(frame.HeaderBlockFragment)
-		frame.Headers = header
+		// Headers are decoded by conn
+		header := frame.Headers
+
+		if frame.Header().Flags&END_HEADERS == END_HEADERS {
+			stream.readHeader(header)
+		}
+	}
+}
 
-		for name, values := range header {
-			for _, value := range values {
-				stream.Bucket.Headers.Add(name, value)
+// calls CallBack with headers, before the body arrives.
+// body is read from Bucket.Body while receiving it.
+func (stream *Stream) readHeader(header http.Header) {
+	if stream.called {
+		Debug("ignore trailer of stream(%v)", stream.ID)
+		return
+	}
+	for name, values := range header {
+		for _, value := range values {
+			stream.Bucket.Headers.Add(name, value)
+		}
+	}
+
+	// 304 has content-length of the representation without body
+	if !stream.noBody && stream.Bucket.Headers.Get(":status") != "304" {
+		stream.contentLength = util.ContentLength(stream.Bucket.Headers)
+	}
+
+	// declared trailers, set here not to race with readTrailer
+	for _, value := range stream.Bucket.Headers["Trailer"] {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" {
+				stream.Bucket.Trailer[name] = nil
 			}
 		}
+	}
+	stream.called = true
+	go stream.CallBack(stream)
+}
 
-		if frame.Header().Flags&END_STREAM == END_STREAM {
-			go stream.CallBack(stream)
+// 1xx except 101, which has no body
+func isInformational(header http.Header) bool {
+	status := header.Get(":status")
+	return len(status) == 3 && status[0] == '1' && status != "101"
+}
+
+// interim response is given to informational, and CallBack waits the final one.
+// interim response ends the stream is malformed (RFC 7540 8.1)
+// error of informational cancels the stream.
+func (stream *Stream) readInformational(header http.Header, endStream bool) {
+	if endStream {
+		stream.malformed("informational response with END_STREAM")
+		return
+	}
+	status, _ := strconv.Atoi(header.Get(":status"))
+	delete(header, ":status")
+	if err := stream.informational(status, header); err != nil {
+		stream.Write(NewRstStreamFrame(stream.ID, CANCEL))
+		stream.CloseWithError(err)
+	}
+}
+
+// trailer is HEADERS with END_STREAM after DATA (RFC 7540 8.1)
+// it is set before Body gets io.EOF, so reader sees it after body.
+// pseudo header or missing END_STREAM is malformed (RFC 7540 8.1.2.1)
+func (stream *Stream) readTrailer(header http.Header, endStream bool) {
+	var msg string
+	if !endStream {
+		msg = "trailer without END_STREAM"
+	}
+	for name := range header {
+		if strings.HasPrefix(name, ":") {
+			msg = fmt.Sprintf("pseudo header %v in trailer", name)
 		}
 	}
+	if msg != "" {
+		stream.malformed(msg)
+		return
+	}
+
+	for name, values := range header {
+		for _, value := range values {
+			stream.Bucket.Trailer.Add(name, value)
+		}
+	}
+	stream.endStream()
 }
 
-func (stream *Stream) ReadLoop() {
-	Debug("start stream (%d) ReadLoop()", stream.ID)
-	for f := range stream.ReadChan {
-		stream.Read(f)
+// END_STREAM ends the body, and DATA should be
+// the length of content-length (RFC 7540 8.1.2.6)
+func (stream *Stream) endStream() {
+	if stream.contentLength >= 0 && stream.received != stream.contentLength {
+		stream.malformed(fmt.Sprintf("content-length %v but DATA is %v", stream.contentLength, stream.received))
+		return
 	}
-	Debug("stop stream (%d) ReadLoop()", stream.ID)
+	stream.Bucket.Body.CloseWithError(io.EOF)
+}
+
+// DATA over maxBody is not delivered to handler, which gets
+// http.MaxBytesError after buffered body. window of the stream is
+// not recovered any more, so peer can't keep sending.
+// handlerCallBack answers 413 or resets the stream.
+func (stream *Stream) discard(frame *DataFrame) {
+	if !stream.overLimit {
+		Error("request body of stream(%v) exceeds %v bytes", stream.ID, stream.maxBody)
+		stream.overLimit = true
+		stream.Window.Stop()
+		stream.Bucket.Body.CloseWithError(&http.MaxBytesError{Limit: stream.maxBody})
+	}
+	// consumed as if it were read, against the window
+	stream.Window.Consume(int32(len(frame.Data)))
+	frame.Release()
+}
+
+// malformed message is stream error of PROTOCOL_ERROR (RFC 7540 8.1.2.6),
+// reader of the body gets it instead of truncated body.
+func (stream *Stream) malformed(msg string) {
+	Error("malformed message of stream(%v): %v", stream.ID, msg)
+	stream.Write(NewRstStreamFrame(stream.ID, PROTOCOL_ERROR))
+	stream.CloseWithError(&StreamError{StreamID: stream.ID, Code: PROTOCOL_ERROR})
 }
 
 func (stream *Stream) Write(frame Frame) {
 	Trace("stream.Write (%v)", frame)
-	if stream.Closed {
+	stream.writeMu.Lock()
+	defer stream.writeMu.Unlock()
+	// Closed may be written by conn.Close() meanwhile
+	if stream.ctx.Err() != nil {
 		return
 	}
 	stream.ChangeState(frame, SEND)
-	stream.WriteChan <- frame
+	// NO_ERROR ends the stream after complete response, not an abort
+	if rst, ok := frame.(*RstStreamFrame); ok && rst.ErrorCode != NO_ERROR && stream.onReset != nil {
+		stream.onReset()
+	}
+	select {
+	case stream.WriteChan <- frame:
+	case <-stream.ctx.Done():
+		Debug("discard %v to closed stream(%v)", frame.Header().Type, stream.ID)
+	}
+}
+
+// waits Write in progress, frame of it is sent to WriteChan after this
+func (stream *Stream) waitWrite() {
+	stream.writeMu.Lock()
+	stream.writeMu.Unlock()
+}
+
+// writes data in DATA frames within peer's SETTINGS_MAX_FRAME_SIZE,
+// consuming stream window, connection window is left to conn.WriteLoop.
+// blocks until window is available, fails if the stream is closed.
+// with endStream, the last frame has END_STREAM.
+func (stream *Stream) WriteData(data []byte, endStream bool) error {
+	if len(data) == 0 && endStream {
+		stream.Write(NewDataFrame(END_STREAM, stream.ID, nil, nil))
+		return nil
+	}
+
+	for len(data) > 0 {
+		if err := stream.ctx.Err(); err != nil {
+			return stream.Err()
+		}
+		size := int32(len(data))
+		if maxFrameSize := stream.Settings.Peer(SETTINGS_MAX_FRAME_SIZE); size > maxFrameSize {
+			size = maxFrameSize
+		}
+
+		// connection window is consumed by conn.WriteLoop,
+		// writer waits there not to queue DATA unboundedly
+		if !stream.waitQueue() {
+			return stream.Err()
+		}
+		size = stream.acquirePeer(size)
+		if size == 0 {
+			return stream.Err()
+		}
+		stream.queue(int(size))
+
+		Debug("send %v/%v data", size, len(data))
+		var flags Flag = UNSET
+		if endStream && int(size) == len(data) {
+			flags = END_STREAM
+		}
+		// body は送信後に書き換えないので、コピーせずにそのまま渡す
+		stream.Write(NewDataFrame(flags, stream.ID, data[:size], nil))
+		data = data[size:]
+	}
+	return nil
+}
+
+// blocks while DATA queued for connection window exceeds MaxQueuedData.
+// false if the stream is closed.
+func (stream *Stream) waitQueue() bool {
+	for {
+		stream.queuedMu.Lock()
+		queued, dequeued := stream.queued, stream.dequeued
+		stream.queuedMu.Unlock()
+		if queued < MaxQueuedData {
+			return true
+		}
+		select {
+		case <-dequeued:
+		case <-stream.ctx.Done():
+			return false
+		}
+	}
+}
+
+func (stream *Stream) queue(size int) {
+	stream.queuedMu.Lock()
+	defer stream.queuedMu.Unlock()
+	stream.queued += size
+}
+
+// called by conn.WriteLoop when queued DATA is written
+func (stream *Stream) dequeue(size int) {
+	stream.queuedMu.Lock()
+	defer stream.queuedMu.Unlock()
+	stream.queued -= size
+	close(stream.dequeued)
+	stream.dequeued = make(chan struct{})
+}
+
+// Window.AcquirePeer with WriteTimeout, which runs only while
+// peer window is not positive. timeout resets the stream with CANCEL
+// and closes it with ErrWriteTimeout. 0 if the stream is closed.
+func (stream *Stream) acquirePeer(length int32) int32 {
+	var timeout <-chan time.Time
+	for {
+		updated := stream.Window.Updated()
+		if size := stream.Window.TryAcquirePeer(length); size > 0 {
+			return size
+		}
+		if timeout == nil && stream.WriteTimeout > 0 {
+			timer := time.NewTimer(stream.WriteTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-updated:
+		case <-stream.ctx.Done():
+			return 0
+		case <-timeout:
+			Error("stream(%v) is blocked by flow control over %v", stream.ID, stream.WriteTimeout)
+			stream.Write(NewRstStreamFrame(stream.ID, CANCEL))
+			stream.CloseWithError(ErrWriteTimeout)
+			return 0
+		}
+	}
 }
 
 func (stream *Stream) WindowUpdate(length int32) {
@@ -140,27 +453,77 @@ func (stream *Stream) WindowUpdate(length int32) {
 	update := stream.Window.Consume(length)
 
 	// update があれば WindowUpdate を送る
+	// window is updated before sending, so peer can't send DATA
+	// over the window we know
 	if update > 0 {
-		stream.Write(NewWindowUpdateFrame(stream.ID, uint32(update)))
 		stream.Window.Update(update)
+		stream.Write(NewWindowUpdateFrame(stream.ID, uint32(update)))
 	}
 }
 
+// safe to call more than once (RST_STREAM and conn.Close)
 func (stream *Stream) Close() {
-	Debug("stream(%d) Close()", stream.ID)
-	// stream.WriteChan は conn.WriteChan であり
-	// conn の方で close するので
-	// ここでは close しない
-	stream.Closed = true
-	Info("close stream(%v).ReadChan", stream.ID)
-	close(stream.ReadChan)
+	stream.CloseWithError(io.ErrUnexpectedEOF)
+}
+
+// closes the stream, err is returned by Err and Body
+func (stream *Stream) CloseWithError(err error) {
+	stream.closeOnce.Do(func() {
+		Debug("stream(%d) Close() by %v", stream.ID, err)
+		// stream.WriteChan は conn.WriteChan であり
+		// conn と共有なので close しない
+		stream.Closed = true
+		stream.err = err
+		stream.cancel()
+		stream.Bucket.Body.CloseWithError(err)
+	})
+}
+
+// done when the stream is closed (by RST_STREAM or connection error)
+// request of the stream has this context for aborting handler.
+func (stream *Stream) Context() context.Context {
+	return stream.ctx
+}
+
+// reason why the stream is closed,
+// valid after Context() is done
+func (stream *Stream) Err() error {
+	// canceled by connection without Close
+	if err := stream.ctx.Err(); err != nil {
+		stream.CloseWithError(err)
+	}
+	return stream.err
+}
+
+// closed by RST_STREAM of peer, which cancels handler and
+// fails reader of response with StreamError of the code
+func (stream *Stream) reset(code ErrorCode) {
+	Error("stream(%v) is reset by RST_STREAM(%v)", stream.ID, code)
+	if stream.onReset != nil {
+		stream.onReset()
+	}
+	// refused stream is not processed by peer (RFC 7540 8.1.4)
+	if code == REFUSED_STREAM {
+		stream.CloseWithError(ErrRetryOnNewConn)
+		return
+	}
+	stream.CloseWithError(&StreamError{StreamID: stream.ID, Code: code})
+}
+
+// closes the stream without sending RST_STREAM
+// for the one peer doesn't process, like after GOAWAY
+func (stream *Stream) abort(err error) {
+	stream.stateMu.Lock()
+	stream.changeState(CLOSED)
+	stream.stateMu.Unlock()
+	stream.CloseWithError(err)
 }
 
 // Encode Header using HPACK
 func (stream *Stream) EncodeHeader(header http.Header) []byte {
 	headerList := hpack.ToHeaderList(header)
 	Trace("sending header list %s", headerList)
-	return stream.HpackContext.Encode(*headerList)
+	return stream.PeerHpackContext.Encode(*headerList)
 }
 
 // Decode Header using HPACK
@@ -0,0 +1,242 @@
+package http2
+
+import (
+	assert "github.com/Jxck/assertion"
+	. "github.com/Jxck/http2/frame"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// stream with peer's SETTINGS_INITIAL_WINDOW_SIZE
+func newTestStream(id uint32, writeChan chan Frame, initialWindowSize int32) *Stream {
+	settings := NewSettings()
+	settings.ApplyPeer(map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: initialWindowSize})
+	return NewStream(id, writeChan, settings, nil, nil, nil)
+}
+
+func TestStreamWriteData(t *testing.T) {
+	writeChan := make(chan Frame)
+	streams := map[uint32]*Stream{
+		1: newTestStream(1, writeChan, 100),
+		3: newTestStream(3, writeChan, 200),
+	}
+	for _, stream := range streams {
+		go stream.WriteData(make([]byte, 1000), false)
+	}
+
+	// budgets known by peer
+	budgets := map[uint32]int{1: 100, 3: 200}
+	received := map[uint32]int{}
+	for received[1]+received[3] < 2000 {
+		var frame Frame
+		select {
+		case frame = <-writeChan:
+		case <-time.After(time.Second):
+			t.Fatalf("write timeout %v", received)
+		}
+		id, length := frame.Header().StreamID, len(frame.(*DataFrame).Data)
+		received[id] += length
+		budgets[id] -= length
+		if budgets[id] < 0 {
+			t.Fatalf("window exceeded %v", budgets)
+		}
+
+		// trickle updates
+		for length > 0 {
+			increment := 30
+			if length < increment {
+				increment = length
+			}
+			streams[id].Window.UpdatePeer(int32(increment))
+			budgets[id] += increment
+			length -= increment
+		}
+	}
+	assert.Equal(t, received[1], 1000)
+	assert.Equal(t, received[3], 1000)
+}
+
+func TestStreamWriteDataNegativeWindow(t *testing.T) {
+	writeChan := make(chan Frame, 16)
+	stream := newTestStream(1, writeChan, 100)
+	done := make(chan error)
+	go func() {
+		done <- stream.WriteData(make([]byte, 110), false)
+	}()
+
+	frame := <-writeChan
+	assert.Equal(t, len(frame.(*DataFrame).Data), 100)
+
+	// decrease of SETTINGS_INITIAL_WINDOW_SIZE makes it -50
+	stream.Window.UpdateInitialSize(50)
+	stream.Window.UpdatePeer(50)
+	select {
+	case frame = <-writeChan:
+		t.Fatalf("window is not positive but sent %v", frame)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stream.Window.UpdatePeer(10)
+	frame = <-writeChan
+	assert.Equal(t, len(frame.(*DataFrame).Data), 10)
+	assert.Equal(t, <-done, nil)
+}
+
+func TestStreamWriteDataCancel(t *testing.T) {
+	writeChan := make(chan Frame, 16)
+	stream := newTestStream(1, writeChan, 0)
+	done := make(chan error)
+	go func() {
+		done <- stream.WriteData([]byte("data"), false)
+	}()
+
+	// RST_STREAM wakes blocked writer
+	stream.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("WriteData to closed stream should fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writer is not released by Close()")
+	}
+}
+
+func TestStreamContentLength(t *testing.T) {
+	cases := []struct {
+		header http.Header
+		noBody bool
+		data   []string // nil is END_STREAM on HEADERS
+		body   string
+		ok     bool
+	}{
+		{http.Header{"content-length": {"5"}}, false, []string{"hel", "lo"}, "hello", true},
+		{http.Header{"content-length": {"0"}}, false, nil, "", true},
+		{http.Header{}, false, []string{"hello"}, "hello", true},
+		// under-run
+		{http.Header{"content-length": {"10"}}, false, []string{"hello"}, "", false},
+		{http.Header{"content-length": {"5"}}, false, nil, "", false},
+		// over-run
+		{http.Header{"content-length": {"3"}}, false, []string{"hel", "lo"}, "", false},
+		// without body
+		{http.Header{"content-length": {"5"}}, true, nil, "", true},
+		{http.Header{":status": {"304"}, "content-length": {"5"}}, false, nil, "", true},
+	}
+
+	for _, c := range cases {
+		writeChan := make(chan Frame, 8)
+		stream := newTestStream(1, writeChan, DEFAULT_INITIAL_WINDOW_SIZE)
+		stream.CallBack = func(stream *Stream) {}
+		stream.noBody = c.noBody
+
+		var flags Flag = END_HEADERS
+		if c.data == nil {
+			flags += END_STREAM
+		}
+		headers := NewHeadersFrame(flags, 1, nil, nil, nil)
+		headers.Headers = c.header
+		stream.Read(headers)
+		for i, data := range c.data {
+			var flags Flag = UNSET
+			if i == len(c.data)-1 {
+				flags = END_STREAM
+			}
+			stream.Read(NewDataFrame(flags, 1, []byte(data), nil))
+		}
+
+		body, err := ioutil.ReadAll(stream.Bucket.Body)
+		if c.ok {
+			assert.Equal(t, err, nil)
+			assert.Equal(t, string(body), c.body)
+			continue
+		}
+
+		// malformed message is reset, and reader gets the error
+		streamError, ok := err.(*StreamError)
+		if !ok {
+			t.Errorf("%v %v: got %v want StreamError", c.header, c.data, err)
+			continue
+		}
+		assert.Equal(t, streamError.Code, ErrorCode(PROTOCOL_ERROR))
+		rst := (<-writeChan).(*RstStreamFrame)
+		assert.Equal(t, rst.ErrorCode, ErrorCode(PROTOCOL_ERROR))
+	}
+}
+
+func TestStreamReservedState(t *testing.T) {
+	type step struct {
+		frame   Frame
+		context Context
+		state   State
+		ok      bool
+	}
+	promise := NewPushPromiseFrame(END_HEADERS, 1, 2, nil, nil)
+	headers := func(flags Flag) Frame {
+		return NewHeadersFrame(flags+END_HEADERS, 2, nil, nil, nil)
+	}
+	data := NewDataFrame(END_STREAM, 2, []byte("data"), nil)
+
+	// RFC 7540 5.1
+	var cases = []struct {
+		name  string
+		steps []step
+	}{
+		{"push", []step{
+			{promise, SEND, RESERVED_LOCAL, true},
+			{NewWindowUpdateFrame(2, 100), RECV, RESERVED_LOCAL, true},
+			{NewPriorityFrame(2, false, 1, 16), RECV, RESERVED_LOCAL, true},
+			{headers(UNSET), SEND, HALF_CLOSED_REMOTE, true},
+			{data, SEND, CLOSED, true},
+		}},
+		{"push without body", []step{
+			{promise, SEND, RESERVED_LOCAL, true},
+			{headers(END_STREAM), SEND, CLOSED, true},
+		}},
+		{"push canceled", []step{
+			{promise, SEND, RESERVED_LOCAL, true},
+			{NewRstStreamFrame(2, CANCEL), RECV, CLOSED, true},
+		}},
+		{"reserved (local): DATA", []step{
+			{promise, SEND, RESERVED_LOCAL, true},
+			{data, RECV, RESERVED_LOCAL, false},
+		}},
+		{"reserved (local): HEADERS", []step{
+			{promise, SEND, RESERVED_LOCAL, true},
+			{headers(UNSET), RECV, RESERVED_LOCAL, false},
+		}},
+		{"promised", []step{
+			{promise, RECV, RESERVED_REMOTE, true},
+			{NewWindowUpdateFrame(2, 100), SEND, RESERVED_REMOTE, true},
+			{headers(UNSET), RECV, HALF_CLOSED_LOCAL, true},
+			{data, RECV, CLOSED, true},
+		}},
+		{"promised and canceled", []step{
+			{promise, RECV, RESERVED_REMOTE, true},
+			{NewRstStreamFrame(2, CANCEL), SEND, CLOSED, true},
+		}},
+		{"reserved (remote): DATA", []step{
+			{promise, RECV, RESERVED_REMOTE, true},
+			{data, RECV, RESERVED_REMOTE, false},
+		}},
+	}
+
+	for _, c := range cases {
+		stream := newTestStream(2, make(chan Frame), DEFAULT_INITIAL_WINDOW_SIZE)
+		for _, s := range c.steps {
+			err := stream.ChangeState(s.frame, s.context)
+			if s.ok && err != nil {
+				t.Errorf("%v: %v %v: %v", c.name, s.context, s.frame.Header().Type, err)
+			}
+			if !s.ok {
+				// connection error of PROTOCOL_ERROR
+				connectionError, ok := err.(*ConnectionError)
+				if !ok || connectionError.Code != PROTOCOL_ERROR {
+					t.Errorf("%v: %v %v: got %v want PROTOCOL_ERROR", c.name, s.context, s.frame.Header().Type, err)
+				}
+			}
+			assert.Equal(t, stream.State, s.state)
+		}
+	}
+}
@@ -1,13 +1,20 @@
 package http2
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	. "github.com/Jxck/color"
 	. "github.com/Jxck/http2/frame"
 	. "github.com/Jxck/logger"
+	"io"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"strconv"
+	"sync"
+	"time"
 )
 
 // Transport implements http.RoundTriper
@@ -16,24 +23,45 @@ type Transport struct {
 	Conn     *Conn
 	CertPath string
 	KeyPath  string
+
+	// SETTINGS sent after connection preface
+	// merged into DefaultSettings, nil is default.
+	Settings map[SettingsID]int32
+
+	// keepalive of connection, see Conn.ReadIdleTimeout
+	// 0 of PingTimeout is default
+	ReadIdleTimeout time.Duration
+	PingTimeout     time.Duration
+
+	// see Conn.SettingsTimeout, 0 is default
+	SettingsTimeout time.Duration
+
+	// pooled Conn idle for this is closed, see Conn.IdleTimeout
+	IdleConnTimeout time.Duration
+
+	// Conn is reused for the address while it takes new request
+	mu      sync.Mutex
+	address string
 }
 
 // connect tcp connection with host
 func (transport *Transport) Connect(url *URL) (err error) {
 	address := url.Host + ":" + url.Port
 
-	// loading key pair
-	cert, err := tls.LoadX509KeyPair(transport.CertPath, transport.KeyPath)
-	if err != nil {
-		return err
-	}
-
 	// setting TLS config
 	config := tls.Config{
-		Certificates:       []tls.Certificate{cert},
 		InsecureSkipVerify: true,
 		NextProtos:         []string{VERSION},
 	}
+
+	// loading key pair of client certificate, if any
+	if transport.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(transport.CertPath, transport.KeyPath)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
 	conn, err := tls.Dial("tcp", address, &config)
 	if err != nil {
 		return err
@@ -44,20 +72,26 @@ func (transport *Transport) Connect(url *URL) (err error) {
 	Info("%v %v", Yellow("handshake"), state.HandshakeComplete)
 	Info("%v %v", Yellow("protocol"), state.NegotiatedProtocol)
 
-	Conn := NewConn(conn)
-
-	// send Magic Octet
-	err = Conn.WriteMagic()
+	// send Magic Octet and SETTINGS
+	Conn, err := NewClientConn(conn, transport.Settings)
 	if err != nil {
 		return err
 	}
 
-	go Conn.WriteLoop()
+	Conn.ReadIdleTimeout = transport.ReadIdleTimeout
+	if transport.PingTimeout > 0 {
+		Conn.PingTimeout = transport.PingTimeout
+	}
+	Conn.IdleTimeout = transport.IdleConnTimeout
+	if transport.SettingsTimeout > 0 {
+		// restarts timer of SETTINGS sent by NewClientConn
+		Conn.SettingsTimeout = transport.SettingsTimeout
+		Conn.resetSettingsTimer()
+	}
 
-	// send default settings to id 0
-	settingsFrame := NewSettingsFrame(UNSET, 0, DefaultSettings)
-	Conn.WriteChan <- settingsFrame
+	go Conn.WriteLoop()
 	transport.Conn = Conn
+	transport.address = address
 
 	go Conn.ReadLoop()
 
@@ -69,7 +103,7 @@ func (transport *Transport) RoundTrip(req *http.Request) (res *http.Response, er
 	// add headers
 	req.Header.Add("accept", "*/*")
 	req.Header.Add("x-http2-version", VERSION)
-	if req.ContentLength != 0 {
+	if req.ContentLength > 0 {
 		req.Header.Add("content-length", fmt.Sprintf("%d", req.ContentLength))
 	}
 
@@ -82,45 +116,169 @@ func (transport *Transport) RoundTrip(req *http.Request) (res *http.Response, er
 	}
 	req = util.UpgradeRequest(req, url)
 
-	// establish tcp connection and handshake
-	err = transport.Connect(url)
+	res, err = transport.roundTrip(req, url)
+	if errors.Is(err, ErrRetryOnNewConn) && idempotent(req.Method) {
+		// not processed by server, so safe to send again
+		// with the body from the first by GetBody
+		Info("retry %v %v on new connection", req.Method, req.URL)
+		req, err = rewindBody(req)
+		if err == nil {
+			res, err = transport.roundTrip(req, url)
+		}
+	}
 	if err != nil {
 		Error("%v", err)
 		return nil, err
 	}
 
+	Notice("\n%s", White(util.ResponseString(res)))
+
+	// TODO: send GOAWAY
+	// stream.Write(NewGoAwayFrame(0, stream.ID, NO_ERROR, nil))
+
+	return res, nil
+}
+
+// sends request on a stream, connecting if no Conn takes new request.
+// fails with ErrRetryOnNewConn if the stream is not processed.
+func (transport *Transport) roundTrip(req *http.Request, url *URL) (*http.Response, error) {
+	transport.mu.Lock()
+	if transport.Conn == nil || !transport.Conn.CanTakeNewRequest() || transport.address != url.Host+":"+url.Port {
+		// establish tcp connection and handshake
+		err := transport.Connect(url)
+		if err != nil {
+			transport.mu.Unlock()
+			return nil, err
+		}
+	}
+	conn := transport.Conn
+	transport.mu.Unlock()
+
+	// peer's SETTINGS_MAX_HEADER_LIST_SIZE
+	maxHeaderListSize := conn.Settings.Peer(SETTINGS_MAX_HEADER_LIST_SIZE)
+	if size := HeaderListSize(req.Header); size > uint32(maxHeaderListSize) {
+		return nil, fmt.Errorf("header list size(%v) is larger than peer's SETTINGS_MAX_HEADER_LIST_SIZE(%v)", size, maxHeaderListSize)
+	}
+
 	callback, response := TransportCallBack(req)
-	transport.Conn.CallBack = callback
 
-	// create stream
-	stream := transport.Conn.NewStream(<-NextClientStreamID)
-	transport.Conn.Streams[stream.ID] = stream
+	// 1xx response is given to httptrace like net/http
+	var informational func(status int, header http.Header) error
+	if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.Got1xxResponse != nil {
+		informational = func(status int, header http.Header) error {
+			return trace.Got1xxResponse(status, textproto.MIMEHeader(header))
+		}
+	}
+
+	// create stream and send request header via HEADERS Frame
+	// waits if streams reach peer's SETTINGS_MAX_CONCURRENT_STREAMS
+	// Conn is shared by concurrent requests on their own streams
+	// without body, HEADERS ends the stream.
+	// ContentLength 0 with Body is unknown length like net/http
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	stream, err := conn.openStream(req.Header, !hasBody, callback, informational)
+	if err != nil {
+		return nil, err
+	}
+	if hasBody {
+		go writeRequestBody(req.Context(), stream, req.Body)
+	}
 
-	// send request header via HEADERS Frame
-	var flags Flag = END_STREAM + END_HEADERS
-	headerBlockFragment := stream.EncodeHeader(req.Header)
-	Trace("encoded header block %v", headerBlockFragment)
-	frame := NewHeadersFrame(flags, stream.ID, nil, headerBlockFragment, nil)
-	frame.Headers = req.Header
-	stream.Write(frame) // TODO: err
+	// body is read from the stream after return
+	select {
+	case res := <-response:
+		return res, nil
+	case <-req.Context().Done():
+		abortStream(stream, CANCEL, req.Context().Err())
+		return nil, req.Context().Err()
+	case <-stream.Context().Done():
+		select {
+		case res := <-response:
+			return res, nil
+		default:
+			return nil, stream.Err()
+		}
+	}
+}
 
-	res = <-response
+// request body is streamed in chunks of peer's SETTINGS_MAX_FRAME_SIZE,
+// blocking while windows are exhausted. its DATA is interleaved with
+// other streams by conn.WriteLoop, and the last one has END_STREAM.
+// canceled ctx resets the stream with CANCEL, and error of reading
+// the body with INTERNAL_ERROR.
+func writeRequestBody(ctx context.Context, stream *Stream, body io.ReadCloser) {
+	defer body.Close()
 
-	stream.Close()
+	// wakes upload blocked by window
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			abortStream(stream, CANCEL, ctx.Err())
+		case <-done:
+		}
+	}()
 
-	Notice("\n%s", White(util.ResponseString(res)))
+	for {
+		// DATA is sent without copy, so buffer is not reused
+		buf := make([]byte, stream.Settings.Peer(SETTINGS_MAX_FRAME_SIZE))
+		n, err := body.Read(buf)
+		if n > 0 {
+			if stream.WriteData(buf[:n], false) != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			stream.WriteData(nil, true)
+			return
+		}
+		if err != nil {
+			Error("read request body of stream(%v): %v", stream.ID, err)
+			abortStream(stream, INTERNAL_ERROR, err)
+			return
+		}
+	}
+}
 
-	// TODO: send GOAWAY
-	// stream.Write(NewGoAwayFrame(0, stream.ID, NO_ERROR, nil))
+// resets the stream of request, err is returned to its reader
+func abortStream(stream *Stream, code ErrorCode, err error) {
+	stream.Write(NewRstStreamFrame(stream.ID, code))
+	stream.CloseWithError(err)
+}
 
-	return res, nil
+// request to send again, with new body from GetBody.
+// body may be read by the first try, so it can't be sent without that.
+func rewindBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, fmt.Errorf("%w: request body can not be sent again without GetBody", ErrRetryOnNewConn)
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	retry := *req
+	retry.Body = body
+	return &retry, nil
 }
 
+// methods safe to retry (RFC 7231 4.2.2)
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// response is buffered, not to block the stream closed meanwhile
 func TransportCallBack(req *http.Request) (CallBack, chan *http.Response) {
-	response := make(chan *http.Response)
+	response := make(chan *http.Response, 1)
 	return func(stream *Stream) {
 
-		body := stream.Bucket.Body
 		headers := stream.Bucket.Headers
 
 		status, _ := strconv.Atoi(headers.Get(":status")) // err
@@ -132,11 +290,11 @@ func TransportCallBack(req *http.Request) (CallBack, chan *http.Response) {
 			ProtoMajor:    1,
 			ProtoMinor:    1,
 			Header:        headers,
-			Body:          body,
-			ContentLength: int64(body.Len()),
+			Body:          &responseBody{stream.Bucket.Body, stream},
+			ContentLength: util.ContentLength(headers),
 			// TransferEncoding []string
 			// Close bool
-			// Trailer Header
+			Trailer: stream.Bucket.Trailer,
 			Request: req,
 		}
 
@@ -144,3 +302,19 @@ func TransportCallBack(req *http.Request) (CallBack, chan *http.Response) {
 
 	}, response
 }
+
+// DATA of response is buffered in Body within the windows, and
+// WINDOW_UPDATE is sent as it is read, so slow reader holds back server.
+type responseBody struct {
+	*Body
+	stream *Stream
+}
+
+// closing before the end resets the stream with CANCEL,
+// buffered data is discarded and its connection window is released.
+func (body *responseBody) Close() error {
+	if state := body.stream.CurrentState(); state != HALF_CLOSED_REMOTE && state != CLOSED {
+		abortStream(body.stream, CANCEL, ErrBodyClosed)
+	}
+	return body.Body.Close()
+}
@@ -0,0 +1,437 @@
+package http2
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	assert "github.com/Jxck/assertion"
+	. "github.com/Jxck/http2/frame"
+	"github.com/Jxck/http2/hpack"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewClientConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	settings := map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 1 << 20}
+	go func() {
+		conn, err := NewClientConn(client, settings)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}()
+
+	preface := make([]byte, len(CONNECTION_PREFACE))
+	_, err := io.ReadFull(server, preface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(preface), CONNECTION_PREFACE)
+
+	// SETTINGS follows preface
+	frame, err := NewFramer(server, server).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settingsFrame, ok := frame.(*SettingsFrame)
+	if !ok {
+		t.Fatalf("got %v want SETTINGS", frame)
+	}
+	assert.Equal(t, settingsFrame.Settings[SETTINGS_INITIAL_WINDOW_SIZE], int32(1<<20))
+	assert.Equal(t, settingsFrame.Settings[SETTINGS_MAX_FRAME_SIZE], DefaultSettings[SETTINGS_MAX_FRAME_SIZE])
+}
+
+// round trip with HTTP/2 server of net/http
+func TestClientConnRoundTrip(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{VERSION},
+	}
+	tc, err := tls.Dial("tcp", ts.Listener.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, tc.ConnectionState().NegotiatedProtocol, VERSION)
+
+	conn, err := NewClientConn(tc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/index.html", nil)
+	url, _ := NewURL(req.URL.String())
+	req = util.UpgradeRequest(req, url)
+
+	go conn.WriteLoop()
+	go conn.ReadLoop()
+
+	callback, response := TransportCallBack(req)
+	_, err = conn.OpenStream(req.Header, true, callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case res := <-response:
+		assert.Equal(t, res.StatusCode, 200)
+		body, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, string(body), "hello /index.html")
+	case <-time.After(3 * time.Second):
+		t.Fatal("response timeout")
+	}
+}
+
+func TestTransportInformational(t *testing.T) {
+	conn, framer, frames := newTestClientConn(t, NilSettings)
+	transport := &Transport{Conn: conn, address: "example.com:443"}
+
+	var got []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			got = append(got, fmt.Sprintf("%v %v", code, header.Get("Link")))
+			return nil
+		},
+	}
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	type result struct {
+		res *http.Response
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		res, err := transport.RoundTrip(req)
+		results <- result{res, err}
+	}()
+
+	id := waitFrame(t, frames, HeadersFrameType).Header().StreamID
+	ctx := hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE))
+	for _, header := range []http.Header{
+		{":status": {"103"}, "link": {"</style.css>; rel=preload"}},
+		{":status": {"103"}, "link": {"</script.js>; rel=preload"}},
+	} {
+		hints := NewHeadersFrame(END_HEADERS, id, nil, nil, nil)
+		hints.Headers = header
+		hints.HpackContext = ctx
+		framer.WriteFrame(hints)
+	}
+	final := NewHeadersFrame(END_STREAM+END_HEADERS, id, nil, nil, nil)
+	final.Headers = http.Header{":status": {"200"}}
+	final.HpackContext = ctx
+	framer.WriteFrame(final)
+
+	select {
+	case r := <-results:
+		assert.Equal(t, r.err, nil)
+		assert.Equal(t, r.res.StatusCode, 200)
+	case <-time.After(time.Second):
+		t.Fatal("response timeout")
+	}
+	assert.Equal(t, got, []string{"103 </style.css>; rel=preload", "103 </script.js>; rel=preload"})
+}
+
+// serves hs configured with s on TLS listener, returns its address
+func serveTLSTest(t *testing.T, hs *http.Server, s *Server) string {
+	ConfigureServer(hs, s)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.ServeTLS(ln, "keys/cert.pem", "keys/key.pem")
+	t.Cleanup(func() {
+		hs.Close()
+	})
+	return ln.Addr().String()
+}
+
+func newTestTransport(t *testing.T) *Transport {
+	transport := &Transport{}
+	t.Cleanup(func() {
+		if transport.Conn != nil {
+			transport.Conn.Close()
+		}
+	})
+	return transport
+}
+
+// parallel requests share one connection, and are served concurrently
+func TestTransportMultiplexing(t *testing.T) {
+	const n = 100
+	var mu sync.Mutex
+	conns, arrived := 0, 0
+	all := make(chan struct{})
+	hs := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			arrived++
+			if arrived == n {
+				close(all)
+			}
+			mu.Unlock()
+
+			// each handler waits the others, so serialized requests time out
+			select {
+			case <-all:
+			case <-time.After(5 * time.Second):
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			fmt.Fprintf(w, "%v %v %s", r.Method, r.URL.Path, body)
+		}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				mu.Lock()
+				conns++
+				mu.Unlock()
+			}
+		},
+	}
+	addr := serveTLSTest(t, hs, &Server{MaxConcurrentStreams: n})
+	transport := newTestTransport(t)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			url := fmt.Sprintf("https://%v/%v", addr, i)
+			want := fmt.Sprintf("GET /%v ", i)
+			req, _ := http.NewRequest("GET", url, nil)
+			// request body is interleaved with others
+			if i%2 == 1 {
+				body := strings.Repeat(fmt.Sprint(i), 10<<10)
+				req, _ = http.NewRequest("POST", url, strings.NewReader(body))
+				want = fmt.Sprintf("POST /%v %v", i, body)
+			}
+			res, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			if string(body) != want {
+				t.Errorf("%v: got %.40q want %.40q", i, body, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, conns, 1)
+}
+
+// reads repeated pattern, not to hold large body in memory
+type patternReader struct{}
+
+func (patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = "0123456789abcdef"[i%16]
+	}
+	return len(p), nil
+}
+
+// large body of unknown length is streamed within small window
+func TestTransportUpload(t *testing.T) {
+	const size = 50 << 20
+	addr := serveTLSTest(t, &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, r.Body)
+		}),
+	}, &Server{InitialStreamWindow: 1 << 14})
+	transport := newTestTransport(t)
+
+	body := ioutil.NopCloser(io.LimitReader(patternReader{}, size))
+	req, _ := http.NewRequest("POST", "https://"+addr+"/", body)
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.StatusCode, 200)
+
+	want := sha256.New()
+	io.Copy(want, io.LimitReader(patternReader{}, size))
+	got := sha256.New()
+	n, err := io.Copy(got, res.Body)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, int64(size))
+	assert.Equal(t, got.Sum(nil), want.Sum(nil))
+}
+
+// upload is reset by canceled request or error of body,
+// and handler reading it gets the code
+func TestTransportUploadAbort(t *testing.T) {
+	errs := make(chan error, 1)
+	started := make(chan bool, 1)
+	addr := serveTLSTest(t, &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body.Read(make([]byte, 1))
+			started <- true
+			_, err := io.Copy(ioutil.Discard, r.Body)
+			errs <- err
+		}),
+	}, &Server{})
+	transport := newTestTransport(t)
+
+	cases := []struct {
+		abort func(pw *io.PipeWriter, cancel context.CancelFunc)
+		err   error
+		code  ErrorCode
+	}{
+		{func(pw *io.PipeWriter, cancel context.CancelFunc) { cancel() }, context.Canceled, CANCEL},
+		{func(pw *io.PipeWriter, cancel context.CancelFunc) { pw.CloseWithError(io.ErrClosedPipe) }, io.ErrClosedPipe, INTERNAL_ERROR},
+	}
+	for _, c := range cases {
+		pr, pw := io.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequest("PUT", "https://"+addr+"/", pr)
+		req = req.WithContext(ctx)
+		done := make(chan error, 1)
+		go func() {
+			_, err := transport.RoundTrip(req)
+			done <- err
+		}()
+		pw.Write([]byte("data"))
+		<-started
+
+		c.abort(pw, cancel)
+		select {
+		case err := <-done:
+			assert.Equal(t, err, c.err)
+		case <-time.After(3 * time.Second):
+			t.Fatal("RoundTrip is not aborted")
+		}
+		streamError, ok := (<-errs).(*StreamError)
+		if !ok {
+			t.Fatalf("handler should get StreamError")
+		}
+		assert.Equal(t, streamError.Code, c.code)
+		cancel()
+	}
+}
+
+// slow reader of response holds back the server by connection window,
+// even if stream window is large, and closing the body resets the stream
+func TestTransportSlowReader(t *testing.T) {
+	const size = 10 << 20
+	var written int64
+	errs := make(chan error, 1)
+	addr := serveTLSTest(t, &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/small" {
+				w.Write(make([]byte, 100<<10))
+				return
+			}
+			chunk := make([]byte, 1<<10)
+			var err error
+			for n := 0; n < size && err == nil; n += len(chunk) {
+				_, err = w.Write(chunk)
+				atomic.AddInt64(&written, int64(len(chunk)))
+			}
+			errs <- err
+		}),
+	}, &Server{})
+	transport := newTestTransport(t)
+	transport.Settings = map[SettingsID]int32{SETTINGS_INITIAL_WINDOW_SIZE: 1 << 20}
+
+	req, _ := http.NewRequest("GET", "https://"+addr+"/", nil)
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := res.Body.(*responseBody)
+
+	// 1KB/s, 100 times faster
+	buf := make([]byte, 1<<10)
+	read := 0
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n, err := io.ReadFull(body, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read += n
+
+		// memory of client is bounded by connection window
+		if buffered := body.Len(); buffered > DEFAULT_INITIAL_WINDOW_SIZE {
+			t.Fatalf("%v bytes are buffered", buffered)
+		}
+	}
+	// server queues MaxQueuedData and a frame waiting connection window,
+	// and handler keeps ResponseBufferSize and a chunk not sent
+	limit := int64(read + DEFAULT_INITIAL_WINDOW_SIZE + MaxQueuedData + DEFAULT_MAX_FRAME_SIZE + ResponseBufferSize + len(buf))
+	if w := atomic.LoadInt64(&written); w > limit {
+		t.Errorf("server wrote %v bytes for %v read", w, read)
+	}
+
+	body.Close()
+	select {
+	case err := <-errs:
+		streamError, ok := err.(*StreamError)
+		if !ok {
+			t.Fatalf("handler should get StreamError, got %v", err)
+		}
+		assert.Equal(t, streamError.Code, ErrorCode(CANCEL))
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler is not stopped by closing body")
+	}
+
+	// buffered data is discarded, and connection window is released
+	conn := transport.Conn
+	req, _ = http.NewRequest("GET", "https://"+addr+"/small", nil)
+	res, err = transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, res.Body)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, int64(100<<10))
+	assert.Equal(t, transport.Conn, conn)
+}
+
+func TestRewindBody(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	retry, err := rewindBody(req)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, retry, req)
+
+	// body of NewRequest is read again by GetBody
+	req, _ = http.NewRequest("PUT", "https://example.com/", strings.NewReader("body"))
+	ioutil.ReadAll(req.Body)
+	retry, err = rewindBody(req)
+	assert.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(retry.Body)
+	assert.Equal(t, string(body), "body")
+
+	// without GetBody, it is not sent again
+	req, _ = http.NewRequest("PUT", "https://example.com/", ioutil.NopCloser(strings.NewReader("body")))
+	_, err = rewindBody(req)
+	if !errors.Is(err, ErrRetryOnNewConn) {
+		t.Errorf("got %v want ErrRetryOnNewConn", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -75,6 +76,16 @@ func (u Util) ResponseString(res *http.Response) string {
 	return str
 }
 
+// content-length of header, -1 for unknown
+// body is streamed, so it's not known from body
+func (u Util) ContentLength(header http.Header) int64 {
+	length, err := strconv.ParseInt(header.Get("content-length"), 10, 64)
+	if err != nil || length < 0 {
+		return -1
+	}
+	return length
+}
+
 func (u Util) Indent(v interface{}) string {
 	return strings.Replace(fmt.Sprintf("%v", v), "\n", "\n\t\t\t\t", -1)
 }
@@ -1,17 +1,25 @@
 package http2
 
 import (
+	"errors"
 	"fmt"
 	. "github.com/Jxck/color"
 	. "github.com/Jxck/http2/frame"
 	. "github.com/Jxck/logger"
 	"log"
+	"sync"
 )
 
 func init() {
 	log.SetFlags(log.Lshortfile)
 }
 
+// flow control window should not exceed 2^31-1 (RFC 7540 6.9.1)
+const MAX_WINDOW_SIZE int64 = 1<<31 - 1
+
+// FLOW_CONTROL_ERROR, for stream or connection
+var ErrWindowOverflow = errors.New("flow control window exceeds 2^31-1")
+
 type Window struct {
 	initialSize     int32
 	currentSize     int32
@@ -19,16 +27,21 @@ type Window struct {
 	peerInitialSize int32
 	peerCurrentSize int32
 	peerThreshold   int32
+	held            int32 // received but not read yet, see Hold
+	stopped         bool  // our window is not recovered, see Stop
+	mu              sync.Mutex
+	updated         chan struct{} // closed when peer window increases
 }
 
 func NewWindowDefault() *Window {
 	return &Window{
 		initialSize:     DEFAULT_INITIAL_WINDOW_SIZE,
 		currentSize:     DEFAULT_INITIAL_WINDOW_SIZE,
-		threshold:       DEFAULT_INITIAL_WINDOW_SIZE/2 + 1,
+		threshold:       windowThreshold(DEFAULT_INITIAL_WINDOW_SIZE),
 		peerInitialSize: DEFAULT_INITIAL_WINDOW_SIZE,
 		peerCurrentSize: DEFAULT_INITIAL_WINDOW_SIZE,
-		peerThreshold:   DEFAULT_INITIAL_WINDOW_SIZE/2 + 1,
+		peerThreshold:   windowThreshold(DEFAULT_INITIAL_WINDOW_SIZE),
+		updated:         make(chan struct{}),
 	}
 }
 
@@ -36,51 +49,138 @@ func NewWindow(initialWindow, peerInitilaWindow int32) *Window {
 	return &Window{
 		initialSize:     initialWindow,
 		currentSize:     initialWindow,
-		threshold:       initialWindow/2 + 1,
+		threshold:       windowThreshold(initialWindow),
 		peerInitialSize: peerInitilaWindow,
 		peerCurrentSize: peerInitilaWindow,
-		peerThreshold:   peerInitilaWindow/2 + 1,
+		peerThreshold:   windowThreshold(peerInitilaWindow),
+		updated:         make(chan struct{}),
 	}
 }
 
-func (window *Window) UpdateInitialSize(newInitialWindowSize int32) {
-	currentInitialWindowSize := window.initialSize
+// WINDOW_UPDATE is sent when window gets smaller than this
+func windowThreshold(initialWindow int32) int32 {
+	return int32(float64(initialWindow)*WindowUpdateRatio) + 1
+}
+
+// wakes writers waiting in AcquirePeer
+// should be called with lock
+func (window *Window) notify() {
+	close(window.updated)
+	window.updated = make(chan struct{})
+}
+
+// applies change of peer's SETTINGS_INITIAL_WINDOW_SIZE.
+// window may get negative, then AcquirePeer waits WINDOW_UPDATE
+// until it gets positive (RFC 7540 6.9.2)
+// exceeding 2^31-1 is connection error of FLOW_CONTROL_ERROR.
+func (window *Window) UpdateInitialSize(newInitialWindowSize int32) error {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	currentInitialWindowSize := window.peerInitialSize
 	currentWindowSize := window.peerCurrentSize
-	newWindwoSize := newInitialWindowSize - (window.initialSize - currentWindowSize)
+	newWindowSize := int64(newInitialWindowSize) - (int64(currentInitialWindowSize) - int64(currentWindowSize))
+	if newWindowSize > MAX_WINDOW_SIZE {
+		msg := fmt.Sprintf("window size %v exceeds 2^31-1 by SETTINGS_INITIAL_WINDOW_SIZE %v", newWindowSize, newInitialWindowSize)
+		Error("%v", msg)
+		return &ConnectionError{Code: FLOW_CONTROL_ERROR, Reason: msg}
+	}
+	newWindwoSize := int32(newWindowSize)
 
 	window.peerCurrentSize = newWindwoSize
-	window.initialSize = newInitialWindowSize
+	window.peerInitialSize = newInitialWindowSize
+	window.peerThreshold = windowThreshold(newInitialWindowSize)
 
 	Trace(Brown(`update initial window size
 	"New WindowSize(%v)" = "New InitialWindowSize(%v)" - ("Current InitialWindow ize(%v)" - "Current WindowSize(%v)")`),
 		newWindwoSize, newInitialWindowSize, currentInitialWindowSize, currentWindowSize)
+	window.notify()
+	return nil
+}
+
+// changes our window to newInitialWindowSize, returns the difference.
+// connection window is enlarged by WINDOW_UPDATE of it, and stream window
+// by our SETTINGS_INITIAL_WINDOW_SIZE acknowledged by peer.
+// window may get negative, peer has sent DATA within the previous one.
+func (window *Window) UpdateLocalInitialSize(newInitialWindowSize int32) (increment int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	increment = newInitialWindowSize - window.initialSize
+	window.initialSize = newInitialWindowSize
+	window.currentSize += increment
+	window.threshold = windowThreshold(newInitialWindowSize)
+
+	Trace(Brown("update local initial window size (%v), current (%v)"), newInitialWindowSize, window.currentSize)
+	return increment
 }
 
 func (window *Window) Update(windowSizeIncrement int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
 	current := window.currentSize
 	window.currentSize = current + windowSizeIncrement
 
 	Trace(Brown("increment current window size (%v) + increment (%v) = (%v)"), current, windowSizeIncrement, window.currentSize)
 }
 
-func (window *Window) UpdatePeer(windowSizeIncrement int32) {
+// fails with ErrWindowOverflow if window exceeds 2^31-1,
+// caller makes it stream or connection error.
+func (window *Window) UpdatePeer(windowSizeIncrement int32) error {
+	window.mu.Lock()
+	defer window.mu.Unlock()
 	current := window.peerCurrentSize
+	if int64(current)+int64(windowSizeIncrement) > MAX_WINDOW_SIZE {
+		Error("peer window size (%v) + increment (%v) exceeds 2^31-1", current, windowSizeIncrement)
+		return ErrWindowOverflow
+	}
 	window.peerCurrentSize = current + windowSizeIncrement
 
 	Trace(Brown("increment peer window size (%v) + increment (%v) = (%v)"), current, windowSizeIncrement, window.peerCurrentSize)
+	window.notify()
+	return nil
 }
 
 func (window *Window) Consume(length int32) (update int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
 	window.currentSize -= length
+	return window.recover()
+}
 
-	if window.currentSize < window.threshold {
-		update = window.initialSize - window.currentSize
-	}
+// data not read yet is not recovered by Consume,
+// Release recovers it after it is read
+func (window *Window) Hold(length int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	window.held += length
+}
 
+func (window *Window) Release(length int32) (update int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	window.held -= length
+	return window.recover()
+}
+
+// update to initial size, except held data
+// should be called with lock
+func (window *Window) recover() (update int32) {
+	if window.currentSize+window.held < window.threshold && !window.stopped {
+		update = window.initialSize - window.currentSize - window.held
+	}
 	return update
 }
 
+// Consume returns no update after this,
+// so peer can't send more than the current window
+func (window *Window) Stop() {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	window.stopped = true
+}
+
 func (window *Window) ConsumePeer(length int32) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
 	current := window.peerCurrentSize
 	window.peerCurrentSize = current - length
 
@@ -88,6 +188,8 @@ func (window *Window) ConsumePeer(length int32) {
 }
 
 func (window *Window) Consumable(length int32) int32 {
+	window.mu.Lock()
+	defer window.mu.Unlock()
 	if window.peerCurrentSize < length {
 		return window.peerCurrentSize
 	} else {
@@ -95,6 +197,55 @@ func (window *Window) Consumable(length int32) int32 {
 	}
 }
 
+// consumes peer window up to length, and returns consumed size.
+// blocks until peer window gets positive,
+// returns 0 if done is closed while waiting.
+func (window *Window) AcquirePeer(length int32, done <-chan struct{}) int32 {
+	for {
+		updated := window.Updated()
+		if size := window.TryAcquirePeer(length); size > 0 {
+			return size
+		}
+		select {
+		case <-updated:
+		case <-done:
+			return 0
+		}
+	}
+}
+
+// AcquirePeer without blocking, 0 if peer window is not positive
+func (window *Window) TryAcquirePeer(length int32) int32 {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	if window.peerCurrentSize <= 0 {
+		return 0
+	}
+	if length > window.peerCurrentSize {
+		length = window.peerCurrentSize
+	}
+	window.peerCurrentSize -= length
+	Trace(Brown("acquire peer window size (%v), rest (%v)"), length, window.peerCurrentSize)
+	return length
+}
+
+// window we advertised to peer, received DATA beyond it
+// including not consumed yet is flow control error
+func (window *Window) Receivable() int32 {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	return window.currentSize
+}
+
+// closed when peer window increases after this call
+func (window *Window) Updated() <-chan struct{} {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+	return window.updated
+}
+
 func (window *Window) String() string {
+	window.mu.Lock()
+	defer window.mu.Unlock()
 	return fmt.Sprintf(Yellow("window: curr(%d) - peer(%d)"), window.currentSize, window.peerCurrentSize)
 }